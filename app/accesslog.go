@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// clfTimeLayout is the timestamp format of the Common Log Format
+const clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// accessLogger writes one line per request in Common or Combined Log
+// Format, with the request duration in seconds appended
+type accessLogger struct {
+	mu       sync.Mutex
+	out      io.Writer
+	file     *rotatingFile // set when logging to a file
+	combined bool
+}
+
+// openAccessLog opens the access log destination: "-" for stdout, "off" to
+// disable logging, or a file path to append to. Files rotate per policy.
+func openAccessLog(dest, format string, policy rotationPolicy) (*accessLogger, error) {
+	l := &accessLogger{out: os.Stdout, combined: format != "common"}
+	switch dest {
+	case "off":
+		return nil, nil
+	case "-", "":
+	default:
+		f, err := openRotatingFile(dest, policy)
+		if err != nil {
+			return nil, err
+		}
+		l.out, l.file = f, f
+	}
+	return l, nil
+}
+
+// log records a finished request
+func (l *accessLogger) log(req *Request, resp *response, duration time.Duration) {
+	b := getBuffer()
+	defer putBuffer(b)
+
+	b.WriteString(clientIP(req))
+	b.WriteString(" - ")
+	if req.user != "" {
+		writeLogEscaped(b, req.user)
+	} else {
+		b.WriteByte('-')
+	}
+	b.WriteString(" [")
+	b.WriteString(time.Now().Format(clfTimeLayout))
+	b.WriteString("] \"")
+	writeLogEscaped(b, req.Method)
+	b.WriteByte(' ')
+	writeLogEscaped(b, redactTarget(req.Target))
+	b.WriteByte(' ')
+	writeLogEscaped(b, req.Version)
+	b.WriteString("\" ")
+	b.WriteString(strconv.Itoa(resp.status))
+	b.WriteByte(' ')
+	if resp.written > 0 {
+		b.WriteString(strconv.FormatInt(resp.written, 10))
+	} else {
+		b.WriteByte('-')
+	}
+	if l.combined {
+		b.WriteString(" \"")
+		writeLogValue(b, req.Header("Referer"))
+		b.WriteString("\" \"")
+		writeLogValue(b, req.Header("User-Agent"))
+		b.WriteByte('"')
+	}
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatFloat(duration.Seconds(), 'f', 6, 64))
+	b.WriteByte('\n')
+
+	l.mu.Lock()
+	_, _ = l.out.Write(b.Bytes())
+	l.mu.Unlock()
+}
+
+// writeLogValue writes a quoted field's content, using "-" for empty values
+func writeLogValue(b *bytes.Buffer, s string) {
+	if s == "" {
+		b.WriteByte('-')
+		return
+	}
+	writeLogEscaped(b, s)
+}
+
+// writeLogEscaped writes s with quotes, backslashes, and control bytes
+// escaped so a client can't forge or break log lines
+func writeLogEscaped(b *bytes.Buffer, s string) {
+	const hex = "0123456789abcdef"
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			b.WriteString(`\x`)
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&0xf])
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
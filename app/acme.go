@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ACME defaults
+const (
+	defaultACMEDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+	defaultACMECache     = "acme-cache"
+	defaultACMEHTTPAddr  = ":80"
+
+	// Certificates are renewed once they have less than this left
+	acmeRenewBefore = 30 * 24 * time.Hour
+	// How often the renewal loop looks at the certificate
+	acmeCheckInterval = 12 * time.Hour
+	// How long to wait for the CA to validate a challenge or issue
+	acmePollTimeout = 2 * time.Minute
+)
+
+// acmeManager obtains and renews a certificate for a set of domains from an
+// ACME CA (RFC 8555), answering HTTP-01 challenges on a plain listener and
+// caching keys and certificates on disk
+type acmeManager struct {
+	directoryURL string
+	domains      []string
+	email        string
+	cacheDir     string
+	httpAddr     string
+	client       *http.Client
+	log          *slog.Logger
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+
+	// fallback answers requests that aren't challenges, when set
+	fallback func(w io.Writer, req *Request) error
+
+	// challenges maps HTTP-01 tokens to their key authorizations
+	challengeMu sync.Mutex
+	challenges  map[string]string
+
+	// Account state, set up on first issuance
+	accountKey *ecdsa.PrivateKey
+	accountURL string
+	dir        acmeDirectory
+	nonce      string
+}
+
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type acmeOrder struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+}
+
+type acmeAuthorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []struct {
+		Type   string `json:"type"`
+		URL    string `json:"url"`
+		Token  string `json:"token"`
+		Status string `json:"status"`
+	} `json:"challenges"`
+}
+
+// acmeProblem is an RFC 7807 error document returned by the CA
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+func (p *acmeProblem) Error() string {
+	return "acme: " + p.Type + ": " + p.Detail
+}
+
+func newACMEManager(domains []string, email, cacheDir, directoryURL, httpAddr string, log *slog.Logger) *acmeManager {
+	return &acmeManager{
+		directoryURL: directoryURL,
+		domains:      domains,
+		email:        email,
+		cacheDir:     cacheDir,
+		httpAddr:     httpAddr,
+		client:       &http.Client{Timeout: 30 * time.Second},
+		log:          log,
+		challenges:   make(map[string]string),
+	}
+}
+
+// tlsConfig returns a server configuration that presents the managed
+// certificate
+func (m *acmeManager) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"http/1.1"},
+	}
+}
+
+func (m *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return nil, errors.New("acme: certificate not issued yet")
+	}
+	return m.cert, nil
+}
+
+// start binds the challenge listener with bind, loads any cached
+// certificate, and keeps the certificate renewed in the background
+func (m *acmeManager) start(bind func(kind, addr string, lc *net.ListenConfig) (net.Listener, error)) error {
+	if err := os.MkdirAll(m.cacheDir, 0o700); err != nil {
+		return err
+	}
+	l, err := bind("acme", m.httpAddr, nil)
+	if err != nil {
+		return err
+	}
+	go m.serveChallenges(l)
+
+	if cert, err := tls.LoadX509KeyPair(m.certPath(), m.keyPath()); err == nil {
+		m.mu.Lock()
+		m.cert = &cert
+		m.mu.Unlock()
+		m.log.Info("loaded cached certificate", "domains", m.domains)
+	}
+	go m.renewLoop()
+	return nil
+}
+
+func (m *acmeManager) certPath() string { return filepath.Join(m.cacheDir, m.domains[0]+".crt") }
+func (m *acmeManager) keyPath() string  { return filepath.Join(m.cacheDir, m.domains[0]+".key") }
+
+// renewLoop issues a certificate when there is none or it is close to
+// expiry, retrying failures on the next check
+func (m *acmeManager) renewLoop() {
+	for {
+		if m.needsRenewal() {
+			m.log.Info("requesting certificate", "domains", m.domains, "ca", m.directoryURL)
+			if err := m.obtain(); err != nil {
+				m.log.Error("failed to obtain certificate", "domains", m.domains, "err", err)
+				time.Sleep(time.Minute)
+				continue
+			}
+			m.log.Info("certificate issued", "domains", m.domains)
+		}
+		time.Sleep(acmeCheckInterval)
+	}
+}
+
+func (m *acmeManager) needsRenewal() bool {
+	m.mu.RLock()
+	cert := m.cert
+	m.mu.RUnlock()
+	if cert == nil {
+		return true
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return true
+	}
+	return time.Until(leaf.NotAfter) < acmeRenewBefore
+}
+
+// serveChallenges answers HTTP-01 validation requests. Anything else gets
+// a 404.
+func (m *acmeManager) serveChallenges(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+			reader := getReader(conn)
+			defer putReader(reader)
+			w := getWriter(conn)
+			defer putWriter(w)
+			req := getRequest()
+			defer putRequest(req)
+
+			if err := readRequest(reader, req); err != nil {
+				_ = writeStatus(w, 400, true)
+				_ = w.Flush()
+				return
+			}
+			m.handleChallenge(w, req)
+			_ = w.Flush()
+		}(conn)
+	}
+}
+
+func (m *acmeManager) handleChallenge(w io.Writer, req *Request) {
+	token, ok := strings.CutPrefix(req.Path, "/.well-known/acme-challenge/")
+	if !ok || req.Method != "GET" {
+		if m.fallback != nil {
+			_ = m.fallback(w, req)
+			return
+		}
+		_ = writeStatus(w, 404, true)
+		return
+	}
+	m.challengeMu.Lock()
+	keyAuth, ok := m.challenges[token]
+	m.challengeMu.Unlock()
+	if !ok {
+		_ = writeStatus(w, 404, true)
+		return
+	}
+	_ = writeBody(w, 200, "application/octet-stream", []byte(keyAuth))
+}
+
+// obtain runs a full order: account, order, HTTP-01 authorizations,
+// finalization with a fresh key, and download of the chain
+func (m *acmeManager) obtain() error {
+	if err := m.setupAccount(); err != nil {
+		return err
+	}
+
+	identifiers := make([]map[string]string, len(m.domains))
+	for i, d := range m.domains {
+		identifiers[i] = map[string]string{"type": "dns", "value": d}
+	}
+	var order acmeOrder
+	resp, err := m.post(m.dir.NewOrder, map[string]any{"identifiers": identifiers}, &order)
+	if err != nil {
+		return fmt.Errorf("new order: %w", err)
+	}
+	orderURL := resp.Header.Get("Location")
+
+	for _, authzURL := range order.Authorizations {
+		if err := m.authorize(authzURL); err != nil {
+			return err
+		}
+	}
+
+	// Finalize with a CSR for a new certificate key
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.domains[0]},
+		DNSNames: m.domains,
+	}, certKey)
+	if err != nil {
+		return err
+	}
+	if _, err := m.post(order.Finalize, map[string]string{"csr": b64(csr)}, &order); err != nil {
+		return fmt.Errorf("finalize: %w", err)
+	}
+	deadline := time.Now().Add(acmePollTimeout)
+	for order.Status != "valid" {
+		if order.Status == "invalid" || time.Now().After(deadline) {
+			return fmt.Errorf("order %s stuck in status %q", orderURL, order.Status)
+		}
+		time.Sleep(2 * time.Second)
+		if _, err := m.post(orderURL, nil, &order); err != nil {
+			return fmt.Errorf("poll order: %w", err)
+		}
+	}
+
+	resp, err = m.post(order.Certificate, nil, nil)
+	if err != nil {
+		return fmt.Errorf("download certificate: %w", err)
+	}
+	chainPEM, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(chainPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(m.keyPath(), keyPEM, 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(m.certPath(), chainPEM, 0o644); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.cert = &cert
+	m.mu.Unlock()
+	return nil
+}
+
+// authorize completes the HTTP-01 challenge of one authorization
+func (m *acmeManager) authorize(authzURL string) error {
+	var authz acmeAuthorization
+	if _, err := m.post(authzURL, nil, &authz); err != nil {
+		return fmt.Errorf("fetch authorization: %w", err)
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+
+	var challengeURL, token string
+	for _, c := range authz.Challenges {
+		if c.Type == "http-01" {
+			challengeURL, token = c.URL, c.Token
+		}
+	}
+	if challengeURL == "" {
+		return fmt.Errorf("no http-01 challenge offered for %s", authz.Identifier.Value)
+	}
+
+	thumbprint, err := jwkThumbprint(&m.accountKey.PublicKey)
+	if err != nil {
+		return err
+	}
+	m.challengeMu.Lock()
+	m.challenges[token] = token + "." + thumbprint
+	m.challengeMu.Unlock()
+	defer func() {
+		m.challengeMu.Lock()
+		delete(m.challenges, token)
+		m.challengeMu.Unlock()
+	}()
+
+	// An empty object tells the CA the response is ready
+	resp, err := m.post(challengeURL, struct{}{}, nil)
+	if err != nil {
+		return fmt.Errorf("accept challenge: %w", err)
+	}
+	resp.Body.Close()
+	deadline := time.Now().Add(acmePollTimeout)
+	for {
+		time.Sleep(2 * time.Second)
+		if _, err := m.post(authzURL, nil, &authz); err != nil {
+			return fmt.Errorf("poll authorization: %w", err)
+		}
+		switch authz.Status {
+		case "valid":
+			return nil
+		case "invalid":
+			return fmt.Errorf("validation of %s failed", authz.Identifier.Value)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out validating %s", authz.Identifier.Value)
+		}
+	}
+}
+
+// setupAccount loads or creates the account key and registers it with the CA
+func (m *acmeManager) setupAccount() error {
+	if m.accountURL != "" {
+		return nil
+	}
+
+	resp, err := m.client.Get(m.directoryURL)
+	if err != nil {
+		return fmt.Errorf("fetch directory: %w", err)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&m.dir)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("decode directory: %w", err)
+	}
+
+	keyFile := filepath.Join(m.cacheDir, "account.key")
+	if data, err := os.ReadFile(keyFile); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return errors.New("malformed " + keyFile)
+		}
+		if m.accountKey, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			return err
+		}
+	} else {
+		if m.accountKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return err
+		}
+		der, err := x509.MarshalECPrivateKey(m.accountKey)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+			return err
+		}
+	}
+
+	account := map[string]any{"termsOfServiceAgreed": true}
+	if m.email != "" {
+		account["contact"] = []string{"mailto:" + m.email}
+	}
+	resp, err = m.post(m.dir.NewAccount, account, nil)
+	if err != nil {
+		return fmt.Errorf("register account: %w", err)
+	}
+	resp.Body.Close()
+	m.accountURL = resp.Header.Get("Location")
+	return nil
+}
+
+// post sends a JWS-signed request. A nil payload makes it a POST-as-GET.
+// When out is set the response body is decoded into it and closed;
+// otherwise the caller owns the body.
+func (m *acmeManager) post(url string, payload, out any) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		body, err := m.signJWS(url, payload)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := m.client.Post(url, "application/jose+json", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		m.nonce = resp.Header.Get("Replay-Nonce")
+
+		if resp.StatusCode >= 400 {
+			problem := &acmeProblem{}
+			_ = json.NewDecoder(resp.Body).Decode(problem)
+			resp.Body.Close()
+			// Nonces expire; the error response carries a fresh one
+			if problem.Type == "urn:ietf:params:acme:error:badNonce" && attempt < 3 {
+				continue
+			}
+			return nil, problem
+		}
+		if out != nil {
+			err = json.NewDecoder(resp.Body).Decode(out)
+			resp.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return resp, nil
+	}
+}
+
+// signJWS wraps payload in a flattened JWS signed with the account key
+// using ES256. The account's key ID is used once registered, the full
+// public key before that.
+func (m *acmeManager) signJWS(url string, payload any) ([]byte, error) {
+	if m.nonce == "" {
+		resp, err := m.client.Head(m.dir.NewNonce)
+		if err != nil {
+			return nil, fmt.Errorf("fetch nonce: %w", err)
+		}
+		resp.Body.Close()
+		m.nonce = resp.Header.Get("Replay-Nonce")
+	}
+
+	protected := map[string]any{"alg": "ES256", "nonce": m.nonce, "url": url}
+	m.nonce = ""
+	if m.accountURL != "" {
+		protected["kid"] = m.accountURL
+	} else {
+		jwk, err := ecJWK(&m.accountKey.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		protected["jwk"] = jwk
+	}
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	var encodedPayload string
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		encodedPayload = b64(data)
+	}
+	encodedHeader := b64(header)
+
+	digest := sha256.Sum256([]byte(encodedHeader + "." + encodedPayload))
+	r, s, err := ecdsa.Sign(rand.Reader, m.accountKey, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return json.Marshal(map[string]string{
+		"protected": encodedHeader,
+		"payload":   encodedPayload,
+		"signature": b64(sig),
+	})
+}
+
+// ecJWK returns the JSON Web Key members of a P-256 public key
+func ecJWK(pub *ecdsa.PublicKey) (map[string]string, error) {
+	key, err := pub.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	// Uncompressed point: 0x04 || X || Y
+	point := key.Bytes()
+	return map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   b64(point[1:33]),
+		"y":   b64(point[33:]),
+	}, nil
+}
+
+// jwkThumbprint computes the RFC 7638 thumbprint used in key authorizations
+func jwkThumbprint(pub *ecdsa.PublicKey) (string, error) {
+	jwk, err := ecJWK(pub)
+	if err != nil {
+		return "", err
+	}
+	// Members in lexicographic order with no whitespace
+	canonical := `{"crv":"` + jwk["crv"] + `","kty":"` + jwk["kty"] + `","x":"` + jwk["x"] + `","y":"` + jwk["y"] + `"}`
+	sum := sha256.Sum256([]byte(canonical))
+	return b64(sum[:]), nil
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"runtime/pprof"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxProfileSeconds bounds how long a CPU profile or trace request may run
+const maxProfileSeconds = 300
+
+// writeBody writes a complete response with a body and closes the exchange
+func writeBody(w io.Writer, code int, contentType string, body []byte) error {
+	_, err := fmt.Fprintf(w,
+		"HTTP/1.1 %d %s\r\nDate: %s\r\nContent-Type: %s\r\nContent-Length: %d\r\nConnection: close\r\n\r\n",
+		code, statusText(code), httpDate(), contentType, len(body),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+// serveAdmin runs the admin listener's accept loop. Admin connections are
+// short-lived: one request, one response, then close.
+func (s *Server) serveAdmin(l net.Listener) {
+	for {
+		conn, err := s.Accept(l)
+		if err != nil {
+			// Listener closed
+			return
+		}
+		go s.handleAdminConnection(conn)
+	}
+}
+
+func (s *Server) handleAdminConnection(conn net.Conn) {
+	defer conn.Close()
+
+	reader := getReader(conn)
+	defer putReader(reader)
+	w := getWriter(conn)
+	defer putWriter(w)
+	req := getRequest()
+	defer putRequest(req)
+	req.conn = conn
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := readRequest(reader, req); err != nil {
+		_ = writeStatus(w, requestErrorStatus(err), true)
+		_ = w.Flush()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	path, query := req.Path, req.Query()
+	post := map[string]bool{"/reload": true, "/cache/purge": true, "/log-level": true, "/shutdown": true}
+	if !s.adminAuthorized(req) {
+		writeUnauthorized(w)
+	} else if s.browserRequest(req, post[path]) {
+		_ = writeStatus(w, 403, true)
+	} else if req.Method == "POST" && post[path] {
+		switch path {
+		case "/reload":
+			s.handleReload(w)
+		case "/cache/purge":
+			s.handleCachePurge(w, req)
+		case "/log-level":
+			s.handleLogLevel(w, req)
+		case "/shutdown":
+			_ = writeBody(w, 202, "text/plain; charset=utf-8", []byte("shutting down\n"))
+			_ = w.Flush()
+			s.Shutdown()
+		}
+	} else if req.Method != "GET" {
+		_ = writeStatus(w, 405, true)
+	} else if path == "/metrics" {
+		var buf bytes.Buffer
+		s.writeMetrics(&buf)
+		_ = writeBody(w, 200, "text/plain; version=0.0.4; charset=utf-8", buf.Bytes())
+	} else if path == "/stats" {
+		_ = writeBody(w, 200, "application/json", s.statsJSON())
+	} else if path == "/version" {
+		_ = writeBody(w, 200, "application/json", currentBuild().json())
+	} else if path == "/config" {
+		s.handleConfig(w)
+	} else if path == "/connections" {
+		s.handleConnections(w)
+	} else if path == "/routes" {
+		_ = writeJSON(w, s.routeStats.summary())
+	} else if path == "/log-level" {
+		s.handleLogLevel(w, req)
+	} else if path == "/sign" {
+		s.handleSign(w, query)
+	} else if strings.HasPrefix(path, "/debug/pprof/") {
+		s.handlePprof(w, conn, strings.TrimPrefix(path, "/debug/pprof/"), query)
+	} else {
+		_ = writeStatus(w, 404, true)
+	}
+	_ = w.Flush()
+}
+
+// handleReload applies the current configuration, as SIGHUP does
+func (s *Server) handleReload(w io.Writer) {
+	if err := s.reload(); err != nil {
+		s.log.Error("failed to reload configuration", "err", err)
+		_ = writeBody(w, 500, "text/plain; charset=utf-8", []byte(err.Error()+"\n"))
+		return
+	}
+	_ = writeBody(w, 200, "text/plain; charset=utf-8", []byte("reloaded\n"))
+}
+
+// handlePprof serves the runtime profiles in the same shape as
+// net/http/pprof, so `go tool pprof http://admin/debug/pprof/heap` works
+func (s *Server) handlePprof(w *bufio.Writer, conn net.Conn, name string, query url.Values) {
+	seconds := 30
+	if v := query.Get("seconds"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxProfileSeconds {
+			_ = writeStatus(w, 400, true)
+			return
+		}
+		seconds = n
+	}
+	debug, _ := strconv.Atoi(query.Get("debug"))
+
+	var buf bytes.Buffer
+	switch name {
+	case "":
+		_ = writeBody(w, 200, "text/html; charset=utf-8", pprofIndex())
+		return
+	case "cmdline":
+		_ = writeBody(w, 200, "text/plain; charset=utf-8", []byte(strings.Join(redactArgs(os.Args), "\x00")))
+		return
+	case "profile":
+		// The connection is idle while profiling
+		_ = conn.SetWriteDeadline(time.Now().Add(time.Duration(seconds)*time.Second + 10*time.Second))
+		if err := pprof.StartCPUProfile(&buf); err != nil {
+			// Another profile is already running
+			_ = writeBody(w, 500, "text/plain; charset=utf-8", []byte(err.Error()+"\n"))
+			return
+		}
+		time.Sleep(time.Duration(seconds) * time.Second)
+		pprof.StopCPUProfile()
+	case "trace":
+		_ = conn.SetWriteDeadline(time.Now().Add(time.Duration(seconds)*time.Second + 10*time.Second))
+		if err := trace.Start(&buf); err != nil {
+			_ = writeBody(w, 500, "text/plain; charset=utf-8", []byte(err.Error()+"\n"))
+			return
+		}
+		time.Sleep(time.Duration(seconds) * time.Second)
+		trace.Stop()
+	default:
+		profile := pprof.Lookup(name)
+		if profile == nil {
+			_ = writeStatus(w, 404, true)
+			return
+		}
+		if err := profile.WriteTo(&buf, debug); err != nil {
+			_ = writeBody(w, 500, "text/plain; charset=utf-8", []byte(err.Error()+"\n"))
+			return
+		}
+		if debug > 0 {
+			_ = writeBody(w, 200, "text/plain; charset=utf-8", buf.Bytes())
+			return
+		}
+	}
+	_ = writeBody(w, 200, "application/octet-stream", buf.Bytes())
+}
+
+func pprofIndex() []byte {
+	profiles := pprof.Profiles()
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name() < profiles[j].Name() })
+
+	var b bytes.Buffer
+	b.WriteString("<html><head><title>/debug/pprof/</title></head><body>\n<p>/debug/pprof/</p>\n<table>\n")
+	for _, p := range profiles {
+		fmt.Fprintf(&b, "<tr><td>%d</td><td><a href=\"%s?debug=1\">%s</a></td></tr>\n", p.Count(), p.Name(), p.Name())
+	}
+	b.WriteString("<tr><td></td><td><a href=\"profile\">profile</a> (CPU, ?seconds=30)</td></tr>\n")
+	b.WriteString("<tr><td></td><td><a href=\"trace?seconds=5\">trace</a></td></tr>\n")
+	b.WriteString("<tr><td></td><td><a href=\"cmdline\">cmdline</a></td></tr>\n")
+	b.WriteString("</table>\n</body></html>\n")
+	return b.Bytes()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// secretSettings are shown as "redacted" by /config
+var secretSettings = map[string]bool{
+	"admin-token":     true,
+	"basic-auth":      true,
+	"csrf-secret":     true,
+	"jwt-secret":      true,
+	"session-secret":  true,
+	"url-signing-key": true,
+	"webhook-secret":  true,
+}
+
+// adminAuthorized checks the bearer token when --admin-token is set
+func (s *Server) adminAuthorized(req *Request) bool {
+	token := s.settings().adminToken
+	if token == "" {
+		return true
+	}
+	auth := req.Header("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[7:]), []byte(token)) == 1
+}
+
+func writeUnauthorized(w io.Writer) {
+	body := statusText(401) + "\n"
+	_, _ = fmt.Fprintf(w,
+		"HTTP/1.1 401 %s\r\nDate: %s\r\nWWW-Authenticate: Bearer realm=\"admin\"\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		statusText(401), httpDate(), len(body), body,
+	)
+}
+
+// browserRequest reports whether a request to a token-less admin API came
+// from a web page in a local browser rather than a local tool. A page that
+// rebinds its own name to 127.0.0.1 still sends that name as Host, and a
+// cross-site form post carries an Origin.
+func (s *Server) browserRequest(req *Request, changesState bool) bool {
+	if s.settings().adminToken != "" {
+		return false
+	}
+	if changesState && req.Header("Origin") != "" {
+		return true
+	}
+	host := req.Header("Host")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return !isLoopbackHost(strings.Trim(host, "[]"))
+}
+
+// isLoopbackAddr reports whether addr only listens on loopback. Host names
+// other than localhost can't be known not to resolve elsewhere.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	return err == nil && isLoopbackHost(host)
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// redactArgs returns the command line with the values of secretSettings
+// replaced, whether given as --name=value or --name value
+func redactArgs(args []string) []string {
+	out := make([]string, len(args))
+	next := false
+	for i, arg := range args {
+		if next {
+			out[i], next = redactedValue, false
+			continue
+		}
+		out[i] = arg
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !secretSettings[name] {
+			continue
+		}
+		if hasValue {
+			out[i] = arg[:strings.Index(arg, "=")+1] + redactedValue
+		} else {
+			next = true
+		}
+	}
+	return out
+}
+
+func writeJSON(w io.Writer, v any) error {
+	body, _ := json.MarshalIndent(v, "", "  ")
+	return writeBody(w, 200, "application/json", append(body, '\n'))
+}
+
+// handleConfig reports every setting given on the command line or in the
+// config file, as last loaded, with secrets redacted
+func (s *Server) handleConfig(w io.Writer) {
+	out := make(map[string]any)
+	for name, values := range s.settings().given {
+		if secretSettings[name] {
+			out[name] = "redacted"
+		} else if len(values) == 1 {
+			out[name] = values[0]
+		} else {
+			out[name] = values
+		}
+	}
+	_ = writeJSON(w, out)
+}
+
+// connInfo is one open connection in /connections
+type connInfo struct {
+	Remote   string `json:"remote"`
+	Local    string `json:"local"`
+	Opened   string `json:"opened"`
+	Age      string `json:"age"`
+	Requests uint64 `json:"requests"`
+	Idle     bool   `json:"idle"`
+	IdleFor  string `json:"idle_for"`
+}
+
+// handleConnections lists the open client connections, oldest first
+func (s *Server) handleConnections(w io.Writer) {
+	now := time.Now()
+	s.connsMu.Lock()
+	conns := make([]*timeoutConn, 0, len(s.conns))
+	for tc := range s.conns {
+		conns = append(conns, tc)
+	}
+	s.connsMu.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].opened.Before(conns[j].opened) })
+
+	out := make([]connInfo, 0, len(conns))
+	for _, tc := range conns {
+		out = append(out, connInfo{
+			Remote:   tc.RemoteAddr().String(),
+			Local:    tc.LocalAddr().String(),
+			Opened:   tc.opened.UTC().Format(time.RFC3339),
+			Age:      now.Sub(tc.opened).Round(time.Millisecond).String(),
+			Requests: tc.requests.Load(),
+			Idle:     tc.idle.Load(),
+			IdleFor:  tc.idleFor(now).Round(time.Millisecond).String(),
+		})
+	}
+	_ = writeJSON(w, out)
+}
+
+// handleCachePurge empties the response cache, or just the paths under
+// ?prefix=
+func (s *Server) handleCachePurge(w io.Writer, req *Request) {
+	if s.cache == nil {
+		_ = writeBody(w, 404, "text/plain; charset=utf-8", []byte("no response cache is configured\n"))
+		return
+	}
+	n := s.cache.purge(req.Query().Get("prefix"))
+	_ = writeJSON(w, map[string]int{"purged": n})
+}
+
+// handleLogLevel reports the log level, or on POST sets it from ?level=
+// until the next reload
+func (s *Server) handleLogLevel(w io.Writer, req *Request) {
+	if req.Method == "POST" {
+		level, err := parseLogLevel(req.Query().Get("level"))
+		if err != nil {
+			_ = writeBody(w, 400, "text/plain; charset=utf-8", []byte("level must be debug, info, warn, or error\n"))
+			return
+		}
+		s.logLevel.Set(level)
+		s.log.Info("log level changed", "level", level.String())
+	}
+	_ = writeJSON(w, map[string]string{"level": levelName(s.logLevel.Level())})
+}
+
+func levelName(level slog.Level) string {
+	return strings.ToLower(level.String())
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAdminNeedsTokenOffLoopback(t *testing.T) {
+	for _, flags := range [][]string{
+		{"--admin-addr", ":9000"},
+		{"--admin-addr", "0.0.0.0:9000"},
+		{"--admin-addr", "admin.example:9000"},
+	} {
+		if s := New(WithFlags(flags...)); s.initErr == nil || !strings.Contains(s.initErr.Error(), "--admin-token") {
+			t.Errorf("New(%q) = %v, want the token required", flags, s.initErr)
+		}
+	}
+	newUnitServer(t, "--admin-addr", "127.0.0.1:9000")
+	newUnitServer(t, "--admin-addr", "[::1]:9000")
+	newUnitServer(t, "--admin-addr", "localhost:9000")
+	newUnitServer(t, "--admin-addr", ":9000", "--admin-token", "t0ken")
+}
+
+func TestRedactArgs(t *testing.T) {
+	got := redactArgs([]string{
+		"server", "--directory", "/srv", "--jwt-secret", "s3cret",
+		"-admin-token=t0ken", "--webhook-secret=", "--port", "80",
+	})
+	want := []string{
+		"server", "--directory", "/srv", "--jwt-secret", redactedValue,
+		"-admin-token=" + redactedValue, "--webhook-secret=" + redactedValue, "--port", "80",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("redactArgs = %q, want %q", got, want)
+	}
+}
+
+// adminStatus sends raw to the admin listener and returns the status
+func adminStatus(t *testing.T, ts *testServer, raw string) int {
+	t.Helper()
+	conn, err := net.Dial("tcp", ts.s.adminListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// TestAdminRefusesBrowsers checks a token-less admin API turns away what a
+// web page in a local browser could send it
+func TestAdminRefusesBrowsers(t *testing.T) {
+	ts := newTestServer(t, "--admin-addr", "127.0.0.1:0")
+	for _, tt := range []struct {
+		req  string
+		want int
+	}{
+		{"GET /version HTTP/1.1\r\nHost: 127.0.0.1:9000\r\n\r\n", 200},
+		{"GET /version HTTP/1.1\r\nHost: localhost\r\n\r\n", 200},
+		{"GET /version HTTP/1.1\r\nHost: [::1]:9000\r\n\r\n", 200},
+		{"POST /reload HTTP/1.1\r\nHost: localhost:9000\r\nContent-Length: 0\r\n\r\n", 200},
+		// DNS rebinding
+		{"GET /config HTTP/1.1\r\nHost: rebind.example:9000\r\n\r\n", 403},
+		// Cross-site form posts
+		{"POST /shutdown HTTP/1.1\r\nHost: 127.0.0.1:9000\r\nOrigin: https://evil.example\r\nContent-Length: 0\r\n\r\n", 403},
+		{"POST /reload HTTP/1.1\r\nHost: 127.0.0.1:9000\r\nOrigin: null\r\nContent-Length: 0\r\n\r\n", 403},
+	} {
+		if got := adminStatus(t, ts, tt.req); got != tt.want {
+			t.Errorf("%q: status %d, want %d", tt.req, got, tt.want)
+		}
+	}
+
+	// With a token, the token is what's checked
+	ts = newTestServer(t, "--admin-addr", "127.0.0.1:0", "--admin-token", "t0ken")
+	if got := adminStatus(t, ts, "GET /version HTTP/1.1\r\nHost: admin.example\r\nAuthorization: Bearer t0ken\r\n\r\n"); got != 200 {
+		t.Errorf("token request with a name as Host: status %d", got)
+	}
+}
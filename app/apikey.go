@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiKeyCheckInterval is how often the key file is checked for changes
+const apiKeyCheckInterval = 5 * time.Second
+
+// apiKey is one entry of the key file
+type apiKey struct {
+	label  string
+	bucket *requestBucket // nil when the key is unlimited
+}
+
+// apiKeyStore holds the keys from a file of "KEY LABEL [RATE]" lines,
+// reloading it when it changes. Keys are indexed by their SHA-256 so
+// lookups don't leak timing about the raw keys.
+type apiKeyStore struct {
+	path string
+
+	mu      sync.RWMutex
+	keys    map[[32]byte]*apiKey
+	modTime time.Time
+	checked time.Time
+}
+
+func loadAPIKeys(path string) (*apiKeyStore, error) {
+	st := &apiKeyStore{path: path}
+	if err := st.reload(); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// reload rereads the key file whether or not it has changed
+func (st *apiKeyStore) reload() error {
+	info, err := os.Stat(st.path)
+	if err != nil {
+		return err
+	}
+	return st.load(info.ModTime())
+}
+
+func (st *apiKeyStore) load(modTime time.Time) error {
+	f, err := os.Open(st.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Keys that survive a reload keep their rate limit state
+	st.mu.RLock()
+	old := st.keys
+	st.mu.RUnlock()
+
+	keys := make(map[[32]byte]*apiKey)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return fmt.Errorf("%s:%d: expected KEY LABEL [RATE]", st.path, n)
+		}
+		key := &apiKey{label: fields[1]}
+		if len(fields) == 3 {
+			rate, err := parseRequestRate(fields[2])
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", st.path, n, err)
+			}
+			key.bucket = newRequestBucket(rate)
+		}
+		sum := sha256.Sum256([]byte(fields[0]))
+		if prev, ok := old[sum]; ok && prev.bucket != nil && key.bucket != nil && prev.bucket.rate == key.bucket.rate {
+			key.bucket = prev.bucket
+		}
+		keys[sum] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	st.keys, st.modTime = keys, modTime
+	st.mu.Unlock()
+	return nil
+}
+
+// lookup finds a key, first reloading the file if it has changed
+func (st *apiKeyStore) lookup(raw string) *apiKey {
+	st.mu.RLock()
+	stale := time.Since(st.checked) > apiKeyCheckInterval
+	st.mu.RUnlock()
+	if stale {
+		st.refresh()
+	}
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.keys[sha256.Sum256([]byte(raw))]
+}
+
+// refresh reloads the key file when its modification time moved. A file
+// that fails to parse leaves the previous keys in place.
+func (st *apiKeyStore) refresh() {
+	st.mu.Lock()
+	if time.Since(st.checked) <= apiKeyCheckInterval {
+		st.mu.Unlock()
+		return
+	}
+	st.checked = time.Now()
+	modTime := st.modTime
+	st.mu.Unlock()
+
+	info, err := os.Stat(st.path)
+	if err != nil || info.ModTime().Equal(modTime) {
+		return
+	}
+	_ = st.load(info.ModTime())
+}
+
+// apiKeyAuth returns a middleware requiring a known key, from the header
+// or the query parameter, on paths under any of prefixes. The key's label
+// becomes the request's user.
+func apiKeyAuth(st *apiKeyStore, prefixes []string, header, param string) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(s *Server, w ResponseWriter, req *Request) {
+			if req.signedURL || !hasAnyPrefix(req.Path, prefixes) {
+				next(s, w, req)
+				return
+			}
+
+			raw := req.Header(header)
+			if raw == "" && param != "" && req.RawQuery != "" {
+				raw = req.Query().Get(param)
+			}
+			key := st.lookup(raw)
+			if raw == "" || key == nil {
+				sendStatus(w, 401)
+				return
+			}
+			req.user = key.label
+			if key.bucket != nil {
+				if ok, wait := key.bucket.allow(); !ok {
+					req.Logger().Info("api key rate limited", "key", key.label)
+					sendTooManyRequests(w, wait)
+					return
+				}
+			}
+			next(s, w, req)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAPIKeyAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	writeKeys := func(text string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeKeys("# key label rate\nk-alice alice\nk-bob bob 2/m\n")
+	ts := newTestServer(t, "--api-keys", path, "--api-key-protect", "/anything")
+
+	ts.Get("/anything").Do().Status(401)
+	ts.Get("/anything").Header("X-API-Key", "k-alice").Do().Status(200)
+	ts.Get("/anything?api_key=k-alice").Do().Status(200)
+	ts.Get("/anything").Header("X-API-Key", "k-mallory").Do().Status(401)
+	ts.Get("/anything?api_key=").Do().Status(401)
+	ts.Get("/echo/abc").Do().Status(200)
+
+	for range 2 {
+		ts.Get("/anything").Header("X-API-Key", "k-bob").Do().Status(200)
+	}
+	ts.Get("/anything").Header("X-API-Key", "k-bob").Do().Status(429)
+
+	// A reload keeps the rate limit state of keys that are still there
+	if err := ts.s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	ts.Get("/anything").Header("X-API-Key", "k-bob").Do().Status(429)
+
+	// and picks up changes to the file
+	writeKeys("k-bob bob 2/m\nk-carol carol\n")
+	if err := ts.s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	ts.Get("/anything").Header("X-API-Key", "k-carol").Do().Status(200)
+	ts.Get("/anything").Header("X-API-Key", "k-alice").Do().Status(401)
+	ts.Get("/anything").Header("X-API-Key", "k-bob").Do().Status(429)
+
+	// A file that no longer parses is refused, and the old keys kept
+	writeKeys("k-dave\n")
+	if err := ts.s.reload(); err == nil {
+		t.Error("reload accepted a malformed key file")
+	}
+	ts.Get("/anything").Header("X-API-Key", "k-carol").Do().Status(200)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// auditLog records every attempt to change a file under /files, one JSON
+// object per line. The file is only ever appended to and never rotated by
+// the server; it is reopened along with the other logs on SIGUSR1.
+type auditLog struct {
+	file *rotatingFile
+}
+
+// auditRecord is one line of the audit log
+type auditRecord struct {
+	Time   string `json:"time"`
+	Action string `json:"action"`
+	Remote string `json:"remote"`
+	User   string `json:"user,omitempty"`
+	File   string `json:"file"`
+	Bytes  int64  `json:"bytes"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := openRotatingFile(path, rotationPolicy{})
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: f}, nil
+}
+
+// record appends an entry for action on file. A status of 400 or more
+// marks a failed attempt, with reason saying why.
+func (a *auditLog) record(req *Request, action, file string, n int64, status int, reason string) {
+	line, _ := json.Marshal(auditRecord{
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+		Action: action,
+		Remote: clientIP(req),
+		User:   req.user,
+		File:   file,
+		Bytes:  n,
+		Status: status,
+		Error:  reason,
+	})
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		req.Logger().Error("failed to write audit log", "err", err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// bannerListener is one address the server accepts connections on
+type bannerListener struct {
+	name string // what is served there, e.g. "http" or "admin"
+	addr string // the bound address, with the port actually chosen
+}
+
+// startupBanner is the effective configuration reported once the listeners
+// are bound
+type startupBanner struct {
+	listeners []bannerListener
+	acceptors int
+	directory string
+	features  []string
+	timeouts  phaseTimeouts
+	drain     time.Duration
+}
+
+func (s *Server) startupBanner() startupBanner {
+	b := startupBanner{
+		acceptors: len(s.listeners),
+		features:  s.features,
+		timeouts:  s.settings().timeouts,
+		drain:     s.drainTimeout,
+	}
+	scheme := "http"
+	if s.tlsConfig != nil {
+		scheme = "https"
+	}
+	b.listeners = append(b.listeners, bannerListener{scheme, listenerAddr(s.listeners[0])})
+	if s.plainListener != nil {
+		b.listeners = append(b.listeners, bannerListener{"http", listenerAddr(s.plainListener)})
+	}
+	if s.redirectListener != nil {
+		b.listeners = append(b.listeners, bannerListener{"redirect", listenerAddr(s.redirectListener)})
+	}
+	if s.adminListener != nil {
+		b.listeners = append(b.listeners, bannerListener{"admin", listenerAddr(s.adminListener)})
+	}
+	if dir := s.settings().directory; dir != "" {
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		b.directory = dir
+	}
+	return b
+}
+
+// log records the banner as one structured line
+func (b startupBanner) log(log *slog.Logger) {
+	listeners := make([]any, 0, len(b.listeners))
+	for _, l := range b.listeners {
+		listeners = append(listeners, slog.String(l.name, l.addr))
+	}
+	log.Info("listening",
+		slog.Group("listeners", listeners...),
+		"acceptors", b.acceptors,
+		"directory", b.directory,
+		"features", b.features,
+		slog.Group("timeouts",
+			"idle", b.timeouts.idle,
+			"header", b.timeouts.header,
+			"body", b.timeouts.body,
+			"handler", b.timeouts.handler,
+			"write", b.timeouts.write,
+			"drain", b.drain,
+		),
+	)
+}
+
+// print writes the banner for a person reading the terminal
+func (b startupBanner) print(w io.Writer) {
+	fmt.Fprintln(w, currentBuild())
+	for i, l := range b.listeners {
+		label := ""
+		if i == 0 {
+			label = "listening"
+		}
+		suffix := ""
+		if i == 0 && b.acceptors > 1 {
+			suffix = fmt.Sprintf(" (%d acceptors)", b.acceptors)
+		}
+		fmt.Fprintf(w, "  %-10s %-8s %s%s\n", label, l.name, l.addr, suffix)
+	}
+	directory := b.directory
+	if directory == "" {
+		directory = "(none, /files is disabled)"
+	}
+	fmt.Fprintf(w, "  %-10s %s\n", "directory", directory)
+	features := strings.Join(b.features, ", ")
+	if features == "" {
+		features = "(none)"
+	}
+	fmt.Fprintf(w, "  %-10s %s\n", "features", features)
+	t := b.timeouts
+	fmt.Fprintf(w, "  %-10s idle %s, header %s, body %s, handler %s, write %s, drain %s\n",
+		"timeouts", t.idle, t.header, t.body, t.handler, t.write, b.drain)
+}
+
+// configFeatures names the optional features cfg turns on
+func configFeatures(cfg *serverConfig) []string {
+	var features []string
+	add := func(on bool, name string) {
+		if on {
+			features = append(features, name)
+		}
+	}
+	add(cfg.tlsCert != "" || cfg.tlsSelfSigned || len(cfg.acmeDomains) > 0, "tls")
+	add(len(cfg.acmeDomains) > 0, "acme")
+	add(cfg.tlsClientCA != "", "client-certificates")
+	add(cfg.proxyProtocol, "proxy-protocol")
+	add(len(cfg.proxies) > 0, "reverse-proxy")
+	add(cfg.proxyRecord != "", "proxy-record")
+	add(cfg.proxyReplay != "", "proxy-replay")
+	add(len(cfg.fastcgi) > 0, "fastcgi")
+	add(cfg.cgiDir != "", "cgi")
+	add(cfg.stubsPath != "", "stubs")
+	add(cfg.templateDir != "", "templates")
+	add(cfg.errorPages != "", "error-pages")
+	add(len(cfg.plugins) > 0, "plugins")
+	add(len(cfg.cacheRoutes) > 0 && !cfg.dev, "response-cache")
+	add(cfg.corsConfig != nil, "cors")
+	add(cfg.security != nil, "security-headers")
+	add(len(cfg.headerRules) > 0, "header-rules")
+	add(len(cfg.authRules) > 0, "basic-auth")
+	add(len(cfg.jwtPrefixes) > 0, "jwt")
+	add(len(cfg.apiKeyPrefixes) > 0, "api-keys")
+	add(len(cfg.csrfPrefixes) > 0, "csrf")
+	add(cfg.sessions, "sessions")
+	add(cfg.signingKey != "", "signed-urls")
+	add(len(cfg.clientRates) > 0 || cfg.maxRequestRate != nil, "rate-limits")
+	add(cfg.maxRate > 0 || len(cfg.routeRates) > 0, "bandwidth-limits")
+	add(cfg.maxInFlight > 0, "load-shedding")
+	add(cfg.auditPath != "", "audit-log")
+	add(len(cfg.webhooks) > 0, "webhooks")
+	add(cfg.otlpEndpoint != "", "tracing")
+	add(cfg.openAPI || cfg.swaggerUI, "openapi")
+	add(cfg.swaggerUI, "swagger-ui")
+	add(cfg.versionEndpoint, "version-endpoint")
+	add(cfg.metricsEndpoint, "metrics-endpoint")
+	add(cfg.dev, "dev")
+	return features
+}
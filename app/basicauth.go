@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Successful bcrypt checks are remembered briefly so keep-alive clients
+// don't pay the hashing cost on every request
+const (
+	authCacheTTL  = 5 * time.Minute
+	authCacheSize = 1024
+)
+
+// htpasswd holds the credentials of an htpasswd file. Only bcrypt ($2a$,
+// $2b$, $2y$) entries are supported; unsalted {SHA}, MD5, and crypt entries
+// are rejected when the file is loaded.
+type htpasswd struct {
+	path  string
+	mu    sync.RWMutex
+	users map[string]string
+
+	cacheMu sync.Mutex
+	cache   map[[32]byte]time.Time
+}
+
+func loadHtpasswd(path string) (*htpasswd, error) {
+	h := &htpasswd{path: path, cache: make(map[[32]byte]time.Time)}
+	if err := h.reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// reload rereads the file, keeping the old credentials if it can't be read
+func (h *htpasswd) reload() error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return fmt.Errorf("%s:%d: expected user:hash", h.path, n)
+		}
+		if strings.HasPrefix(hash, "{SHA}") {
+			return fmt.Errorf("%s:%d: %q has an unsalted {SHA} hash, which is no longer accepted; rehash it with bcrypt (htpasswd -B)", h.path, n, user)
+		}
+		if !strings.HasPrefix(hash, "$2") {
+			return fmt.Errorf("%s:%d: unsupported hash for %q, use bcrypt (htpasswd -B)", h.path, n, user)
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.users = users
+	h.mu.Unlock()
+	h.cacheMu.Lock()
+	clear(h.cache)
+	h.cacheMu.Unlock()
+	return nil
+}
+
+// verify checks a user's password
+func (h *htpasswd) verify(user, password string) bool {
+	h.mu.RLock()
+	hash, ok := h.users[user]
+	h.mu.RUnlock()
+	if !ok {
+		return false
+	}
+
+	key := sha256.Sum256([]byte(hash + "\x00" + user + "\x00" + password))
+	h.cacheMu.Lock()
+	expires, cached := h.cache[key]
+	h.cacheMu.Unlock()
+	if cached && time.Now().Before(expires) {
+		return true
+	}
+	if match, err := bcryptVerify(hash, password); err != nil || !match {
+		return false
+	}
+	h.cacheMu.Lock()
+	if len(h.cache) >= authCacheSize {
+		clear(h.cache)
+	}
+	h.cache[key] = time.Now().Add(authCacheTTL)
+	h.cacheMu.Unlock()
+	return true
+}
+
+// basicAuthRule protects paths starting with prefix
+type basicAuthRule struct {
+	prefix string
+	users  *htpasswd
+}
+
+// parseBasicAuth reads the user and password from an Authorization header
+func parseBasicAuth(header string) (user, password string, ok bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[len(prefix):]))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// basicAuth returns a middleware requiring credentials from the htpasswd
+// file of the longest matching rule. Requests outside every rule pass
+// through.
+func basicAuth(rules []basicAuthRule, realm string) Middleware {
+	challenge := fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm)
+	return func(next HandlerFunc) HandlerFunc {
+		return func(s *Server, w ResponseWriter, req *Request) {
+			var rule *basicAuthRule
+			for i := range rules {
+				r := &rules[i]
+				if strings.HasPrefix(req.Path, r.prefix) && (rule == nil || len(r.prefix) > len(rule.prefix)) {
+					rule = r
+				}
+			}
+			// Signed links were authorized when they were issued
+			if rule == nil || req.signedURL {
+				next(s, w, req)
+				return
+			}
+
+			user, password, ok := parseBasicAuth(req.Header("Authorization"))
+			if !ok || !rule.users.verify(user, password) {
+				if ok {
+					req.Logger().Info("authentication failed", "user", user)
+				}
+				w.Header().Set("WWW-Authenticate", challenge)
+				sendStatus(w, 401)
+				return
+			}
+			req.user = user
+			next(s, w, req)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeHtpasswd writes an htpasswd file holding user and a bcrypt hash of
+// password, at the lowest cost so tests stay fast
+func writeHtpasswd(t *testing.T, user, password string) string {
+	t.Helper()
+	salt := []byte("0123456789abcdef")
+	hash := "$2b$04$" + bcryptEncoding.EncodeToString(salt) + bcryptEncoding.EncodeToString(bcryptHash([]byte(password), salt, 4))
+	return writeHtpasswdLines(t, user+":"+hash)
+}
+
+func writeHtpasswdLines(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestHtpasswdRejectsWeakHashes checks only bcrypt entries load
+func TestHtpasswdRejectsWeakHashes(t *testing.T) {
+	for _, tt := range []struct{ line, err string }{
+		{"ann:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", `"ann" has an unsalted {SHA} hash`},
+		{"ann:$apr1$abcdefgh$0123456789abcdefghijkl", "unsupported hash"},
+		{"ann:plaintext", "unsupported hash"},
+	} {
+		path := writeHtpasswdLines(t, tt.line)
+		if _, err := loadHtpasswd(path); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("loading %q: error %v, want one containing %q", tt.line, err, tt.err)
+		}
+	}
+
+	users, err := loadHtpasswd(writeHtpasswd(t, "ann", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !users.verify("ann", "secret") || users.verify("ann", "guess") || users.verify("bob", "secret") {
+		t.Error("bcrypt entry verified wrongly")
+	}
+}
+
+// TestBasicAuthDotSegments checks dot segments can't walk a request in
+// under a protected prefix without matching it
+func TestBasicAuthDotSegments(t *testing.T) {
+	ts := newTestServer(t, "--basic-auth", "/files/private/="+writeHtpasswd(t, "ann", "secret"))
+	if err := os.Mkdir(filepath.Join(ts.dir, "private"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	ts.writeFile("private/secret.txt", "classified")
+
+	for _, target := range []string{
+		"/files/private/secret.txt",
+		"/files/x/../private/secret.txt",
+		"/files/./private/secret.txt",
+		"/files//private/secret.txt",
+		"/../files/private/secret.txt",
+	} {
+		ts.Get(target).Do().Status(401).BodyIs("")
+	}
+	ts.Get("/files/x/../private/secret.txt").Header("Authorization", "Basic YW5uOnNlY3JldA==").Do().
+		Status(200).BodyIs("classified")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strconv"
+)
+
+// bcryptEncoding is bcrypt's own base64 alphabet
+var bcryptEncoding = base64.NewEncoding("./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789").WithPadding(base64.NoPadding)
+
+var errBadBcryptHash = errors.New("malformed bcrypt hash")
+
+// blowfish is the cipher state bcrypt's expensive key schedule runs on
+type blowfish struct {
+	p [18]uint32
+	s [4][256]uint32
+}
+
+func (c *blowfish) f(x uint32) uint32 {
+	return ((c.s[0][x>>24] + c.s[1][x>>16&0xff]) ^ c.s[2][x>>8&0xff]) + c.s[3][x&0xff]
+}
+
+func (c *blowfish) encrypt(l, r uint32) (uint32, uint32) {
+	l ^= c.p[0]
+	for i := 1; i < 16; i += 2 {
+		r ^= c.f(l) ^ c.p[i]
+		l ^= c.f(r) ^ c.p[i+1]
+	}
+	r ^= c.p[17]
+	return r, l
+}
+
+// streamWord reads the next big-endian word of b, wrapping around
+func streamWord(b []byte, pos *int) uint32 {
+	var w uint32
+	for i := 0; i < 4; i++ {
+		w = w<<8 | uint32(b[*pos])
+		*pos = (*pos + 1) % len(b)
+	}
+	return w
+}
+
+// expandKey mixes key into the state, and salt into the encryption stream
+// when it is set
+func (c *blowfish) expandKey(key, salt []byte) {
+	j := 0
+	for i := range c.p {
+		c.p[i] ^= streamWord(key, &j)
+	}
+	j = 0
+	var l, r uint32
+	next := func() {
+		if salt != nil {
+			l ^= streamWord(salt, &j)
+			r ^= streamWord(salt, &j)
+		}
+		l, r = c.encrypt(l, r)
+	}
+	for i := 0; i < len(c.p); i += 2 {
+		next()
+		c.p[i], c.p[i+1] = l, r
+	}
+	for b := range c.s {
+		for i := 0; i < 256; i += 2 {
+			next()
+			c.s[b][i], c.s[b][i+1] = l, r
+		}
+	}
+}
+
+// bcryptHash computes the 23-byte bcrypt digest of password
+func bcryptHash(password, salt []byte, cost int) []byte {
+	// The key includes the NUL terminator; only the first 72 bytes count
+	key := append(append([]byte(nil), password...), 0)
+	if len(key) > 72 {
+		key = key[:72]
+	}
+
+	c := &blowfish{p: blowfishP, s: blowfishS}
+	c.expandKey(key, salt)
+	for i := uint64(0); i < 1<<uint(cost); i++ {
+		c.expandKey(key, nil)
+		c.expandKey(salt, nil)
+	}
+
+	// Encrypt "OrpheanBeholderScryDoubt" 64 times
+	text := []byte("OrpheanBeholderScryDoubt")
+	words := make([]uint32, 6)
+	for i := range words {
+		pos := i * 4
+		words[i] = streamWord(text, &pos)
+	}
+	for n := 0; n < 64; n++ {
+		for i := 0; i < 6; i += 2 {
+			words[i], words[i+1] = c.encrypt(words[i], words[i+1])
+		}
+	}
+	out := make([]byte, 24)
+	for i, w := range words {
+		out[i*4], out[i*4+1], out[i*4+2], out[i*4+3] = byte(w>>24), byte(w>>16), byte(w>>8), byte(w)
+	}
+	return out[:23]
+}
+
+// bcryptVerify reports whether password matches a $2a$, $2b$, or $2y$ hash
+func bcryptVerify(hash, password string) (bool, error) {
+	// $2b$10$ + 22 characters of salt + 31 of digest
+	if len(hash) != 60 || hash[0] != '$' || hash[1] != '2' || hash[3] != '$' || hash[6] != '$' {
+		return false, errBadBcryptHash
+	}
+	switch hash[2] {
+	case 'a', 'b', 'y':
+	default:
+		return false, errBadBcryptHash
+	}
+	cost, err := strconv.Atoi(hash[4:6])
+	if err != nil || cost < 4 || cost > 31 {
+		return false, errBadBcryptHash
+	}
+	salt, err := bcryptEncoding.DecodeString(hash[7:29])
+	if err != nil || len(salt) != 16 {
+		return false, errBadBcryptHash
+	}
+	digest := bcryptEncoding.EncodeToString(bcryptHash([]byte(password), salt, cost))
+	return subtle.ConstantTimeCompare([]byte(digest), []byte(hash[29:])) == 1, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+// TestBlowfish checks the cipher and its tables against Eric Young's
+// Blowfish test vectors
+func TestBlowfish(t *testing.T) {
+	tests := []struct {
+		key          []byte
+		l, r         uint32
+		wantL, wantR uint32
+	}{
+		{[]byte{0, 0, 0, 0, 0, 0, 0, 0}, 0x00000000, 0x00000000, 0x4ef99745, 0x6198dd78},
+		{[]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, 0xffffffff, 0xffffffff, 0x51866fd5, 0xb85ecb8a},
+		{[]byte{0x30, 0, 0, 0, 0, 0, 0, 0}, 0x10000000, 0x00000001, 0x7d856f9a, 0x613063f2},
+	}
+	for _, tt := range tests {
+		c := &blowfish{p: blowfishP, s: blowfishS}
+		c.expandKey(tt.key, nil)
+		if l, r := c.encrypt(tt.l, tt.r); l != tt.wantL || r != tt.wantR {
+			t.Errorf("key %x: encrypt(%08x%08x) = %08x%08x, want %08x%08x", tt.key, tt.l, tt.r, l, r, tt.wantL, tt.wantR)
+		}
+	}
+}
+
+// TestBcryptVerify uses OpenBSD's $2a$05$ test vectors
+func TestBcryptVerify(t *testing.T) {
+	tests := []struct{ hash, password string }{
+		{"$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+		{"$2a$05$CCCCCCCCCCCCCCCCCCCCC.VGOzA784oUp/Z0DY336zx7pLYAy0lwK", "U*U*"},
+		{"$2a$05$XXXXXXXXXXXXXXXXXXXXXOAcXxm9kjPGEMsLznoKqmqw7tc8WCx4a", "U*U*U"},
+		{"$2a$05$CCCCCCCCCCCCCCCCCCCCC.7uG0VCzI2bS7j6ymqJi9CdcdxiRTWNy", ""},
+		// Only the first 72 bytes count
+		{"$2a$05$abcdefghijklmnopqrstuu5s2v8.iXieOjg/.AySBTTZIIVFJeBui",
+			"0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789chars after 72 are ignored"},
+	}
+	for _, tt := range tests {
+		if ok, err := bcryptVerify(tt.hash, tt.password); !ok || err != nil {
+			t.Errorf("bcryptVerify(%q, %q) = %v, %v; want a match", tt.hash, tt.password, ok, err)
+		}
+		if ok, err := bcryptVerify(tt.hash, "x"+tt.password); ok || err != nil {
+			t.Errorf("bcryptVerify(%q, wrong password) = %v, %v; want no match", tt.hash, ok, err)
+		}
+	}
+
+	for _, hash := range []string{
+		"",
+		"$2x$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+		"$2a$03$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+		"$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOe",
+	} {
+		if _, err := bcryptVerify(hash, "U*U"); err != errBadBcryptHash {
+			t.Errorf("bcryptVerify(%q) error = %v, want %v", hash, err, errBadBcryptHash)
+		}
+	}
+}
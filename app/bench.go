@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// headerFlags collects repeated -H flags
+type headerFlags []string
+
+func (h *headerFlags) String() string { return strings.Join(*h, ", ") }
+
+func (h *headerFlags) Set(v string) error {
+	*h = append(*h, v)
+	return nil
+}
+
+// splitTarget turns "http://host:port/path" or "host:port/path" into an
+// address and request path
+func splitTarget(target string) (addr, path string) {
+	target = strings.TrimPrefix(target, "http://")
+	addr, path, found := strings.Cut(target, "/")
+	if !strings.Contains(addr, ":") {
+		addr += ":4221"
+	}
+	if !found {
+		return addr, "/"
+	}
+	return addr, "/" + path
+}
+
+// benchResult is what one worker measured
+type benchResult struct {
+	latencies []time.Duration
+	statuses  map[int]int
+	errors    int
+}
+
+// runBench implements the bench subcommand: it hammers a running server
+// with concurrent requests and prints throughput and latency percentiles.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), commandUsage("bench"))
+		fs.PrintDefaults()
+	}
+	concurrency := fs.Int("c", 10, "number of concurrent connections")
+	total := fs.Int("n", 1000, "total number of requests (ignored when -d is set)")
+	duration := fs.Duration("d", 0, "run for this long instead of a fixed number of requests")
+	method := fs.String("m", "GET", "request method")
+	body := fs.String("body", "", "request body")
+	keepAlive := fs.Bool("k", true, "reuse connections between requests")
+	var headers headerFlags
+	fs.Var(&headers, "H", "extra request header as \"Name: value\" (repeatable)")
+	_ = fs.Parse(args)
+
+	target := "localhost:4221/"
+	if fs.NArg() > 0 {
+		target = fs.Arg(0)
+	}
+	addr, path := splitTarget(target)
+	if *concurrency < 1 {
+		fmt.Fprintln(os.Stderr, "-c must be at least 1")
+		return 2
+	}
+
+	// Workers take tickets until the count or the deadline runs out
+	var issued atomic.Int64
+	var deadline time.Time
+	if *duration > 0 {
+		deadline = time.Now().Add(*duration)
+	}
+	next := func() bool {
+		if !deadline.IsZero() {
+			return time.Now().Before(deadline)
+		}
+		return issued.Add(1) <= int64(*total)
+	}
+
+	results := make([]benchResult, *concurrency)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(res *benchResult) {
+			defer wg.Done()
+			res.statuses = make(map[int]int)
+			benchWorker(addr, path, *method, headers, []byte(*body), *keepAlive, next, res)
+		}(&results[i])
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// Merge the per-worker measurements
+	var latencies []time.Duration
+	statuses := make(map[int]int)
+	errorCount := 0
+	for _, res := range results {
+		latencies = append(latencies, res.latencies...)
+		for code, n := range res.statuses {
+			statuses[code] += n
+		}
+		errorCount += res.errors
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	fmt.Printf("Target:       %s%s (%d connections)\n", addr, path, *concurrency)
+	fmt.Printf("Requests:     %d (%d errors)\n", len(latencies), errorCount)
+	fmt.Printf("Duration:     %s\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("Throughput:   %.1f req/s\n", float64(len(latencies))/elapsed.Seconds())
+	if len(latencies) > 0 {
+		fmt.Printf("Latency:      p50 %s  p90 %s  p95 %s  p99 %s  max %s\n",
+			percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 95),
+			percentile(latencies, 99), latencies[len(latencies)-1])
+	}
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	parts := make([]string, 0, len(codes))
+	for _, code := range codes {
+		parts = append(parts, fmt.Sprintf("%d=%d", code, statuses[code]))
+	}
+	fmt.Printf("Status codes: %s\n", strings.Join(parts, " "))
+
+	if errorCount > 0 {
+		return 1
+	}
+	return 0
+}
+
+func benchWorker(addr, path, method string, headers []string, body []byte, keepAlive bool, next func() bool, res *benchResult) {
+	var conn net.Conn
+	var r *bufio.Reader
+	var w *bufio.Writer
+	closeConn := func() {
+		if conn != nil {
+			conn.Close()
+			conn = nil
+		}
+	}
+	defer closeConn()
+
+	reqHeaders := headers
+	if !keepAlive {
+		reqHeaders = append(append([]string{}, headers...), "Connection: close")
+	}
+
+	for next() {
+		start := time.Now()
+		if conn == nil {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				res.errors++
+				continue
+			}
+			conn = c
+			r = bufio.NewReader(conn)
+			w = bufio.NewWriter(conn)
+		}
+		_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+		if err := writeClientRequest(w, method, addr, path, reqHeaders, body); err != nil {
+			res.errors++
+			closeConn()
+			continue
+		}
+		resp, err := readClientResponse(r, method)
+		if err != nil {
+			res.errors++
+			closeConn()
+			continue
+		}
+		res.latencies = append(res.latencies, time.Since(start))
+		res.statuses[resp.Status]++
+		if resp.Close || !keepAlive {
+			closeConn()
+		}
+	}
+}
+
+// percentile returns the p-th percentile of sorted durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return sorted[i]
+}
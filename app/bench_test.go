@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// discardConn is a net.Conn that swallows writes, for benchmarking handlers
+// without a socket
+type discardConn struct{}
+
+func (discardConn) Read(p []byte) (int, error)         { return 0, io.EOF }
+func (discardConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (discardConn) Close() error                       { return nil }
+func (discardConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (discardConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (discardConn) SetDeadline(t time.Time) error      { return nil }
+func (discardConn) SetReadDeadline(t time.Time) error  { return nil }
+func (discardConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func newBenchServer(b *testing.B) *Server {
+	s := &Server{
+		gzip:              newGzipPool(defaultGzipLevel),
+		chunks:            newChunkPool(defaultFileChunkSize),
+		chunkWriteTimeout: defaultChunkWriteTimeout,
+		log:               slog.New(slog.NewTextHandler(io.Discard, nil)),
+		logLevel:          new(slog.LevelVar),
+	}
+	s.setSettings(&liveConfig{directory: b.TempDir()})
+	return s
+}
+
+// benchmarkRoute parses raw once per iteration and runs it through the router
+func benchmarkRoute(b *testing.B, s *Server, raw string) {
+	data := []byte(raw)
+	rd := bytes.NewReader(data)
+	r := bufio.NewReader(rd)
+	w := bufio.NewWriter(io.Discard)
+	req := getRequest()
+	defer putRequest(req)
+	req.conn, req.reader = discardConn{}, r
+	resp := getResponse(w, req)
+	defer putResponse(resp)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rd.Reset(data)
+		r.Reset(rd)
+		if err := readRequest(r, req); err != nil {
+			b.Fatal(err)
+		}
+		resp.reset(w, req)
+		s.handleRequest(resp, req)
+		_ = resp.finish()
+		_ = w.Flush()
+	}
+}
+
+func BenchmarkRouteRoot(b *testing.B) {
+	benchmarkRoute(b, newBenchServer(b), "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+}
+
+func BenchmarkRouteEcho(b *testing.B) {
+	benchmarkRoute(b, newBenchServer(b), "GET /echo/hello HTTP/1.1\r\nHost: x\r\n\r\n")
+}
+
+func BenchmarkRouteEchoGzip(b *testing.B) {
+	benchmarkRoute(b, newBenchServer(b), "GET /echo/hello HTTP/1.1\r\nHost: x\r\nAccept-Encoding: gzip\r\n\r\n")
+}
+
+func BenchmarkRouteUserAgent(b *testing.B) {
+	benchmarkRoute(b, newBenchServer(b), "GET /user-agent HTTP/1.1\r\nHost: x\r\nUser-Agent: bench/1.0\r\n\r\n")
+}
+
+func BenchmarkRouteNotFound(b *testing.B) {
+	benchmarkRoute(b, newBenchServer(b), "GET /missing HTTP/1.1\r\nHost: x\r\n\r\n")
+}
+
+func benchmarkFileServing(b *testing.B, size int) {
+	s := newBenchServer(b)
+	content := bytes.Repeat([]byte("x"), size)
+	if err := os.WriteFile(filepath.Join(s.settings().directory, "file"), content, 0o644); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(size))
+	benchmarkRoute(b, s, "GET /files/file HTTP/1.1\r\nHost: x\r\n\r\n")
+}
+
+func BenchmarkFileServing1K(b *testing.B)  { benchmarkFileServing(b, 1<<10) }
+func BenchmarkFileServing1M(b *testing.B)  { benchmarkFileServing(b, 1<<20) }
+func BenchmarkFileServing16M(b *testing.B) { benchmarkFileServing(b, 16<<20) }
+
+func BenchmarkFileUpload(b *testing.B) {
+	body := strings.Repeat("y", 64<<10)
+	raw := "POST /files/upload HTTP/1.1\r\nHost: x\r\nContent-Length: 65536\r\n\r\n" + body
+	b.SetBytes(int64(len(body)))
+	benchmarkRoute(b, newBenchServer(b), raw)
+}
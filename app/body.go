@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxDrainBody is the most unread request body the server reads and throws
+// away to keep a connection alive. Past that, closing is cheaper.
+const maxDrainBody = 256 << 10
+
+// setBody frames the body that follows the head just read from r
+func (req *Request) setBody(r *bufio.Reader) {
+	if req.isChunked() {
+		req.body = newChunkedReader(r, maxChunkedBody)
+		return
+	}
+	req.bodyLimit = io.LimitedReader{R: r}
+	if cl, ok := req.LookupHeader("Content-Length"); ok {
+		req.bodyLimit.N, _ = strconv.ParseInt(cl, 10, 64)
+	}
+	req.body = &req.bodyLimit
+}
+
+// bodyDone reports whether the body has been read to its end
+func (req *Request) bodyDone() bool {
+	switch b := req.body.(type) {
+	case *io.LimitedReader:
+		return b.N <= 0
+	case *chunkedReader:
+		return b.done
+	}
+	return true
+}
+
+// drainBody reads and discards whatever of the body the handler left, so
+// the next request on the connection is read from the right place. It
+// reports false when the connection can't be reused: more than
+// maxDrainBody is left, the body is malformed or cut off, or the client is
+// waiting for a 100 Continue before sending it.
+func drainBody(req *Request) bool {
+	if req.bodyDone() {
+		return true
+	}
+	if strings.EqualFold(req.Header("Expect"), "100-continue") {
+		return false
+	}
+	if b, ok := req.body.(*io.LimitedReader); ok && b.N > maxDrainBody {
+		return false
+	}
+	_, _ = io.CopyN(io.Discard, req.body, maxDrainBody+1)
+	return req.bodyDone()
+}
+
+// drainRequestBody drains req's body before resp is finished, or marks the
+// connection to close when that isn't possible. Reads run under the body
+// timeout, as the handler's would.
+func (s *Server) drainRequestBody(tc *timeoutConn, req *Request, resp *response, t *phaseTimeouts) {
+	if resp.closeConn || req.bodyDone() {
+		return
+	}
+	tc.read = t.body
+	drained := drainBody(req)
+	tc.read = 0
+	if !drained {
+		req.Logger().Debug("closing after an unread request body")
+		resp.closeConn = true
+	}
+}
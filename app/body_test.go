@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestUnreadBodyDrained sends bodies nothing reads and checks the
+// connection carries on with the next request
+func TestUnreadBodyDrained(t *testing.T) {
+	ts := newTestServer(t)
+	c := ts.Conn()
+	resp := c.Do(ts.Request("POST", "/no-such-route").Body("GET /echo/smuggled HTTP/1.1\r\nHost: x\r\n\r\n")).Status(404)
+	if resp.Close {
+		t.Error("connection closed after a small unread body")
+	}
+	c.Do(ts.Get("/echo/next")).Status(200).BodyIs("next")
+
+	resp = c.Raw("POST /no-such-route HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n").Status(404)
+	if resp.Close {
+		t.Error("connection closed after an unread chunked body")
+	}
+	c.Do(ts.Get("/echo/next")).Status(200).BodyIs("next")
+
+	// A rate-limited request is refused before anything reads its body
+	ts = newTestServer(t, "--max-request-rate", "1/m")
+	c = ts.Conn()
+	c.Do(ts.Get("/echo/first")).Status(200)
+	c.Do(ts.Request("POST", "/echo/x").Body("abc")).Status(429)
+	c.Do(ts.Get("/echo/next")).Status(429)
+}
+
+func TestUnreadBodyCloses(t *testing.T) {
+	ts := newTestServer(t)
+
+	big := strings.Repeat("a", maxDrainBody+1)
+	resp := ts.Conn().Do(ts.Request("POST", "/no-such-route").Body(big)).Status(404)
+	if !resp.Close {
+		t.Error("connection kept alive after a body too large to drain")
+	}
+
+	// The client holds the body back until a 100 Continue that never comes
+	resp = ts.Conn().Raw("POST /no-such-route HTTP/1.1\r\nHost: x\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n").Status(404)
+	if !resp.Close {
+		t.Error("connection kept alive waiting on an Expect: 100-continue body")
+	}
+
+	resp = ts.Conn().Raw("POST /no-such-route HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n").Status(404)
+	if !resp.Close {
+		t.Error("connection kept alive after a malformed chunked body")
+	}
+}
+
+// TestSlowUploadNotTimedOut trickles a body in over longer than the handler
+// timeout, which mustn't count against the handler while it keeps coming
+func TestSlowUploadNotTimedOut(t *testing.T) {
+	ts := newTestServer(t, "--handler-timeout", "100ms")
+	c := ts.Conn()
+	go func() {
+		_, _ = io.WriteString(c.conn, "POST /files/slow.txt HTTP/1.1\r\nHost: x\r\nContent-Length: 6\r\n\r\n")
+		for _, b := range []string{"s", "l", "o", "w", "l", "y"} {
+			time.Sleep(50 * time.Millisecond)
+			_, _ = io.WriteString(c.conn, b)
+		}
+	}()
+	c.Raw("").Status(201)
+	if data, err := os.ReadFile(filepath.Join(ts.dir, "slow.txt")); err != nil || string(data) != "slowly" {
+		t.Errorf("written file %q, %v", data, err)
+	}
+}
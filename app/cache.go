@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for the opt-in response cache
+const (
+	defaultCacheTTL      = time.Minute
+	defaultCacheMaxBytes = 16 << 20
+)
+
+// cacheEntry is a complete stored response, split so extra headers can be
+// added when it is replayed. Entries are never modified once stored.
+type cacheEntry struct {
+	key     string
+	head    []byte // status line and headers, without Date or the final blank line
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+func (e *cacheEntry) size() int {
+	return len(e.head) + len(e.body)
+}
+
+// writeTo replays the stored response with the current Date and its Age,
+// adding the connection header and an X-Cache marker
+func (e *cacheEntry) writeTo(w io.Writer, closeConn bool) error {
+	bw := getBuffer()
+	defer putBuffer(bw)
+	bw.Write(e.head)
+	bw.WriteString("\r\nDate: ")
+	bw.Write(httpDate())
+	bw.WriteString("\r\nAge: ")
+	bw.WriteString(strconv.FormatInt(int64(time.Since(e.stored)/time.Second), 10))
+	if closeConn {
+		bw.WriteString("\r\nConnection: close")
+	}
+	bw.WriteString("\r\nX-Cache: HIT\r\n\r\n")
+	bw.Write(e.body)
+	_, err := w.Write(bw.Bytes())
+	return err
+}
+
+// responseCache stores complete 200 responses for configured route prefixes,
+// keyed on method, path, and negotiated content encoding. Entries expire
+// after ttl and the least recently used ones are evicted to stay within
+// maxBytes.
+type responseCache struct {
+	routes   []string
+	ttl      time.Duration
+	maxBytes int
+
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func newResponseCache(routes []string, ttl time.Duration, maxBytes int) *responseCache {
+	return &responseCache{
+		routes:   routes,
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// withoutHeader returns a copy of a response head with the named header's
+// lines left out
+func withoutHeader(head []byte, name string) []byte {
+	out := make([]byte, 0, len(head))
+	for i, line := range bytes.Split(head, []byte("\r\n")) {
+		if i > 0 {
+			if n, _, ok := bytes.Cut(line, []byte(":")); ok && equalFold(n, name) {
+				continue
+			}
+			out = append(out, "\r\n"...)
+		}
+		out = append(out, line...)
+	}
+	return out
+}
+
+func cacheKey(method, path, encoding string) string {
+	return method + " " + encoding + " " + path
+}
+
+// cacheable reports whether responses for the request may be cached
+func (c *responseCache) cacheable(method, path string) bool {
+	if method != "GET" {
+		return false
+	}
+	for _, prefix := range c.routes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *responseCache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if ok {
+		entry := elem.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.lru.MoveToFront(elem)
+			c.hits.Add(1)
+			return entry, true
+		}
+		c.removeLocked(elem)
+	}
+	c.misses.Add(1)
+	return nil, false
+}
+
+// put stores a raw response if it is a complete 200 that fits in the cache
+func (c *responseCache) put(key string, raw []byte) {
+	if !bytes.HasPrefix(raw, []byte("HTTP/1.1 200 ")) {
+		return
+	}
+	headEnd := bytes.Index(raw, []byte("\r\n\r\n"))
+	if headEnd < 0 {
+		return
+	}
+	now := time.Now()
+	entry := &cacheEntry{
+		key:     key,
+		head:    withoutHeader(raw[:headEnd], "Date"),
+		body:    bytes.Clone(raw[headEnd+4:]),
+		stored:  now,
+		expires: now.Add(c.ttl),
+	}
+	if entry.size() > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.removeLocked(elem)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += entry.size()
+	for c.size > c.maxBytes {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+// invalidate drops every cached representation of a path
+func (c *responseCache) invalidate(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, encoding := range []string{"", "gzip"} {
+		if elem, ok := c.entries[cacheKey("GET", path, encoding)]; ok {
+			c.removeLocked(elem)
+		}
+	}
+}
+
+// purge drops every entry whose path starts with prefix and returns how
+// many were dropped
+func (c *responseCache) purge(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for key, elem := range c.entries {
+		// Keys are "method encoding path"
+		if parts := strings.SplitN(key, " ", 3); len(parts) == 3 && strings.HasPrefix(parts[2], prefix) {
+			c.removeLocked(elem)
+			n++
+		}
+	}
+	return n
+}
+
+func (c *responseCache) removeLocked(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size()
+}
+
+// Stats returns the hit and miss counters
+func (c *responseCache) Stats() (hits, misses uint64) {
+	return c.hits.Load(), c.misses.Load()
+}
+
+// handleCachedRequest serves a cacheable request from the cache, or runs its
+// route's handler and stores the response. Middleware has already run.
+func (s *Server) handleCachedRequest(resp *response, req *Request) {
+	key := cacheKey(req.Method, req.Path, negotiateEncoding(req))
+	if entry, ok := s.cache.get(key); ok {
+		_ = entry.writeTo(resp.w, resp.closeConn)
+		resp.wroteHeader, resp.headerSent = true, true
+		resp.status, resp.written = 200, int64(len(entry.body))
+		return
+	}
+
+	// Send the response through a capture so it can be stored
+	capture := newResponseCapture(resp.w, s.cache.maxBytes)
+	defer capture.release()
+	cw := getWriter(capture)
+	defer putWriter(cw)
+
+	conn := resp.w
+	resp.w = cw
+	req.handler(s, resp, req)
+	_ = resp.finish()
+	_ = resp.failed(cw.Flush())
+	resp.w = conn
+
+	// Responses carrying Connection: close, or cut short, aren't reusable
+	if !resp.closeConn && resp.err == nil {
+		if raw := capture.captured(); raw != nil {
+			s.cache.put(key, raw)
+		}
+	}
+}
+
+// responseCapture passes writes through to the connection while keeping a
+// copy of up to limit bytes for the cache
+type responseCapture struct {
+	dst      io.Writer
+	buf      *bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+func newResponseCapture(dst io.Writer, limit int) *responseCapture {
+	return &responseCapture{dst: dst, buf: getBuffer(), limit: limit}
+}
+
+func (rc *responseCapture) Write(p []byte) (int, error) {
+	if !rc.overflow {
+		if rc.buf.Len()+len(p) > rc.limit {
+			rc.overflow = true
+		} else {
+			rc.buf.Write(p)
+		}
+	}
+	return rc.dst.Write(p)
+}
+
+// captured returns the full response, or nil if it didn't fit
+func (rc *responseCapture) captured() []byte {
+	if rc.overflow {
+		return nil
+	}
+	return rc.buf.Bytes()
+}
+
+func (rc *responseCapture) release() {
+	putBuffer(rc.buf)
+	rc.buf = nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// httpDateLayout is the IMF-fixdate format used by the Date header. Its
+// output is always 29 bytes long.
+const (
+	httpDateLayout = "Mon, 02 Jan 2006 15:04:05 GMT"
+	httpDateLen    = len(httpDateLayout)
+)
+
+type dateValue struct {
+	unix int64
+	text []byte
+}
+
+var currentDate atomic.Pointer[dateValue]
+
+// httpDate returns the current time formatted for the Date header. The
+// formatted value is shared and only recomputed once a second.
+func httpDate() []byte {
+	now := time.Now()
+	if d := currentDate.Load(); d != nil && d.unix == now.Unix() {
+		return d.text
+	}
+	d := &dateValue{unix: now.Unix(), text: []byte(now.UTC().Format(httpDateLayout))}
+	currentDate.Store(d)
+	return d.text
+}
+
+func statusText(code int) string {
+	switch code {
+	case 200:
+		return "OK"
+	case 201:
+		return "Created"
+	case 204:
+		return "No Content"
+	case 301:
+		return "Moved Permanently"
+	case 302:
+		return "Found"
+	case 307:
+		return "Temporary Redirect"
+	case 308:
+		return "Permanent Redirect"
+	case 400:
+		return "Bad Request"
+	case 401:
+		return "Unauthorized"
+	case 403:
+		return "Forbidden"
+	case 404:
+		return "Not Found"
+	case 405:
+		return "Method Not Allowed"
+	case 408:
+		return "Request Timeout"
+	case 422:
+		return "Unprocessable Content"
+	case 429:
+		return "Too Many Requests"
+	case 500:
+		return "Internal Server Error"
+	case 503:
+		return "Service Unavailable"
+	}
+	// The rest are rare enough not to need a fast path
+	if text := http.StatusText(code); text != "" {
+		return text
+	}
+	return "Unknown"
+}
+
+// cannedResponse is a pre-serialized bodyless response with a fixed-width
+// slot where the current date is patched in when it's written
+type cannedResponse struct {
+	raw        []byte
+	dateOffset int
+}
+
+// newCannedResponse renders a bodyless response. extraHeaders, if set, are
+// complete "Name: value" lines separated by CRLF.
+func newCannedResponse(code int, closeConn bool, extraHeaders string) cannedResponse {
+	head := fmt.Sprintf("HTTP/1.1 %d %s\r\nDate: ", code, statusText(code))
+	tail := "\r\nContent-Length: 0"
+	if extraHeaders != "" {
+		tail += "\r\n" + extraHeaders
+	}
+	if closeConn {
+		tail += "\r\nConnection: close"
+	}
+	tail += "\r\n\r\n"
+	raw := make([]byte, 0, len(head)+httpDateLen+len(tail))
+	raw = append(raw, head...)
+	raw = append(raw, httpDateLayout...) // placeholder
+	raw = append(raw, tail...)
+	return cannedResponse{raw: raw, dateOffset: len(head)}
+}
+
+// writeTo writes the response with the current date patched in. Writes land
+// in the connection's buffered writer, so the pieces still go out with one
+// write to the socket.
+func (c cannedResponse) writeTo(w io.Writer) error {
+	if _, err := w.Write(c.raw[:c.dateOffset]); err != nil {
+		return err
+	}
+	if _, err := w.Write(httpDate()); err != nil {
+		return err
+	}
+	_, err := w.Write(c.raw[c.dateOffset+httpDateLen:])
+	return err
+}
+
+// cannedResponses holds the common error responses, rendered once at startup.
+// The second entry of each pair carries Connection: close.
+var cannedResponses = func() map[int][2]cannedResponse {
+	m := make(map[int][2]cannedResponse)
+	for _, code := range []int{400, 404, 405, 408, 500, 503} {
+		m[code] = [2]cannedResponse{newCannedResponse(code, false, ""), newCannedResponse(code, true, "")}
+	}
+	return m
+}()
+
+// writeStatus writes a bodyless response for code. Canned codes are copied
+// straight from their pre-rendered bytes; anything else is formatted.
+func writeStatus(w io.Writer, code int, closeConn bool) error {
+	pair, ok := cannedResponses[code]
+	if !ok {
+		return writeCannedFallback(w, code, closeConn)
+	}
+	if closeConn {
+		return pair[1].writeTo(w)
+	}
+	return pair[0].writeTo(w)
+}
+
+func writeCannedFallback(w io.Writer, code int, closeConn bool) error {
+	return newCannedResponse(code, closeConn, "").writeTo(w)
+}
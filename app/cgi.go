@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults for CGI scripts
+const (
+	defaultCGIPrefix  = "/cgi-bin/"
+	defaultCGITimeout = 30 * time.Second
+	defaultCGIMax     = 16
+)
+
+// cgiHandler runs executables from dir for requests under prefix, at most
+// max at once, each killed after timeout
+type cgiHandler struct {
+	dir     string
+	prefix  string
+	timeout time.Duration
+	slots   chan struct{}
+}
+
+func newCGIHandler(dir, prefix string, timeout time.Duration, max int) *cgiHandler {
+	return &cgiHandler{dir: dir, prefix: prefix, timeout: timeout, slots: make(chan struct{}, max)}
+}
+
+// serve runs the script named by the first path segment after the
+// prefix; the rest of the path is its PATH_INFO
+func (h *cgiHandler) serve(s *Server, w ResponseWriter, req *Request) {
+	name, pathInfo, _ := strings.Cut(strings.TrimPrefix(cleanURLPath(req.Path), h.prefix), "/")
+	if pathInfo != "" {
+		pathInfo = "/" + pathInfo
+	}
+	script := filepath.Join(h.dir, name)
+	info, err := os.Stat(script)
+	if name == "" || err != nil || !info.Mode().IsRegular() {
+		sendStatus(w, 404)
+		return
+	}
+	body, length, ok := requestBody(w, req)
+	if !ok {
+		return
+	}
+
+	select {
+	case h.slots <- struct{}{}:
+		defer func() { <-h.slots }()
+	default:
+		req.Logger().Warn("too many CGI scripts running", "max", cap(h.slots))
+		w.Header().Set("Retry-After", "1")
+		sendStatus(w, 503)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, script)
+	cmd.Dir = h.dir
+	// Scripts get the CGI variables and the server's PATH, nothing else
+	cmd.Env = []string{"PATH=" + os.Getenv("PATH")}
+	for _, p := range cgiParams(req, h.dir, h.prefix+name, pathInfo, length) {
+		// SCRIPT_FILENAME is the file, not DOCUMENT_ROOT plus SCRIPT_NAME
+		if p[0] == "SCRIPT_FILENAME" {
+			p[1] = script
+		}
+		cmd.Env = append(cmd.Env, p[0]+"="+p[1])
+	}
+	cmd.Stdin = body
+	cmd.Stderr = &cgiStderr{log: req.Logger(), script: name}
+	// Wait gives up on pipes the children of a killed script still hold
+	cmd.WaitDelay = time.Second
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		sendStatus(w, 500)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		req.Logger().Error("failed to start CGI script", "script", name, "err", err)
+		sendStatus(w, 500)
+		return
+	}
+	// A script's children can hold stdout open after it's killed
+	stop := context.AfterFunc(ctx, func() { stdout.Close() })
+	defer stop()
+	relayErr := s.relayCGI(w, req, bufio.NewReader(stdout))
+	// What the script didn't get to send isn't wanted
+	_, _ = io.Copy(io.Discard, stdout)
+	err = cmd.Wait()
+	switch {
+	case ctx.Err() != nil:
+		req.Logger().Warn("CGI script timed out", "script", name, "timeout", h.timeout)
+	case relayErr != nil:
+		req.Logger().Warn("bad response from CGI script", "script", name, "err", relayErr, "exit", err)
+	case err != nil:
+		req.Logger().Warn("CGI script failed", "script", name, "err", err)
+	}
+}
+
+// cgiStderr logs each line a script writes to stderr
+type cgiStderr struct {
+	log    *slog.Logger
+	script string
+}
+
+func (e *cgiStderr) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if line != "" {
+			e.log.Warn("CGI stderr", "script", e.script, "msg", line)
+		}
+	}
+	return len(p), nil
+}
+
+// requestBody returns a reader for the request body and its length, or
+// answers 400 and reports false when Content-Length is invalid. A chunked
+// body is decoded up front, answering 413 when it is too large.
+func requestBody(w ResponseWriter, req *Request) (io.Reader, int64, bool) {
+	if req.isChunked() {
+		var body bytes.Buffer
+		if _, err := body.ReadFrom(req.body); err != nil {
+			req.Logger().Debug("bad chunked body", "err", err)
+			code := 400
+			if err == errChunkTooLarge {
+				code = 413
+			}
+			w.Header().Set("Connection", "close")
+			sendStatus(w, code)
+			return nil, 0, false
+		}
+		return &body, int64(body.Len()), true
+	}
+	cl := req.Header("Content-Length")
+	if cl == "" {
+		return strings.NewReader(""), 0, true
+	}
+	n, err := strconv.ParseInt(cl, 10, 64)
+	if err != nil || n < 0 {
+		sendStatus(w, 400)
+		return nil, 0, false
+	}
+	return req.body, n, true
+}
+
+// cleanURLPath resolves dot segments so a script path can't climb out of
+// the document root
+func cleanURLPath(p string) string {
+	clean := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
+// cgiParams builds the CGI/1.1 meta-variables for req, as defined in
+// RFC 3875, with the headers passed as HTTP_* variables
+func cgiParams(req *Request, root, script, pathInfo string, length int64) [][2]string {
+	params := [][2]string{
+		{"GATEWAY_INTERFACE", "CGI/1.1"},
+		{"SERVER_SOFTWARE", "http-server/" + version},
+		{"SERVER_PROTOCOL", req.Version},
+		{"REQUEST_METHOD", req.Method},
+		{"REQUEST_URI", req.Target},
+		{"QUERY_STRING", req.RawQuery},
+		{"SCRIPT_NAME", script},
+		{"SCRIPT_FILENAME", strings.TrimSuffix(root, "/") + script},
+		{"DOCUMENT_ROOT", root},
+		{"PATH_INFO", pathInfo},
+		{"REMOTE_ADDR", clientIP(req)},
+	}
+	if pathInfo != "" {
+		params = append(params, [2]string{"PATH_TRANSLATED", strings.TrimSuffix(root, "/") + pathInfo})
+	}
+	if req.conn != nil {
+		if _, port, err := net.SplitHostPort(req.conn.RemoteAddr().String()); err == nil {
+			params = append(params, [2]string{"REMOTE_PORT", port})
+		}
+		if host, port, err := net.SplitHostPort(req.conn.LocalAddr().String()); err == nil {
+			params = append(params, [2]string{"SERVER_ADDR", host}, [2]string{"SERVER_PORT", port})
+		}
+	}
+	name := req.Header("Host")
+	if h, _, err := net.SplitHostPort(name); err == nil {
+		name = h
+	}
+	params = append(params, [2]string{"SERVER_NAME", name})
+	if req.tlsState != nil {
+		params = append(params, [2]string{"HTTPS", "on"}, [2]string{"REQUEST_SCHEME", "https"})
+	} else {
+		params = append(params, [2]string{"REQUEST_SCHEME", "http"})
+	}
+	if user := req.User(); user != "" {
+		params = append(params, [2]string{"REMOTE_USER", user})
+	}
+	if length > 0 {
+		params = append(params, [2]string{"CONTENT_LENGTH", strconv.FormatInt(length, 10)})
+	}
+	if ct := req.Header("Content-Type"); ct != "" {
+		params = append(params, [2]string{"CONTENT_TYPE", ct})
+	}
+	for _, h := range req.Headers() {
+		name := strings.ToUpper(strings.ReplaceAll(h[0], "-", "_"))
+		// Content-Length and -Type have their own variables, and a client
+		// mustn't be able to set HTTP_PROXY for the script (httpoxy)
+		if name == "CONTENT_LENGTH" || name == "CONTENT_TYPE" || name == "PROXY" {
+			continue
+		}
+		params = append(params, [2]string{"HTTP_" + name, h[1]})
+	}
+	return params
+}
+
+// relayCGI sends a CGI response, headers then body, to the client. The
+// Status header sets the code, and a Location without one redirects.
+func (s *Server) relayCGI(w ResponseWriter, req *Request, r *bufio.Reader) error {
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		sendStatus(w, 502)
+		return fmt.Errorf("reading headers: %w", err)
+	}
+	code := 200
+	if status := header.Get("Status"); status != "" {
+		code, err = strconv.Atoi(strings.Fields(status + " ")[0])
+		if err != nil || code < 100 || code > 999 {
+			sendStatus(w, 502)
+			return fmt.Errorf("bad Status header %q", status)
+		}
+	} else if header.Get("Location") != "" {
+		code = 302
+	}
+	for name, values := range header {
+		if name == "Status" || name == "Date" || isHopHeader(name, "") {
+			continue
+		}
+		for _, v := range values {
+			w.Header().Add(name, v)
+		}
+	}
+	w.WriteHeader(code)
+	if req.Method == "HEAD" {
+		return nil
+	}
+	return s.streamFile(w, req.conn, r)
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// certExpiryWarning is how close to expiry a certificate gets a warning
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// checkReport collects the results of --check
+type checkReport struct {
+	out      io.Writer
+	problems int
+}
+
+func (r *checkReport) ok(format string, args ...any) {
+	fmt.Fprintf(r.out, "ok    "+format+"\n", args...)
+}
+
+func (r *checkReport) warn(format string, args ...any) {
+	fmt.Fprintf(r.out, "warn  "+format+"\n", args...)
+}
+
+func (r *checkReport) fail(format string, args ...any) {
+	fmt.Fprintf(r.out, "FAIL  "+format+"\n", args...)
+	r.problems++
+}
+
+// runCheck validates cfg the way startup would, without binding a socket
+// or starting anything, and returns the exit status: 1 if anything would
+// stop the server from starting
+func runCheck(out io.Writer, cfg *serverConfig) int {
+	r := &checkReport{out: out}
+	r.ok("flags and config file parsed")
+	checkServeDirectory(r, cfg)
+	checkAddrs(r, cfg)
+	checkTLS(r, cfg)
+	checkLogs(r, cfg)
+	checkTemplates(r, cfg)
+	checkErrorPages(r, cfg)
+	checkPlugins(r, cfg)
+
+	s := &Server{log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	if _, err := s.configure(cfg); err != nil {
+		r.fail("auth and middleware: %v", err)
+	} else {
+		r.ok("auth and middleware")
+	}
+
+	if r.problems > 0 {
+		fmt.Fprintf(out, "%d problem(s) found\n", r.problems)
+		return 1
+	}
+	fmt.Fprintln(out, "configuration is valid")
+	return 0
+}
+
+// checkServeDirectory makes sure --directory can be listed and read, and warns
+// if uploads into it would fail
+func checkServeDirectory(r *checkReport, cfg *serverConfig) {
+	dir := cfg.directory
+	if dir == "" {
+		if cfg.chroot {
+			r.fail("directory: --chroot needs --directory")
+		} else {
+			r.ok("directory: none, /files/ is disabled")
+		}
+		return
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		r.fail("directory: %v", err)
+		return
+	}
+	if !info.IsDir() {
+		r.fail("directory: %s is not a directory", dir)
+		return
+	}
+	f, err := os.Open(dir)
+	if err == nil {
+		_, err = f.Readdirnames(1)
+		f.Close()
+	}
+	if err != nil && err != io.EOF {
+		r.fail("directory: %s can't be read: %v", dir, err)
+		return
+	}
+	probe, err := os.CreateTemp(dir, ".check-*")
+	if err != nil {
+		r.warn("directory: %s is readable but not writable, uploads will fail", dir)
+		return
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	r.ok("directory: %s is readable and writable", dir)
+}
+
+// checkAddrs validates every address the server would listen on, and that
+// no two of them clash
+func checkAddrs(r *checkReport, cfg *serverConfig) {
+	tlsOn := cfg.tlsCert != "" || cfg.tlsSelfSigned || len(cfg.acmeDomains) > 0
+	type listenAddr struct{ name, addr string }
+	addrs := []listenAddr{{"listen", cfg.addr()}}
+	if cfg.plainAddr != "" && tlsOn {
+		addrs = append(addrs, listenAddr{"plain-addr", cfg.plainAddr})
+	}
+	// A redirect on the challenge address is served by the challenge listener
+	if cfg.redirectAddr != "" && tlsOn && !(len(cfg.acmeDomains) > 0 && cfg.redirectAddr == cfg.acmeHTTPAddr) {
+		addrs = append(addrs, listenAddr{"redirect-addr", cfg.redirectAddr})
+	}
+	if cfg.adminAddr != "" {
+		addrs = append(addrs, listenAddr{"admin-addr", cfg.adminAddr})
+	}
+	if len(cfg.acmeDomains) > 0 {
+		addrs = append(addrs, listenAddr{"acme-http-addr", cfg.acmeHTTPAddr})
+	}
+
+	seen := make(map[string]string)
+	for _, a := range addrs {
+		if err := checkAddr(a.addr); err != nil {
+			r.fail("%s: %v", a.name, err)
+			continue
+		}
+		// Port 0 binds a different free port each time, so can't clash
+		if other, ok := seen[a.addr]; ok && !strings.HasSuffix(a.addr, ":0") {
+			r.fail("%s: %s is also used by --%s", a.name, a.addr, other)
+			continue
+		}
+		seen[a.addr] = a.name
+		r.ok("%s: %s", a.name, a.addr)
+	}
+}
+
+func checkAddr(addr string) error {
+	network, address := splitListenAddr(addr)
+	if network == "unix" {
+		if address == "" {
+			return errors.New("empty socket path")
+		}
+		dir := filepath.Dir(address)
+		if info, err := os.Stat(dir); err != nil {
+			return err
+		} else if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		return nil
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return err
+	}
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return fmt.Errorf("invalid IPv6 address %q", host)
+	}
+	return nil
+}
+
+// checkTLS loads the certificate, client CA bundle, and TLS policy
+func checkTLS(r *checkReport, cfg *serverConfig) {
+	// A cached self-signed certificate would be written; an in-memory one
+	// tests the same thing
+	static := *cfg
+	static.tlsSelfSignedCache = ""
+	config, err := staticTLSConfig(&static)
+	if err != nil {
+		r.fail("tls: %v", err)
+		return
+	}
+	if config == nil && len(cfg.acmeDomains) == 0 {
+		r.ok("tls: off")
+	} else if len(cfg.acmeDomains) > 0 {
+		r.ok("tls: certificates from ACME for %s", strings.Join(cfg.acmeDomains, ", "))
+	} else if cfg.tlsSelfSigned {
+		r.ok("tls: self-signed certificate for localhost")
+	} else {
+		checkCertificate(r, config.Certificates[0])
+	}
+
+	policy := tlsPresets[cfg.tlsPreset].with(cfg.tlsOverrides)
+	if policy.isZero() {
+		return
+	}
+	if config == nil && len(cfg.acmeDomains) == 0 {
+		r.fail("tls policy: requires TLS to be enabled")
+		return
+	}
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if err := policy.apply(config); err != nil {
+		r.fail("tls policy: %v", err)
+		return
+	}
+	r.ok("tls policy")
+}
+
+// checkCertificate reports who a certificate is for and when it expires
+func checkCertificate(r *checkReport, cert tls.Certificate) {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		r.fail("tls: %v", err)
+		return
+	}
+	names := leaf.DNSNames
+	if len(names) == 0 {
+		names = []string{leaf.Subject.CommonName}
+	}
+	left := time.Until(leaf.NotAfter)
+	switch {
+	case left <= 0:
+		r.fail("tls: certificate for %s expired %s", strings.Join(names, ", "), leaf.NotAfter.Format(time.DateOnly))
+	case left < certExpiryWarning:
+		r.warn("tls: certificate for %s expires %s", strings.Join(names, ", "), leaf.NotAfter.Format(time.DateOnly))
+	default:
+		r.ok("tls: certificate for %s, valid until %s", strings.Join(names, ", "), leaf.NotAfter.Format(time.DateOnly))
+	}
+}
+
+// checkTemplates parses the template directory
+func checkTemplates(r *checkReport, cfg *serverConfig) {
+	if cfg.templateDir == "" {
+		return
+	}
+	ts, err := loadTemplates(cfg.templateDir, false)
+	if err != nil {
+		r.fail("templates: %v", err)
+		return
+	}
+	r.ok("templates: %d page(s) in %s", len(ts.pages), cfg.templateDir)
+}
+
+// checkErrorPages parses the error page directory
+func checkErrorPages(r *checkReport, cfg *serverConfig) {
+	if cfg.errorPages == "" {
+		return
+	}
+	ep, err := loadErrorPages(cfg.errorPages, false)
+	if err != nil {
+		r.fail("error pages: %v", err)
+		return
+	}
+	r.ok("error pages: %d page(s) in %s", len(ep.pages), cfg.errorPages)
+}
+
+// checkPlugins opens each plugin file, which runs its package init code
+func checkPlugins(r *checkReport, cfg *serverConfig) {
+	for _, path := range cfg.plugins {
+		if p, err := openPlugin(path); err != nil {
+			r.fail("plugin: %v", err)
+		} else {
+			r.ok("plugin: %s from %s", p.Name(), path)
+		}
+	}
+}
+
+// checkLogs makes sure each log file can be appended to, or created
+func checkLogs(r *checkReport, cfg *serverConfig) {
+	files := []struct{ name, path string }{
+		{"log-file", cfg.logPath},
+		{"audit-log", cfg.auditPath},
+	}
+	if cfg.accessLogDest != "-" && cfg.accessLogDest != "off" {
+		files = append(files, struct{ name, path string }{"access-log", cfg.accessLogDest})
+	}
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+		if err := checkWritable(f.path); err != nil {
+			r.fail("%s: %v", f.name, err)
+		} else {
+			r.ok("%s: %s", f.name, f.path)
+		}
+	}
+}
+
+// checkWritable opens an existing file for appending without changing it,
+// or checks the directory a new one would be created in
+func checkWritable(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err == nil {
+		return f.Close()
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	info, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", filepath.Dir(path))
+	}
+	return nil
+}
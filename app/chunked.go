@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+)
+
+// maxChunkedBody is the most a chunked request body may decode to. The
+// body is buffered so handlers that need a length still get one.
+const maxChunkedBody = 8 << 20
+
+var (
+	errBadChunk      = errors.New("malformed chunk")
+	errChunkTooLarge = errors.New("chunked body too large")
+)
+
+// chunkedReader decodes a chunked transfer-coded body from r. Chunk
+// extensions and trailers are read and discarded.
+type chunkedReader struct {
+	r     *bufio.Reader
+	left  int64 // bytes left in the current chunk
+	total int64 // bytes decoded so far
+	limit int64
+	done  bool
+	err   error
+}
+
+func newChunkedReader(r *bufio.Reader, limit int64) *chunkedReader {
+	return &chunkedReader{r: r, limit: limit}
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	if cr.done {
+		return 0, io.EOF
+	}
+	if cr.left == 0 {
+		if cr.err = cr.nextChunk(); cr.err != nil {
+			return 0, cr.err
+		}
+		if cr.done {
+			return 0, io.EOF
+		}
+	}
+	if int64(len(p)) > cr.left {
+		p = p[:cr.left]
+	}
+	n, err := cr.r.Read(p)
+	cr.left -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && cr.left == 0 {
+		err = cr.chunkEnd()
+	}
+	cr.err = err
+	return n, err
+}
+
+// nextChunk reads a chunk-size line, or at the last chunk the trailers
+func (cr *chunkedReader) nextChunk() error {
+	line, err := readLine(cr.r)
+	if err != nil {
+		return chunkErr(err)
+	}
+	if i := bytes.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	line = bytes.TrimRight(line, " \t")
+	size, ok := parseChunkSize(line)
+	if !ok {
+		return errBadChunk
+	}
+	if size > cr.limit-cr.total {
+		return errChunkTooLarge
+	}
+	if size == 0 {
+		// Trailers end at a blank line
+		for {
+			line, err := readLine(cr.r)
+			if err != nil {
+				return chunkErr(err)
+			}
+			if len(line) == 0 {
+				cr.done = true
+				return nil
+			}
+		}
+	}
+	cr.left = size
+	cr.total += size
+	return nil
+}
+
+// chunkEnd reads the CRLF that follows a chunk's data
+func (cr *chunkedReader) chunkEnd() error {
+	line, err := readLine(cr.r)
+	if err != nil {
+		return chunkErr(err)
+	}
+	if len(line) != 0 {
+		return errBadChunk
+	}
+	return nil
+}
+
+// parseChunkSize reads a chunk size in hex. More than 15 digits can't fit
+// in an int64, so they are refused before overflowing.
+func parseChunkSize(b []byte) (int64, bool) {
+	if len(b) == 0 || len(b) > 15 {
+		return 0, false
+	}
+	var n int64
+	for _, c := range b {
+		switch {
+		case '0' <= c && c <= '9':
+			c -= '0'
+		case 'a' <= c && c <= 'f':
+			c -= 'a' - 10
+		case 'A' <= c && c <= 'F':
+			c -= 'A' - 10
+		default:
+			return 0, false
+		}
+		n = n<<4 | int64(c)
+	}
+	return n, true
+}
+
+func chunkErr(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// isChunked reports whether req's body is chunked transfer-coded
+func (req *Request) isChunked() bool {
+	te, ok := req.LookupHeader("Transfer-Encoding")
+	return ok && strings.EqualFold(te, "chunked")
+}
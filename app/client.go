@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clientResponse is a response read by the built-in client tooling
+type clientResponse struct {
+	Version string
+	Status  int
+	Reason  string
+	Headers [][2]string
+	Body    []byte
+
+	// Close is set when the server won't accept more requests on the connection
+	Close bool
+}
+
+// Header returns the first value of the named header, case-insensitively
+func (resp *clientResponse) Header(name string) string {
+	for _, h := range resp.Headers {
+		if strings.EqualFold(h[0], name) {
+			return h[1]
+		}
+	}
+	return ""
+}
+
+// writeClientRequest sends a request with the given extra header lines
+func writeClientRequest(w *bufio.Writer, method, host, path string, headers []string, body []byte) error {
+	fmt.Fprintf(w, "%s %s HTTP/1.1\r\nHost: %s\r\n", method, path, host)
+	for _, h := range headers {
+		w.WriteString(h)
+		w.WriteString("\r\n")
+	}
+	if len(body) > 0 {
+		fmt.Fprintf(w, "Content-Length: %d\r\n", len(body))
+	}
+	w.WriteString("\r\n")
+	w.Write(body)
+	return w.Flush()
+}
+
+// readClientResponse reads one response, including its body, from r
+func readClientResponse(r *bufio.Reader, method string) (*clientResponse, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	version, rest, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+	codeStr, reason, _ := strings.Cut(rest, " ")
+	code, err := strconv.Atoi(codeStr)
+	if err != nil || !strings.HasPrefix(version, "HTTP/") {
+		return nil, fmt.Errorf("malformed status line %q", line)
+	}
+	resp := &clientResponse{Version: version, Status: code, Reason: reason}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed header line %q", line)
+		}
+		resp.Headers = append(resp.Headers, [2]string{strings.TrimSpace(name), strings.TrimSpace(value)})
+	}
+	resp.Close = strings.EqualFold(resp.Header("Connection"), "close") || version == "HTTP/1.0"
+
+	// Responses that never carry a body
+	if method == "HEAD" || code == 204 || code == 304 || (code >= 100 && code < 200) {
+		return resp, nil
+	}
+
+	switch {
+	case strings.EqualFold(resp.Header("Transfer-Encoding"), "chunked"):
+		resp.Body, err = readChunkedBody(r)
+	case resp.Header("Content-Length") != "":
+		n, convErr := strconv.ParseInt(resp.Header("Content-Length"), 10, 64)
+		if convErr != nil || n < 0 {
+			return nil, fmt.Errorf("bad Content-Length %q", resp.Header("Content-Length"))
+		}
+		resp.Body = make([]byte, n)
+		_, err = io.ReadFull(r, resp.Body)
+	default:
+		// No framing, the body runs until the server closes
+		resp.Body, err = io.ReadAll(r)
+		resp.Close = true
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// readChunkedBody decodes a chunked response body whole
+func readChunkedBody(r *bufio.Reader) ([]byte, error) {
+	return io.ReadAll(newChunkedReader(r, math.MaxInt64))
+}
+
+// runRequest implements the request subcommand, a small curl for poking a
+// running server: it sends one request and prints the response body, or
+// with -i the status line and headers too. Exit statuses follow curl's: 7
+// when the server can't be reached, 22 for an error response with -f.
+func runRequest(args []string) int {
+	fs := flag.NewFlagSet("request", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), commandUsage("request"))
+		fs.PrintDefaults()
+	}
+	method := fs.String("X", "", "request method (default GET, or POST with -d)")
+	data := fs.String("d", "", "request body; @file reads it from a file, @- from stdin")
+	include := fs.Bool("i", false, "print the status line and headers")
+	head := fs.Bool("I", false, "send a HEAD request and print only the status line and headers")
+	fail := fs.Bool("f", false, "exit with status 22 when the response is 400 or above")
+	timeout := fs.Duration("timeout", 30*time.Second, "give up after this long")
+	var headers headerFlags
+	fs.Var(&headers, "H", "extra request header as \"Name: value\" (repeatable)")
+	_ = fs.Parse(args)
+
+	target := "localhost:4221/"
+	if fs.NArg() > 0 {
+		target = fs.Arg(0)
+	}
+	addr, path := splitTarget(target)
+
+	var body []byte
+	switch {
+	case *data == "@-":
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		body = b
+	case strings.HasPrefix(*data, "@"):
+		b, err := os.ReadFile((*data)[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		body = b
+	default:
+		body = []byte(*data)
+	}
+	switch {
+	case *method != "":
+	case *head:
+		*method = "HEAD"
+	case len(body) > 0:
+		*method = "POST"
+	default:
+		*method = "GET"
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, *timeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 7
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(*timeout))
+	headers = append(headers, "Connection: close")
+	if err := writeClientRequest(bufio.NewWriter(conn), *method, addr, path, headers, body); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	resp, err := readClientResponse(bufio.NewReader(conn), *method)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *include || *head {
+		fmt.Printf("%s %d %s\n", resp.Version, resp.Status, resp.Reason)
+		for _, h := range resp.Headers {
+			fmt.Printf("%s: %s\n", h[0], h[1])
+		}
+		if !*head {
+			fmt.Println()
+		}
+	}
+	if !*head {
+		os.Stdout.Write(resp.Body)
+	}
+	if *fail && resp.Status >= 400 {
+		return 22
+	}
+	return 0
+}
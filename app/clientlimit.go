@@ -0,0 +1,140 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultRateLimitClients bounds how many client buckets are remembered
+const defaultRateLimitClients = 10000
+
+// clientRateRule limits each client on paths under prefix; "" applies to
+// every path
+type clientRateRule struct {
+	prefix string
+	rate   requestRate
+}
+
+// clientLimiter keeps a token bucket per client and rule in an LRU, so a
+// flood of distinct addresses can't grow it without bound. An evicted
+// client simply starts again with a full bucket.
+type clientLimiter struct {
+	rules      []clientRateRule
+	maxClients int
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List
+
+	limited atomic.Uint64
+}
+
+type clientBucket struct {
+	key    string
+	bucket *requestBucket
+}
+
+func newClientLimiter(rules []clientRateRule, maxClients int) *clientLimiter {
+	return &clientLimiter{
+		rules:      rules,
+		maxClients: maxClients,
+		buckets:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// rule returns the rule with the longest prefix matching path, or nil
+func (l *clientLimiter) rule(path string) *clientRateRule {
+	var best *clientRateRule
+	for i := range l.rules {
+		r := &l.rules[i]
+		if strings.HasPrefix(path, r.prefix) && (best == nil || len(r.prefix) > len(best.prefix)) {
+			best = r
+		}
+	}
+	return best
+}
+
+func (l *clientLimiter) bucket(r *clientRateRule, client string) *requestBucket {
+	key := r.prefix + "\x00" + client
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if elem, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(elem)
+		return elem.Value.(*clientBucket).bucket
+	}
+	if l.lru.Len() >= l.maxClients {
+		oldest := l.lru.Back()
+		l.lru.Remove(oldest)
+		delete(l.buckets, oldest.Value.(*clientBucket).key)
+	}
+	b := newRequestBucket(r.rate)
+	l.buckets[key] = l.lru.PushFront(&clientBucket{key: key, bucket: b})
+	return b
+}
+
+// Stats returns the number of tracked buckets and of requests refused
+func (l *clientLimiter) Stats() (clients int, limited uint64) {
+	l.mu.Lock()
+	clients = l.lru.Len()
+	l.mu.Unlock()
+	return clients, l.limited.Load()
+}
+
+// clientRateLimit returns a middleware answering 429 once a client exceeds
+// the rate of the rule matching the request path
+func clientRateLimit(l *clientLimiter) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(s *Server, w ResponseWriter, req *Request) {
+			r := l.rule(req.Path)
+			if r == nil {
+				next(s, w, req)
+				return
+			}
+			if ok, wait := l.bucket(r, clientIP(req)).allow(); !ok {
+				l.limited.Add(1)
+				sendTooManyRequests(w, wait)
+				return
+			}
+			next(s, w, req)
+		}
+	}
+}
+
+// connLimiter caps the number of connections open from each client address
+type connLimiter struct {
+	max int
+
+	mu    sync.Mutex
+	conns map[string]int
+
+	refused atomic.Uint64
+}
+
+func newConnLimiter(max int) *connLimiter {
+	return &connLimiter{max: max, conns: make(map[string]int)}
+}
+
+// acquire counts a new connection from ip, reporting false if ip already
+// has the maximum open
+func (l *connLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip] >= l.max {
+		l.refused.Add(1)
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
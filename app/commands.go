@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// command is a subcommand of the binary, e.g. "http-server bench"
+type command struct {
+	name string
+	// args is what follows the name on the command line, for usage text
+	args    string
+	summary string
+	run     func(args []string) int
+}
+
+// commands is filled in by init, since help lists it
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "[flags]", "run the server (the default when no command is given)", runServe},
+		{"check", "[flags]", "validate the configuration without binding anything", runCheckCommand},
+		{"bench", "[flags] [host:port/path]", "load-test a running server", runBench},
+		{"request", "[flags] [host:port/path]", "send one request and print the response", runRequest},
+		{"sign", "-key KEY [flags] /files/name...", "print signed links to files", runSign},
+		{"service", "install|uninstall NAME [flags]", "install or remove the Windows service", runService},
+		{"help", "", "list the commands", runHelp},
+	}
+}
+
+// findCommand returns the subcommand named by the first argument, if any.
+// Anything else, flags included, runs the server as before subcommands.
+func findCommand(args []string) (*command, []string) {
+	if len(args) > 0 {
+		for i := range commands {
+			if commands[i].name == args[0] {
+				return &commands[i], args[1:]
+			}
+		}
+	}
+	return &commands[0], args
+}
+
+// commandUsage is the usage line of the named command
+func commandUsage(name string) string {
+	for _, c := range commands {
+		if c.name == name {
+			return "usage: http-server " + strings.TrimSpace(c.name+" "+c.args)
+		}
+	}
+	return "usage: http-server [flags]"
+}
+
+// writeUsage lists how each command is invoked, so the flag help and help
+// can't drift from what findCommand accepts
+func writeUsage(out io.Writer) {
+	fmt.Fprintln(out, "usage: http-server [flags]")
+	for _, c := range commands {
+		fmt.Fprintln(out, "       http-server "+strings.TrimSpace(c.name+" "+c.args))
+	}
+}
+
+func runServe(args []string) int {
+	runServer(args, nil)
+	return 0
+}
+
+// runCheckCommand parses args as serve would and validates the result
+func runCheckCommand(args []string) int {
+	cfg, err := parseFlags(args)
+	if err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+	return runCheck(os.Stdout, cfg)
+}
+
+func runHelp(args []string) int {
+	writeUsage(os.Stdout)
+	fmt.Println()
+	for _, c := range commands {
+		fmt.Printf("  %-8s %s\n", c.name, c.summary)
+	}
+	fmt.Println()
+	fmt.Println(`Run "http-server COMMAND -h" for a command's flags.`)
+	return 0
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestUsageListsCommands checks the usage text names every command that
+// findCommand accepts, and nothing else
+func TestUsageListsCommands(t *testing.T) {
+	var b strings.Builder
+	writeUsage(&b)
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != len(commands)+1 {
+		t.Fatalf("usage has %d lines for %d commands:\n%s", len(lines), len(commands), b.String())
+	}
+	for i, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "http-server" {
+			t.Errorf("usage line %q", line)
+			continue
+		}
+		if c, _ := findCommand(fields[1:]); c != &commands[i] {
+			t.Errorf("usage line %q runs %s", line, c.name)
+		}
+		if !strings.HasSuffix(commandUsage(fields[1]), line[len("       "):]) {
+			t.Errorf("commandUsage(%q) = %q, want it to match %q", fields[1], commandUsage(fields[1]), line)
+		}
+	}
+}
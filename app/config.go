@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// configSetting is one flag value read from a config file
+type configSetting struct {
+	name  string
+	value string
+	line  int
+}
+
+var configKey = regexp.MustCompile(`^([A-Za-z0-9_.-]+)\s*[:=]\s*(.*)$`)
+
+// readConfigFile reads settings named after the command line flags, written
+// in a small subset of YAML or TOML:
+//
+//	port: 8080
+//	directory: /srv/files
+//	tls:
+//	  cert: /etc/server/cert.pem
+//	  key: /etc/server/key.pem
+//	cors-origin:
+//	  - https://example.com
+//
+// Nested keys are joined with dashes, so tls.cert sets --tls-cert. TOML
+// [sections], key = value pairs, underscores, and [a, b] lists work too.
+// Each list item is one use of a repeatable flag.
+func readConfigFile(path string) ([]configSetting, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	type level struct {
+		indent int
+		name   string
+	}
+	var stack []level
+	var settings []configSetting
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		raw := strings.TrimRight(scanner.Text(), " \t\r")
+		line := strings.TrimLeft(raw, " \t")
+		if line == "" || line[0] == '#' || line == "---" {
+			continue
+		}
+		indent := len(raw) - len(line)
+
+		// TOML section headers replace the whole stack
+		if line[0] == '[' && strings.HasSuffix(line, "]") {
+			name := strings.ReplaceAll(strings.Trim(line, "[] "), ".", "-")
+			stack = []level{{indent: -1, name: name}}
+			continue
+		}
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		prefix := ""
+		for _, l := range stack {
+			prefix += l.name + "-"
+		}
+
+		if item, ok := strings.CutPrefix(line, "- "); ok {
+			if prefix == "" {
+				return nil, fmt.Errorf("%s:%d: list item outside a list", path, n)
+			}
+			value, err := configValue(item)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+			settings = append(settings, configSetting{strings.TrimSuffix(prefix, "-"), value, n})
+			continue
+		}
+
+		m := configKey.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("%s:%d: expected key: value", path, n)
+		}
+		key := strings.ReplaceAll(strings.ReplaceAll(m[1], "_", "-"), ".", "-")
+		if m[2] == "" {
+			stack = append(stack, level{indent: indent, name: key})
+			continue
+		}
+		values, err := configValues(m[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		for _, value := range values {
+			settings = append(settings, configSetting{prefix + key, value, n})
+		}
+	}
+	return settings, scanner.Err()
+}
+
+// configValues reads a scalar, or each item of a [a, b] list
+func configValues(v string) ([]string, error) {
+	if !strings.HasPrefix(v, "[") {
+		value, err := configValue(v)
+		return []string{value}, err
+	}
+	if !strings.HasSuffix(v, "]") {
+		return nil, fmt.Errorf("unterminated list")
+	}
+	var values []string
+	var item strings.Builder
+	var quote byte
+	for i := 1; i < len(v)-1; i++ {
+		c := v[i]
+		switch {
+		case quote != 0 && c == '\\' && i+1 < len(v)-1:
+			item.WriteByte(c)
+			i++
+			c = v[i]
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == ',':
+			value, err := configValue(item.String())
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+			item.Reset()
+			continue
+		}
+		item.WriteByte(c)
+	}
+	if rest := strings.TrimSpace(item.String()); rest != "" {
+		value, err := configValue(rest)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// configValue unquotes a scalar and drops a trailing comment
+func configValue(v string) (string, error) {
+	v = strings.TrimSpace(v)
+	switch {
+	case strings.HasPrefix(v, `"`):
+		end := closingQuote(v)
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string")
+		}
+		return strconv.Unquote(v[:end+1])
+	case strings.HasPrefix(v, "'"):
+		end := strings.IndexByte(v[1:], '\'')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string")
+		}
+		return v[1 : end+1], nil
+	}
+	if i := strings.Index(v, " #"); i >= 0 {
+		v = strings.TrimSpace(v[:i])
+	}
+	return v, nil
+}
+
+// closingQuote finds the end of the double-quoted string v starts with
+func closingQuote(v string) int {
+	for i := 1; i < len(v); i++ {
+		switch v[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// configPath finds --config among args without parsing anything else, so
+// the file can be applied before the command line overrides it
+func configPath(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "config" {
+			continue
+		}
+		if hasValue {
+			return value
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
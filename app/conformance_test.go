@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestConformance sends requests RFC 7230 and 7231 have something to say
+// about and checks the exact status each gets
+func TestConformance(t *testing.T) {
+	tests := []struct {
+		name   string
+		req    string
+		status int
+	}{
+		// Request line
+		{"plain", "GET / HTTP/1.1\r\nHost: x\r\n\r\n", 200},
+		{"http/1.0 without host", "GET / HTTP/1.0\r\n\r\n", 200},
+		{"bare lf line endings", "GET / HTTP/1.1\nHost: x\n\n", 200},
+		{"lowercase method", "get / HTTP/1.1\r\nHost: x\r\n\r\n", 501},
+		{"mixed case method", "Get / HTTP/1.1\r\nHost: x\r\n\r\n", 501},
+		{"unknown method", "BREW / HTTP/1.1\r\nHost: x\r\n\r\n", 501},
+		{"method with separator", "G(T / HTTP/1.1\r\nHost: x\r\n\r\n", 400},
+		{"missing version", "GET /\r\nHost: x\r\n\r\n", 400},
+		{"extra field", "GET / HTTP/1.1 x\r\nHost: x\r\n\r\n", 400},
+		{"lowercase version", "GET / http/1.1\r\nHost: x\r\n\r\n", 400},
+		{"malformed version", "GET / HTTP/1.1.1\r\nHost: x\r\n\r\n", 400},
+		{"http/2 over http/1 framing", "GET / HTTP/2.0\r\nHost: x\r\n\r\n", 505},
+		{"bare cr in request line", "GET / HTTP/1.1\r\rHost: x\r\n\r\n", 400},
+		{"control character in target", "GET /\x01 HTTP/1.1\r\nHost: x\r\n\r\n", 400},
+
+		// Host
+		{"missing host", "GET / HTTP/1.1\r\n\r\n", 400},
+		{"missing host on a later minor version", "GET / HTTP/1.2\r\n\r\n", 400},
+		{"host on a later minor version", "GET / HTTP/1.2\r\nHost: x\r\n\r\n", 200},
+		{"repeated host", "GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n", 400},
+		{"empty host", "GET / HTTP/1.1\r\nHost:\r\n\r\n", 200},
+
+		// Header fields
+		{"space before colon", "GET / HTTP/1.1\r\nHost : x\r\n\r\n", 400},
+		{"tab before colon", "GET / HTTP/1.1\r\nHost\t: x\r\n\r\n", 400},
+		{"space inside name", "GET / HTTP/1.1\r\nHost: x\r\nX Y: z\r\n\r\n", 400},
+		{"obsolete line folding", "GET / HTTP/1.1\r\nHost: x\r\nX-A: 1\r\n 2\r\n\r\n", 400},
+		{"leading whitespace on first header", "GET / HTTP/1.1\r\n Host: x\r\n\r\n", 400},
+		{"no colon", "GET / HTTP/1.1\r\nHost: x\r\nNoColon\r\n\r\n", 400},
+		{"empty name", "GET / HTTP/1.1\r\nHost: x\r\n: v\r\n\r\n", 400},
+		{"bare cr in value", "GET / HTTP/1.1\r\nHost: x\r\nX-A: 1\r2\r\n\r\n", 400},
+		{"nul in value", "GET / HTTP/1.1\r\nHost: x\r\nX-A: 1\x002\r\n\r\n", 400},
+		{"whitespace around value", "GET / HTTP/1.1\r\nHost: x\r\nX-A: \t 1 \t\r\n\r\n", 200},
+
+		// Content-Length
+		{"negative content-length", "POST /anything HTTP/1.1\r\nHost: x\r\nContent-Length: -1\r\n\r\n", 400},
+		{"signed content-length", "POST /anything HTTP/1.1\r\nHost: x\r\nContent-Length: +1\r\n\r\na", 400},
+		{"hex content-length", "POST /anything HTTP/1.1\r\nHost: x\r\nContent-Length: 0x1\r\n\r\na", 400},
+		{"empty content-length", "POST /anything HTTP/1.1\r\nHost: x\r\nContent-Length:\r\n\r\n", 400},
+		{"overflowing content-length", "POST /anything HTTP/1.1\r\nHost: x\r\nContent-Length: 99999999999999999999\r\n\r\n", 400},
+		{"conflicting content-lengths", "POST /anything HTTP/1.1\r\nHost: x\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\nab", 400},
+		{"repeated equal content-lengths", "POST /anything HTTP/1.1\r\nHost: x\r\nContent-Length: 1\r\nContent-Length: 1\r\n\r\na", 200},
+		{"content-length list", "POST /anything HTTP/1.1\r\nHost: x\r\nContent-Length: 1, 1\r\n\r\na", 400},
+
+		// Transfer-Encoding
+		{"chunked", "POST /anything HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n1\r\na\r\n0\r\n\r\n", 200},
+		{"chunked in capitals", "POST /anything HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: CHUNKED\r\n\r\n0\r\n\r\n", 200},
+		{"chunked and content-length", "POST /anything HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n0\r\n\r\n", 400},
+		{"unknown coding", "POST /anything HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: gzip\r\n\r\n", 501},
+		{"coding list", "POST /anything HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n", 501},
+		{"repeated transfer-encoding", "POST /anything HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", 501},
+		{"obfuscated transfer-encoding", "POST /anything HTTP/1.1\r\nHost: x\r\nTransfer-Encoding : chunked\r\n\r\n0\r\n\r\n", 400},
+
+		// Chunk sizes
+		{"chunk size overflows", "POST /anything HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\nfffffffffffffffff\r\n", 400},
+		{"chunk size past the limit", "POST /anything HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\nffffffffff\r\n", 413},
+		{"negative chunk size", "POST /anything HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n-1\r\n", 400},
+		{"chunk size with prefix", "POST /anything HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n0x1\r\na\r\n0\r\n\r\n", 400},
+		{"chunk longer than its size", "POST /anything HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n1\r\nab\r\n0\r\n\r\n", 400},
+		{"chunk extension", "POST /anything HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n1;name=value\r\na\r\n0\r\n\r\n", 200},
+		{"trailer", "POST /anything HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n1\r\na\r\n0\r\nX-T: 1\r\n\r\n", 200},
+
+		// Oversized heads
+		{"long request line", "GET /" + strings.Repeat("a", 8192) + " HTTP/1.1\r\nHost: x\r\n\r\n", 400},
+		{"long header", "GET / HTTP/1.1\r\nHost: x\r\nX-A: " + strings.Repeat("a", 8192) + "\r\n\r\n", 400},
+		{"too many headers", "GET / HTTP/1.1\r\nHost: x\r\n" + strings.Repeat("X-A: a\r\n", maxHeaderFields) + "\r\n", 431},
+		{"headers too large", "GET / HTTP/1.1\r\nHost: x\r\n" + strings.Repeat("X-A: "+strings.Repeat("a", 4000)+"\r\n", maxHeaderBytes/4000+1) + "\r\n", 431},
+		{"headers at the limits", "GET / HTTP/1.1\r\nHost: x\r\n" + strings.Repeat("X-A: a\r\n", maxHeaderFields-1) + "\r\n", 200},
+	}
+	ts := newTestServer(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := &testServer{t: t, s: ts.s, dir: ts.dir, dial: ts.dial}
+			ts.Raw(tt.req).Status(tt.status)
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import "time"
+
+// reapInterval is how often the registry is swept for idle connections
+const reapInterval = time.Second
+
+// trackConn registers an open connection, for shutdown, the idle reaper,
+// and the admin connection list
+func (s *Server) trackConn(tc *timeoutConn) {
+	s.connsMu.Lock()
+	if s.conns == nil {
+		s.conns = make(map[*timeoutConn]struct{})
+	}
+	s.conns[tc] = struct{}{}
+	s.connsMu.Unlock()
+}
+
+func (s *Server) untrackConn(tc *timeoutConn) {
+	s.connsMu.Lock()
+	delete(s.conns, tc)
+	s.connsMu.Unlock()
+}
+
+// connCount returns the number of open client connections
+func (s *Server) connCount() int {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	return len(s.conns)
+}
+
+// reapIdleConns sweeps the registry until shutdown, which closes idle
+// connections itself
+func (s *Server) reapIdleConns() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.draining.Load() {
+			return
+		}
+		if n := s.reapIdle(time.Now()); n > 0 {
+			s.log.Debug("closed idle connections", "count", n)
+		}
+	}
+}
+
+// reapIdle closes the connections waiting for a request that have been
+// quiet for longer than the idle timeout, returning how many. The read
+// deadline usually gets there first; this catches connections whose
+// deadline was set before a reload shortened the timeout, or that never
+// got one.
+func (s *Server) reapIdle(now time.Time) int {
+	timeout := s.settings().timeouts.idle
+	if timeout <= 0 {
+		return 0
+	}
+	reaped := 0
+	s.connsMu.Lock()
+	for tc := range s.conns {
+		if tc.idle.Load() && tc.idleFor(now) > timeout {
+			_ = tc.Conn.Close()
+			reaped++
+		}
+	}
+	s.connsMu.Unlock()
+	if s.metrics != nil {
+		s.metrics.idleClosed.Add(uint64(reaped))
+	}
+	return reaped
+}
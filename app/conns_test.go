@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds, failing the test after a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReapIdleConns(t *testing.T) {
+	ts := newPipeServer(t, "--idle-timeout", "1m")
+	c := ts.Conn()
+	c.Do(ts.Get("/echo/a")).Status(200)
+	waitFor(t, "the connection to go idle", func() bool {
+		ts.s.connsMu.Lock()
+		defer ts.s.connsMu.Unlock()
+		for tc := range ts.s.conns {
+			return tc.idle.Load()
+		}
+		return false
+	})
+	if n := ts.s.connCount(); n != 1 {
+		t.Fatalf("connCount = %d, want 1", n)
+	}
+
+	// Within the idle timeout nothing is closed
+	if n := ts.s.reapIdle(time.Now()); n != 0 {
+		t.Fatalf("reapIdle closed %d connections inside the timeout", n)
+	}
+	if n := ts.s.reapIdle(time.Now().Add(2 * time.Minute)); n != 1 {
+		t.Fatalf("reapIdle closed %d connections, want 1", n)
+	}
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Error("reaped connection still open")
+	}
+	waitFor(t, "the connection to leave the registry", func() bool { return ts.s.connCount() == 0 })
+	if n := ts.s.metrics.idleClosed.Load(); n != 1 {
+		t.Errorf("idleClosed = %d, want 1", n)
+	}
+}
+
+func TestReapIdleConnsSkipsBusy(t *testing.T) {
+	ts := newPipeServer(t, "--idle-timeout", "1m")
+	c := ts.Conn()
+	// The request head is never finished, so the connection isn't idle
+	go func() { _, _ = c.conn.Write([]byte("GET /echo/a HTTP/1.1\r\n")) }()
+	waitFor(t, "the request to start", func() bool {
+		ts.s.connsMu.Lock()
+		defer ts.s.connsMu.Unlock()
+		// Bytes have been read and the connection left the idle wait
+		for tc := range ts.s.conns {
+			return tc.lastActive.Load() > tc.opened.UnixNano() && !tc.idle.Load()
+		}
+		return false
+	})
+	if n := ts.s.reapIdle(time.Now().Add(2 * time.Minute)); n != 0 {
+		t.Errorf("reapIdle closed %d connections mid-request", n)
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	ts := newTestServer(t, "--max-conns-per-ip", "1")
+	c := ts.Conn()
+	c.Do(ts.Get("/echo/a")).Status(200)
+	waitFor(t, "the first connection to be registered", func() bool { return ts.s.connCount() == 1 })
+
+	// The second is refused before the server reads anything from it
+	conn, err := ts.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 503 || !resp.Close || resp.Header.Get("Date") == "" {
+		t.Errorf("got %d, close %v, Date %q; want a closing 503", resp.StatusCode, resp.Close, resp.Header.Get("Date"))
+	}
+
+	// The first connection carries on
+	c.Do(ts.Get("/echo/b")).Status(200).BodyIs("b")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Cookie is a cookie to set on the client
+type Cookie struct {
+	Name  string
+	Value string
+	Path  string // "/" when empty
+	// MaxAge is in seconds; 0 leaves it a session cookie, and a negative
+	// value deletes the cookie
+	MaxAge   int
+	HttpOnly bool
+	Secure   bool
+	SameSite string // Lax, Strict, or None, or empty to leave it out
+}
+
+// isToken reports whether s is an RFC 9110 token, as header and cookie
+// names must be
+func isToken(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func isTokenChar(c byte) bool {
+	return c > ' ' && c < 0x7f && strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) < 0
+}
+
+// validCookieValue reports whether v can be sent without quoting, as
+// RFC 6265 restricts cookie values
+func validCookieValue(v string) bool {
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if c <= ' ' || c >= 0x7f || c == '"' || c == ',' || c == ';' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// SetCookie adds a Set-Cookie header for c. It must be called before the
+// response header is written.
+func SetCookie(w ResponseWriter, c Cookie) error {
+	if !isToken(c.Name) {
+		return errors.New("invalid cookie name " + strconv.Quote(c.Name))
+	}
+	if !validCookieValue(c.Value) {
+		return errors.New("invalid value for cookie " + c.Name)
+	}
+	var b strings.Builder
+	b.WriteString(c.Name + "=" + c.Value)
+	path := c.Path
+	if path == "" {
+		path = "/"
+	}
+	b.WriteString("; Path=" + path)
+	if c.MaxAge < 0 {
+		b.WriteString("; Max-Age=0")
+	} else if c.MaxAge > 0 {
+		b.WriteString("; Max-Age=" + strconv.Itoa(c.MaxAge))
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	if c.SameSite != "" {
+		b.WriteString("; SameSite=" + c.SameSite)
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	w.Header().Add("Set-Cookie", b.String())
+	return nil
+}
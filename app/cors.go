@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// defaultCORSMethods are allowed cross-origin unless --cors-methods is set
+const defaultCORSMethods = "GET, HEAD, POST"
+
+// corsPolicy decides which other origins browsers may let call the server
+type corsPolicy struct {
+	origins     []string // "*" allows any origin
+	methods     string
+	headers     string // "" echoes the headers a preflight asks for
+	expose      string
+	credentials bool
+	maxAge      int // seconds, 0 leaves it to the browser
+}
+
+func newCORSPolicy() *corsPolicy {
+	return &corsPolicy{methods: defaultCORSMethods}
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for origin, or
+// "" if it isn't allowed. "*" never comes with credentials; configure
+// refuses the combination.
+func (p *corsPolicy) allowOrigin(origin string) string {
+	for _, o := range p.origins {
+		if o == "*" {
+			return "*"
+		}
+		if strings.EqualFold(o, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// cors returns a middleware answering preflight requests and adding
+// Access-Control-* headers to responses for allowed origins. It runs ahead
+// of authentication since browsers send preflights without credentials.
+func cors(p *corsPolicy) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(s *Server, w ResponseWriter, req *Request) {
+			origin := req.Header("Origin")
+			if origin == "" {
+				next(s, w, req)
+				return
+			}
+			h := w.Header()
+			h.Add("Vary", "Origin")
+			allowed := p.allowOrigin(origin)
+
+			preflight := req.Method == "OPTIONS" && req.Header("Access-Control-Request-Method") != ""
+			if preflight {
+				if allowed == "" {
+					sendStatus(w, 403)
+					return
+				}
+				h.Set("Access-Control-Allow-Origin", allowed)
+				h.Set("Access-Control-Allow-Methods", p.methods)
+				if p.headers != "" {
+					h.Set("Access-Control-Allow-Headers", p.headers)
+				} else if requested := req.Header("Access-Control-Request-Headers"); requested != "" {
+					h.Set("Access-Control-Allow-Headers", requested)
+					h.Add("Vary", "Access-Control-Request-Headers")
+				}
+				if p.credentials {
+					h.Set("Access-Control-Allow-Credentials", "true")
+				}
+				if p.maxAge > 0 {
+					h.Set("Access-Control-Max-Age", strconv.Itoa(p.maxAge))
+				}
+				sendStatus(w, 204)
+				return
+			}
+
+			if allowed != "" {
+				h.Set("Access-Control-Allow-Origin", allowed)
+				if p.credentials {
+					h.Set("Access-Control-Allow-Credentials", "true")
+				}
+				if p.expose != "" {
+					h.Set("Access-Control-Expose-Headers", p.expose)
+				}
+			}
+			next(s, w, req)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	ts := newTestServer(t,
+		"--cors-origin", "https://app.example/",
+		"--cors-methods", "GET, PUT",
+		"--cors-expose-headers", "X-Request-Id",
+		"--cors-credentials",
+		"--cors-max-age", "600",
+	)
+
+	// Simple requests from an allowed origin, matched without case or the
+	// trailing slash the flag was given with
+	ts.Get("/echo/abc").Header("Origin", "https://APP.example").Do().Status(200).
+		HeaderIs("Access-Control-Allow-Origin", "https://APP.example").
+		HeaderIs("Access-Control-Allow-Credentials", "true").
+		HeaderIs("Access-Control-Expose-Headers", "X-Request-Id").
+		HeaderIs("Vary", "Origin").
+		BodyIs("abc")
+	// Other origins get the response without permission to read it
+	ts.Get("/echo/abc").Header("Origin", "https://evil.example").Do().Status(200).
+		HeaderIs("Access-Control-Allow-Origin", "").
+		HeaderIs("Access-Control-Allow-Credentials", "").
+		HeaderIs("Vary", "Origin")
+	// Same-origin requests are left alone
+	ts.Get("/echo/abc").Do().Status(200).HeaderIs("Vary", "")
+
+	ts.Request("OPTIONS", "/echo/abc").
+		Header("Origin", "https://app.example").
+		Header("Access-Control-Request-Method", "PUT").
+		Header("Access-Control-Request-Headers", "X-Custom").Do().
+		Status(204).
+		HeaderIs("Access-Control-Allow-Origin", "https://app.example").
+		HeaderIs("Access-Control-Allow-Methods", "GET, PUT").
+		HeaderIs("Access-Control-Allow-Headers", "X-Custom").
+		HeaderIs("Access-Control-Allow-Credentials", "true").
+		HeaderIs("Access-Control-Max-Age", "600")
+	ts.Request("OPTIONS", "/echo/abc").
+		Header("Origin", "https://evil.example").
+		Header("Access-Control-Request-Method", "PUT").Do().
+		Status(403).
+		HeaderIs("Access-Control-Allow-Origin", "")
+}
+
+func TestCORSAnyOrigin(t *testing.T) {
+	ts := newTestServer(t, "--cors-origin", "*", "--cors-headers", "Content-Type")
+	ts.Get("/echo/abc").Header("Origin", "https://anywhere.example").Do().Status(200).
+		HeaderIs("Access-Control-Allow-Origin", "*").
+		HeaderIs("Access-Control-Allow-Credentials", "")
+	ts.Request("OPTIONS", "/echo/abc").
+		Header("Origin", "https://anywhere.example").
+		Header("Access-Control-Request-Method", "POST").
+		Header("Access-Control-Request-Headers", "X-Custom").Do().
+		Status(204).
+		HeaderIs("Access-Control-Allow-Origin", "*").
+		HeaderIs("Access-Control-Allow-Methods", defaultCORSMethods).
+		HeaderIs("Access-Control-Allow-Headers", "Content-Type")
+}
+
+func TestCORSWildcardCredentials(t *testing.T) {
+	s := New(WithFlags("--cors-origin", "*", "--cors-credentials"))
+	if s.initErr == nil || !strings.Contains(s.initErr.Error(), "--cors-credentials") {
+		t.Errorf("New = %v, want * with credentials refused", s.initErr)
+	}
+	newUnitServer(t, "--cors-origin", "https://app.example", "--cors-credentials")
+}
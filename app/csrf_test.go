@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFProtect(t *testing.T) {
+	ts := newTestServer(t, "--csrf-protect", "/anything")
+
+	// A safe request is issued the token cookie
+	setCookie := ts.Get("/anything").Do().Status(200).Header.Get("Set-Cookie")
+	cookie, _, _ := strings.Cut(setCookie, ";")
+	token, ok := strings.CutPrefix(cookie, "csrf_token=")
+	if !ok || token == "" || !strings.Contains(setCookie, "SameSite=Strict") {
+		t.Fatalf("Set-Cookie = %q", setCookie)
+	}
+	// and isn't issued another while it holds a valid one
+	ts.Get("/anything").Header("Cookie", cookie).Do().Status(200).HeaderIs("Set-Cookie", "")
+
+	post := func() *testRequest {
+		return ts.Request("POST", "/anything").Header("Cookie", cookie)
+	}
+	post().Header("X-CSRF-Token", token).Do().Status(200)
+	post().Header("Content-Type", "application/x-www-form-urlencoded").
+		Body(url.Values{"csrf_token": {token}, "name": {"ann"}}.Encode()).Do().
+		Status(200).BodyContains(`name=ann"`)
+
+	post().Do().Status(403)
+	post().Header("X-CSRF-Token", token+"x").Do().Status(403)
+	post().Header("Content-Type", "application/x-www-form-urlencoded").Body("csrf_token=wrong").Do().Status(403)
+	// A forged cookie fails its signature, so matching it proves nothing
+	ts.Request("POST", "/anything").Header("Cookie", "csrf_token=a.b").Header("X-CSRF-Token", "a.b").Do().Status(403)
+
+	// Tokens issued before a reload are still good after it
+	if err := ts.s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	post().Header("X-CSRF-Token", token).Do().Status(200)
+
+	// Other paths are left alone
+	ts.Request("POST", "/echo/abc").Do().Status(200)
+}
@@ -0,0 +1,28 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// daemonEnv is never set where daemonize isn't supported
+const daemonEnv = "HTTP_SERVER_DAEMON"
+
+// daemonize isn't supported without Unix sessions; run the server under a
+// service manager instead
+func daemonize() int {
+	fmt.Println("--daemon is not supported on this platform")
+	return 1
+}
+
+// processRunning reports whether a process with the given ID exists
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
@@ -0,0 +1,65 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// daemonEnv marks a process started by daemonize. It stays set so a process
+// started by an upgrade doesn't detach again.
+const daemonEnv = "HTTP_SERVER_DAEMON"
+
+// daemonize starts this binary again in a new session with the same
+// arguments and no terminal, waits for it to start serving, and returns
+// the exit status for this process
+func daemonize() int {
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		fmt.Println("Failed to start daemon:", err.Error())
+		return 1
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		fmt.Println("Failed to start daemon:", err.Error())
+		return 1
+	}
+	defer devNull.Close()
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		fmt.Println("Failed to start daemon:", err.Error())
+		return 1
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = devNull, devNull, devNull
+	cmd.ExtraFiles = []*os.File{readyW}
+	cmd.Env = append(os.Environ(), daemonEnv+"=1", upgradeReadyEnv+"=3")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		fmt.Println("Failed to start daemon:", err.Error())
+		return 1
+	}
+
+	// The pipe reads EOF instead if the server exits during startup
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		_ = cmd.Wait()
+		fmt.Println("The server exited during startup; run it with --check or without --daemon to see why")
+		return 1
+	}
+	fmt.Println("Running in the background as pid", cmd.Process.Pid)
+	_ = cmd.Process.Release()
+	return 0
+}
+
+// processRunning reports whether a process with the given ID exists
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// --dev polls for changed files rather than using OS notifications, which
+// keeps it to the standard library and the same on every platform
+const (
+	devPollInterval = time.Second
+	// maxDevFiles bounds each scan, so pointing --directory at a huge tree
+	// doesn't spin a core
+	maxDevFiles = 10000
+	// maxDevListed is how many changed paths one log line names
+	maxDevListed = 10
+)
+
+// fileStamp is what a scan remembers about a file to spot changes
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// watchDev polls the served directory, the templates, and the config file
+// until shutdown. A changed config file is reloaded; changed assets and
+// templates are logged, and picked up on their next request since nothing
+// is cached in dev mode.
+func (s *Server) watchDev() {
+	configFile := configPath(s.args)
+	var templateDir string
+	if s.templates != nil {
+		templateDir = s.templates.dir
+	}
+	s.log.Info("development mode: watching for changes",
+		"directory", s.settings().directory, "templates", templateDir, "config", configFile)
+
+	assets := s.scanDevFiles(templateDir)
+	config := statFile(configFile)
+	ticker := time.NewTicker(devPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.draining.Load() {
+			return
+		}
+		if configFile != "" {
+			if stamp := statFile(configFile); stamp != config {
+				config = stamp
+				if err := s.reload(); err != nil {
+					s.log.Error("config reload failed, keeping the previous configuration", "file", configFile, "err", err)
+				}
+			}
+		}
+		next := s.scanDevFiles(templateDir)
+		if changed := changedFiles(assets, next); len(changed) > 0 {
+			attrs := []any{"count", len(changed)}
+			if len(changed) > maxDevListed {
+				changed = append(changed[:maxDevListed], "...")
+			}
+			s.log.Info("files changed", append(attrs, "files", changed)...)
+		}
+		assets = next
+	}
+}
+
+// scanDevFiles stamps every file under the served directory and the
+// template directory. The directory is read from the live settings, so a
+// reload that moves it is followed.
+func (s *Server) scanDevFiles(templateDir string) map[string]fileStamp {
+	files := make(map[string]fileStamp)
+	for _, root := range []string{s.settings().directory, templateDir} {
+		if root == "" {
+			continue
+		}
+		_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			if len(files) >= maxDevFiles {
+				return filepath.SkipAll
+			}
+			if info, err := d.Info(); err == nil {
+				files[path] = fileStamp{info.ModTime(), info.Size()}
+			}
+			return nil
+		})
+	}
+	return files
+}
+
+// statFile stamps a single file, or returns the zero stamp when it's
+// missing
+func statFile(path string) fileStamp {
+	if path == "" {
+		return fileStamp{}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{info.ModTime(), info.Size()}
+}
+
+// changedFiles lists the paths added, removed, or modified between two
+// scans, sorted
+func changedFiles(before, after map[string]fileStamp) []string {
+	var changed []string
+	for path, stamp := range after {
+		if old, ok := before[path]; !ok || old != stamp {
+			changed = append(changed, path)
+		}
+	}
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// logDevRequest logs a request and its response in full, for dev mode.
+// Credentials are still redacted, since dev logs get pasted into issues.
+func (s *Server) logDevRequest(req *Request, resp *response, phases requestPhases) {
+	reqHeaders := make([]any, 0, len(req.fields))
+	for _, h := range req.Headers() {
+		value := h[1]
+		if isSecretHeader([]byte(h[0])) {
+			value = redactedValue
+		}
+		reqHeaders = append(reqHeaders, slog.String(h[0], value))
+	}
+	respHeaders := make([]any, 0, resp.header.Len())
+	for _, f := range resp.header.fields {
+		value := f[1]
+		if isSecretHeader([]byte(f[0])) {
+			value = redactedValue
+		}
+		respHeaders = append(respHeaders, slog.String(f[0], value))
+	}
+
+	req.Logger().Info("request",
+		"target", redactTarget(req.Target),
+		"version", req.Version,
+		"route", routeLabel(req),
+		"status", resp.status,
+		"bytes", resp.written,
+		"keep_alive", !resp.closeConn,
+		"duration", phases.total(),
+		slog.Group("phases",
+			"read", phases.read,
+			"handler", phases.handler,
+			"write", phases.write,
+		),
+		slog.Group("request_headers", reqHeaders...),
+		slog.Group("response_headers", respHeaders...),
+	)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+)
+
+// Option configures a server made with New
+type Option func(*options)
+
+type options struct {
+	args []string
+	log  io.Writer
+}
+
+// WithFlags configures the server as the command line would, e.g.
+// WithFlags("--gzip-level", "9", "--cors-origin", "*"). A reload re-reads
+// the same flags.
+func WithFlags(args ...string) Option {
+	return func(o *options) { o.args = append(o.args, args...) }
+}
+
+// WithAddr listens on addr, e.g. "127.0.0.1:0" for an ephemeral port
+func WithAddr(addr string) Option {
+	return WithFlags("--listen", addr)
+}
+
+// WithDirectory serves and stores /files/ in dir
+func WithDirectory(dir string) Option {
+	return WithFlags("--directory", dir)
+}
+
+// WithLogOutput sends the server log to w instead of stderr, unless
+// --log-file is set
+func WithLogOutput(w io.Writer) Option {
+	return func(o *options) { o.log = w }
+}
+
+// New builds a server for use as a library, e.g. from a test:
+//
+//	s := New(WithAddr("127.0.0.1:0"), WithLogOutput(io.Discard))
+//	s.Handle("/hello/{name}", hello)
+//	go s.ListenAndServe(ctx)
+//	<-s.Ready()
+//	resp, err := http.Get("http://" + s.Addr().String() + "/hello/you")
+//
+// A configuration error is returned by ListenAndServe.
+func New(opts ...Option) *Server {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	ready := make(chan struct{})
+	cfg, err := parseFlags(o.args)
+	if err != nil {
+		return &Server{initErr: err, ready: ready}
+	}
+	s, err := newServer(cfg, o.args, o.log)
+	if err != nil {
+		return &Server{initErr: err, ready: ready}
+	}
+	s.ready = ready
+	return s
+}
+
+// Handle adds a route, keyed by path template as in the built-in route
+// table, e.g. "/hello/{name}". Routes added here are matched before the
+// built-in ones. It must be called before ListenAndServe.
+func (s *Server) Handle(pattern string, h HandlerFunc) {
+	s.pluginRoutes = sortRoutes(append(s.pluginRoutes, newRoutes([]route{{pattern: pattern, handler: h}})...))
+}
+
+// ListenAndServe binds the server's listeners and serves until ctx is
+// done, then shuts down as on SIGTERM, returning once the connections are
+// drained. Unlike Start it leaves the process alone: no signal handlers,
+// pid file, privilege dropping, or exiting on error.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	if s.initErr != nil {
+		return s.initErr
+	}
+	s.started = time.Now()
+	if err := s.listen(); err != nil {
+		s.Close()
+		return err
+	}
+	defer s.Close()
+	stop := context.AfterFunc(ctx, s.Shutdown)
+	defer stop()
+	if s.onReady != nil {
+		s.onReady()
+	}
+	close(s.ready)
+	s.run()
+	return nil
+}
+
+// Ready is closed once ListenAndServe is accepting connections
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Addr returns the address of the main listener, once it is bound
+func (s *Server) Addr() net.Addr {
+	if len(s.listeners) == 0 {
+		return nil
+	}
+	return s.listeners[0].Addr()
+}
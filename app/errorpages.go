@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	htmltemplate "html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+)
+
+// errorPages holds the templates --error-pages answers error statuses
+// with. Each file is named for a status code or class and the variant it
+// renders:
+//
+//	404.html  4xx.html  500.json  5xx.json
+//
+// HTML pages are html/template, so request values are escaped; JSON pages
+// are text/template, with a json function for quoting values:
+//
+//	{"error": {{json .StatusText}}, "path": {{json .Path}}}
+type errorPages struct {
+	dir string
+	// reload reparses the directory on every error, for development
+	reload bool
+	pages  map[string]pageTemplate
+}
+
+// pageTemplate is a parsed error page of either kind
+type pageTemplate interface {
+	Execute(w io.Writer, data any) error
+}
+
+// errorPageData is what an error page template is executed with
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Method     string
+	Path       string
+	RequestID  uint64
+}
+
+var errorPageFuncs = texttemplate.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func loadErrorPages(dir string, reload bool) (*errorPages, error) {
+	pages, err := parseErrorPages(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &errorPages{dir: dir, reload: reload, pages: pages}, nil
+}
+
+// parseErrorPages parses every error page in dir. Files not named like
+// one are ignored, so the directory can hold the pages' assets too.
+func parseErrorPages(dir string) (map[string]pageTemplate, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	pages := make(map[string]pageTemplate)
+	for _, e := range entries {
+		name := e.Name()
+		base, ext, _ := strings.Cut(name, ".")
+		if e.IsDir() || !isErrorPageName(base) || (ext != "html" && ext != "json") {
+			continue
+		}
+		text, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		var t pageTemplate
+		if ext == "html" {
+			t, err = htmltemplate.New(name).Parse(string(text))
+		} else {
+			t, err = texttemplate.New(name).Funcs(errorPageFuncs).Parse(string(text))
+		}
+		if err != nil {
+			return nil, err
+		}
+		pages[name] = t
+	}
+	return pages, nil
+}
+
+// isErrorPageName reports whether name is a 4xx or 5xx status code, or
+// one of those classes written as "4xx" or "5xx"
+func isErrorPageName(name string) bool {
+	if len(name) != 3 || (name[0] != '4' && name[0] != '5') {
+		return false
+	}
+	return name[1:] == "xx" || (isDigit(name[1]) && isDigit(name[2]))
+}
+
+// lookup returns the page for code in the given variant, the status's own
+// page before its class's, or nil when there's neither
+func (ep *errorPages) lookup(code int, ext string) (pageTemplate, error) {
+	pages := ep.pages
+	if ep.reload {
+		var err error
+		if pages, err = parseErrorPages(ep.dir); err != nil {
+			return nil, err
+		}
+	}
+	status := strconv.Itoa(code)
+	if t := pages[status+"."+ext]; t != nil {
+		return t, nil
+	}
+	return pages[status[:1]+"xx."+ext], nil
+}
+
+// render gives r the error page for its status, if there is one. Anything
+// that goes wrong leaves r as the handler left it, bodyless.
+func (ep *errorPages) render(r *response) {
+	ext, contentType := "html", "text/html; charset=utf-8"
+	if wantsJSON(r.req) {
+		ext, contentType = "json", "application/json"
+	}
+	t, err := ep.lookup(r.status, ext)
+	if t == nil {
+		if err != nil {
+			r.req.Logger().Warn("failed to load error pages", "dir", ep.dir, "err", err)
+		}
+		return
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	data := errorPageData{
+		Status:     r.status,
+		StatusText: statusText(r.status),
+		Method:     r.req.Method,
+		Path:       r.req.Path,
+		RequestID:  r.req.id,
+	}
+	if err := t.Execute(buf, data); err != nil {
+		r.req.Logger().Warn("failed to render error page", "status", r.status, "err", err)
+		return
+	}
+	if ext == "json" && !json.Valid(buf.Bytes()) {
+		r.req.Logger().Warn("error page rendered invalid JSON", "status", r.status)
+		return
+	}
+	r.header.Set("Content-Type", contentType)
+	r.header.Del("Content-Length")
+	r.contentLength = -1
+	_, _ = r.Write(buf.Bytes())
+}
+
+// wantsJSON reports whether the client asked for JSON rather than HTML
+func wantsJSON(req *Request) bool {
+	accept := req.Header("Accept")
+	return strings.Contains(accept, "json") && !strings.Contains(accept, "text/html")
+}
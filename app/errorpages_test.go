@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestErrorPages(t *testing.T) {
+	dir := t.TempDir()
+	for name, text := range map[string]string{
+		"404.html":  `<h1>{{.Status}} {{.StatusText}}</h1><p>{{.Path}}</p>`,
+		"404.json":  `{"status": {{.Status}}, "path": {{json .Path}}}`,
+		"5xx.html":  `<h1>server error {{.Status}}</h1>`,
+		"500.json":  `{"status": {{.Path}}}`,
+		"style.css": `ignored`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts := newTestServer(t, "--error-pages", dir)
+
+	ts.Get("/files/<b>").Do().Status(404).
+		HeaderIs("Content-Type", "text/html; charset=utf-8").
+		BodyIs("<h1>404 Not Found</h1><p>/files/&lt;b&gt;</p>")
+	ts.Get(`/files/"x"`).Header("Accept", "application/json").Do().Status(404).
+		HeaderIs("Content-Type", "application/json").
+		BodyIs(`{"status": 404, "path": "/files/\"x\""}`)
+	ts.Get("/status/503").Do().Status(503).BodyIs("<h1>server error 503</h1>")
+
+	// No page for the status or its class, and a page rendering invalid
+	// JSON, both fall back to the bodyless response
+	ts.Get("/status/401").Do().Status(401).BodyIs("")
+	ts.Get("/status/500").Header("Accept", "application/json").Do().Status(500).BodyIs("")
+
+	// Bodies handlers write themselves are left alone
+	ts.Get("/echo/x").Do().Status(200).BodyIs("x")
+
+	c := ts.Conn()
+	c.Do(ts.Request("HEAD", "/no-such-route")).Status(404).
+		HeaderIs("Content-Length", "43").BodyIs("")
+	c.Do(ts.Get("/no-such-route")).Status(404).
+		BodyIs("<h1>404 Not Found</h1><p>/no-such-route</p>")
+}
+
+func TestErrorPageNames(t *testing.T) {
+	for name, want := range map[string]bool{
+		"404": true, "4xx": true, "503": true, "5xx": true,
+		"200": false, "3xx": false, "40": false, "4x4": false, "xxx": false,
+	} {
+		if got := isErrorPageName(name); got != want {
+			t.Errorf("isErrorPageName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
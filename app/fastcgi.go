@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Timeouts for talking to a FastCGI backend. As with nginx, a script may
+// go a minute between writes before it's given up on.
+const (
+	fastcgiDialTimeout = 5 * time.Second
+	fastcgiReadTimeout = 60 * time.Second
+)
+
+// FastCGI record types and roles, from the specification
+const (
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+	fcgiResponder    = 1
+
+	// fcgiMaxContent is the most a single record can carry
+	fcgiMaxContent = 65535
+)
+
+// fastcgiRule sends requests matching pattern to a FastCGI backend.
+// A pattern starting "*" matches a file extension anywhere in the path,
+// so /index.php/extra runs index.php with PATH_INFO /extra; otherwise it
+// is a path prefix.
+type fastcgiRule struct {
+	pattern string
+	network string
+	addr    string
+}
+
+// parseFastCGI reads PATTERN=ADDR
+func parseFastCGI(v string) (fastcgiRule, error) {
+	pattern, addr, ok := strings.Cut(v, "=")
+	if !ok || addr == "" || !(strings.HasPrefix(pattern, "*.") || strings.HasPrefix(pattern, "/")) {
+		return fastcgiRule{}, errors.New("must look like *.php=127.0.0.1:9000 or /app/=unix:/run/php-fpm.sock")
+	}
+	network, address := splitListenAddr(addr)
+	return fastcgiRule{pattern: pattern, network: network, addr: address}, nil
+}
+
+// split returns the script part of urlPath and the path info after it,
+// or ok false when the rule doesn't match
+func (r fastcgiRule) split(urlPath string) (script, pathInfo string, ok bool) {
+	ext, isExt := strings.CutPrefix(r.pattern, "*")
+	if !isExt {
+		return urlPath, "", strings.HasPrefix(urlPath, r.pattern)
+	}
+	for i := 0; ; {
+		j := strings.Index(urlPath[i:], ext)
+		if j < 0 {
+			return "", "", false
+		}
+		end := i + j + len(ext)
+		if end == len(urlPath) || urlPath[end] == '/' {
+			return urlPath[:end], urlPath[end:], true
+		}
+		i = end
+	}
+}
+
+// matchFastCGI returns the first rule matching path, if any
+func (s *Server) matchFastCGI(urlPath string) *fastcgiRule {
+	for i := range s.fastcgi {
+		if _, _, ok := s.fastcgi[i].split(urlPath); ok {
+			return &s.fastcgi[i]
+		}
+	}
+	return nil
+}
+
+// serveFastCGI runs req through the rule's backend and relays the response
+func (s *Server) serveFastCGI(w ResponseWriter, req *Request, rule *fastcgiRule) {
+	script, pathInfo, _ := rule.split(cleanURLPath(req.Path))
+	body, length, ok := requestBody(w, req)
+	if !ok {
+		return
+	}
+
+	conn, err := net.DialTimeout(rule.network, rule.addr, fastcgiDialTimeout)
+	if err != nil {
+		req.Logger().Warn("failed to connect to FastCGI backend", "addr", rule.addr, "err", err)
+		sendStatus(w, 502)
+		return
+	}
+	defer conn.Close()
+
+	params := cgiParams(req, s.fastcgiRoot, script, pathInfo, length)
+	if err := writeFastCGIRequest(conn, params, body); err != nil {
+		req.Logger().Warn("failed to send request to FastCGI backend", "addr", rule.addr, "err", err)
+		sendStatus(w, 502)
+		return
+	}
+
+	stdout := &fcgiStdoutReader{conn: conn, log: func(msg string) {
+		req.Logger().Warn("FastCGI stderr", "addr", rule.addr, "msg", msg)
+	}}
+	if err := s.relayCGI(w, req, bufio.NewReader(stdout)); err != nil {
+		req.Logger().Warn("bad response from FastCGI backend", "addr", rule.addr, "err", err)
+	}
+}
+
+// writeFastCGIRequest sends a responder request with params and body
+func writeFastCGIRequest(conn net.Conn, params [][2]string, body io.Reader) error {
+	bw := bufio.NewWriter(conn)
+	// Role responder, and close the connection when done
+	if err := writeFCGIRecord(bw, fcgiBeginRequest, []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0}); err != nil {
+		return err
+	}
+	var buf []byte
+	for _, p := range params {
+		buf = appendFCGILength(buf, len(p[0]))
+		buf = appendFCGILength(buf, len(p[1]))
+		buf = append(buf, p[0]...)
+		buf = append(buf, p[1]...)
+	}
+	if err := writeFCGIStream(bw, fcgiParams, buf); err != nil {
+		return err
+	}
+	chunk := make([]byte, 32<<10)
+	for {
+		n, err := body.Read(chunk)
+		if n > 0 {
+			if err := writeFCGIRecord(bw, fcgiStdin, chunk[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := writeFCGIRecord(bw, fcgiStdin, nil); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// writeFCGIStream writes data as records of type kind, then the empty
+// record that ends the stream
+func writeFCGIStream(w io.Writer, kind byte, data []byte) error {
+	for len(data) > 0 {
+		n := min(len(data), fcgiMaxContent)
+		if err := writeFCGIRecord(w, kind, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return writeFCGIRecord(w, kind, nil)
+}
+
+// writeFCGIRecord writes one record for request ID 1, padded to 8 bytes
+func writeFCGIRecord(w io.Writer, kind byte, content []byte) error {
+	padding := -len(content) & 7
+	header := [8]byte{1, kind, 0, 1, byte(len(content) >> 8), byte(len(content)), byte(padding), 0}
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+	_, err := w.Write(make([]byte, padding))
+	return err
+}
+
+// appendFCGILength encodes a name or value length, in one byte when it fits
+func appendFCGILength(b []byte, n int) []byte {
+	if n < 128 {
+		return append(b, byte(n))
+	}
+	return binary.BigEndian.AppendUint32(b, uint32(n)|1<<31)
+}
+
+// fcgiStdoutReader reads the stdout stream of a response, passing stderr
+// lines to log, until the backend ends the request
+type fcgiStdoutReader struct {
+	conn    net.Conn
+	log     func(string)
+	pending []byte
+	done    bool
+}
+
+func (r *fcgiStdoutReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		_ = r.conn.SetReadDeadline(time.Now().Add(fastcgiReadTimeout))
+		var header [8]byte
+		if _, err := io.ReadFull(r.conn, header[:]); err != nil {
+			return 0, err
+		}
+		length := int(binary.BigEndian.Uint16(header[4:6]))
+		content := make([]byte, length+int(header[6]))
+		if _, err := io.ReadFull(r.conn, content); err != nil {
+			return 0, err
+		}
+		content = content[:length]
+		switch header[1] {
+		case fcgiStdout:
+			r.pending = content
+		case fcgiStderr:
+			if msg := strings.TrimSpace(string(content)); msg != "" {
+				r.log(msg)
+			}
+		case fcgiEndRequest:
+			r.done = true
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,860 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default listen address
+const (
+	defaultHost = "0.0.0.0"
+	defaultPort = 4221
+)
+
+// serverConfig holds everything settable from the command line or a
+// config file
+type serverConfig struct {
+	// given is every flag and config file setting as written, for the
+	// admin API's /config
+	given map[string][]string
+
+	host        string
+	port        int
+	listen      string
+	ipv6Only    bool
+	socketMode  os.FileMode
+	socketOwner string
+	directory   string
+	gzipLevel   int
+
+	reusePort bool
+	acceptors int
+	sockOpts  socketOptions
+
+	cacheRoutes   []string
+	cacheTTL      time.Duration
+	cacheMaxBytes int
+
+	maxInFlight    int
+	maxQueue       int
+	queueTimeout   time.Duration
+	retryAfter     int
+	maxRequestRate *requestRate
+
+	fileChunkSize     int
+	chunkWriteTimeout time.Duration
+	timeouts          phaseTimeouts
+	drainTimeout      time.Duration
+	noKeepAlive       bool
+	showVersion       bool
+	check             bool
+	versionEndpoint   bool
+	metricsEndpoint   bool
+	openAPI           bool
+	swaggerUI         bool
+	maxConnRequests   int
+	maxRate           int64
+	routeRates        []routeRate
+
+	accessLogDest   string
+	accessLogFormat string
+	logLevel        *slog.LevelVar
+	logFormat       string
+	logPath         string
+	logPolicy       rotationPolicy
+
+	otlpEndpoint         string
+	serviceName          string
+	routeStatsInterval   time.Duration
+	slowThreshold        time.Duration
+	traceWire            bool
+	redactHeaders        []string
+	redactParams         []string
+	adminAddr            string
+	adminToken           string
+	blockProfileRate     int
+	mutexProfileFraction int
+
+	tlsCert            string
+	tlsKey             string
+	tlsSelfSigned      bool
+	tlsSelfSignedCache string
+	tlsClientCA        string
+	tlsClientAuth      string
+	tlsPreset          string
+	tlsOverrides       tlsPolicy
+	plainAddr          string
+	redirectAddr       string
+	hstsMaxAge         time.Duration
+
+	acmeDomains   []string
+	acmeEmail     string
+	acmeCache     string
+	acmeDirectory string
+	acmeHTTPAddr  string
+
+	security    *securityPolicy
+	headerRules []headerRule
+	corsConfig  *corsPolicy
+
+	authRules      []basicAuthRule
+	authRealm      string
+	jwtPrefixes    []string
+	jwtSecret      string
+	jwtPublicKey   string
+	jwtJWKS        string
+	jwtIssuer      string
+	jwtAudience    string
+	jwtScope       string
+	apiKeyFile     string
+	apiKeyPrefixes []string
+	apiKeyHeader   string
+	apiKeyParam    string
+	csrfPrefixes   []string
+	csrfSecret     string
+	signingKey     string
+	signedRequired bool
+	trustedProxies []*net.IPNet
+	proxyProtocol  bool
+
+	clientRates      []clientRateRule
+	rateLimitClients int
+	maxConnsPerIP    int
+
+	auditPath  string
+	runAsUser  string
+	runAsGroup string
+	chroot     bool
+	pidFile    string
+	daemon     bool
+	scanners   []UploadScanner
+	denyTypes  []string
+
+	webhooks       []string
+	webhookSecret  string
+	webhookRetries int
+
+	proxies             []proxyConfig
+	proxyStrategy       string
+	proxyMaxIdle        int
+	proxyConnectTimeout time.Duration
+	proxyHealth         healthCheck
+	proxyRecord         string
+	proxyReplay         string
+
+	fastcgi     []fastcgiRule
+	fastcgiRoot string
+	cgiDir      string
+	cgiPrefix   string
+	cgiTimeout  time.Duration
+	cgiMax      int
+
+	plugins   []string
+	stubsPath string
+
+	templateDir    string
+	errorPages     string
+	templateReload bool
+
+	// dev turns on development mode
+	dev bool
+
+	sessions      bool
+	sessionSecret string
+	sessionCookie string
+	sessionTTL    time.Duration
+}
+
+func defaultConfig() *serverConfig {
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = "http-server"
+	}
+	return &serverConfig{
+		host:      defaultHost,
+		port:      defaultPort,
+		gzipLevel: defaultGzipLevel,
+		acceptors: runtime.NumCPU(),
+		sockOpts:  defaultSocketOptions(),
+
+		cacheTTL:      defaultCacheTTL,
+		cacheMaxBytes: defaultCacheMaxBytes,
+		queueTimeout:  defaultQueueTimeout,
+		retryAfter:    defaultRetryAfter,
+
+		fileChunkSize:     defaultFileChunkSize,
+		chunkWriteTimeout: defaultChunkWriteTimeout,
+		drainTimeout:      defaultDrainTimeout,
+		timeouts: phaseTimeouts{
+			idle:    defaultIdleTimeout,
+			header:  defaultHeaderTimeout,
+			body:    defaultBodyTimeout,
+			handler: defaultHandlerTimeout,
+		},
+
+		accessLogDest:   "-",
+		accessLogFormat: "combined",
+		logLevel:        new(slog.LevelVar),
+		logFormat:       "json",
+		otlpEndpoint:    os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		serviceName:     serviceName,
+
+		tlsClientAuth: "require",
+		hstsMaxAge:    -1,
+		acmeCache:     defaultACMECache,
+		acmeDirectory: defaultACMEDirectory,
+		acmeHTTPAddr:  defaultACMEHTTPAddr,
+
+		authRealm:        "Restricted",
+		apiKeyHeader:     "X-API-Key",
+		apiKeyParam:      "api_key",
+		rateLimitClients: defaultRateLimitClients,
+
+		proxyStrategy:       "round-robin",
+		proxyMaxIdle:        defaultProxyMaxIdle,
+		proxyConnectTimeout: defaultProxyConnectTimeout,
+		proxyHealth: healthCheck{
+			interval:       defaultHealthInterval,
+			timeout:        defaultHealthTimeout,
+			healthyAfter:   defaultHealthyAfter,
+			unhealthyAfter: defaultUnhealthyAfter,
+		},
+
+		cgiPrefix:  defaultCGIPrefix,
+		cgiTimeout: defaultCGITimeout,
+		cgiMax:     defaultCGIMax,
+
+		webhookRetries: defaultWebhookRetries,
+
+		sessionCookie: defaultSessionCookie,
+		sessionTTL:    defaultSessionTTL,
+	}
+}
+
+// addr is the main listen address, --listen when given
+func (c *serverConfig) addr() string {
+	if c.listen != "" {
+		return c.listen
+	}
+	return net.JoinHostPort(c.host, strconv.Itoa(c.port))
+}
+
+// newFlagSet registers every command line flag against c
+func (c *serverConfig) newFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("http-server", flag.ContinueOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		writeUsage(out)
+		fmt.Fprintln(out, "\nFlags may be written with one or two dashes. Any flag can also be set")
+		fmt.Fprintln(out, "in the --config file, e.g. \"port: 8080\" or \"tls:\" with \"cert: ...\" below it.")
+		fs.PrintDefaults()
+	}
+
+	fs.BoolVar(&c.showVersion, "version", c.showVersion, "print the version and build details, then exit")
+	fs.BoolVar(&c.check, "check", c.check, "validate the configuration without binding anything, then exit")
+	fs.BoolVar(&c.versionEndpoint, "version-endpoint", c.versionEndpoint, "report the build at /version")
+	fs.BoolVar(&c.metricsEndpoint, "metrics-endpoint", c.metricsEndpoint, "serve Prometheus metrics at /metrics on the public listener, not just the admin one")
+	fs.BoolVar(&c.openAPI, "openapi", c.openAPI, "describe the routes as an OpenAPI 3 document at /openapi.json")
+	fs.BoolVar(&c.swaggerUI, "swagger-ui", c.swaggerUI, "browse the OpenAPI document with Swagger UI at /docs; implies --openapi")
+
+	// Listening and serving
+	fs.Func("host", "`address` to listen on, e.g. 127.0.0.1, ::, or [::1] (default 0.0.0.0)", func(v string) error {
+		// JoinHostPort adds the brackets back for IPv6
+		host := strings.TrimSuffix(strings.TrimPrefix(v, "["), "]")
+		if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+			return errors.New("must be a hostname or IP address")
+		}
+		c.host = host
+		return nil
+	})
+	fs.BoolVar(&c.ipv6Only, "ipv6-only", c.ipv6Only, "keep IPv6 listeners such as --host :: from also accepting IPv4")
+	fs.Func("port", "TCP `port` to listen on, 0 for any free one (default 4221)", func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 65535 {
+			return errors.New("must be between 0 and 65535")
+		}
+		c.port = n
+		return nil
+	})
+	fs.Func("listen", "listen on `addr`, host:port or unix:/path/to.sock, instead of --host and --port", func(v string) error {
+		network, address := splitListenAddr(v)
+		if network == "tcp" {
+			if _, _, err := net.SplitHostPort(address); err != nil {
+				return errors.New("must be host:port or unix:/path")
+			}
+		} else if address == "" {
+			return errors.New("needs a socket path after unix:")
+		}
+		c.listen = v
+		return nil
+	})
+	fs.Func("socket-mode", "octal permission `mode` for unix sockets, e.g. 0660", func(v string) error {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || mode == 0 || mode > 0o777 {
+			return errors.New("must be an octal mode such as 0660")
+		}
+		c.socketMode = os.FileMode(mode)
+		return nil
+	})
+	fs.StringVar(&c.socketOwner, "socket-owner", c.socketOwner, "`user[:group]` to own unix sockets")
+	fs.StringVar(&c.directory, "directory", c.directory, "serve and store /files/ in `dir`")
+	fs.Func("gzip-level", "gzip compression `level` from 1 to 9 (default 6)", func(v string) error {
+		level, err := strconv.Atoi(v)
+		if err != nil || level < gzip.BestSpeed || level > gzip.BestCompression {
+			return errors.New("must be between 1 and 9")
+		}
+		c.gzipLevel = level
+		return nil
+	})
+	fs.BoolVar(&c.reusePort, "reuseport", c.reusePort, "open one SO_REUSEPORT listener per acceptor")
+	fs.Func("acceptors", "`n` accept loops with --reuseport (default the CPU count)", intValue(&c.acceptors, 1))
+	fs.Func("tcp-nodelay", "disable Nagle's algorithm, `true` or false (default true)", func(v string) error {
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		c.sockOpts.noDelay = on
+		return nil
+	})
+	fs.Func("tcp-keepalive", "TCP keep-alive `period`, 0 disables (default 15s)", durationValue(&c.sockOpts.keepAlive, 0))
+	fs.Func("read-buffer", "socket receive buffer `bytes`", intValue(&c.sockOpts.readBuffer, 0))
+	fs.Func("write-buffer", "socket send buffer `bytes`", intValue(&c.sockOpts.writeBuffer, 0))
+	fs.Func("backlog", "accept queue length hint, in `connections`", intValue(&c.sockOpts.backlog, 0))
+
+	// Response cache
+	fs.Func("cache-route", "cache responses under path `prefix` (repeatable)", appendValue(&c.cacheRoutes))
+	fs.Func("cache-ttl", "`duration` cached responses stay fresh (default 1m)", durationValue(&c.cacheTTL, 1))
+	fs.Func("cache-max-bytes", "largest response to cache, in `bytes`", intValue(&c.cacheMaxBytes, 1))
+
+	// Load limits
+	fs.Func("max-in-flight", "`n` requests handled at once, 0 for no limit", intValue(&c.maxInFlight, 0))
+	fs.Func("max-queue", "`n` requests waiting for a slot before shedding with 503", intValue(&c.maxQueue, 0))
+	fs.Func("queue-timeout", "`duration` a request may wait for a slot (default 1s)", durationValue(&c.queueTimeout, 0))
+	fs.Func("retry-after", "Retry-After `seconds` sent with 503s (default 1)", intValue(&c.retryAfter, 0))
+	fs.Func("max-request-rate", "server-wide request `rate` such as 1000/s or 1000/s:200", func(v string) error {
+		rate, err := parseRequestRate(v)
+		if err != nil {
+			return err
+		}
+		c.maxRequestRate = &rate
+		return nil
+	})
+	fs.Func("rate-limit", "per-client request `rate` such as 10/s or 600/m:50", func(v string) error {
+		rate, err := parseRequestRate(v)
+		if err != nil {
+			return err
+		}
+		c.clientRates = append(c.clientRates, clientRateRule{rate: rate})
+		return nil
+	})
+	fs.Func("route-rate-limit", "per-client rate under a prefix, `PREFIX=RATE` (repeatable)", func(v string) error {
+		prefix, rateStr, ok := strings.Cut(v, "=")
+		rate, err := parseRequestRate(rateStr)
+		if !ok || prefix == "" || err != nil {
+			return errors.New("must look like /files/=5/s:10")
+		}
+		c.clientRates = append(c.clientRates, clientRateRule{prefix: prefix, rate: rate})
+		return nil
+	})
+	fs.Func("rate-limit-clients", "`n` clients tracked by the rate limiter (default 10000)", intValue(&c.rateLimitClients, 1))
+	fs.Func("max-conns-per-ip", "`n` open connections allowed per client address", intValue(&c.maxConnsPerIP, 1))
+
+	// Timeouts and transfers
+	fs.Func("idle-timeout", "`duration` a keep-alive connection may wait for its next request, 0 for no limit (default 5s)", durationValue(&c.timeouts.idle, 0))
+	fs.Func("header-timeout", "`duration` allowed to send the request head, 0 for no limit (default 5s)", durationValue(&c.timeouts.header, 0))
+	fs.Func("body-timeout", "`duration` allowed for each read of a request body (default 10s)", durationValue(&c.timeouts.body, 0))
+	fs.Func("read-timeout", "sets both --header-timeout and --body-timeout to `duration`", func(v string) error {
+		if err := durationValue(&c.timeouts.header, 0)(v); err != nil {
+			return err
+		}
+		c.timeouts.body = c.timeouts.header
+		return nil
+	})
+	fs.BoolVar(&c.noKeepAlive, "no-keep-alive", c.noKeepAlive, "close every connection after one response")
+	fs.Func("keep-alive-timeout", "same as --idle-timeout", durationValue(&c.timeouts.idle, 0))
+	fs.Func("max-requests-per-conn", "close connections after `n` responses, 0 for no limit", intValue(&c.maxConnRequests, 0))
+	fs.Func("handler-timeout", "`duration` a handler may take to start its response once the body stops arriving, before a 503, 0 for no limit (default 30s)", durationValue(&c.timeouts.handler, 0))
+	fs.Func("write-timeout", "same as --chunk-timeout", durationValue(&c.chunkWriteTimeout, 1))
+	fs.Func("drain-timeout", "`duration` requests in flight get to finish on shutdown, 0 for no limit (default 30s)", durationValue(&c.drainTimeout, 0))
+	fs.Func("file-chunk-size", "`bytes` per chunk when streaming files", intValue(&c.fileChunkSize, 1))
+	fs.Func("chunk-timeout", "`duration` allowed for each write of a response (default 5s)", durationValue(&c.chunkWriteTimeout, 1))
+	fs.Func("max-rate", "per-connection response `rate` such as 10MB/s", func(v string) error {
+		rate, err := parseRate(v)
+		if err != nil {
+			return err
+		}
+		c.maxRate = rate
+		return nil
+	})
+	fs.Func("route-rate", "response rate under a prefix, `PREFIX=RATE` (repeatable)", func(v string) error {
+		prefix, rateStr, ok := strings.Cut(v, "=")
+		rate, err := parseRate(rateStr)
+		if !ok || prefix == "" || err != nil {
+			return errors.New("must look like /files/=1MB/s")
+		}
+		c.routeRates = append(c.routeRates, routeRate{prefix: prefix, rate: rate})
+		return nil
+	})
+
+	// Logging and observability
+	fs.StringVar(&c.accessLogDest, "access-log", c.accessLogDest, "access log `file`, - for stdout, or off")
+	fs.Func("access-log-format", "`format`, common or combined (default combined)", oneOf(&c.accessLogFormat, "common", "combined"))
+	fs.Func("log-level", "`level`, debug, info, warn, or error (default info)", func(v string) error {
+		level, err := parseLogLevel(v)
+		if err != nil {
+			return errors.New("must be debug, info, warn, or error")
+		}
+		c.logLevel.Set(level)
+		return nil
+	})
+	fs.Func("log-format", "`format`, json or text (default json)", oneOf(&c.logFormat, "json", "text"))
+	fs.StringVar(&c.logPath, "log-file", c.logPath, "write the server log to `file` instead of stderr")
+	fs.Func("log-max-size", "rotate log files at this `size`, e.g. 100MB", func(v string) error {
+		size, err := parseSize(v)
+		if err != nil {
+			return err
+		}
+		c.logPolicy.maxSize = size
+		return nil
+	})
+	fs.Func("log-rotate-every", "rotate log files at this `interval`, e.g. 24h", durationValue(&c.logPolicy.interval, 0))
+	fs.Func("log-max-backups", "`n` rotated log files to keep", intValue(&c.logPolicy.maxBackups, 0))
+	fs.StringVar(&c.auditPath, "audit-log", c.auditPath, "append file changes to `file`")
+	fs.StringVar(&c.otlpEndpoint, "otlp-endpoint", c.otlpEndpoint, "export spans to this OTLP/HTTP `url`")
+	fs.StringVar(&c.serviceName, "service-name", c.serviceName, "service.name reported with spans")
+	fs.Func("route-stats-interval", "log per-route latency figures every `interval`", durationValue(&c.routeStatsInterval, 0))
+	fs.Func("slow-request-threshold", "log requests taking at least `duration`", durationValue(&c.slowThreshold, 0))
+	fs.BoolVar(&c.traceWire, "trace-wire", c.traceWire, "log every byte read and written, secrets redacted")
+	fs.Func("redact-header", "also redact this header `name` in logs (repeatable)", appendValue(&c.redactHeaders))
+	fs.Func("redact-param", "also redact this query parameter `name` in logs (repeatable)", appendValue(&c.redactParams))
+	fs.StringVar(&c.adminAddr, "admin-addr", c.adminAddr, "serve the admin API, /metrics, and /debug/pprof/ on `addr`")
+	fs.StringVar(&c.adminToken, "admin-token", c.adminToken, "require `token` as a bearer token on the admin listener")
+	fs.Func("block-profile-rate", "runtime block profile `rate`", intValue(&c.blockProfileRate, 0))
+	fs.Func("mutex-profile-fraction", "runtime mutex profile `fraction`", intValue(&c.mutexProfileFraction, 0))
+
+	// TLS
+	fs.StringVar(&c.tlsCert, "tls-cert", c.tlsCert, "serve HTTPS with this certificate `file`")
+	fs.StringVar(&c.tlsKey, "tls-key", c.tlsKey, "private key `file` for --tls-cert")
+	fs.BoolVar(&c.tlsSelfSigned, "tls-self-signed", c.tlsSelfSigned, "serve HTTPS with a generated self-signed certificate")
+	fs.StringVar(&c.tlsSelfSignedCache, "tls-self-signed-cache", c.tlsSelfSignedCache, "keep the self-signed certificate in `dir`")
+	fs.StringVar(&c.tlsClientCA, "tls-client-ca", c.tlsClientCA, "verify client certificates against this CA `file`")
+	fs.Func("tls-client-auth", "client certificate `mode`, require, verify-if-given, or none (default require)", func(v string) error {
+		if _, err := parseClientAuth(v); err != nil {
+			return errors.New("must be require, verify-if-given, or none")
+		}
+		c.tlsClientAuth = v
+		return nil
+	})
+	fs.Func("tls-policy", "TLS `preset`, modern or intermediate", func(v string) error {
+		if _, ok := tlsPresets[v]; !ok {
+			return errors.New("must be modern or intermediate")
+		}
+		c.tlsPreset = v
+		return nil
+	})
+	fs.Func("tls-min-version", "lowest TLS `version`, 1.2 or 1.3", tlsVersionValue(&c.tlsOverrides.minVersion))
+	fs.Func("tls-max-version", "highest TLS `version`, 1.2 or 1.3", tlsVersionValue(&c.tlsOverrides.maxVersion))
+	fs.Func("tls-ciphers", "comma-separated TLS 1.2 cipher `suites`", func(v string) error {
+		suites, err := parseCipherSuites(v)
+		if err != nil {
+			return err
+		}
+		c.tlsOverrides.cipherSuites = suites
+		return nil
+	})
+	fs.Func("tls-curves", "comma-separated key exchange `curves`", func(v string) error {
+		curves, err := parseCurves(v)
+		if err != nil {
+			return err
+		}
+		c.tlsOverrides.curves = curves
+		return nil
+	})
+	fs.StringVar(&c.plainAddr, "plain-addr", c.plainAddr, "also serve plain HTTP on `addr`")
+	fs.StringVar(&c.redirectAddr, "redirect-addr", c.redirectAddr, "redirect plain HTTP on `addr` to HTTPS")
+	fs.Func("hsts-max-age", "Strict-Transport-Security max-age `duration`, 0 disables", durationValue(&c.hstsMaxAge, 0))
+	fs.Func("acme-domain", "get a certificate for `domain` from ACME (repeatable, or comma-separated)", func(v string) error {
+		for _, domain := range strings.Split(v, ",") {
+			if domain = strings.TrimSpace(domain); domain != "" {
+				c.acmeDomains = append(c.acmeDomains, domain)
+			}
+		}
+		return nil
+	})
+	fs.StringVar(&c.acmeEmail, "acme-email", c.acmeEmail, "contact `address` for the ACME account")
+	fs.StringVar(&c.acmeCache, "acme-cache", c.acmeCache, "keep ACME keys and certificates in `dir`")
+	fs.StringVar(&c.acmeDirectory, "acme-directory", c.acmeDirectory, "ACME directory `url`")
+	fs.StringVar(&c.acmeHTTPAddr, "acme-http-addr", c.acmeHTTPAddr, "answer HTTP-01 challenges on `addr`")
+
+	// Response headers
+	fs.BoolFunc("security-headers", "send the default security headers", func(v string) error {
+		on, err := strconv.ParseBool(v)
+		if on {
+			c.securityPolicy()
+		}
+		return err
+	})
+	fs.Func("security-header", "set a security header, `\"Name: value\"` (repeatable)", func(v string) error {
+		h, err := parseHeaderSetting(v)
+		if err != nil {
+			return err
+		}
+		c.securityPolicy().set(h)
+		return nil
+	})
+	fs.Func("route-security-header", "set a security header under a prefix, `PREFIX=Name: value` (repeatable)", func(v string) error {
+		prefix, setting, ok := strings.Cut(v, "=")
+		h, err := parseHeaderSetting(setting)
+		if !ok || prefix == "" || err != nil {
+			return errors.New("must look like \"/files/=Content-Security-Policy: sandbox\"")
+		}
+		c.securityPolicy().setRoute(prefix, h)
+		return nil
+	})
+	fs.Func("add-header", "add a header under a prefix unless the handler set it, `PREFIX=Name: value` (repeatable)", func(v string) error {
+		r, err := parseHeaderRule(v, false)
+		if err != nil {
+			return err
+		}
+		c.headerRules = append(c.headerRules, r)
+		return nil
+	})
+	fs.Func("set-header", "set a header under a prefix, replacing the handler's, `PREFIX=Name: value` (repeatable)", func(v string) error {
+		r, err := parseHeaderRule(v, true)
+		if err != nil {
+			return err
+		}
+		c.headerRules = append(c.headerRules, r)
+		return nil
+	})
+	fs.Func("cors-origin", "allow cross-origin requests from `origin`, * for any (repeatable)", func(v string) error {
+		p := c.corsPolicy()
+		p.origins = append(p.origins, strings.TrimSuffix(v, "/"))
+		return nil
+	})
+	fs.Func("cors-methods", "`methods` allowed cross-origin (default \"GET, HEAD, POST\")", func(v string) error {
+		c.corsPolicy().methods = v
+		return nil
+	})
+	fs.Func("cors-headers", "request `headers` allowed cross-origin (default those asked for)", func(v string) error {
+		c.corsPolicy().headers = v
+		return nil
+	})
+	fs.Func("cors-expose-headers", "response `headers` exposed cross-origin", func(v string) error {
+		c.corsPolicy().expose = v
+		return nil
+	})
+	fs.BoolFunc("cors-credentials", "allow credentialed cross-origin requests", func(v string) error {
+		on, err := strconv.ParseBool(v)
+		if on {
+			c.corsPolicy().credentials = true
+		}
+		return err
+	})
+	fs.Func("cors-max-age", "`seconds` browsers may cache a preflight", func(v string) error {
+		return intValue(&c.corsPolicy().maxAge, 0)(v)
+	})
+
+	// Authentication and access control
+	fs.Func("basic-auth", "require Basic auth under a prefix, `PREFIX=HTPASSWD` (repeatable)", func(v string) error {
+		prefix, path, ok := strings.Cut(v, "=")
+		if !ok || prefix == "" || path == "" {
+			return errors.New("must look like /files/=/etc/server/htpasswd")
+		}
+		users, err := loadHtpasswd(path)
+		if err != nil {
+			return err
+		}
+		c.authRules = append(c.authRules, basicAuthRule{prefix: prefix, users: users})
+		return nil
+	})
+	fs.StringVar(&c.authRealm, "basic-auth-realm", c.authRealm, "realm sent in Basic auth challenges")
+	fs.Func("jwt-protect", "require a bearer JWT under path `prefix` (repeatable)", appendValue(&c.jwtPrefixes))
+	fs.StringVar(&c.jwtSecret, "jwt-secret", c.jwtSecret, "HS256 `secret`")
+	fs.StringVar(&c.jwtPublicKey, "jwt-public-key", c.jwtPublicKey, "RS256 public key PEM `file`")
+	fs.StringVar(&c.jwtJWKS, "jwt-jwks-url", c.jwtJWKS, "fetch RS256 keys from this JWKS `url`")
+	fs.StringVar(&c.jwtIssuer, "jwt-issuer", c.jwtIssuer, "required iss claim")
+	fs.StringVar(&c.jwtAudience, "jwt-audience", c.jwtAudience, "required aud claim")
+	fs.StringVar(&c.jwtScope, "jwt-scope", c.jwtScope, "required scope")
+	fs.StringVar(&c.apiKeyFile, "api-keys", c.apiKeyFile, "API key `file`, lines of KEY LABEL [RATE]")
+	fs.Func("api-key-protect", "require an API key under path `prefix` (repeatable)", appendValue(&c.apiKeyPrefixes))
+	fs.StringVar(&c.apiKeyHeader, "api-key-header", c.apiKeyHeader, "header carrying the API key")
+	fs.StringVar(&c.apiKeyParam, "api-key-param", c.apiKeyParam, "query parameter carrying the API key, empty to disable")
+	fs.Func("csrf-protect", "require CSRF tokens under path `prefix` (repeatable)", appendValue(&c.csrfPrefixes))
+	fs.StringVar(&c.csrfSecret, "csrf-secret", c.csrfSecret, "key signing CSRF tokens (default random per start)")
+	fs.StringVar(&c.signingKey, "url-signing-key", c.signingKey, "accept signed /files/ links made with `key`")
+	fs.BoolVar(&c.signedRequired, "signed-urls-required", c.signedRequired, "serve /files/ only through signed links")
+	fs.BoolVar(&c.sessions, "sessions", c.sessions, "keep cookie-based sessions for handlers and plugins")
+	fs.StringVar(&c.sessionSecret, "session-secret", c.sessionSecret, "key signing session IDs (default random per start)")
+	fs.StringVar(&c.sessionCookie, "session-cookie", c.sessionCookie, "session cookie `name`")
+	fs.Func("session-ttl", "`duration` a session lasts without a request (default 24h)", durationValue(&c.sessionTTL, 1))
+	fs.Func("trusted-proxy", "take the client address from Forwarded or X-Forwarded-For when the peer is in `CIDR` (repeatable)", func(v string) error {
+		n, err := parseTrustedProxy(v)
+		if err != nil {
+			return errors.New("must be an address or CIDR such as 10.0.0.0/8")
+		}
+		c.trustedProxies = append(c.trustedProxies, n)
+		return nil
+	})
+	fs.BoolVar(&c.proxyProtocol, "proxy-protocol", c.proxyProtocol, "expect a PROXY protocol v1 or v2 header on every HTTP connection, taking the client address from it")
+
+	// Uploads
+	fs.Func("upload-deny-type", "refuse uploads sniffed as this content `type` (repeatable)", appendValue(&c.denyTypes))
+	fs.Func("upload-deny-pattern", "refuse uploads matching `regexp` (repeatable)", func(v string) error {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return err
+		}
+		c.scanners = append(c.scanners, denyPattern(re))
+		return nil
+	})
+	fs.Func("upload-scan-command", "pipe uploads into `command`, refusing them if it fails (repeatable)", func(v string) error {
+		if strings.TrimSpace(v) == "" {
+			return errors.New("needs a command")
+		}
+		c.scanners = append(c.scanners, scanCommand(v))
+		return nil
+	})
+	fs.Func("webhook", "POST a JSON event to `url` for each upload and delete (repeatable)", func(v string) error {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("must be an http:// or https:// URL")
+		}
+		c.webhooks = append(c.webhooks, v)
+		return nil
+	})
+	fs.StringVar(&c.webhookSecret, "webhook-secret", c.webhookSecret, "sign webhook bodies with HMAC-SHA256 using `key`")
+	fs.Func("webhook-retries", "`n` retries for a failed webhook delivery (default 5)", intValue(&c.webhookRetries, 0))
+
+	// Reverse proxy
+	fs.Func("proxy", "forward requests under a prefix, `PREFIX=URL[,URL...]` (repeatable)", func(v string) error {
+		pc, err := parseProxy(v)
+		if err != nil {
+			return err
+		}
+		c.proxies = append(c.proxies, pc)
+		return nil
+	})
+	fs.Func("proxy-strategy", "`strategy` for picking an upstream, round-robin, least-conn, or hash (default round-robin)",
+		oneOf(&c.proxyStrategy, "round-robin", "least-conn", "hash"))
+	fs.Func("proxy-max-idle", "`n` idle connections kept per upstream (default 16)", intValue(&c.proxyMaxIdle, 0))
+	fs.Func("proxy-connect-timeout", "`duration` allowed to connect to an upstream (default 5s)", durationValue(&c.proxyConnectTimeout, 1))
+	fs.Func("proxy-health-path", "probe each upstream at `path`, ejecting it while it fails", func(v string) error {
+		if !strings.HasPrefix(v, "/") {
+			return errors.New("must be a path such as /healthz")
+		}
+		c.proxyHealth.path = v
+		return nil
+	})
+	fs.Func("proxy-health-interval", "`duration` between health probes (default 10s)", durationValue(&c.proxyHealth.interval, 1))
+	fs.Func("proxy-health-timeout", "`duration` a health probe may take (default 2s)", durationValue(&c.proxyHealth.timeout, 1))
+	fs.Func("proxy-healthy-threshold", "`n` passed probes in a row to return an upstream (default 2)", intValue(&c.proxyHealth.healthyAfter, 1))
+	fs.Func("proxy-unhealthy-threshold", "`n` failed probes in a row to eject an upstream (default 3)", intValue(&c.proxyHealth.unhealthyAfter, 1))
+	fs.StringVar(&c.proxyRecord, "proxy-record", c.proxyRecord, "save every upstream response in `dir`, keyed by method, target, and body")
+	fs.StringVar(&c.proxyReplay, "proxy-replay", c.proxyReplay, "answer proxied requests from responses saved in `dir` with --proxy-record, never contacting upstreams")
+
+	// FastCGI
+	fs.Func("fastcgi", "run matching requests on a FastCGI backend, `PATTERN=ADDR` such as *.php=127.0.0.1:9000 (repeatable)", func(v string) error {
+		rule, err := parseFastCGI(v)
+		if err != nil {
+			return err
+		}
+		c.fastcgi = append(c.fastcgi, rule)
+		return nil
+	})
+	fs.StringVar(&c.fastcgiRoot, "fastcgi-root", c.fastcgiRoot, "document root `dir` as the FastCGI backend sees it (default --directory)")
+
+	// CGI
+	fs.StringVar(&c.cgiDir, "cgi-dir", c.cgiDir, "run CGI scripts from `dir`")
+	fs.Func("cgi-prefix", "URL `prefix` CGI scripts are served under (default /cgi-bin/)", func(v string) error {
+		if !strings.HasPrefix(v, "/") || !strings.HasSuffix(v, "/") {
+			return errors.New("must start and end with /")
+		}
+		c.cgiPrefix = v
+		return nil
+	})
+	fs.Func("cgi-timeout", "`duration` a CGI script may run before it's killed (default 30s)", durationValue(&c.cgiTimeout, 1))
+	fs.Func("cgi-max", "`n` CGI scripts run at once (default 16)", intValue(&c.cgiMax, 1))
+
+	// Templates
+	fs.StringVar(&c.templateDir, "templates", c.templateDir, "load HTML page templates from `dir`")
+	fs.BoolVar(&c.templateReload, "templates-reload", c.templateReload, "reparse templates when they change, for development")
+	fs.StringVar(&c.errorPages, "error-pages", c.errorPages, "answer error statuses with the templates in `dir`, named e.g. 404.html, 5xx.json")
+
+	// Development
+	fs.BoolVar(&c.dev, "dev", c.dev, "development mode: reload changed config and templates, disable caching, and log every request in detail")
+
+	// Stubs
+	fs.StringVar(&c.stubsPath, "stubs", c.stubsPath, "answer requests with the canned responses in JSON `file`, reloaded when it changes")
+
+	// Plugins
+	fs.Func("plugin", "load a Go plugin .so `file` (repeatable)", appendValue(&c.plugins))
+
+	// Process
+	fs.StringVar(&c.runAsUser, "user", c.runAsUser, "switch to `user` after binding")
+	fs.StringVar(&c.runAsGroup, "group", c.runAsGroup, "switch to `group` after binding")
+	fs.BoolVar(&c.chroot, "chroot", c.chroot, "chroot into --directory after binding")
+	fs.StringVar(&c.pidFile, "pid-file", c.pidFile, "write the process ID to `file` while running")
+	fs.BoolVar(&c.daemon, "daemon", c.daemon, "detach and run in the background once serving")
+	return fs
+}
+
+// parseFlags reads the command line into a config
+func parseFlags(args []string) (*serverConfig, error) {
+	c := defaultConfig()
+	fs := c.newFlagSet()
+	fs.String("config", "", "read settings from `file`; command line flags take precedence")
+	var settings []configSetting
+	if path := configPath(args); path != "" {
+		var err error
+		settings, err = readConfigFile(path)
+		if err == nil {
+			err = applySettings(fs, settings, path)
+		}
+		if err != nil {
+			fmt.Fprintln(fs.Output(), err)
+			return nil, err
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	c.timeouts.write = c.chunkWriteTimeout
+	c.given = givenSettings(fs, settings, args)
+	return c, nil
+}
+
+// applySettings sets each config file value as if given as a flag
+func applySettings(fs *flag.FlagSet, settings []configSetting, path string) error {
+	for _, setting := range settings {
+		if setting.name == "config" || fs.Lookup(setting.name) == nil {
+			return fmt.Errorf("%s:%d: unknown setting %s", path, setting.line, setting.name)
+		}
+		if err := fs.Set(setting.name, setting.value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value %q for %s: %v", path, setting.line, setting.value, setting.name, err)
+		}
+	}
+	return nil
+}
+
+// recordedValue notes the values a flag is given
+type recordedValue struct {
+	name   string
+	isBool bool
+	given  map[string][]string
+}
+
+func (v *recordedValue) Set(s string) error {
+	v.given[v.name] = append(v.given[v.name], s)
+	return nil
+}
+
+func (v *recordedValue) String() string   { return "" }
+func (v *recordedValue) IsBoolFlag() bool { return v.isBool }
+
+// givenSettings lists every setting as written, config file values first,
+// by parsing args again into a copy of fs that only records. fs has already
+// validated everything.
+func givenSettings(fs *flag.FlagSet, settings []configSetting, args []string) map[string][]string {
+	given := make(map[string][]string)
+	for _, setting := range settings {
+		given[setting.name] = append(given[setting.name], setting.value)
+	}
+	rec := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	rec.SetOutput(io.Discard)
+	fs.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		rec.Var(&recordedValue{name: f.Name, isBool: ok && b.IsBoolFlag(), given: given}, f.Name, "")
+	})
+	_ = rec.Parse(args)
+	return given
+}
+
+func (c *serverConfig) securityPolicy() *securityPolicy {
+	if c.security == nil {
+		c.security = newSecurityPolicy()
+	}
+	return c.security
+}
+
+func (c *serverConfig) corsPolicy() *corsPolicy {
+	if c.corsConfig == nil {
+		c.corsConfig = newCORSPolicy()
+	}
+	return c.corsConfig
+}
+
+// intValue parses an integer of at least min into p
+func intValue(p *int, min int) func(string) error {
+	return func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < min {
+			return fmt.Errorf("must be a number no less than %d", min)
+		}
+		*p = n
+		return nil
+	}
+}
+
+// durationValue parses a duration of at least min into p
+func durationValue(p *time.Duration, min time.Duration) func(string) error {
+	return func(v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < min {
+			if min > 0 {
+				return errors.New("must be a positive duration such as 5s")
+			}
+			return errors.New("must be a duration such as 5s")
+		}
+		*p = d
+		return nil
+	}
+}
+
+// appendValue collects every use of a repeatable flag into p
+func appendValue(p *[]string) func(string) error {
+	return func(v string) error {
+		*p = append(*p, v)
+		return nil
+	}
+}
+
+// oneOf accepts only the listed values
+func oneOf(p *string, values ...string) func(string) error {
+	return func(v string) error {
+		for _, allowed := range values {
+			if v == allowed {
+				*p = v
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s", strings.Join(values, ", "))
+	}
+}
+
+func tlsVersionValue(p *uint16) func(string) error {
+	return func(v string) error {
+		version, err := parseTLSVersion(v)
+		if err != nil {
+			return err
+		}
+		*p = version
+		return nil
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// parseTrustedProxy reads a CIDR, or a single address
+func parseTrustedProxy(v string) (*net.IPNet, error) {
+	if !strings.Contains(v, "/") {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "IP address", Text: v}
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(v)
+	return n, err
+}
+
+// trusted reports whether ip is a proxy allowed to say who its client is
+func (s *Server) trusted(ip net.IP) bool {
+	for _, n := range s.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClient returns the client address a trusted proxy passed on in
+// Forwarded, or failing that X-Forwarded-For, or "" when the peer isn't
+// trusted or sent neither. The list is walked from the right, since only
+// the entries added by trusted proxies can be believed: the first
+// untrusted one is the client.
+func (s *Server) forwardedClient(req *Request) string {
+	peer := net.ParseIP(peerIP(req))
+	if peer == nil || !s.trusted(peer) {
+		return ""
+	}
+	hops := forwardedFor(req)
+	if hops == nil {
+		hops = xForwardedFor(req)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// An obfuscated or "unknown" hop hides everything before it
+			return ""
+		}
+		if i == 0 || !s.trusted(ip) {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// forwardedFor lists the for= addresses of every Forwarded header, in order
+func forwardedFor(req *Request) []string {
+	var hops []string
+	for _, h := range req.Headers() {
+		if !strings.EqualFold(h[0], "Forwarded") {
+			continue
+		}
+		for _, elem := range strings.Split(h[1], ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(name, "for") {
+					continue
+				}
+				hops = append(hops, forwardedNode(value))
+			}
+		}
+	}
+	return hops
+}
+
+// forwardedNode strips the quotes, brackets, and port from a Forwarded
+// node such as "[2001:db8::1]:4711"
+func forwardedNode(v string) string {
+	v = strings.Trim(v, `"`)
+	if strings.HasPrefix(v, "[") {
+		if end := strings.IndexByte(v, ']'); end > 0 {
+			return v[1:end]
+		}
+		return v
+	}
+	if net.ParseIP(v) != nil {
+		return v
+	}
+	if host, _, ok := strings.Cut(v, ":"); ok {
+		return host
+	}
+	return v
+}
+
+// xForwardedFor lists the addresses of every X-Forwarded-For header, in order
+func xForwardedFor(req *Request) []string {
+	var hops []string
+	for _, h := range req.Headers() {
+		if !strings.EqualFold(h[0], "X-Forwarded-For") {
+			continue
+		}
+		for _, ip := range strings.Split(h[1], ",") {
+			hops = append(hops, strings.TrimSpace(ip))
+		}
+	}
+	return hops
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The seeds below and in testdata/fuzz cover malformed requests seen in the
+// wild and in smuggling write-ups. Run a target with e.g.
+//
+//	go test -run '^$' -fuzz FuzzRequestLine -fuzztime 1m .
+
+func FuzzRequestLine(f *testing.F) {
+	for _, seed := range []string{
+		"GET / HTTP/1.1",
+		"GET /echo/abc?x=1 HTTP/1.1",
+		"get / http/1.1",
+		"GET  /  HTTP/1.1",
+		"GET\t/\tHTTP/1.0",
+		"GET /",
+		"GET / HTTP/1.1 extra",
+		"GET / FTP/1.0",
+		"\x00GET / HTTP/1.1",
+		"GET /\r HTTP/1.1",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, line []byte) {
+		var req Request
+		data := append(append([]byte{}, line...), "\r\nHost: x\r\n\r\n"...)
+		if err := readRequest(bufio.NewReader(bytes.NewReader(data)), &req); err != nil {
+			return
+		}
+		if req.Method == "" || !strings.HasPrefix(req.Version, "HTTP/") {
+			t.Fatalf("accepted request line %q as %q %q", line, req.Method, req.Version)
+		}
+		target := req.Path
+		if strings.Contains(req.Target, "?") {
+			target += "?" + req.RawQuery
+		}
+		if target != req.Target {
+			t.Fatalf("target %q split into %q and %q", req.Target, req.Path, req.RawQuery)
+		}
+		if strings.ContainsAny(req.Method+req.Target+req.Version, " \t\n") {
+			t.Fatalf("request line %q parsed with whitespace in a field", line)
+		}
+	})
+}
+
+func FuzzRequestHeaders(f *testing.F) {
+	for _, seed := range []string{
+		"Host: x",
+		"Host:x\r\nUser-Agent: a b c ",
+		"Host : x",
+		" Host: x",
+		"Host: x\r\n\tfolded",
+		"No-Colon",
+		": empty-name",
+		"Content-Length: 5\r\nContent-Length: 6",
+		"Transfer-Encoding: chunked\r\nContent-Length: 3",
+		"X: \x00\x7f\xff",
+		"X: a\rb",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, headers []byte) {
+		var req Request
+		data := append(append([]byte("GET / HTTP/1.1\r\n"), headers...), "\r\n\r\n"...)
+		if err := readRequest(bufio.NewReader(bytes.NewReader(data)), &req); err != nil {
+			return
+		}
+		for _, h := range req.Headers() {
+			name, value := h[0], h[1]
+			if name == "" || strings.ContainsAny(name, ":\n") || strings.Contains(value, "\n") {
+				t.Fatalf("header %q: %q parsed from %q", name, value, headers)
+			}
+			if strings.Trim(name, " \t") != name {
+				t.Fatalf("header name %q keeps surrounding whitespace", name)
+			}
+			if strings.Trim(value, " \t") != value {
+				t.Fatalf("header value %q keeps surrounding whitespace", value)
+			}
+			if _, ok := req.LookupHeader(name); !ok {
+				t.Fatalf("header %q listed but not found", name)
+			}
+		}
+	})
+}
+
+func FuzzChunkedBody(f *testing.F) {
+	for _, seed := range []string{
+		"0\r\n\r\n",
+		"5\r\nhello\r\n0\r\n\r\n",
+		"5;ext=1\r\nhello\r\n0\r\nTrailer: x\r\n\r\n",
+		"5\nhello\n0\n\n",
+		"5\r\nhelloXX0\r\n\r\n",
+		"-1\r\n",
+		"fffffffffffffffff\r\n",
+		"7fffffffffffffff\r\n",
+		"0x5\r\nhello\r\n0\r\n\r\n",
+		" 5\r\nhello\r\n0\r\n\r\n",
+		"5\r\nhel",
+	} {
+		f.Add([]byte(seed), int64(64))
+	}
+	f.Fuzz(func(t *testing.T, data []byte, limit int64) {
+		if limit < 0 {
+			limit = -limit
+		}
+		body, err := io.ReadAll(newChunkedReader(bufio.NewReader(bytes.NewReader(data)), limit))
+		if int64(len(body)) > limit || len(body) > len(data) {
+			t.Fatalf("decoded %d bytes from %d with limit %d", len(body), len(data), limit)
+		}
+		if err != nil {
+			return
+		}
+
+		// Whatever decoded must decode the same once re-encoded
+		var enc bytes.Buffer
+		for rest := body; len(rest) > 0; {
+			n := min(len(rest), 7)
+			enc.WriteString(strconv.FormatInt(int64(n), 16) + "\r\n")
+			enc.Write(rest[:n])
+			enc.WriteString("\r\n")
+			rest = rest[n:]
+		}
+		enc.WriteString("0\r\n\r\n")
+		again, err := io.ReadAll(newChunkedReader(bufio.NewReader(&enc), limit))
+		if err != nil || !bytes.Equal(again, body) {
+			t.Fatalf("re-encoded body %q decoded to %q, %v", body, again, err)
+		}
+	})
+}
+
+func FuzzParseRange(f *testing.F) {
+	for _, seed := range []string{
+		"bytes=0-0",
+		"bytes=0-",
+		"bytes=-5",
+		"bytes=5-1",
+		"bytes=0-1,3-4,-1",
+		"bytes=-0",
+		"bytes=100-",
+		"bytes= 1 - 2 ",
+		"bytes=9223372036854775807-",
+		"bytes=0-9223372036854775807",
+		"items=0-1",
+		"bytes=0-1,0-1,0-1,0-1,0-1,0-1,0-1,0-1,0-1,0-1,0-1,0-1,0-1,0-1,0-1,0-1,0-1",
+	} {
+		f.Add(seed, int64(26))
+	}
+	f.Fuzz(func(t *testing.T, header string, size int64) {
+		if size < 0 {
+			return
+		}
+		ranges, err := parseRange(header, size)
+		if err != nil {
+			if !errors.Is(err, errUnsatisfiable) || ranges != nil {
+				t.Fatalf("parseRange(%q, %d) = %v, %v", header, size, ranges, err)
+			}
+			return
+		}
+		if len(ranges) > maxRanges {
+			t.Fatalf("parseRange(%q, %d) gave %d ranges", header, size, len(ranges))
+		}
+		for _, r := range ranges {
+			if r.start < 0 || r.length <= 0 || r.start+r.length > size {
+				t.Fatalf("parseRange(%q, %d) gave %+v", header, size, r)
+			}
+		}
+	})
+}
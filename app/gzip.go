@@ -0,0 +1,48 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"strings"
+	"sync"
+)
+
+// defaultGzipLevel matches gzip.DefaultCompression's effective level
+const defaultGzipLevel = 6
+
+// gzipPool hands out gzip writers for a single compression level,
+// resetting them onto the destination instead of allocating new ones
+type gzipPool struct {
+	level int
+	pool  sync.Pool
+}
+
+func newGzipPool(level int) *gzipPool {
+	p := &gzipPool{level: level}
+	p.pool.New = func() any {
+		// Level is validated at startup, so this can't fail
+		gw, _ := gzip.NewWriterLevel(nil, level)
+		return gw
+	}
+	return p
+}
+
+func (p *gzipPool) Get(w io.Writer) *gzip.Writer {
+	gw := p.pool.Get().(*gzip.Writer)
+	gw.Reset(w)
+	return gw
+}
+
+func (p *gzipPool) Put(gw *gzip.Writer) {
+	gw.Reset(nil)
+	p.pool.Put(gw)
+}
+
+// negotiateEncoding picks the content encoding for a response based on the
+// request's Accept-Encoding header, returning "" for identity
+func negotiateEncoding(req *Request) string {
+	if strings.Contains(req.Header("Accept-Encoding"), "gzip") {
+		return "gzip"
+	}
+	return ""
+}
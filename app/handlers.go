@@ -0,0 +1,414 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// handleRequest routes a single request to its handler, through any
+// middleware
+func (s *Server) handleRequest(w ResponseWriter, req *Request) {
+	// Routes and middleware match on the cleaned path, so dot segments
+	// can't step a request around a prefix, e.g. out from under an auth rule
+	if strings.HasPrefix(req.Path, "/") {
+		req.Path = cleanURLPath(req.Path)
+	}
+	if p := s.matchProxy(req.Path); p != nil {
+		req.Route, req.pathParam, req.pathValue = p.route, "path", strings.TrimPrefix(req.Path, p.prefix)
+		req.handler = p.handler
+	} else if rule := s.matchFastCGI(req.Path); rule != nil {
+		req.Route = rule.pattern
+		req.handler = func(s *Server, w ResponseWriter, req *Request) { s.serveFastCGI(w, req, rule) }
+	} else if s.cgi != nil && strings.HasPrefix(req.Path, s.cgi.prefix) {
+		req.Route = s.cgi.prefix + "{script}"
+		req.handler = s.cgi.serve
+	} else if sb, value := s.matchStub(req); sb != nil {
+		req.Route, req.pathParam, req.pathValue = sb.Path, sb.route.param, value
+		req.handler = sb.serve
+	} else if r, value := matchRouteIn(s.pluginRoutes, req.Path); r != nil {
+		req.Route, req.pathParam, req.pathValue = r.pattern, r.param, value
+		req.handler = r.handler
+	} else if r, value := matchRoute(req.Path); r != nil {
+		req.Route, req.pathParam, req.pathValue = r.pattern, r.param, value
+		req.handler = r.handler
+	} else {
+		req.Route = unmatchedRoute
+		req.handler = (*Server).handleNotFound
+	}
+	if chain := s.settings().chain; chain != nil {
+		chain(s, w, req)
+		return
+	}
+	callRoute(s, w, req)
+}
+
+// handleNotFound answers requests that matched no route
+func (s *Server) handleNotFound(w ResponseWriter, req *Request) {
+	sendStatus(w, 404)
+}
+
+func (s *Server) handleRoot(w ResponseWriter, req *Request) {
+	// Minimal valid HTTP response for root path
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("OK\n"))
+}
+
+func (s *Server) handleUserAgent(w ResponseWriter, req *Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte(req.Header("User-Agent")))
+}
+
+func (s *Server) handleFiles(w ResponseWriter, req *Request) {
+	filename := req.PathValue("filename")
+	if req.Method == "GET" {
+		s.handleFileGetRequest(w, req, filename)
+	} else if req.Method == "POST" {
+		s.handleFilePostRequest(w, req, filename)
+	} else if req.Method == "DELETE" {
+		s.handleFileDeleteRequest(w, req, filename)
+	} else {
+		// Method not allowed
+		sendStatus(w, 405)
+	}
+}
+
+// maxEchoRepeat caps /echo's ?repeat=
+const maxEchoRepeat = 1000
+
+// echoFramingHeaders are set by the server and can't be chosen with
+// /echo's ?header=
+var echoFramingHeaders = []string{"Content-Length", "Transfer-Encoding", "Connection", "Content-Encoding"}
+
+// echoOptions are /echo's query options: ?upper=1, ?repeat=n, ?status=code,
+// and ?header=Name:Value, which may be repeated
+type echoOptions struct {
+	upper   bool
+	repeat  int
+	status  int
+	headers [][2]string
+}
+
+// parseEchoOptions reads /echo's query, reporting false when an option is
+// invalid
+func parseEchoOptions(req *Request) (echoOptions, bool) {
+	opts := echoOptions{repeat: 1, status: 200}
+	if req.RawQuery == "" {
+		return opts, true
+	}
+	query := req.Query()
+	var err error
+	if v := query.Get("upper"); v != "" {
+		if opts.upper, err = strconv.ParseBool(v); err != nil {
+			return opts, false
+		}
+	}
+	if v := query.Get("repeat"); v != "" {
+		if opts.repeat, err = strconv.Atoi(v); err != nil || opts.repeat < 0 || opts.repeat > maxEchoRepeat {
+			return opts, false
+		}
+	}
+	if v := query.Get("status"); v != "" {
+		if opts.status, err = strconv.Atoi(v); err != nil || opts.status < 200 || opts.status > 599 {
+			return opts, false
+		}
+	}
+	for _, h := range query["header"] {
+		name, value, ok := strings.Cut(h, ":")
+		value = strings.TrimSpace(value)
+		if !ok || !isToken(name) || strings.ContainsAny(value, "\r\n") {
+			return opts, false
+		}
+		for _, framing := range echoFramingHeaders {
+			if strings.EqualFold(name, framing) {
+				return opts, false
+			}
+		}
+		opts.headers = append(opts.headers, [2]string{name, value})
+	}
+	return opts, true
+}
+
+func (s *Server) handleEcho(w ResponseWriter, req *Request) {
+	str := req.PathValue("str")
+	opts, ok := parseEchoOptions(req)
+	if !ok {
+		sendStatus(w, 400)
+		return
+	}
+	if opts.upper {
+		str = strings.ToUpper(str)
+	}
+	if opts.repeat != 1 {
+		str = strings.Repeat(str, opts.repeat)
+	}
+	// A chosen Content-Type replaces the default
+	setHeaders := func() {
+		contentType := "text/plain"
+		for _, h := range opts.headers {
+			if strings.EqualFold(h[0], "Content-Type") {
+				contentType = ""
+			}
+		}
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		for _, h := range opts.headers {
+			w.Header().Add(h[0], h[1])
+		}
+	}
+
+	// Check if client supports gzip compression
+	if negotiateEncoding(req) != "gzip" || !bodyAllowed(opts.status) {
+		setHeaders()
+		w.WriteHeader(opts.status)
+		_, _ = w.Write([]byte(str))
+		return
+	}
+
+	// Client supports gzip, compress the response body
+	buf := getBuffer()
+	defer putBuffer(buf)
+	gzipWriter := s.gzip.Get(buf)
+	_, err := gzipWriter.Write([]byte(str))
+	if err == nil {
+		err = gzipWriter.Close()
+	}
+	s.gzip.Put(gzipWriter)
+	if err != nil {
+		req.Logger().Error("gzip compression failed", "err", err)
+		sendStatus(w, 500)
+		return
+	}
+	if s.metrics != nil {
+		s.metrics.observeCompression(len(str), buf.Len())
+	}
+
+	setHeaders()
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(opts.status)
+	_, _ = w.Write(buf.Bytes())
+}
+
+// filesPath joins filename onto the files directory, reporting false when
+// it isn't a plain relative name that stays inside it
+func filesPath(directory, filename string) (string, bool) {
+	local, err := filepath.Localize(filename)
+	if err != nil {
+		return "", false
+	}
+	return filepath.Join(directory, local), true
+}
+
+func (s *Server) handleFileGetRequest(w ResponseWriter, req *Request, filename string) {
+	directory := s.settings().directory
+	if directory == "" {
+		// No directory specified, return 404
+		sendStatus(w, 404)
+		return
+	}
+
+	filePath, ok := filesPath(directory, filename)
+	if !ok {
+		sendStatus(w, 400)
+		return
+	}
+
+	// Check if file exists and read it
+	file, err := os.Open(filePath)
+	if err != nil {
+		// File doesn't exist or can't be opened, return 404
+		if !errors.Is(err, fs.ErrNotExist) {
+			req.Logger().Warn("failed to open file", "file", filePath, "err", err)
+		}
+		sendStatus(w, 404)
+		return
+	}
+	defer file.Close()
+
+	// Get file size
+	fileInfo, err := file.Stat()
+	if err != nil {
+		req.Logger().Warn("failed to stat file", "file", filePath, "err", err)
+		sendStatus(w, 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(fileInfo.Size(), 10))
+	w.WriteHeader(200)
+
+	// Send file contents
+	if err := s.streamFile(w, req.conn, file); err != nil {
+		req.Logger().Debug("file transfer aborted", "file", filePath, "err", err)
+	}
+}
+
+func (s *Server) handleFilePostRequest(w ResponseWriter, req *Request, filename string) {
+	// Every outcome is audited, failures included
+	fail := func(code int, reason string) {
+		if s.audit != nil {
+			s.audit.record(req, "write", filename, 0, code, reason)
+		}
+		sendStatus(w, code)
+	}
+
+	directory := s.settings().directory
+	if directory == "" {
+		// No directory specified, return 404
+		fail(404, "no directory configured")
+		return
+	}
+
+	// Get content length
+	contentLengthStr, ok := req.LookupHeader("Content-Length")
+	if !ok {
+		fail(400, "missing Content-Length")
+		return
+	}
+
+	contentLength, err := strconv.Atoi(contentLengthStr)
+	if err != nil || contentLength < 0 {
+		fail(400, "invalid Content-Length")
+		return
+	}
+
+	// Stream the body into a temporary file next to the target, so the
+	// scanners see it before it replaces anything
+	filePath, ok := filesPath(directory, filename)
+	if !ok {
+		fail(400, "invalid filename")
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), ".upload-*")
+	if err != nil {
+		req.Logger().Error("failed to create file", "file", filePath, "err", err)
+		fail(500, err.Error())
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	// Webhooks get the checksum, taken on the way through
+	var dst io.Writer = tmp
+	sum := sha256.New()
+	if s.webhooks != nil {
+		dst = io.MultiWriter(tmp, sum)
+	}
+	n, err := io.CopyN(dst, req.body, int64(contentLength))
+	if err == nil {
+		err = tmp.Chmod(0o644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if n < int64(contentLength) {
+			req.Logger().Debug("failed to read request body", "err", err)
+			fail(400, "reading body: "+err.Error())
+		} else {
+			req.Logger().Error("failed to write file", "file", filePath, "err", err)
+			fail(500, err.Error())
+		}
+		return
+	}
+
+	open := func() (io.ReadCloser, error) { return os.Open(tmp.Name()) }
+	if err := s.scanUpload(req, filename, open); err != nil {
+		if errors.Is(err, errUploadRejected) {
+			req.Logger().Info("upload rejected", "file", filename, "reason", err)
+			fail(422, err.Error())
+		} else {
+			req.Logger().Error("failed to scan upload", "file", filename, "err", err)
+			fail(500, err.Error())
+		}
+		return
+	}
+
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		req.Logger().Error("failed to write file", "file", filePath, "err", err)
+		fail(500, err.Error())
+		return
+	}
+
+	if s.cache != nil {
+		s.cache.invalidate("/files/" + filename)
+	}
+	if s.audit != nil {
+		s.audit.record(req, "write", filename, n, 201, "")
+	}
+	if s.webhooks != nil {
+		s.webhooks.fire(fileEvent{
+			Event:    "file.uploaded",
+			File:     filename,
+			Size:     n,
+			SHA256:   hex.EncodeToString(sum.Sum(nil)),
+			ClientIP: clientIP(req),
+			User:     req.user,
+		})
+	}
+
+	// Return 201 Created
+	w.WriteHeader(201)
+}
+
+func (s *Server) handleFileDeleteRequest(w ResponseWriter, req *Request, filename string) {
+	// Every outcome is audited, failures included
+	fail := func(code int, reason string) {
+		if s.audit != nil {
+			s.audit.record(req, "delete", filename, 0, code, reason)
+		}
+		sendStatus(w, code)
+	}
+
+	directory := s.settings().directory
+	if directory == "" {
+		fail(404, "no directory configured")
+		return
+	}
+	filePath, ok := filesPath(directory, filename)
+	if !ok {
+		fail(400, "invalid filename")
+		return
+	}
+
+	// Only files are removed, never the directories holding them
+	info, err := os.Lstat(filePath)
+	if err != nil || info.IsDir() {
+		fail(404, "no such file")
+		return
+	}
+	if err := os.Remove(filePath); err != nil {
+		code := 500
+		if errors.Is(err, fs.ErrNotExist) {
+			code = 404
+		} else {
+			req.Logger().Error("failed to delete file", "file", filePath, "err", err)
+		}
+		fail(code, err.Error())
+		return
+	}
+
+	if s.cache != nil {
+		s.cache.invalidate("/files/" + filename)
+	}
+	if s.audit != nil {
+		s.audit.record(req, "delete", filename, info.Size(), 204, "")
+	}
+	if s.webhooks != nil {
+		s.webhooks.fire(fileEvent{
+			Event:    "file.deleted",
+			File:     filename,
+			Size:     info.Size(),
+			ClientIP: clientIP(req),
+			User:     req.user,
+		})
+	}
+	w.WriteHeader(204)
+}
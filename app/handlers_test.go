@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoot(t *testing.T) {
+	ts := newTestServer(t)
+	ts.Get("/").Do().Status(200)
+	ts.Get("/nope").Do().Status(404)
+}
+
+func TestEcho(t *testing.T) {
+	ts := newTestServer(t)
+	ts.Get("/echo/abc").Do().
+		Status(200).
+		HeaderIs("Content-Type", "text/plain").
+		HeaderIs("Content-Length", "3").
+		BodyIs("abc")
+	ts.Get("/echo/abc?upper=1&repeat=2").Do().Status(200).BodyIs("ABCABC")
+	ts.Get("/echo/abc?status=201&header=X-Test:yes").Do().
+		Status(201).
+		HeaderIs("X-Test", "yes").
+		BodyIs("abc")
+	ts.Get("/echo/abc?header=Content-Length:1").Do().Status(400)
+	ts.Get("/echo/abc?status=99").Do().Status(400)
+}
+
+// TestEchoCachedQuery checks a cached route answers each query for itself
+// rather than replaying whichever response was stored first
+func TestEchoCachedQuery(t *testing.T) {
+	ts := newTestServer(t, "--cache-route", "/echo/")
+	// Responses closing the connection aren't stored, so keep it open
+	c := ts.Conn()
+	c.Do(ts.Get("/echo/abc")).Status(200).BodyIs("abc")
+	c.Do(ts.Get("/echo/abc")).Status(200).HeaderIs("X-Cache", "HIT").BodyIs("abc")
+	c.Do(ts.Get("/echo/abc?upper=1")).Status(200).HeaderIs("X-Cache", "").BodyIs("ABC")
+	c.Do(ts.Get("/echo/xyz?upper=1")).Status(200).BodyIs("XYZ")
+	c.Do(ts.Get("/echo/xyz")).Status(200).BodyIs("xyz")
+}
+
+// TestCachedDateAndAge checks a hit carries the time it was served, not
+// the time it was stored, along with how long it has been stored
+func TestCachedDateAndAge(t *testing.T) {
+	ts := newTestServer(t, "--cache-route", "/echo/")
+	c := ts.Conn()
+	first := c.Do(ts.Get("/echo/abc")).Status(200)
+	time.Sleep(1100 * time.Millisecond)
+	hit := c.Do(ts.Get("/echo/abc")).Status(200).HeaderIs("X-Cache", "HIT").BodyIs("abc")
+
+	if n := len(hit.Header.Values("Date")); n != 1 {
+		t.Fatalf("hit has %d Date headers", n)
+	}
+	stored, err1 := http.ParseTime(first.Header.Get("Date"))
+	served, err2 := http.ParseTime(hit.Header.Get("Date"))
+	if err1 != nil || err2 != nil || !served.After(stored) {
+		t.Errorf("hit dated %q, stored %q; want a newer date", hit.Header.Get("Date"), first.Header.Get("Date"))
+	}
+	if age := hit.Header.Get("Age"); age == "" || age == "0" {
+		t.Errorf("Age = %q, want at least 1", age)
+	}
+}
+
+func TestEchoGzip(t *testing.T) {
+	ts := newTestServer(t)
+	resp := ts.Get("/echo/hello").Header("Accept-Encoding", "deflate, gzip").Do().
+		Status(200).
+		HeaderIs("Content-Encoding", "gzip")
+	zr, err := gzip.NewReader(bytes.NewReader(resp.body))
+	if err != nil {
+		t.Fatalf("body isn't gzip: %v", err)
+	}
+	if got, _ := io.ReadAll(zr); string(got) != "hello" {
+		t.Errorf("decompressed body %q, want %q", got, "hello")
+	}
+
+	ts.Get("/echo/hello").Header("Accept-Encoding", "br").Do().
+		HeaderIs("Content-Encoding", "").
+		BodyIs("hello")
+}
+
+func TestUserAgent(t *testing.T) {
+	ts := newTestServer(t)
+	ts.Get("/user-agent").Header("User-Agent", "foobar/1.2.3").Do().
+		Status(200).
+		HeaderIs("Content-Type", "text/plain").
+		BodyIs("foobar/1.2.3")
+}
+
+func TestFiles(t *testing.T) {
+	ts := newTestServer(t)
+	ts.writeFile("hello.txt", "hello, world")
+	ts.Get("/files/hello.txt").Do().
+		Status(200).
+		HeaderIs("Content-Type", "application/octet-stream").
+		BodyIs("hello, world")
+	ts.Get("/files/missing.txt").Do().Status(404)
+
+	ts.Request("POST", "/files/new.txt").Body("posted").Do().Status(201)
+	data, err := os.ReadFile(filepath.Join(ts.dir, "new.txt"))
+	if err != nil || string(data) != "posted" {
+		t.Errorf("written file %q, %v; want %q", data, err, "posted")
+	}
+	ts.Get("/files/new.txt").Do().Status(200).BodyIs("posted")
+
+	ts.Request("DELETE", "/files/new.txt").Do().Status(204)
+	ts.Get("/files/new.txt").Do().Status(404)
+	ts.Request("DELETE", "/files/new.txt").Do().Status(404)
+}
+
+// TestFileChangesAudited checks uploads and deletes, failed ones included,
+// reach the audit log and webhooks
+func TestFileChangesAudited(t *testing.T) {
+	events := make(chan fileEvent, 4)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev fileEvent
+		_ = json.NewDecoder(r.Body).Decode(&ev)
+		events <- ev
+	}))
+	defer hook.Close()
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	ts := newTestServer(t, "--audit-log", auditPath, "--webhook", hook.URL)
+	if err := os.Mkdir(filepath.Join(ts.dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.Request("POST", "/files/a.txt").Body("abc").Do().Status(201)
+	ts.Request("DELETE", "/files/a.txt").Do().Status(204)
+	ts.Request("DELETE", "/files/a.txt").Do().Status(404)
+	ts.Request("DELETE", "/files/sub").Do().Status(404)
+
+	for _, want := range []string{"file.uploaded", "file.deleted"} {
+		select {
+		case ev := <-events:
+			if ev.Event != want || ev.File != "a.txt" || ev.Size != 3 {
+				t.Errorf("event %+v, want %s of a.txt", ev, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s event", want)
+		}
+	}
+
+	data, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var rec auditRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("audit line %q: %v", line, err)
+		}
+		got = append(got, fmt.Sprintf("%s %s %d %d", rec.Action, rec.File, rec.Bytes, rec.Status))
+	}
+	want := []string{"write a.txt 3 201", "delete a.txt 3 204", "delete a.txt 0 404", "delete sub 0 404"}
+	if !slices.Equal(got, want) {
+		t.Errorf("audit log %q, want %q", got, want)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	ts := newTestServer(t)
+	before, err := os.Stat(ts.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	for range 3 {
+		ts.Get("/readyz").Do().Status(200).BodyIs("ok\n")
+	}
+	// Probes don't touch the served directory, not even with a file they
+	// remove again
+	if after, err := os.Stat(ts.dir); err != nil || !after.ModTime().Equal(before.ModTime()) {
+		t.Errorf("directory modified by probes: %v -> %v, %v", before.ModTime(), after.ModTime(), err)
+	}
+
+	if err := os.Remove(ts.dir); err != nil {
+		t.Fatal(err)
+	}
+	ts.Get("/readyz").Do().Status(503).BodyContains("directory: ")
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	newTestServer(t).Get("/metrics").Do().Status(404)
+	newTestServer(t, "--metrics-endpoint").Get("/metrics").Do().
+		Status(200).
+		HeaderIs("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+}
+
+func TestPipeServer(t *testing.T) {
+	ts := newPipeServer(t)
+	ts.Get("/echo/piped").Do().Status(200).BodyIs("piped")
+	ts.Request("HEAD", "/echo/piped").Do().
+		Status(200).
+		HeaderIs("Content-Length", "5").
+		BodyIs("")
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer is a server running for the length of one test, serving a
+// temporary directory. Requests are built with Get or Request and sent
+// with Do:
+//
+//	ts := newTestServer(t)
+//	ts.Get("/echo/abc").Header("Accept-Encoding", "gzip").Do().
+//		Status(200).HeaderIs("Content-Encoding", "gzip")
+type testServer struct {
+	t   testing.TB
+	s   *Server
+	dir string
+
+	// dial opens a connection to the server
+	dial func() (net.Conn, error)
+}
+
+// newTestServer starts a server on an ephemeral port, configured by flags
+// as on the command line
+func newTestServer(t testing.TB, flags ...string) *testServer {
+	t.Helper()
+	dir := t.TempDir()
+	s := New(testOptions(dir, flags)...)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.ListenAndServe(ctx) }()
+	select {
+	case <-s.Ready():
+	case err := <-done:
+		cancel()
+		t.Fatalf("server failed to start: %v", err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	addr := s.Addr().String()
+	return &testServer{t: t, s: s, dir: dir, dial: func() (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	}}
+}
+
+// newPipeServer starts a server whose connections are in-memory pipes, so
+// no socket is opened
+func newPipeServer(t testing.TB, flags ...string) *testServer {
+	t.Helper()
+	dir := t.TempDir()
+	s := New(testOptions(dir, flags)...)
+	if s.initErr != nil {
+		t.Fatalf("server failed to start: %v", s.initErr)
+	}
+	l := newPipeListener()
+	s.started = time.Now()
+	s.listeners = []net.Listener{l}
+	done := make(chan struct{})
+	go func() {
+		s.run()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		s.Shutdown()
+		<-done
+	})
+	return &testServer{t: t, s: s, dir: dir, dial: l.dial}
+}
+
+func testOptions(dir string, flags []string) []Option {
+	return []Option{
+		WithAddr("127.0.0.1:0"),
+		WithDirectory(dir),
+		WithLogOutput(io.Discard),
+		WithFlags("--access-log", "off"),
+		WithFlags(flags...),
+	}
+}
+
+// writeFile puts a file in the served directory
+func (ts *testServer) writeFile(name, content string) {
+	ts.t.Helper()
+	if err := os.WriteFile(filepath.Join(ts.dir, name), []byte(content), 0o644); err != nil {
+		ts.t.Fatal(err)
+	}
+}
+
+// Get starts building a GET request for target
+func (ts *testServer) Get(target string) *testRequest {
+	return ts.Request("GET", target)
+}
+
+// Request starts building a request
+func (ts *testServer) Request(method, target string) *testRequest {
+	return &testRequest{ts: ts, method: method, target: target}
+}
+
+// Raw sends data as it is and reads one response
+func (ts *testServer) Raw(data string) *testResponse {
+	ts.t.Helper()
+	return ts.roundTrip(data, "GET")
+}
+
+func (ts *testServer) roundTrip(data, method string) *testResponse {
+	ts.t.Helper()
+	conn, err := ts.dial()
+	if err != nil {
+		ts.t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	// Pipes don't buffer, so the request is written while the response
+	// is read
+	go func() { _, _ = io.WriteString(conn, data) }()
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: method})
+	if err != nil {
+		ts.t.Fatalf("reading response to %q: %v", firstLine(data), err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		ts.t.Fatalf("reading body of response to %q: %v", firstLine(data), err)
+	}
+	return &testResponse{t: ts.t, Response: resp, body: body, request: firstLine(data)}
+}
+
+func firstLine(data string) string {
+	line, _, _ := strings.Cut(data, "\r\n")
+	return line
+}
+
+// testRequest is a request being built
+type testRequest struct {
+	ts      *testServer
+	method  string
+	target  string
+	headers [][2]string
+	body    string
+	hasBody bool
+}
+
+// Header adds a header
+func (r *testRequest) Header(name, value string) *testRequest {
+	r.headers = append(r.headers, [2]string{name, value})
+	return r
+}
+
+// Body sets the body, sent with its Content-Length
+func (r *testRequest) Body(body string) *testRequest {
+	r.body, r.hasBody = body, true
+	return r
+}
+
+// Do sends the request on a new connection and reads the response
+func (r *testRequest) Do() *testResponse {
+	r.ts.t.Helper()
+	return r.ts.roundTrip(r.encode(true), r.method)
+}
+
+// encode writes the request out, asking for the connection to close after
+// it unless it's to be kept alive
+func (r *testRequest) encode(closeConn bool) string {
+	var b strings.Builder
+	b.WriteString(r.method + " " + r.target + " HTTP/1.1\r\nHost: test\r\n")
+	if closeConn {
+		b.WriteString("Connection: close\r\n")
+	}
+	for _, h := range r.headers {
+		b.WriteString(h[0] + ": " + h[1] + "\r\n")
+	}
+	if r.hasBody {
+		b.WriteString("Content-Length: " + strconv.Itoa(len(r.body)) + "\r\n")
+	}
+	b.WriteString("\r\n" + r.body)
+	return b.String()
+}
+
+// testConn is one kept-alive connection, for sending requests in turn and
+// checking each response is framed so the next one can be read
+type testConn struct {
+	t    testing.TB
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Conn opens a connection that stays open until the test ends
+func (ts *testServer) Conn() *testConn {
+	ts.t.Helper()
+	conn, err := ts.dial()
+	if err != nil {
+		ts.t.Fatalf("dial: %v", err)
+	}
+	ts.t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &testConn{t: ts.t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// Do sends r on the connection, keeping it alive, and reads the response
+func (c *testConn) Do(r *testRequest) *testResponse {
+	c.t.Helper()
+	return c.roundTrip(r.encode(false), r.method)
+}
+
+// Raw sends data as it is and reads one response
+func (c *testConn) Raw(data string) *testResponse {
+	c.t.Helper()
+	return c.roundTrip(data, "GET")
+}
+
+func (c *testConn) roundTrip(data, method string) *testResponse {
+	c.t.Helper()
+	go func() { _, _ = io.WriteString(c.conn, data) }()
+	resp, err := http.ReadResponse(c.r, &http.Request{Method: method})
+	if err != nil {
+		c.t.Fatalf("reading response to %q: %v", firstLine(data), err)
+	}
+	// Without a length or chunking the body runs to the end of the
+	// connection, and the next response can't be found
+	if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 && !resp.Close && method != "HEAD" {
+		c.t.Fatalf("%s: %d response has no Content-Length on a kept-alive connection", firstLine(data), resp.StatusCode)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatalf("reading body of response to %q: %v", firstLine(data), err)
+	}
+	return &testResponse{t: c.t, Response: resp, body: body, request: firstLine(data)}
+}
+
+// testResponse is a parsed response. Its assertions fail the test and
+// return the response, so they can be chained.
+type testResponse struct {
+	*http.Response
+	t       testing.TB
+	body    []byte
+	request string
+}
+
+func (r *testResponse) Body() string {
+	return string(r.body)
+}
+
+func (r *testResponse) Status(code int) *testResponse {
+	r.t.Helper()
+	if r.StatusCode != code {
+		r.t.Errorf("%s: status %d, want %d; body %q", r.request, r.StatusCode, code, r.body)
+	}
+	return r
+}
+
+func (r *testResponse) HeaderIs(name, value string) *testResponse {
+	r.t.Helper()
+	if got := r.Header.Get(name); got != value {
+		r.t.Errorf("%s: %s = %q, want %q", r.request, name, got, value)
+	}
+	return r
+}
+
+func (r *testResponse) BodyIs(body string) *testResponse {
+	r.t.Helper()
+	if string(r.body) != body {
+		r.t.Errorf("%s: body %q, want %q", r.request, r.body, body)
+	}
+	return r
+}
+
+func (r *testResponse) BodyContains(text string) *testResponse {
+	r.t.Helper()
+	if !strings.Contains(string(r.body), text) {
+		r.t.Errorf("%s: body %q doesn't contain %q", r.request, r.body, text)
+	}
+	return r
+}
+
+// JSON decodes the body into v
+func (r *testResponse) JSON(v any) *testResponse {
+	r.t.Helper()
+	if err := json.Unmarshal(r.body, v); err != nil {
+		r.t.Errorf("%s: body isn't JSON: %v; body %q", r.request, err, r.body)
+	}
+	return r
+}
+
+// pipeListener is a net.Listener handing out one end of in-memory pipes
+// whose other end dial returns
+type pipeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) dial() (net.Conn, error) {
+	server, client := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	err := net.ErrClosed
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = nil
+	})
+	return err
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
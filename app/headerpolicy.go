@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// headerRule changes one response header for paths under a prefix
+type headerRule struct {
+	prefix string
+	header [2]string
+	// override replaces what the handler set; otherwise the header is only
+	// added when the handler left it out
+	override bool
+}
+
+// headerPolicy is the --add-header and --set-header rules, applied in the
+// order given to each response as its head is written, so they see
+// whatever the handler and middleware set
+type headerPolicy struct {
+	rules []headerRule
+}
+
+// parseHeaderRule reads "PREFIX=Name: value"
+func parseHeaderRule(v string, override bool) (headerRule, error) {
+	prefix, setting, ok := strings.Cut(v, "=")
+	h, err := parseHeaderSetting(setting)
+	if !ok || !strings.HasPrefix(prefix, "/") || err != nil {
+		return headerRule{}, errors.New("must look like \"/files/=X-Robots-Tag: noindex\"")
+	}
+	// Changing these would break the framing the writer has worked out
+	switch strings.ToLower(h[0]) {
+	case "content-length", "transfer-encoding", "connection", "date":
+		return headerRule{}, errors.New(h[0] + " is set by the server")
+	}
+	return headerRule{prefix: prefix, header: h, override: override}, nil
+}
+
+// apply changes h for a response to path. An empty value given to
+// --set-header removes the header.
+func (p *headerPolicy) apply(h *Header, path string) {
+	for _, r := range p.rules {
+		if !strings.HasPrefix(path, r.prefix) {
+			continue
+		}
+		name, value := r.header[0], r.header[1]
+		switch {
+		case !r.override:
+			if h.Get(name) == "" && value != "" {
+				h.Add(name, value)
+			}
+		case value == "":
+			h.Del(name)
+		default:
+			h.Set(name, value)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestHeaderPolicy(t *testing.T) {
+	ts := newTestServer(t,
+		"--add-header", "/files/=X-Robots-Tag: noindex",
+		"--set-header", "/echo/=Access-Control-Allow-Origin: *",
+		"--set-header", "/echo/=Content-Type: text/x-echo",
+		"--add-header", "/=Content-Type: application/octet-stream",
+		"--add-header", "/=X-Served-By: test",
+		"--set-header", "/user-agent=X-Served-By:",
+	)
+	ts.writeFile("a.txt", "hello")
+
+	ts.Get("/files/a.txt").Do().Status(200).
+		HeaderIs("X-Robots-Tag", "noindex").
+		HeaderIs("Content-Type", "application/octet-stream").
+		HeaderIs("X-Served-By", "test")
+	// Rules apply to bodyless and error responses too
+	ts.Get("/files/missing").Do().Status(404).HeaderIs("X-Robots-Tag", "noindex")
+	ts.Get("/echo/abc").Do().Status(200).
+		HeaderIs("Access-Control-Allow-Origin", "*").
+		HeaderIs("Content-Type", "text/x-echo").
+		HeaderIs("X-Robots-Tag", "").
+		BodyIs("abc")
+	ts.Get("/user-agent").Header("User-Agent", "t").Do().Status(200).
+		HeaderIs("Content-Type", "text/plain").
+		HeaderIs("X-Served-By", "")
+}
+
+func TestParseHeaderRule(t *testing.T) {
+	for _, v := range []string{
+		"/files/=X-Robots-Tag: noindex",
+		"/=X-Empty:",
+	} {
+		if _, err := parseHeaderRule(v, true); err != nil {
+			t.Errorf("parseHeaderRule(%q): %v", v, err)
+		}
+	}
+	for _, v := range []string{
+		"X-Robots-Tag: noindex",
+		"files=X-Robots-Tag: noindex",
+		"/=X Robots: noindex",
+		"/=Content-Length: 5",
+		"/=transfer-encoding: chunked",
+	} {
+		if _, err := parseHeaderRule(v, true); err == nil {
+			t.Errorf("parseHeaderRule(%q) succeeded", v)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+// handleHealthz answers liveness probes: if the process can run a handler
+// it is alive
+func (s *Server) handleHealthz(w ResponseWriter, req *Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// handleReadyz answers readiness probes with 503 and the failed checks
+// until the server can take traffic
+func (s *Server) handleReadyz(w ResponseWriter, req *Request) {
+	var failed []string
+	if len(s.listeners) == 0 {
+		failed = append(failed, "listener: not bound")
+	}
+	if directory := s.settings().directory; directory != "" {
+		if err := checkDirectory(directory); err != nil {
+			failed = append(failed, "directory: "+err.Error())
+		}
+	}
+	if s.draining.Load() {
+		failed = append(failed, "shutdown: draining")
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "no-store")
+	if len(failed) > 0 {
+		w.WriteHeader(503)
+		_, _ = w.Write([]byte(strings.Join(failed, "\n") + "\n"))
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// checkDirectory verifies the serving directory exists and is writable.
+// Nothing is created in it, since probes come every few seconds and the
+// directory is user data.
+func checkDirectory(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New("not a directory")
+	}
+	return dirWritable(dir)
+}
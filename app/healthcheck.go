@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Defaults for active upstream health checks
+const (
+	defaultHealthInterval   = 10 * time.Second
+	defaultHealthTimeout    = 2 * time.Second
+	defaultHealthyAfter     = 2
+	defaultUnhealthyAfter   = 3
+	healthCheckMaxBodyBytes = 64 << 10
+)
+
+// healthCheck says how proxy upstreams are probed. An upstream is ejected
+// after unhealthyAfter failed probes in a row and returns after
+// healthyAfter successful ones. No path means no probing.
+type healthCheck struct {
+	path           string
+	interval       time.Duration
+	timeout        time.Duration
+	healthyAfter   int
+	unhealthyAfter int
+}
+
+// startHealthChecks probes each upstream on its own schedule
+func (p *proxyRoute) startHealthChecks(log *slog.Logger) {
+	if p.health.path == "" {
+		return
+	}
+	client := &http.Client{
+		Transport: p.transport,
+		Timeout:   p.health.timeout,
+		// A redirect is an answer, and counts as healthy
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	for _, up := range p.upstreams {
+		go p.watchUpstream(up, client, log.With("prefix", p.prefix, "upstream", up.url.Host))
+	}
+}
+
+func (p *proxyRoute) watchUpstream(up *upstream, client *http.Client, log *slog.Logger) {
+	target := up.url.Scheme + "://" + up.url.Host + p.health.path
+	var passed, failed int
+	ticker := time.NewTicker(p.health.interval)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		err := probe(client, target)
+		if err == nil {
+			passed, failed = passed+1, 0
+			if up.ejected.Load() && passed >= p.health.healthyAfter {
+				up.ejected.Store(false)
+				log.Info("upstream healthy, back in rotation")
+			}
+			continue
+		}
+		passed, failed = 0, failed+1
+		log.Debug("upstream health check failed", "err", err)
+		if !up.ejected.Load() && failed >= p.health.unhealthyAfter {
+			up.ejected.Store(true)
+			log.Warn("upstream unhealthy, ejected", "err", err)
+		}
+	}
+}
+
+// probe requests target, passing on any 2xx or 3xx status
+func probe(client *http.Client, target string) error {
+	resp, err := client.Get(target)
+	if err != nil {
+		return err
+	}
+	// Reading the body lets the connection go back to the pool
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, healthCheckMaxBodyBytes))
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// allEjected reports whether every upstream is failing its health checks
+func (p *proxyRoute) allEjected() bool {
+	for _, up := range p.upstreams {
+		if !up.ejected.Load() {
+			return false
+		}
+	}
+	return true
+}
+
+// upstreamStatus is one upstream in /stats
+type upstreamStatus struct {
+	Prefix   string `json:"prefix"`
+	URL      string `json:"url"`
+	Healthy  bool   `json:"healthy"`
+	Active   int64  `json:"active_requests"`
+	Requests uint64 `json:"requests"`
+	Errors   uint64 `json:"errors"`
+}
+
+// upstreamStatuses reports every proxy upstream
+func (s *Server) upstreamStatuses() []upstreamStatus {
+	var out []upstreamStatus
+	for _, p := range s.proxies {
+		for _, up := range p.upstreams {
+			out = append(out, upstreamStatus{
+				Prefix:   p.prefix,
+				URL:      up.url.String(),
+				Healthy:  !up.ejected.Load(),
+				Active:   up.active.Load(),
+				Requests: up.requests.Load(),
+				Errors:   up.errors.Load(),
+			})
+		}
+	}
+	return out
+}
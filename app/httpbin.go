@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Limits on the testing endpoints, so they can't be used to hold
+// connections open indefinitely or run up large responses
+const (
+	maxAnythingBody = 1 << 20 // request body /anything reflects
+	maxRedirects    = 100     // chain /redirect/{n} starts
+	maxStreamLines  = 100     // lines /stream/{n} sends
+	maxDripBytes    = 10 << 20
+	maxDripPieces   = 1000 // separate writes /drip makes
+	maxDripDuration = time.Minute
+	maxRangeBytes   = 1 << 20 // body /range/{n} serves
+	maxTestDelay    = 10 * time.Second
+)
+
+// /drip sends 10 bytes over 2 seconds unless asked otherwise
+const (
+	defaultDripBytes    = 10
+	defaultDripDuration = 2 * time.Second
+)
+
+// parseTestDuration reads a ?delay= or ?duration= value, either seconds as
+// in httpbin or a duration such as 250ms, capped at limit
+func parseTestDuration(v string, def, limit time.Duration) (time.Duration, bool) {
+	if v == "" {
+		return def, true
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		secs, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, false
+		}
+		d = time.Duration(secs * float64(time.Second))
+	}
+	if d < 0 {
+		return 0, false
+	}
+	return min(d, limit), true
+}
+
+// handleStatus answers with the status code in the path, for testing how
+// clients handle errors and retries
+func (s *Server) handleStatus(w ResponseWriter, req *Request) {
+	code, err := strconv.Atoi(req.PathValue("code"))
+	if err != nil || code < 200 || code > 599 {
+		sendStatus(w, 400)
+		return
+	}
+	query := req.Query()
+	delay, ok := parseTestDuration(query.Get("delay"), 0, maxTestDelay)
+	if !ok {
+		sendStatus(w, 400)
+		return
+	}
+	time.Sleep(delay)
+
+	body := query.Get("body")
+	// These statuses never have a body
+	if body == "" || code == 204 || code == 304 {
+		sendStatus(w, code)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(code)
+	if req.Method != "HEAD" {
+		_, _ = w.Write([]byte(body))
+	}
+}
+
+// sendJSON answers with v as indented JSON
+func sendJSON(w ResponseWriter, v any) {
+	body, _ := json.MarshalIndent(v, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(append(body, '\n'))
+}
+
+// requestHeaders collects the request's headers by name as sent, joining
+// repeated ones with commas
+func requestHeaders(req *Request) map[string]string {
+	headers := make(map[string]string)
+	for _, h := range req.Headers() {
+		if prior, ok := headers[h[0]]; ok {
+			headers[h[0]] = prior + ", " + h[1]
+		} else {
+			headers[h[0]] = h[1]
+		}
+	}
+	return headers
+}
+
+// handleHeaders reports every request header
+func (s *Server) handleHeaders(w ResponseWriter, req *Request) {
+	sendJSON(w, map[string]any{"headers": requestHeaders(req)})
+}
+
+// handleIP reports the client address, which with --trusted-proxy is the
+// one the proxy forwarded for
+func (s *Server) handleIP(w ResponseWriter, req *Request) {
+	sendJSON(w, map[string]string{"origin": clientIP(req)})
+}
+
+// handleAnything reflects the whole request, for testing client libraries.
+// A body that isn't UTF-8 text is reported in base64.
+func (s *Server) handleAnything(w ResponseWriter, req *Request) {
+	body, n, ok := requestBody(w, req)
+	if !ok {
+		return
+	}
+	if n > maxAnythingBody {
+		// The body is left unread, so the connection can't be reused
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(413)
+		return
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		req.Logger().Debug("failed to read request body", "err", err)
+		sendStatus(w, 400)
+		return
+	}
+
+	out := map[string]any{
+		"method":  req.Method,
+		"path":    req.Path,
+		"query":   req.Query(),
+		"headers": requestHeaders(req),
+		"origin":  clientIP(req),
+	}
+	if utf8.Valid(data) {
+		out["body"], out["body_encoding"] = string(data), "utf-8"
+	} else {
+		out["body"], out["body_encoding"] = base64.StdEncoding.EncodeToString(data), "base64"
+	}
+	sendJSON(w, out)
+}
+
+// handleRedirect answers /redirect/n with a redirect to /redirect/n-1,
+// until /redirect/0 answers 200. ?code= picks 301, 302 (the default), 303,
+// 307, or 308, and is kept along the chain.
+func (s *Server) handleRedirect(w ResponseWriter, req *Request) {
+	n, err := strconv.Atoi(req.PathValue("n"))
+	if err != nil || n < 0 || n > maxRedirects {
+		sendStatus(w, 400)
+		return
+	}
+	code := 302
+	if v := req.Query().Get("code"); v != "" {
+		switch code, _ = strconv.Atoi(v); code {
+		case 301, 302, 303, 307, 308:
+		default:
+			sendStatus(w, 400)
+			return
+		}
+	}
+	if n == 0 {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("redirects done\n"))
+		return
+	}
+	location := "/redirect/" + strconv.Itoa(n-1)
+	if req.RawQuery != "" {
+		location += "?" + req.RawQuery
+	}
+	w.Header().Set("Location", location)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(code)
+}
+
+// handleStream sends n JSON lines, flushing each as its own chunk
+func (s *Server) handleStream(w ResponseWriter, req *Request) {
+	n, err := strconv.Atoi(req.PathValue("n"))
+	if err != nil || n < 0 {
+		sendStatus(w, 400)
+		return
+	}
+	n = min(n, maxStreamLines)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(200)
+	if req.Method == "HEAD" {
+		return
+	}
+	f, _ := w.(flusher)
+	for i := 0; i < n; i++ {
+		line, _ := json.Marshal(map[string]any{"id": i, "time": time.Now().UTC().Format(time.RFC3339Nano), "path": req.Path})
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			return
+		}
+		if f != nil {
+			if err := f.Flush(); err != nil {
+				req.Logger().Debug("stream aborted", "err", err)
+				return
+			}
+		}
+	}
+}
+
+// handleDrip trickles ?numbytes= bytes out over ?duration=, after ?delay=,
+// with ?code= as the status, for testing client read timeouts. Each piece
+// is flushed under the per-chunk write deadline, as file bodies are.
+func (s *Server) handleDrip(w ResponseWriter, req *Request) {
+	query := req.Query()
+	numBytes, code := defaultDripBytes, 200
+	var err error
+	if v := query.Get("numbytes"); v != "" {
+		if numBytes, err = strconv.Atoi(v); err != nil || numBytes < 0 || numBytes > maxDripBytes {
+			sendStatus(w, 400)
+			return
+		}
+	}
+	if v := query.Get("code"); v != "" {
+		if code, err = strconv.Atoi(v); err != nil || code < 200 || code > 599 {
+			sendStatus(w, 400)
+			return
+		}
+	}
+	duration, ok := parseTestDuration(query.Get("duration"), defaultDripDuration, maxDripDuration)
+	delay, ok2 := parseTestDuration(query.Get("delay"), 0, maxTestDelay)
+	if !ok || !ok2 {
+		sendStatus(w, 400)
+		return
+	}
+	time.Sleep(delay)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(numBytes))
+	w.WriteHeader(code)
+	if req.Method == "HEAD" || numBytes == 0 || !bodyAllowed(code) {
+		return
+	}
+	pieces := min(numBytes, maxDripPieces)
+	interval := duration / time.Duration(pieces)
+	f, _ := w.(flusher)
+	sent := 0
+	for i := 1; i <= pieces; i++ {
+		time.Sleep(interval)
+		// Spread the bytes evenly over the pieces
+		n := numBytes*i/pieces - sent
+		if req.conn != nil {
+			_ = req.conn.SetWriteDeadline(time.Now().Add(s.chunkWriteTimeout))
+		}
+		if _, err := w.Write(bytes.Repeat([]byte{'*'}, n)); err == nil && f != nil {
+			err = f.Flush()
+		}
+		if err != nil {
+			req.Logger().Debug("drip aborted", "sent", sent, "err", err)
+			return
+		}
+		sent += n
+	}
+}
+
+// handleCookies reports the cookies sent
+func (s *Server) handleCookies(w ResponseWriter, req *Request) {
+	sendJSON(w, map[string]any{"cookies": req.Cookies()})
+}
+
+// handleSetCookies sets a cookie for each query parameter, then redirects
+// to /cookies so the client shows what it kept
+func (s *Server) handleSetCookies(w ResponseWriter, req *Request) {
+	for name, values := range req.Query() {
+		if err := SetCookie(w, Cookie{Name: name, Value: values[0]}); err != nil {
+			w.Header().Del("Set-Cookie")
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(400)
+			_, _ = w.Write([]byte(err.Error() + "\n"))
+			return
+		}
+	}
+	redirectToCookies(w)
+}
+
+// handleDeleteCookies expires each cookie named in the query, then
+// redirects to /cookies
+func (s *Server) handleDeleteCookies(w ResponseWriter, req *Request) {
+	for name := range req.Query() {
+		// Names that can't be set can't have been set here either
+		_ = SetCookie(w, Cookie{Name: name, MaxAge: -1})
+	}
+	redirectToCookies(w)
+}
+
+func redirectToCookies(w ResponseWriter) {
+	w.Header().Set("Location", "/cookies")
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(302)
+}
+
+// handleBasicAuthTest challenges for Basic credentials and accepts the
+// user and password in the path, /basic-auth/user/pass, for testing how
+// clients answer a 401
+func (s *Server) handleBasicAuthTest(w ResponseWriter, req *Request) {
+	wantUser, wantPassword, ok := strings.Cut(req.PathValue("credentials"), "/")
+	if !ok || wantUser == "" {
+		sendStatus(w, 404)
+		return
+	}
+	user, password, ok := parseBasicAuth(req.Header("Authorization"))
+	if !ok || user != wantUser || password != wantPassword {
+		w.Header().Set("WWW-Authenticate", `Basic realm="basic-auth test", charset="UTF-8"`)
+		sendStatus(w, 401)
+		return
+	}
+	sendJSON(w, map[string]any{"authenticated": true, "user": user})
+}
+
+// alphabetBody is a body of size bytes running a to z over and over, so
+// any range of it can be checked by position alone
+type alphabetBody int64
+
+func (b alphabetBody) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(b) {
+		return 0, io.EOF
+	}
+	n := min(int64(len(p)), int64(b)-off)
+	for i := int64(0); i < n; i++ {
+		p[i] = 'a' + byte((off+i)%26)
+	}
+	if n < int64(len(p)) {
+		return int(n), io.EOF
+	}
+	return int(n), nil
+}
+
+// handleRange serves n bytes of the alphabet with Range and If-Range
+// support. The ETag depends only on n, and Last-Modified is when the
+// server started.
+func (s *Server) handleRange(w ResponseWriter, req *Request) {
+	n, err := strconv.Atoi(req.PathValue("n"))
+	if err != nil || n < 0 || n > maxRangeBytes {
+		sendStatus(w, 400)
+		return
+	}
+	etag := `"range-` + strconv.Itoa(n) + `"`
+	s.serveRanges(w, req, alphabetBody(n), int64(n), "application/octet-stream", etag, s.started)
+}
+
+// handleUUID answers with a random version 4 UUID
+func (s *Server) handleUUID(w ResponseWriter, req *Request) {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	h := hex.EncodeToString(b[:])
+	sendJSON(w, map[string]string{"uuid": h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]})
+}
+
+// handleBase64 decodes the URL-safe base64 in the path, padded or not
+func (s *Server) handleBase64(w ResponseWriter, req *Request) {
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(req.PathValue("value"), "="))
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(400)
+		_, _ = w.Write([]byte("invalid base64\n"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write(decoded)
+}
+
+// handleCache answers with validators, and 304 to a request carrying ones
+// that match. /cache/n also allows caching for n seconds.
+func (s *Server) handleCache(w ResponseWriter, req *Request) {
+	if v := req.PathValue("seconds"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 {
+			sendStatus(w, 400)
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(seconds))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	// Both validators hold until the server restarts
+	modTime := s.started.UTC().Truncate(time.Second)
+	etag := `"cache-` + strconv.FormatInt(modTime.Unix(), 36) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modTime.Format(httpDateLayout))
+	if notModified(req, etag, modTime) {
+		w.WriteHeader(304)
+		return
+	}
+	sendJSON(w, map[string]string{"etag": etag, "last_modified": modTime.Format(httpDateLayout)})
+}
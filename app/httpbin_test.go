@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestStatusEndpoint(t *testing.T) {
+	ts := newTestServer(t)
+	ts.Get("/status/418").Do().Status(418)
+	ts.Get("/status/204").Do().Status(204).BodyIs("")
+	ts.Get("/status/abc").Do().Status(400)
+}
+
+func TestHeadersAndAnything(t *testing.T) {
+	ts := newTestServer(t)
+	var headers struct {
+		Headers map[string]string `json:"headers"`
+	}
+	ts.Get("/headers").Header("X-Test", "one").Do().
+		Status(200).
+		HeaderIs("Content-Type", "application/json").
+		JSON(&headers)
+	if headers.Headers["X-Test"] != "one" {
+		t.Errorf("/headers reported %v", headers.Headers)
+	}
+
+	var anything struct {
+		Method       string              `json:"method"`
+		Path         string              `json:"path"`
+		Query        map[string][]string `json:"query"`
+		Body         string              `json:"body"`
+		BodyEncoding string              `json:"body_encoding"`
+	}
+	ts.Request("PUT", "/anything/a/b?x=1").Body("text").Do().Status(200).JSON(&anything)
+	if anything.Method != "PUT" || anything.Path != "/anything/a/b" || anything.Body != "text" || anything.BodyEncoding != "utf-8" {
+		t.Errorf("/anything reported %+v", anything)
+	}
+	if got := anything.Query["x"]; len(got) != 1 || got[0] != "1" {
+		t.Errorf("/anything query %v", anything.Query)
+	}
+
+	ts.Request("POST", "/anything").Body("\xff\xfe").Do().Status(200).JSON(&anything)
+	if anything.BodyEncoding != "base64" || anything.Body != base64.StdEncoding.EncodeToString([]byte("\xff\xfe")) {
+		t.Errorf("binary body reported as %q (%s)", anything.Body, anything.BodyEncoding)
+	}
+}
+
+func TestRedirectEndpoint(t *testing.T) {
+	ts := newTestServer(t)
+	ts.Get("/redirect/2").Do().Status(302).HeaderIs("Location", "/redirect/1")
+	ts.Get("/redirect/1?code=307").Do().Status(307).HeaderIs("Location", "/redirect/0?code=307")
+	ts.Get("/redirect/0").Do().Status(200)
+	ts.Get("/redirect/1?code=200").Do().Status(400)
+}
+
+func TestStreamEndpoint(t *testing.T) {
+	ts := newTestServer(t)
+	resp := ts.Get("/stream/3").Do().Status(200)
+	if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("Transfer-Encoding %v, want chunked", resp.TransferEncoding)
+	}
+	if lines := strings.Count(resp.Body(), "\n"); lines != 3 {
+		t.Errorf("%d lines streamed, want 3: %q", lines, resp.Body())
+	}
+}
+
+func TestRangeEndpoint(t *testing.T) {
+	ts := newTestServer(t)
+	ts.Get("/range/26").Do().Status(200).HeaderIs("Accept-Ranges", "bytes").BodyIs("abcdefghijklmnopqrstuvwxyz")
+	ts.Get("/range/26").Header("Range", "bytes=2-4").Do().
+		Status(206).
+		HeaderIs("Content-Range", "bytes 2-4/26").
+		BodyIs("cde")
+	ts.Get("/range/26").Header("Range", "bytes=-3").Do().Status(206).BodyIs("xyz")
+	ts.Get("/range/26").Header("Range", "bytes=30-").Do().
+		Status(416).
+		HeaderIs("Content-Range", "bytes */26")
+	resp := ts.Get("/range/26").Header("Range", "bytes=0-0,25-").Do().Status(206)
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "multipart/byteranges") {
+		t.Errorf("Content-Type %q, want multipart/byteranges", resp.Header.Get("Content-Type"))
+	}
+	resp.BodyContains("Content-Range: bytes 25-25/26")
+}
+
+func TestCacheEndpoint(t *testing.T) {
+	ts := newTestServer(t)
+	resp := ts.Get("/cache/60").Do().Status(200).HeaderIs("Cache-Control", "public, max-age=60")
+	etag := resp.Header.Get("ETag")
+	ts.Get("/cache").Header("If-None-Match", etag).Do().Status(304).BodyIs("")
+	ts.Get("/cache").Header("If-Modified-Since", resp.Header.Get("Last-Modified")).Do().Status(304)
+	ts.Get("/cache").Header("If-None-Match", `"other"`).Do().Status(200)
+}
+
+func TestCookiesEndpoints(t *testing.T) {
+	ts := newTestServer(t)
+	var cookies struct {
+		Cookies map[string]string `json:"cookies"`
+	}
+	ts.Get("/cookies").Header("Cookie", "a=1; b=2").Do().Status(200).JSON(&cookies)
+	if cookies.Cookies["a"] != "1" || cookies.Cookies["b"] != "2" {
+		t.Errorf("/cookies reported %v", cookies.Cookies)
+	}
+	resp := ts.Get("/cookies/set?flavour=oat").Do().Status(302).HeaderIs("Location", "/cookies")
+	if got := resp.Header.Get("Set-Cookie"); !strings.HasPrefix(got, "flavour=oat") {
+		t.Errorf("Set-Cookie %q", got)
+	}
+}
+
+func TestBasicAuthEndpoint(t *testing.T) {
+	ts := newTestServer(t)
+	ts.Get("/basic-auth/ann/secret").Do().Status(401)
+	ts.Get("/basic-auth/ann/secret").
+		Header("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("ann:wrong"))).
+		Do().Status(401)
+	ts.Get("/basic-auth/ann/secret").
+		Header("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("ann:secret"))).
+		Do().Status(200).BodyContains(`"user": "ann"`)
+}
+
+func TestUUIDAndBase64(t *testing.T) {
+	ts := newTestServer(t)
+	var out struct {
+		UUID string `json:"uuid"`
+	}
+	ts.Get("/uuid").Do().Status(200).JSON(&out)
+	if len(out.UUID) != 36 || out.UUID[14] != '4' {
+		t.Errorf("uuid %q isn't a version 4 UUID", out.UUID)
+	}
+	ts.Get("/base64/" + base64.URLEncoding.EncodeToString([]byte("hi there"))).Do().Status(200).BodyIs("hi there")
+	ts.Get("/base64/%%%").Do().Status(400)
+}
+
+func TestAnythingChunked(t *testing.T) {
+	ts := newTestServer(t)
+	ts.Raw("POST /anything HTTP/1.1\r\nHost: x\r\nConnection: close\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"3\r\nabc\r\n2;ext\r\nde\r\n0\r\n\r\n").Status(200).BodyContains(`"body": "abcde"`)
+	ts.Raw("POST /anything HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\nabc").Status(400)
+	if resp := ts.Raw("POST /anything HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n").Status(400); !resp.Close {
+		t.Errorf("connection kept open after a malformed chunk")
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWKS keys are refetched this often, or sooner when a token names an
+// unknown key (but no more than once per jwksMinRefresh)
+const (
+	jwksRefreshInterval = time.Hour
+	jwksMinRefresh      = time.Minute
+	jwtClockSkew        = 30 * time.Second
+)
+
+var (
+	errTokenMalformed = errors.New("malformed token")
+	errTokenSignature = errors.New("invalid signature")
+	errTokenExpired   = errors.New("token expired")
+	errTokenNotYet    = errors.New("token not valid yet")
+	errTokenIssuer    = errors.New("unexpected issuer")
+	errTokenAudience  = errors.New("unexpected audience")
+	errTokenScope     = errors.New("insufficient scope")
+)
+
+// jwtVerifier validates bearer tokens signed with HS256 or RS256
+type jwtVerifier struct {
+	secret    []byte         // HS256
+	publicKey *rsa.PublicKey // RS256 with a fixed key
+	jwks      *jwksCache     // RS256 with keys from a JWKS endpoint
+
+	issuer   string
+	audience string
+	scope    string
+}
+
+// loadRSAPublicKey reads a PEM public key or certificate
+func loadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data in " + path)
+	}
+	var pub any
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pub = cert.PublicKey
+	} else if pub, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return nil, err
+	}
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New(path + " is not an RSA key")
+	}
+	return key, nil
+}
+
+// verify checks a compact JWS token and returns its claims
+func (v *jwtVerifier) verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errTokenMalformed
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errTokenMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errTokenMalformed
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	// The algorithm must be one this verifier was configured for, so an
+	// RSA public key can never be used as an HMAC secret
+	switch {
+	case header.Alg == "HS256" && v.secret != nil:
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, errTokenSignature
+		}
+	case header.Alg == "RS256" && (v.publicKey != nil || v.jwks != nil):
+		key := v.publicKey
+		if v.jwks != nil {
+			if key = v.jwks.key(header.Kid); key == nil {
+				return nil, errTokenSignature
+			}
+		}
+		digest := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errTokenSignature
+		}
+	default:
+		return nil, errTokenSignature
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errTokenMalformed
+	}
+	now := time.Now()
+	// A token without an expiry would be good forever
+	if exp, ok := claims["exp"].(float64); !ok || now.After(time.Unix(int64(exp), 0).Add(jwtClockSkew)) {
+		return nil, errTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errTokenNotYet
+	}
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return nil, errTokenIssuer
+	}
+	if v.audience != "" && !hasAudience(claims["aud"], v.audience) {
+		return nil, errTokenAudience
+	}
+	if v.scope != "" && !hasScope(claims["scope"], v.scope) {
+		return claims, errTokenScope
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// hasAudience handles "aud" as either a string or a list
+func hasAudience(aud any, want string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == want
+	case []any:
+		for _, a := range aud {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasScope checks a space-separated "scope" claim
+func hasScope(scope any, want string) bool {
+	s, _ := scope.(string)
+	for _, granted := range strings.Fields(s) {
+		if granted == want {
+			return true
+		}
+	}
+	return false
+}
+
+// jwtAuth returns a middleware requiring a valid bearer token on paths
+// under any of prefixes. Invalid tokens get a 401 and tokens without the
+// required scope a 403, with WWW-Authenticate as in RFC 6750.
+func jwtAuth(v *jwtVerifier, prefixes []string) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(s *Server, w ResponseWriter, req *Request) {
+			if req.signedURL || !hasAnyPrefix(req.Path, prefixes) {
+				next(s, w, req)
+				return
+			}
+
+			auth := req.Header("Authorization")
+			if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+				w.Header().Set("WWW-Authenticate", `Bearer`)
+				sendStatus(w, 401)
+				return
+			}
+			claims, err := v.verify(strings.TrimSpace(auth[7:]))
+			if err == errTokenScope {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, v.scope))
+				sendStatus(w, 403)
+				return
+			}
+			if err != nil {
+				req.Logger().Info("rejected bearer token", "err", err)
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, err.Error()))
+				sendStatus(w, 401)
+				return
+			}
+			req.claims = claims
+			if sub, ok := claims["sub"].(string); ok {
+				req.user = sub
+			}
+			next(s, w, req)
+		}
+	}
+}
+
+// jwksCache holds RSA keys fetched from a JWKS endpoint, by key ID
+type jwksCache struct {
+	url    string
+	client *http.Client
+	log    *slog.Logger
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+	// refreshing is closed when the fetch in flight finishes, nil if none is
+	refreshing chan struct{}
+}
+
+func newJWKSCache(url string, log *slog.Logger) *jwksCache {
+	return &jwksCache{url: url, client: &http.Client{Timeout: 10 * time.Second}, log: log}
+}
+
+// key returns the key with the given ID, refreshing the set when it is
+// stale or doesn't know the ID. Only one fetch runs at a time, and keys
+// already known keep being returned while it does.
+func (c *jwksCache) key(kid string) *rsa.PublicKey {
+	c.mu.Lock()
+	key, ok := c.keys[kid]
+	age := time.Since(c.fetched)
+	done := c.refreshing
+	if done == nil && ((ok && age >= jwksRefreshInterval) || (!ok && age >= jwksMinRefresh)) {
+		done = c.refreshLocked()
+	}
+	c.mu.Unlock()
+	if ok || done == nil {
+		return key
+	}
+
+	<-done
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.keys[kid]
+}
+
+// refreshLocked starts fetching the key set in the background and returns
+// the channel closed when it's done
+func (c *jwksCache) refreshLocked() chan struct{} {
+	done := make(chan struct{})
+	c.refreshing = done
+	c.fetched = time.Now()
+	go func() {
+		keys, err := c.fetch()
+		if err != nil {
+			c.log.Warn("failed to fetch JWKS", "url", c.url, "err", err)
+		}
+		c.mu.Lock()
+		if err == nil {
+			c.keys = keys
+		}
+		c.refreshing = nil
+		c.mu.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// fetch downloads the key set, keeping its RSA keys
+func (c *jwksCache) fetch() (map[string]*rsa.PublicKey, error) {
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// signJWT builds a token with the given header and claims, signing it
+// with an HMAC secret or an RSA key
+func signJWT(t *testing.T, header, claims map[string]any, key any) string {
+	t.Helper()
+	enc := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(header) + "." + enc(claims)
+	var sig []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTVerify(t *testing.T) {
+	secret := []byte("s3cret")
+	v := &jwtVerifier{secret: secret, issuer: "https://issuer.example", audience: "api", scope: "files:read"}
+	hs := map[string]any{"alg": "HS256", "typ": "JWT"}
+	now := time.Now().Unix()
+	good := map[string]any{"iss": "https://issuer.example", "aud": []string{"other", "api"}, "scope": "files:read files:write", "sub": "ann", "exp": now + 60}
+	with := func(k string, val any) map[string]any {
+		c := make(map[string]any, len(good)+1)
+		for k, v := range good {
+			c[k] = v
+		}
+		if val == nil {
+			delete(c, k)
+		} else {
+			c[k] = val
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"valid", signJWT(t, hs, good, secret), nil},
+		{"within clock skew", signJWT(t, hs, with("exp", now-10), secret), nil},
+		{"expired", signJWT(t, hs, with("exp", now-120), secret), errTokenExpired},
+		{"no expiry", signJWT(t, hs, with("exp", nil), secret), errTokenExpired},
+		{"expiry not a number", signJWT(t, hs, with("exp", "never"), secret), errTokenExpired},
+		{"not yet valid", signJWT(t, hs, with("nbf", now+120), secret), errTokenNotYet},
+		{"wrong issuer", signJWT(t, hs, with("iss", "https://evil.example"), secret), errTokenIssuer},
+		{"wrong audience", signJWT(t, hs, with("aud", "other"), secret), errTokenAudience},
+		{"missing scope", signJWT(t, hs, with("scope", "files:write"), secret), errTokenScope},
+		{"wrong secret", signJWT(t, hs, good, []byte("guess")), errTokenSignature},
+		{"alg none", signJWT(t, map[string]any{"alg": "none"}, good, nil), errTokenSignature},
+		{"alg not configured", signJWT(t, map[string]any{"alg": "RS256"}, good, secret), errTokenSignature},
+		{"two segments", "a.b", errTokenMalformed},
+		{"bad header", "!!.e30.", errTokenMalformed},
+	}
+	for _, tt := range tests {
+		claims, err := v.verify(tt.token)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: verify = %v, want %v", tt.name, err, tt.want)
+		}
+		if err == nil && claims["sub"] != "ann" {
+			t.Errorf("%s: claims %v", tt.name, claims)
+		}
+	}
+}
+
+// TestJWTVerifyRS256 checks RSA tokens, and that the public key can't be
+// used as an HMAC secret
+func TestJWTVerifyRS256(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pemData, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := loadRSAPublicKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &jwtVerifier{publicKey: pub}
+	claims := map[string]any{"sub": "ann", "exp": time.Now().Unix() + 60}
+
+	if _, err := v.verify(signJWT(t, map[string]any{"alg": "RS256"}, claims, priv)); err != nil {
+		t.Errorf("RS256 token: %v", err)
+	}
+	if _, err := v.verify(signJWT(t, map[string]any{"alg": "HS256"}, claims, pemData)); err != errTokenSignature {
+		t.Errorf("HS256 token keyed with the public key: %v, want %v", err, errTokenSignature)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.verify(signJWT(t, map[string]any{"alg": "RS256"}, claims, other)); err != errTokenSignature {
+		t.Errorf("token from another key: %v, want %v", err, errTokenSignature)
+	}
+}
+
+func TestJWTAuth(t *testing.T) {
+	secret := []byte("s3cret")
+	ts := newTestServer(t, "--jwt-protect", "/echo/", "--jwt-secret", string(secret), "--jwt-scope", "echo")
+	hs := map[string]any{"alg": "HS256"}
+	exp := time.Now().Unix() + 60
+
+	ts.Get("/echo/abc").Do().Status(401).HeaderIs("WWW-Authenticate", "Bearer")
+	ts.Get("/echo/abc").Header("Authorization", "Basic YW5uOnNlY3JldA==").Do().Status(401)
+	ts.Get("/echo/abc").Header("Authorization", "Bearer "+signJWT(t, hs, map[string]any{"scope": "echo", "exp": exp}, []byte("guess"))).Do().
+		Status(401).HeaderIs("WWW-Authenticate", `Bearer error="invalid_token", error_description="invalid signature"`)
+	ts.Get("/echo/abc").Header("Authorization", "Bearer "+signJWT(t, hs, map[string]any{"scope": "other", "exp": exp}, secret)).Do().
+		Status(403).HeaderIs("WWW-Authenticate", `Bearer error="insufficient_scope", scope="echo"`)
+	ts.Get("/echo/abc").Header("Authorization", "bearer "+signJWT(t, hs, map[string]any{"scope": "echo", "sub": "ann", "exp": exp}, secret)).Do().
+		Status(200).BodyIs("abc")
+	// Dot segments don't step around the prefix
+	ts.Get("/x/../echo/abc").Do().Status(401)
+	ts.Get("/user-agent").Header("User-Agent", "t").Do().Status(200)
+}
+
+// jwk writes key as a JWKS entry
+func jwk(kid string, key *rsa.PublicKey) string {
+	return fmt.Sprintf(`{"kty":"RSA","kid":%q,"n":%q,"e":%q}`, kid,
+		base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()))
+}
+
+// TestJWKSRefresh checks a stale set is refetched once, in the background,
+// while the keys it already has keep working
+func TestJWKSRefresh(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) == 1 {
+			fmt.Fprintf(w, `{"keys":[%s]}`, jwk("a", &priv.PublicKey))
+			return
+		}
+		<-release
+		fmt.Fprintf(w, `{"keys":[%s,%s]}`, jwk("a", &priv.PublicKey), jwk("b", &priv.PublicKey))
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	c := newJWKSCache(upstream.URL, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if c.key("a") == nil {
+		t.Fatal("key a not fetched")
+	}
+
+	// The set goes stale, and its refetch hangs
+	c.mu.Lock()
+	c.fetched = time.Now().Add(-2 * jwksRefreshInterval)
+	c.mu.Unlock()
+	got := make(chan *rsa.PublicKey)
+	go func() { got <- c.key("a") }()
+	select {
+	case k := <-got:
+		if k == nil {
+			t.Fatal("known key lost while refreshing")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("known key blocked on the refresh")
+	}
+
+	// Lookups of a new key wait for the fetch already running
+	var wg sync.WaitGroup
+	var missing atomic.Int32
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if c.key("b") == nil {
+				missing.Add(1)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	release <- struct{}{}
+	wg.Wait()
+	if n := missing.Load(); n != 0 {
+		t.Errorf("%d lookups of the new key failed", n)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("%d fetches, want 2", n)
+	}
+}
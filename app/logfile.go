@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rotationPolicy controls when a rotatingFile starts a new file. Zero values
+// disable the corresponding limit.
+type rotationPolicy struct {
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+}
+
+// rotatingFile is an append-only log file that rotates itself by size or
+// age, and can be reopened after an external tool like logrotate moved it
+type rotatingFile struct {
+	path   string
+	policy rotationPolicy
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotatingFile(path string, policy rotationPolicy) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, policy: policy}
+	if err := f.openLocked(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) openLocked() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.shouldRotateLocked(len(p)) {
+		// Keep logging to the old file if rotation fails
+		_ = f.rotateLocked()
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) shouldRotateLocked(next int) bool {
+	if f.policy.maxSize > 0 && f.size > 0 && f.size+int64(next) > f.policy.maxSize {
+		return true
+	}
+	return f.policy.interval > 0 && time.Since(f.opened) >= f.policy.interval
+}
+
+// rotateLocked moves the current file aside with a timestamp suffix, starts
+// a fresh one, and prunes old backups
+func (f *rotatingFile) rotateLocked() error {
+	backup := f.path + "." + time.Now().Format("20060102-150405.000")
+	if err := os.Rename(f.path, backup); err != nil {
+		return err
+	}
+	old := f.file
+	if err := f.openLocked(); err != nil {
+		// Put the file back so writes keep landing somewhere sensible
+		_ = os.Rename(backup, f.path)
+		return err
+	}
+	old.Close()
+	f.pruneLocked()
+	return nil
+}
+
+func (f *rotatingFile) pruneLocked() {
+	if f.policy.maxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil || len(backups) <= f.policy.maxBackups {
+		return
+	}
+	// Timestamp suffixes sort chronologically
+	sort.Strings(backups)
+	for _, name := range backups[:len(backups)-f.policy.maxBackups] {
+		_ = os.Remove(name)
+	}
+}
+
+// Reopen closes the file and opens the path again, picking up a new file if
+// the old one was moved away
+func (f *rotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	old := f.file
+	if err := f.openLocked(); err != nil {
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+// openLogOutput returns where structured logs go: stderr, or a rotating
+// file when path is set
+func openLogOutput(path string, policy rotationPolicy) (io.Writer, *rotatingFile, error) {
+	if path == "" || path == "-" {
+		return os.Stderr, nil, nil
+	}
+	f, err := openRotatingFile(path, policy)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f, nil
+}
+
+// reopenLogs reopens every log file the server writes to
+func (s *Server) reopenLogs() {
+	files := []*rotatingFile{s.logFile}
+	if s.accessLog != nil {
+		files = append(files, s.accessLog.file)
+	}
+	if s.audit != nil {
+		files = append(files, s.audit.file)
+	}
+	for _, f := range files {
+		if f == nil {
+			continue
+		}
+		if err := f.Reopen(); err != nil {
+			s.log.Error("failed to reopen log file", "path", f.path, "err", err)
+			continue
+		}
+		s.log.Info("reopened log file", "path", f.path)
+	}
+}
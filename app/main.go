@@ -1,317 +1,921 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"compress/gzip"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"os"
 	"path/filepath"
-	"strconv"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 func main() {
-	var directory string
+	cmd, args := findCommand(os.Args[1:])
+	os.Exit(cmd.run(args))
+}
+
+// serviceRun connects a server to the service manager running it
+type serviceRun struct {
+	// log receives the server log when --log-file isn't set
+	log io.Writer
+	// started is called once the server is serving
+	started func(s *Server)
+}
 
-	// Parse command line arguments
-	for i, arg := range os.Args {
-		if arg == "--directory" && i+1 < len(os.Args) {
-			directory = os.Args[i+1]
-			break
+// runServer configures a server from args and serves until it shuts down.
+// svc is set when running as a Windows service.
+func runServer(args []string, svc *serviceRun) {
+	cfg, err := parseFlags(args)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(2)
+	}
+	if cfg.showVersion {
+		fmt.Println(currentBuild())
+		return
+	}
+	if cfg.check {
+		os.Exit(runCheck(os.Stdout, cfg))
+	}
+	if cfg.daemon && os.Getenv(daemonEnv) == "" {
+		if cfg.logPath == "" {
+			fmt.Println("warning: --daemon without --log-file discards the server log")
 		}
+		os.Exit(daemonize())
 	}
 
-	s := Server{directory: directory}
+	var defaultLog io.Writer
+	if svc != nil {
+		defaultLog = svc.log
+	}
+	s, err := newServer(cfg, args, defaultLog)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	if svc != nil {
+		s.onReady = func() { svc.started(s) }
+	} else {
+		s.bannerOut = os.Stdout
+	}
 	s.Start()
 }
 
+// newServer builds a server from cfg, parsed from args. defaultLog receives
+// the server log when --log-file isn't set, or stderr when it is nil.
+func newServer(cfg *serverConfig, args []string, defaultLog io.Writer) (*Server, error) {
+	var err error
+	s := &Server{
+		addr:      cfg.addr(),
+		gzip:      newGzipPool(cfg.gzipLevel),
+		reusePort: cfg.reusePort,
+		acceptors: cfg.acceptors,
+		sockOpts:  cfg.sockOpts,
+
+		chunks:            newChunkPool(cfg.fileChunkSize),
+		chunkWriteTimeout: cfg.chunkWriteTimeout,
+
+		maxRate:    cfg.maxRate,
+		routeRates: cfg.routeRates,
+
+		traceWire:     cfg.traceWire,
+		slowThreshold: cfg.slowThreshold,
+		dev:           cfg.dev,
+		features:      configFeatures(cfg),
+		adminAddr:     cfg.adminAddr,
+		metrics:       newServerMetrics(),
+
+		routeStats:         newRouteStats(),
+		routeStatsInterval: cfg.routeStatsInterval,
+		drainTimeout:       cfg.drainTimeout,
+		noKeepAlive:        cfg.noKeepAlive,
+		maxConnRequests:    cfg.maxConnRequests,
+		versionEndpoint:    cfg.versionEndpoint,
+		metricsEndpoint:    cfg.metricsEndpoint,
+		openAPI:            cfg.openAPI || cfg.swaggerUI,
+		swaggerUI:          cfg.swaggerUI,
+		socketMode:         cfg.socketMode,
+		socketOwner:        cfg.socketOwner,
+		ipv6Only:           cfg.ipv6Only,
+	}
+	s.tlsConfig, err = staticTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if s.tlsConfig != nil {
+		s.plainAddr = cfg.plainAddr
+		s.redirectAddr = cfg.redirectAddr
+	}
+	logOut, logFile, err := openLogOutput(cfg.logPath, cfg.logPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	if defaultLog != nil && cfg.logPath == "" {
+		logOut = defaultLog
+	}
+	s.logLevel, s.logFile = cfg.logLevel, logFile
+	s.log, _ = newLogger(logOut, cfg.logLevel, cfg.logFormat)
+
+	if len(cfg.acmeDomains) > 0 {
+		acme := newACMEManager(cfg.acmeDomains, cfg.acmeEmail, cfg.acmeCache, cfg.acmeDirectory, cfg.acmeHTTPAddr, s.log)
+		if err := acme.start(s.bind); err != nil {
+			return nil, fmt.Errorf("failed to start ACME: %w", err)
+		}
+		s.tlsConfig = acme.tlsConfig()
+		if cfg.tlsClientCA != "" {
+			mode, _ := parseClientAuth(cfg.tlsClientAuth)
+			if err := enableClientAuth(s.tlsConfig, cfg.tlsClientCA, mode); err != nil {
+				return nil, fmt.Errorf("failed to load client CA bundle: %w", err)
+			}
+		}
+		s.plainAddr = cfg.plainAddr
+		s.redirectAddr = cfg.redirectAddr
+		// The challenge listener also does the redirecting when they share
+		// an address
+		if cfg.redirectAddr == cfg.acmeHTTPAddr {
+			acme.fallback = s.writeHTTPSRedirect
+			s.redirectAddr = ""
+		}
+	}
+	// The policy is the preset with individual settings layered on top
+	policy := tlsPresets[cfg.tlsPreset].with(cfg.tlsOverrides)
+	if !policy.isZero() {
+		if s.tlsConfig == nil {
+			return nil, errors.New("TLS policy options require TLS to be enabled")
+		}
+		if err := policy.apply(s.tlsConfig); err != nil {
+			return nil, fmt.Errorf("invalid TLS policy: %w", err)
+		}
+	}
+	if s.tlsConfig == nil && cfg.redirectAddr != "" {
+		return nil, errors.New("--redirect-addr requires TLS to be enabled")
+	}
+	// HSTS defaults on when plain HTTP is being redirected to HTTPS
+	if cfg.hstsMaxAge < 0 && cfg.redirectAddr != "" {
+		cfg.hstsMaxAge = defaultHSTSMaxAge
+	}
+	if s.tlsConfig != nil && cfg.hstsMaxAge > 0 {
+		s.hsts = hstsHeader(cfg.hstsMaxAge)
+	}
+	if cfg.maxConnsPerIP > 0 {
+		s.connLimit = newConnLimiter(cfg.maxConnsPerIP)
+	}
+	if cfg.sessions {
+		s.sessions, err = newSessionManager(cfg.sessionSecret, cfg.sessionCookie, cfg.sessionTTL, newMemorySessionStore())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create session key: %w", err)
+		}
+	}
+	// Made even without --csrf-protect, which a reload may turn on
+	s.csrfKey = make([]byte, 32)
+	if _, err := rand.Read(s.csrfKey); err != nil {
+		return nil, fmt.Errorf("failed to create CSRF key: %w", err)
+	}
+	live, err := s.configure(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.setSettings(live)
+	s.args = args
+	// Redacted names only grow, and only at startup, so the log writers can
+	// read them without locking
+	for _, name := range cfg.redactHeaders {
+		secretHeaders = addSecret(secretHeaders, name)
+	}
+	for _, name := range cfg.redactParams {
+		secretParams = addSecret(secretParams, name)
+	}
+	if len(cfg.apiKeyPrefixes) > 0 {
+		// Keys are secrets wherever they're sent from
+		secretHeaders = addSecret(secretHeaders, cfg.apiKeyHeader)
+		if cfg.apiKeyParam != "" {
+			secretParams = addSecret(secretParams, cfg.apiKeyParam)
+		}
+	}
+
+	accessLog, err := openAccessLog(cfg.accessLogDest, cfg.accessLogFormat, cfg.logPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open access log: %w", err)
+	}
+	s.accessLog = accessLog
+	if cfg.auditPath != "" {
+		audit, err := openAuditLog(cfg.auditPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+		s.audit = audit
+	}
+	if len(cfg.webhooks) > 0 {
+		s.webhooks = newWebhooks(cfg.webhooks, cfg.webhookSecret, cfg.webhookRetries, s.log)
+	}
+	if cfg.otlpEndpoint != "" {
+		s.tracer = newTracer(cfg.otlpEndpoint, cfg.serviceName, s.log)
+	}
+	runtime.SetBlockProfileRate(cfg.blockProfileRate)
+	runtime.SetMutexProfileFraction(cfg.mutexProfileFraction)
+	if len(cfg.cacheRoutes) > 0 && !cfg.dev {
+		s.cache = newResponseCache(cfg.cacheRoutes, cfg.cacheTTL, cfg.cacheMaxBytes)
+	}
+	if cfg.maxInFlight > 0 {
+		s.shedder = newLoadShedder(cfg.maxInFlight, cfg.maxQueue, cfg.queueTimeout, cfg.retryAfter)
+	}
+	s.runAsUser, s.runAsGroup, s.chroot = cfg.runAsUser, cfg.runAsGroup, cfg.chroot
+	s.pidFile = cfg.pidFile
+	s.trustedProxies = cfg.trustedProxies
+	s.fastcgi, s.fastcgiRoot = cfg.fastcgi, cfg.fastcgiRoot
+	if len(s.fastcgi) > 0 && s.fastcgiRoot == "" {
+		if cfg.directory == "" {
+			return nil, errors.New("--fastcgi requires --fastcgi-root or --directory")
+		}
+		s.fastcgiRoot, _ = filepath.Abs(cfg.directory)
+	}
+	if cfg.cgiDir != "" {
+		dir, err := filepath.Abs(cfg.cgiDir)
+		if err != nil {
+			return nil, err
+		}
+		s.cgi = newCGIHandler(dir, cfg.cgiPrefix, cfg.cgiTimeout, cfg.cgiMax)
+	}
+	s.proxyProtocol = cfg.proxyProtocol
+	var rec *recorder
+	switch {
+	case cfg.proxyRecord != "" && cfg.proxyReplay != "":
+		return nil, errors.New("--proxy-record and --proxy-replay can't be used together")
+	case cfg.proxyRecord != "":
+		if err := os.MkdirAll(cfg.proxyRecord, 0o755); err != nil {
+			return nil, err
+		}
+		rec = &recorder{dir: cfg.proxyRecord}
+	case cfg.proxyReplay != "":
+		rec = &recorder{dir: cfg.proxyReplay, replay: true}
+		// Upstreams are never contacted, so there is nothing to probe
+		cfg.proxyHealth.path = ""
+	}
+	for _, pc := range cfg.proxies {
+		p := newProxyRoute(pc, cfg.proxyStrategy, cfg.proxyMaxIdle, cfg.proxyConnectTimeout, cfg.proxyHealth)
+		p.recorder = rec
+		s.proxies = append(s.proxies, p)
+	}
+	// Longest prefix first, so matchProxy finds the most specific
+	sort.SliceStable(s.proxies, func(i, j int) bool { return len(s.proxies[i].prefix) > len(s.proxies[j].prefix) })
+	// The cheap type check runs before content scans
+	if len(cfg.denyTypes) > 0 {
+		cfg.scanners = append([]UploadScanner{denyContentTypes(cfg.denyTypes)}, cfg.scanners...)
+	}
+	s.UploadScanners = cfg.scanners
+	if cfg.templateDir != "" {
+		if s.templates, err = loadTemplates(cfg.templateDir, cfg.templateReload || cfg.dev); err != nil {
+			return nil, fmt.Errorf("failed to load templates: %w", err)
+		}
+	}
+	// Plugins may render pages from Init
+	if err := s.loadPlugins(cfg.plugins); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
 type Server struct {
-	listener  net.Listener
-	directory string
+	addr      string
+	listeners []net.Listener
+	gzip      *gzipPool
+	cache     *responseCache
+	shedder   *loadShedder
+	connLimit *connLimiter
+
+	// live holds the settings a reload can change, and args the command
+	// line they are re-read from
+	live atomic.Pointer[liveConfig]
+	args []string
+
+	// overRate counts the requests refused by the server-wide request rate
+	overRate atomic.Uint64
+
+	// With reusePort set, acceptors listeners are opened on the same address
+	// using SO_REUSEPORT, each with its own accept loop
+	reusePort bool
+	acceptors int
+
+	sockOpts socketOptions
+
+	// With tlsConfig set the main listeners speak TLS, and plainAddr
+	// optionally serves plain HTTP alongside them
+	tlsConfig     *tls.Config
+	plainAddr     string
+	plainListener net.Listener
+
+	// redirectAddr serves 301s to the HTTPS equivalent of every request,
+	// and hsts is the Strict-Transport-Security value sent over TLS
+	redirectAddr     string
+	redirectListener net.Listener
+	hsts             string
+
+	// File bodies are streamed in chunks, each with its own write deadline
+	chunks            *chunkPool
+	chunkWriteTimeout time.Duration
+
+	// Keep-alive policy: noKeepAlive closes every connection after one
+	// response, and maxConnRequests caps the responses per connection, 0
+	// meaning unlimited
+	noKeepAlive     bool
+	maxConnRequests int
+
+	// Per-connection response byte rate limits, 0 meaning unlimited
+	maxRate    int64
+	routeRates []routeRate
+
+	log       *slog.Logger
+	logLevel  *slog.LevelVar
+	logFile   *rotatingFile
+	accessLog *accessLogger
+	audit     *auditLog
+	metrics   *serverMetrics
+	tracer    *tracer
+
+	// The account to switch to after binding, and whether to chroot into
+	// the serving directory first
+	runAsUser  string
+	runAsGroup string
+	chroot     bool
+
+	// pidFile holds this process's ID while it runs
+	pidFile string
+	// proxies forward requests under their prefixes to upstreams
+	proxies []*proxyRoute
+	// fastcgi sends matching requests to FastCGI backends, naming scripts
+	// under fastcgiRoot
+	fastcgi     []fastcgiRule
+	fastcgiRoot string
+	// sessions keeps per-client state across requests
+	sessions *sessionManager
+	// apiKeys are the --api-keys, kept across reloads with their rate
+	// limit state
+	apiKeys *apiKeyStore
+	// csrfKey signs CSRF tokens when --csrf-secret isn't set, made once so
+	// tokens stay valid across reloads
+	csrfKey []byte
+	// templates are the pages Render draws on
+	templates *templateSet
+	// pluginRoutes are the routes plugins add
+	pluginRoutes []route
+	// webhooks are told about uploads
+	webhooks *webhooks
+	// cgi runs scripts from a cgi-bin directory
+	cgi *cgiHandler
+	// trustedProxies may name the client they forward for
+	trustedProxies []*net.IPNet
+	// proxyProtocol is set when connections to the HTTP listeners start
+	// with a PROXY protocol header
+	proxyProtocol bool
+
+	// onReady is called once the server is serving
+	onReady func()
+	// ready is closed once ListenAndServe is serving, and initErr is the
+	// error New ran into, returned by ListenAndServe
+	ready   chan struct{}
+	initErr error
+
+	// Middleware added with Use, which runs inside the configured middleware
+	middleware []Middleware
+
+	// Rolling per-route latency and error figures, logged every
+	// routeStatsInterval when it is set
+	routeStats         *routeStats
+	routeStatsInterval time.Duration
+
+	// draining is set once the server starts shutting down, failing
+	// readiness checks so load balancers stop sending traffic. Open
+	// connections are tracked so they can be drained, for up to
+	// drainTimeout.
+	draining     atomic.Bool
+	drainTimeout time.Duration
+	connWG       sync.WaitGroup
+	connsMu      sync.Mutex
+	conns        map[*timeoutConn]struct{}
+
+	// Access applied to unix sockets the server binds; zero values leave
+	// the defaults
+	socketMode  os.FileMode
+	socketOwner string
+
+	// ipv6Only keeps IPv6 listeners from accepting IPv4-mapped connections
+	ipv6Only bool
+
+	// Every listener bound, so an upgrade can hand them to a new process,
+	// and those handed to this one by an old process
+	bound       []boundListener
+	inheritOnce sync.Once
+	inherited   map[string][]net.Listener
+	readyPipe   *os.File
+	upgrading   atomic.Bool
+
+	// versionEndpoint serves the build details at /version
+	versionEndpoint bool
+	// metricsEndpoint serves /metrics on the public listener too
+	metricsEndpoint bool
+	// openAPI serves /openapi.json, and swaggerUI a page browsing it at /docs
+	openAPI   bool
+	swaggerUI bool
+
+	// traceWire logs the raw bytes of every connection
+	traceWire bool
+
+	// features names the optional features the configuration turns on,
+	// and bannerOut, when set, gets the startup banner in readable form
+	features  []string
+	bannerOut io.Writer
+
+	// dev is set by --dev: changed files are picked up as they are saved,
+	// nothing is cached, and every request is logged in detail
+	dev bool
+
+	// Requests taking at least slowThreshold are logged as warnings, 0
+	// disabling the check
+	slowThreshold time.Duration
+
+	// connIDs and reqIDs number connections and requests for log correlation
+	connIDs atomic.Uint64
+	reqIDs  atomic.Uint64
+
+	started time.Time
+
+	// Lifecycle hooks for embedders, all optional. OnAccept runs on the
+	// connection's goroutine before anything is read, and closes the
+	// connection when it returns false. OnRequest runs before the handler;
+	// returning false means the hook wrote the response itself. OnResponse
+	// runs once each response is complete, and OnClose after the
+	// connection is closed with the number of requests it served.
+	OnAccept   func(conn net.Conn) bool
+	OnRequest  func(w ResponseWriter, req *Request) bool
+	OnResponse func(req *Request, status int, written int64, duration time.Duration)
+	OnClose    func(conn net.Conn, requests int)
+
+	// UploadScanners vet every file upload before it is moved into place
+	UploadScanners []UploadScanner
+
+	// Optional admin listener serving the admin API, /metrics, and
+	// /debug/pprof/
+	adminAddr     string
+	adminListener net.Listener
 }
 
 func (s *Server) Start() {
+	s.started = time.Now()
 	s.Listen()
 	defer s.Close()
-	fmt.Println("listening on 0.0.0.0:4221")
+	// Written as root if need be, before dropping privileges
+	if s.pidFile != "" {
+		if err := writePidFile(s.pidFile); err != nil {
+			s.log.Error("failed to write pid file", "path", s.pidFile, "err", err)
+			os.Exit(1)
+		}
+		defer s.removePidFile()
+	}
+	// Privileged ports are bound by now, so root is no longer needed
+	if s.runAsUser != "" || s.runAsGroup != "" || s.chroot {
+		if err := s.dropPrivileges(); err != nil {
+			s.log.Error("failed to drop privileges", "err", err)
+			os.Exit(1)
+		}
+	}
+	s.watchReopenSignal()
+	s.watchReloadSignal()
+	s.watchShutdownSignals()
+	s.watchUpgradeSignal()
+	s.notifyReady()
+	if s.onReady != nil {
+		s.onReady()
+	}
+	s.run()
+}
+
+// run serves on the bound listeners until they are closed, then drains
+func (s *Server) run() {
+	banner := s.startupBanner()
+	banner.log(s.log)
+	if s.bannerOut != nil {
+		banner.print(s.bannerOut)
+	}
 
-	// Handle multiple concurrent connections
+	if s.routeStatsInterval > 0 {
+		go s.logRouteStats(s.routeStatsInterval)
+	}
+	if s.dev {
+		go s.watchDev()
+	}
+	go s.reapIdleConns()
+	for _, p := range s.proxies {
+		p.startHealthChecks(s.log)
+	}
+
+	if s.adminListener != nil {
+		go s.serveAdmin(s.adminListener)
+	}
+
+	// Handle multiple concurrent connections, one accept loop per listener
+	var wg sync.WaitGroup
+	for _, l := range s.listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			s.serve(l, s.tlsConfig)
+		}(l)
+	}
+	if s.redirectListener != nil {
+		go s.serveRedirects(s.redirectListener)
+	}
+	if s.plainListener != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serve(s.plainListener, nil)
+		}()
+	}
+	wg.Wait()
+	if s.draining.Load() {
+		s.drain()
+	}
+}
+
+// serve runs an accept loop on l until it is closed. Connections are
+// wrapped in TLS when config is set; the handshake happens on the first
+// read, under the connection's read deadline.
+func (s *Server) serve(l net.Listener, config *tls.Config) {
 	for {
-		conn := s.Accept()
+		conn, err := s.Accept(l)
+		if err != nil {
+			// Listener closed
+			return
+		}
+		// The PROXY header comes before any TLS record
+		if s.proxyProtocol {
+			timeout := s.settings().timeouts.header
+			if timeout == 0 {
+				timeout = defaultHeaderTimeout
+			}
+			conn = newProxyProtoConn(conn, timeout)
+		}
+		if config != nil {
+			conn = tls.Server(conn, config)
+		}
+		s.connWG.Add(1)
 		go s.handleConnection(conn)
 	}
 }
 
 func (s *Server) handleConnection(conn net.Conn) {
-	defer conn.Close()
+	served := 0
+	defer func() {
+		conn.Close()
+		s.connWG.Done()
+		if s.OnClose != nil {
+			s.OnClose(conn, served)
+		}
+	}()
+	if s.OnAccept != nil && !s.OnAccept(conn) {
+		return
+	}
+	// A client already holding its share of connections gets a 503 and is
+	// closed before anything is read
+	if s.connLimit != nil {
+		ip := remoteIP(conn.RemoteAddr())
+		if !s.connLimit.acquire(ip) {
+			// Written through a pooled writer like any response, with a
+			// short deadline so a client that won't read can't hold on
+			w := getWriter(conn)
+			defer putWriter(w)
+			_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+			_ = writeStatus(w, 503, true)
+			_ = w.Flush()
+			return
+		}
+		defer s.connLimit.release(ip)
+	}
+	connLog := s.log.With("conn_id", s.connIDs.Add(1), "remote", conn.RemoteAddr().String())
+	// Deadlines are set through tc as the connection moves between phases
+	tc := &timeoutConn{Conn: conn, write: s.settings().timeouts.write, opened: time.Now()}
+	tc.lastActive.Store(tc.opened.UnixNano())
+	s.trackConn(tc)
+	defer s.untrackConn(tc)
+	var client net.Conn = tc
+	if s.traceWire {
+		client = &wireConn{Conn: tc, log: connLog}
+	}
+	if s.metrics != nil {
+		s.metrics.openConn.Add(1)
+		defer s.metrics.openConn.Add(-1)
+	}
+
+	// Reader and writer live for the whole connection so buffered bytes
+	// from pipelined requests aren't lost between requests
+	reader := getReader(client)
+	defer putReader(reader)
+	// Response bytes are paced through a token bucket when rates are set
+	var out io.Writer = client
+	var throttle *throttledWriter
+	if s.maxRate > 0 || len(s.routeRates) > 0 {
+		throttle = &throttledWriter{conn: client, writeTimeout: s.chunkWriteTimeout}
+		out = throttle
+	}
+	w := getWriter(out)
+	defer putWriter(w)
+	req := getRequest()
+	defer putRequest(req)
+	req.conn, req.reader = client, reader
+	req.log = connLog
+	resp := getResponse(w, req)
+	defer putResponse(resp)
 
 	for {
-		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		timeouts := &s.settings().timeouts
+		tc.waitIdle(timeouts)
+		if s.draining.Load() {
+			return
+		}
 
-		method, path, headers, reader, err := readRequestAndGetMethodPathAndHeaders(conn)
-		if err != nil {
-			// Connection closed or malformed request, exit loop
+		// Wait for the first byte so an idle keep-alive connection can
+		// close quietly instead of getting a 408
+		if _, err := reader.Peek(1); err != nil {
 			return
 		}
-		fmt.Println("Accepted path:", path)
+		start := time.Now()
+		tc.readHeaders(timeouts, start)
+		var phases requestPhases
+		if err := readRequest(reader, req); err != nil {
+			// Incomplete or malformed request, answer it and exit loop
+			code := requestErrorStatus(err)
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				req.log.Debug("malformed request", "status", code, "err", err)
+				_ = writeStatus(w, code, true)
+				_ = w.Flush()
+			}
+			return
+		}
+		// The handshake completes with the first request
+		if tlsConn, ok := conn.(*tls.Conn); ok && req.tlsState == nil {
+			state := tlsConn.ConnectionState()
+			req.tlsState = &state
+			if subject := clientSubject(&state); subject != "" {
+				req.log = req.log.With("client_subject", subject)
+			}
+		}
+		req.id = s.reqIDs.Add(1)
+		if s.trustedProxies != nil {
+			req.forwardedIP = s.forwardedClient(req)
+		}
+		resp.reset(w, req)
+		live := s.settings()
+		resp.errorPages, resp.headers = live.errorPages, live.headers
+		phases.read = time.Since(start)
+		if s.metrics != nil {
+			s.metrics.inFlight.Add(1)
+		}
+		if s.tracer != nil {
+			startTrace(req)
+		}
+
+		if s.hsts != "" && req.tlsState != nil {
+			resp.header.Set("Strict-Transport-Security", s.hsts)
+		}
+		// Handlers that set their own caching policy override this
+		if s.dev {
+			resp.header.Set("Cache-Control", "no-store")
+		}
 
 		// Check if client wants to close connection
-		connectionHeader := headers["Connection"]
-		shouldClose := strings.ToLower(connectionHeader) == "close"
-
-		// Prepare connection header for responses
-		var connectionResponseHeader string
-		if shouldClose {
-			connectionResponseHeader = "\r\nConnection: close"
-		}
-
-		// Handle different paths
-		if path == "/" {
-			// Minimal valid HTTP response for root path
-			body := "OK\n"
-			resp := fmt.Sprintf(
-				"HTTP/1.1 200 OK\r\nContent-Length: %d\r\nContent-Type: text/plain%s\r\n\r\n%s",
-				len(body), connectionResponseHeader, body,
-			)
-			_, _ = conn.Write([]byte(resp))
-		} else if strings.HasPrefix(path, "/echo/") {
-			// Handle /echo/{str} endpoint
-			str := strings.TrimPrefix(path, "/echo/")
-
-			// Check if client supports gzip compression
-			acceptEncoding := headers["Accept-Encoding"]
-			supportsGzip := strings.Contains(acceptEncoding, "gzip")
-
-			if supportsGzip {
-				// Client supports gzip, compress the response body
-				var buf bytes.Buffer
-				gzipWriter := gzip.NewWriter(&buf)
-				_, err := gzipWriter.Write([]byte(str))
-				if err != nil {
-					resp := "HTTP/1.1 500 Internal Server Error\r\n\r\n"
-					_, _ = conn.Write([]byte(resp))
-					return
-				}
-				err = gzipWriter.Close()
-				if err != nil {
-					resp := "HTTP/1.1 500 Internal Server Error\r\n\r\n"
-					_, _ = conn.Write([]byte(resp))
-					return
-				}
-
-				compressedData := buf.Bytes()
-
-				// Send response headers
-				respHeader := fmt.Sprintf(
-					"HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Encoding: gzip\r\nContent-Length: %d%s\r\n\r\n",
-					len(compressedData), connectionResponseHeader,
-				)
-				_, _ = conn.Write([]byte(respHeader))
-
-				// Send compressed body
-				_, _ = conn.Write(compressedData)
-			} else {
-				// Client doesn't support gzip, send standard response
-				resp := fmt.Sprintf(
-					"HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: %d%s\r\n\r\n%s",
-					len(str), connectionResponseHeader, str,
-				)
-				_, _ = conn.Write([]byte(resp))
+		if strings.EqualFold(req.Header("Connection"), "close") {
+			resp.closeConn = true
+		}
+		// or the keep-alive policy ends it here
+		if s.noKeepAlive || (s.maxConnRequests > 0 && served+1 >= s.maxConnRequests) {
+			resp.closeConn = true
+		}
+
+		if throttle != nil {
+			throttle.setRate(s.rateFor(req.Path))
+		}
+
+		// Refuse the request outright when the server is over its request
+		// rate or saturated
+		if ok, wait := s.allowRequest(); !ok {
+			sendTooManyRequests(resp, wait)
+			s.drainRequestBody(tc, req, resp, timeouts)
+			_ = resp.finish()
+		} else if s.shedder != nil && !s.shedder.acquire() {
+			_ = resp.writeCanned(503, s.shedder.unavailable)
+			resp.closeConn = true
+		} else {
+			tc.startHandler(timeouts)
+			// A false return from OnRequest means the hook answered itself
+			if s.OnRequest == nil || s.OnRequest(resp, req) {
+				s.handleRequest(resp, req)
 			}
-		} else if path == "/user-agent" {
-			// Handle /user-agent endpoint
-			userAgent := headers["User-Agent"]
-			resp := fmt.Sprintf(
-				"HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: %d%s\r\n\r\n%s",
-				len(userAgent), connectionResponseHeader, userAgent,
-			)
-			_, _ = conn.Write([]byte(resp))
-		} else if strings.HasPrefix(path, "/files/") {
-			// Handle /files/{filename} endpoint
-			filename := strings.TrimPrefix(path, "/files/")
-			if method == "GET" {
-				s.handleFileGetRequest(conn, filename)
-			} else if method == "POST" {
-				s.handleFilePostRequest(conn, filename, headers, reader)
-			} else {
-				// Method not allowed
-				resp := fmt.Sprintf("HTTP/1.1 405 Method Not Allowed%s\r\n\r\n", connectionResponseHeader)
-				_, _ = conn.Write([]byte(resp))
+			// Keep-alive ends with the current request once shutdown starts
+			if s.draining.Load() {
+				resp.closeConn = true
 			}
-		} else {
-			// Return 404 for any other path
-			resp := fmt.Sprintf("HTTP/1.1 404 Not Found\r\nContent-Length: 0%s\r\n\r\n", connectionResponseHeader)
-			_, _ = conn.Write([]byte(resp))
+			if tc.finishHandler() {
+				// Nothing reached the client, so whatever the handler
+				// buffered is replaced by a 503
+				req.Logger().Warn("handler timed out", "timeout", timeouts.handler)
+				w.Reset(out)
+				resp.reset(w, req)
+				_ = resp.writeCanned(503, cannedResponses[503][1])
+				resp.closeConn = true
+			}
+			s.drainRequestBody(tc, req, resp, timeouts)
+			_ = resp.finish()
+			if s.shedder != nil {
+				s.shedder.release()
+			}
+		}
+
+		duration := time.Since(start)
+		phases.handler = duration - phases.read
+		served++
+		tc.requests.Add(1)
+		if s.OnResponse != nil {
+			s.OnResponse(req, resp.status, resp.written, duration)
+		}
+		if s.metrics != nil {
+			s.metrics.inFlight.Add(-1)
+			s.metrics.observeRequest(req, resp, duration)
+		}
+		if s.routeStats != nil {
+			s.routeStats.observe(routeLabel(req), resp.status, duration)
+		}
+		if s.tracer != nil {
+			s.tracer.finish(req, resp, start, start.Add(duration))
+		}
+		if s.accessLog != nil {
+			s.accessLog.log(req, resp, duration)
+		}
+		if s.logLevel.Level() <= slog.LevelDebug {
+			req.Logger().Debug("request completed", "status", resp.status, "bytes", resp.written, "duration", duration)
 		}
 
-		// Close connection if requested by client
-		if shouldClose {
+		// Push the buffered response out before waiting for the next request
+		flushStart := time.Now()
+		err := resp.failed(w.Flush())
+		if s.slowThreshold > 0 || s.dev {
+			phases.write = time.Since(flushStart)
+			if s.slowThreshold > 0 && phases.total() >= s.slowThreshold {
+				s.logSlowRequest(req, resp, phases)
+			}
+			if s.dev {
+				s.logDevRequest(req, resp, phases)
+			}
+		}
+		if err != nil {
+			s.responseAborted(req, resp, err)
+			return
+		}
+		if resp.closeConn {
 			return
 		}
 	}
 }
 
-func (s *Server) handleFileGetRequest(conn net.Conn, filename string) {
-	if s.directory == "" {
-		// No directory specified, return 404
-		resp := "HTTP/1.1 404 Not Found\r\n\r\n"
-		_, _ = conn.Write([]byte(resp))
-		return
-	}
-
-	// Construct full file path
-	filePath := filepath.Join(s.directory, filename)
-
-	// Check if file exists and read it
-	file, err := os.Open(filePath)
-	if err != nil {
-		// File doesn't exist or can't be opened, return 404
-		resp := "HTTP/1.1 404 Not Found\r\n\r\n"
-		_, _ = conn.Write([]byte(resp))
-		return
-	}
-	defer file.Close()
-
-	// Get file size
-	fileInfo, err := file.Stat()
-	if err != nil {
-		resp := "HTTP/1.1 404 Not Found\r\n\r\n"
-		_, _ = conn.Write([]byte(resp))
-		return
+// responseAborted records a response the connection failed partway
+// through. Whatever the handler did after the failure went nowhere.
+func (s *Server) responseAborted(req *Request, resp *response, err error) {
+	if s.metrics != nil {
+		s.metrics.aborted.Add(1)
 	}
-
-	// Send response headers
-	resp := fmt.Sprintf(
-		"HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nContent-Length: %d\r\n\r\n",
-		fileInfo.Size(),
-	)
-	_, _ = conn.Write([]byte(resp))
-
-	// Send file contents
-	_, _ = io.Copy(conn, file)
+	req.Logger().Debug("response aborted", "status", resp.status, "bytes", resp.written, "err", err)
 }
 
-func (s *Server) handleFilePostRequest(conn net.Conn, filename string, headers map[string]string, reader *bufio.Reader) {
-	if s.directory == "" {
-		// No directory specified, return 404
-		resp := "HTTP/1.1 404 Not Found\r\n\r\n"
-		_, _ = conn.Write([]byte(resp))
-		return
+func (s *Server) Listen() {
+	if err := s.listen(); err != nil {
+		s.log.Error("failed to bind", "err", err)
+		os.Exit(1)
 	}
+}
 
-	// Get content length
-	contentLengthStr, ok := headers["Content-Length"]
-	if !ok {
-		resp := "HTTP/1.1 400 Bad Request\r\n\r\n"
-		_, _ = conn.Write([]byte(resp))
-		return
+// listen binds every listener the server is configured for
+func (s *Server) listen() error {
+	n := 1
+	// Keep-alive is applied per connection from sockOpts instead
+	lc := net.ListenConfig{KeepAlive: -1}
+	if network, _ := splitListenAddr(s.addr); s.reusePort && network == "tcp" {
+		n = s.acceptors
+		lc.Control = setReusePort
 	}
 
-	contentLength, err := strconv.Atoi(contentLengthStr)
-	if err != nil || contentLength < 0 {
-		resp := "HTTP/1.1 400 Bad Request\r\n\r\n"
-		_, _ = conn.Write([]byte(resp))
-		return
+	for i := 0; i < n; i++ {
+		l, err := s.bind("main", s.addr, &lc)
+		if err != nil {
+			return err
+		}
+		if err := s.sockOpts.applyListener(l); err != nil {
+			s.log.Warn("failed to apply backlog hint", "err", err)
+		}
+		s.listeners = append(s.listeners, l)
 	}
 
-	// Read request body
-	body := make([]byte, contentLength)
-	_, err = io.ReadFull(reader, body)
-	if err != nil {
-		resp := "HTTP/1.1 400 Bad Request\r\n\r\n"
-		_, _ = conn.Write([]byte(resp))
-		return
+	if s.plainAddr != "" {
+		l, err := s.bind("plain", s.plainAddr, &lc)
+		if err != nil {
+			return fmt.Errorf("plain HTTP listener: %w", err)
+		}
+		s.plainListener = l
 	}
 
-	// Create file path
-	filePath := filepath.Join(s.directory, filename)
-
-	// Create and write file
-	file, err := os.Create(filePath)
-	if err != nil {
-		resp := "HTTP/1.1 500 Internal Server Error\r\n\r\n"
-		_, _ = conn.Write([]byte(resp))
-		return
+	if s.redirectAddr != "" {
+		l, err := s.bind("redirect", s.redirectAddr, nil)
+		if err != nil {
+			return fmt.Errorf("redirect listener: %w", err)
+		}
+		s.redirectListener = l
 	}
-	defer file.Close()
 
-	_, err = file.Write(body)
-	if err != nil {
-		resp := "HTTP/1.1 500 Internal Server Error\r\n\r\n"
-		_, _ = conn.Write([]byte(resp))
-		return
+	if s.adminAddr != "" {
+		l, err := s.bind("admin", s.adminAddr, nil)
+		if err != nil {
+			return fmt.Errorf("admin listener: %w", err)
+		}
+		s.adminListener = l
 	}
-
-	// Return 201 Created
-	resp := "HTTP/1.1 201 Created\r\n\r\n"
-	_, _ = conn.Write([]byte(resp))
+	return nil
 }
 
-func readRequestAndGetMethodPathAndHeaders(conn net.Conn) (string, string, map[string]string, *bufio.Reader, error) {
-	r := bufio.NewReader(conn)
-
-	// Request line: METHOD SP PATH SP VERSION CRLF
-	reqLine, err := r.ReadString('\n')
-	if err != nil {
-		return "", "", nil, nil, err
-	}
-	reqLine = strings.TrimRight(reqLine, "\r\n")
-	parts := strings.Fields(reqLine)
-	if len(parts) != 3 {
-		return "", "", nil, nil, fmt.Errorf("bad request line")
-	}
-	method, path, version := parts[0], parts[1], parts[2]
-	if !strings.HasPrefix(version, "HTTP/") {
-		return "", "", nil, nil, fmt.Errorf("not http")
-	}
-
-	// Read headers until blank line
-	headers := make(map[string]string)
+// Accept waits for the next connection on l. Transient failures such as
+// running out of file descriptors are retried with backoff; the only error
+// returned is the listener being closed.
+func (s *Server) Accept(l net.Listener) (net.Conn, error) {
+	var backoff time.Duration
 	for {
-		line, err := r.ReadString('\n')
-		if err != nil {
-			return "", "", nil, nil, err
+		conn, err := l.Accept()
+		if err == nil {
+			s.log.Debug("accepted connection", "remote", conn.RemoteAddr().String())
+			if err := s.sockOpts.applyConn(conn); err != nil {
+				s.log.Warn("failed to apply socket options", "remote", conn.RemoteAddr().String(), "err", err)
+			}
+			return conn, nil
 		}
-		if line == "\r\n" { // end of headers
-			break
+		if errors.Is(err, net.ErrClosed) {
+			return nil, err
 		}
-		// Parse header: Name: Value
-		line = strings.TrimRight(line, "\r\n")
-		colonIndex := strings.Index(line, ":")
-		if colonIndex > 0 {
-			name := strings.TrimSpace(line[:colonIndex])
-			value := strings.TrimSpace(line[colonIndex+1:])
-			headers[name] = value
+
+		if backoff == 0 {
+			backoff = 5 * time.Millisecond
+		} else if backoff *= 2; backoff > time.Second {
+			backoff = time.Second
+		}
+		if isTemporaryAcceptError(err) {
+			s.log.Warn("temporary error accepting connection", "err", err, "retry_in", backoff)
+		} else {
+			s.log.Error("error accepting connection", "err", err, "retry_in", backoff)
 		}
+		time.Sleep(backoff)
 	}
-	return method, path, headers, r, nil
 }
 
-func (s *Server) Listen() {
-	l, err := net.Listen("tcp", "0.0.0.0:4221")
-	if err != nil {
-		fmt.Println("Failed to bind to port 4221")
-		os.Exit(1)
+// isTemporaryAcceptError reports whether an accept error is expected to
+// clear up on its own, like descriptor exhaustion or a client aborting
+// before the handshake finished
+func isTemporaryAcceptError(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
 	}
-	s.listener = l
-}
-
-func (s *Server) Accept() net.Conn {
-	conn, err := s.listener.Accept()
-	if err != nil {
-		fmt.Println("Error accepting connection:", err.Error())
-		os.Exit(1)
+	for _, errno := range []syscall.Errno{
+		syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM,
+		syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EINTR,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
 	}
-	fmt.Println("Accepted connection from:", conn.RemoteAddr())
-	return conn
+	return false
 }
 
 func (s *Server) Close() {
-	if err := s.listener.Close(); err != nil {
-		fmt.Println("Failed to close listener:", err.Error())
+	if s.adminListener != nil {
+		_ = s.adminListener.Close()
+	}
+	if s.plainListener != nil {
+		_ = s.plainListener.Close()
+	}
+	if s.redirectListener != nil {
+		_ = s.redirectListener.Close()
+	}
+	for _, l := range s.listeners {
+		// Shutdown may have closed them already
+		if err := l.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			s.log.Warn("failed to close listener", "err", err)
+		}
 	}
 }
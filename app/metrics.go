@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Histogram bucket upper bounds
+var (
+	durationBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	sizeBuckets     = []float64{100, 1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20, 100 << 20}
+	ratioBuckets    = []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1}
+)
+
+// histogram is a lock-free Prometheus-style histogram. counts holds
+// per-bucket observations and is made cumulative when exposed.
+type histogram struct {
+	bounds []float64
+	counts []atomic.Uint64 // len(bounds)+1, the last being +Inf
+	count  atomic.Uint64
+	sum    atomic.Uint64 // float64 bits
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// requestKey identifies one series of http_requests_total
+type requestKey struct {
+	route  string
+	method string
+	status int
+}
+
+// serverMetrics collects the numbers exposed on /metrics. Label values are
+// kept to small fixed sets (route templates, known methods, status codes)
+// so the number of series stays bounded.
+type serverMetrics struct {
+	requests  sync.Map // requestKey -> *atomic.Uint64
+	durations sync.Map // route -> *histogram
+	sizes     sync.Map // route -> *histogram
+
+	inFlight atomic.Int64
+	openConn atomic.Int64
+	// aborted counts responses cut short by a failed write, and
+	// idleClosed connections closed by the idle reaper
+	aborted    atomic.Uint64
+	idleClosed atomic.Uint64
+
+	compressionRatio  *histogram
+	compressedBytes   atomic.Uint64
+	uncompressedBytes atomic.Uint64
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{compressionRatio: newHistogram(ratioBuckets)}
+}
+
+// metricMethod maps a request method onto a fixed set of label values
+func metricMethod(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "DELETE", "PATCH", "OPTIONS":
+		return method
+	}
+	return "OTHER"
+}
+
+// observeRequest records a finished request
+func (m *serverMetrics) observeRequest(req *Request, resp *response, duration time.Duration) {
+	route := routeLabel(req)
+	key := requestKey{route: route, method: metricMethod(req.Method), status: resp.status}
+	c, ok := m.requests.Load(key)
+	if !ok {
+		c, _ = m.requests.LoadOrStore(key, new(atomic.Uint64))
+	}
+	c.(*atomic.Uint64).Add(1)
+
+	loadHistogram(&m.durations, route, durationBuckets).observe(duration.Seconds())
+	loadHistogram(&m.sizes, route, sizeBuckets).observe(float64(resp.written))
+}
+
+// observeCompression records one compressed response body
+func (m *serverMetrics) observeCompression(uncompressed, compressed int) {
+	m.uncompressedBytes.Add(uint64(uncompressed))
+	m.compressedBytes.Add(uint64(compressed))
+	if uncompressed > 0 {
+		m.compressionRatio.observe(float64(compressed) / float64(uncompressed))
+	}
+}
+
+func loadHistogram(m *sync.Map, route string, bounds []float64) *histogram {
+	h, ok := m.Load(route)
+	if !ok {
+		h, _ = m.LoadOrStore(route, newHistogram(bounds))
+	}
+	return h.(*histogram)
+}
+
+// handleMetrics serves the metrics in the Prometheus text format, when
+// --metrics-endpoint is set. The admin listener always serves them.
+func (s *Server) handleMetrics(w ResponseWriter, req *Request) {
+	if !s.metricsEndpoint {
+		sendStatus(w, 404)
+		return
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		sendStatus(w, 405)
+		return
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	s.writeMetrics(buf)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// writeMetrics renders every metric in the Prometheus text exposition format
+func (s *Server) writeMetrics(b *bytes.Buffer) {
+	m := s.metrics
+	if m == nil {
+		return
+	}
+
+	build := currentBuild()
+	writeMetricHeader(b, "http_server_build_info", "gauge", "Always 1, labelled with the running build.")
+	fmt.Fprintf(b, "http_server_build_info{version=%q,commit=%q,go_version=%q} 1\n", build.Version, build.Commit, build.GoVersion)
+
+	writeMetricHeader(b, "http_requests_total", "counter", "Requests served, by route, method, and status.")
+	var keys []requestKey
+	m.requests.Range(func(k, _ any) bool {
+		keys = append(keys, k.(requestKey))
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		a, c := keys[i], keys[j]
+		if a.route != c.route {
+			return a.route < c.route
+		}
+		if a.method != c.method {
+			return a.method < c.method
+		}
+		return a.status < c.status
+	})
+	for _, k := range keys {
+		c, _ := m.requests.Load(k)
+		fmt.Fprintf(b, "http_requests_total{route=%q,method=%q,status=\"%d\"} %d\n",
+			k.route, k.method, k.status, c.(*atomic.Uint64).Load())
+	}
+
+	writeMetricHeader(b, "http_request_duration_seconds", "histogram", "Time from reading a request to finishing its response.")
+	writeRouteHistograms(b, "http_request_duration_seconds", &m.durations)
+	writeMetricHeader(b, "http_response_size_bytes", "histogram", "Response body sizes.")
+	writeRouteHistograms(b, "http_response_size_bytes", &m.sizes)
+
+	writeMetricHeader(b, "http_requests_in_flight", "gauge", "Requests currently being handled.")
+	fmt.Fprintf(b, "http_requests_in_flight %d\n", m.inFlight.Load())
+	writeMetricHeader(b, "http_open_connections", "gauge", "Client connections currently open.")
+	fmt.Fprintf(b, "http_open_connections %d\n", m.openConn.Load())
+	writeMetricHeader(b, "http_connections_idle_closed_total", "counter", "Idle connections closed by the reaper after the idle timeout.")
+	fmt.Fprintf(b, "http_connections_idle_closed_total %d\n", m.idleClosed.Load())
+	writeMetricHeader(b, "http_responses_aborted_total", "counter", "Responses cut short because writing to the connection failed.")
+	fmt.Fprintf(b, "http_responses_aborted_total %d\n", m.aborted.Load())
+
+	writeMetricHeader(b, "http_compression_ratio", "histogram", "Compressed size over uncompressed size of gzip responses.")
+	writeHistogram(b, "http_compression_ratio", "", m.compressionRatio)
+	writeMetricHeader(b, "http_compression_input_bytes_total", "counter", "Bytes fed to the gzip encoder.")
+	fmt.Fprintf(b, "http_compression_input_bytes_total %d\n", m.uncompressedBytes.Load())
+	writeMetricHeader(b, "http_compression_output_bytes_total", "counter", "Bytes produced by the gzip encoder.")
+	fmt.Fprintf(b, "http_compression_output_bytes_total %d\n", m.compressedBytes.Load())
+
+	if s.cache != nil {
+		hits, misses := s.cache.Stats()
+		writeMetricHeader(b, "http_cache_hits_total", "counter", "Responses served from the response cache.")
+		fmt.Fprintf(b, "http_cache_hits_total %d\n", hits)
+		writeMetricHeader(b, "http_cache_misses_total", "counter", "Cacheable requests not found in the response cache.")
+		fmt.Fprintf(b, "http_cache_misses_total %d\n", misses)
+	}
+	live := s.settings()
+	if live.limiter != nil {
+		clients, limited := live.limiter.Stats()
+		writeMetricHeader(b, "http_rate_limit_clients", "gauge", "Clients with a rate limit bucket.")
+		fmt.Fprintf(b, "http_rate_limit_clients %d\n", clients)
+		writeMetricHeader(b, "http_rate_limited_total", "counter", "Requests refused with 429 by the per-client rate limit.")
+		fmt.Fprintf(b, "http_rate_limited_total %d\n", limited)
+	}
+	if s.connLimit != nil {
+		writeMetricHeader(b, "http_connections_refused_total", "counter", "Connections refused because their client had too many open.")
+		fmt.Fprintf(b, "http_connections_refused_total %d\n", s.connLimit.refused.Load())
+	}
+	if live.requestLimit != nil {
+		writeMetricHeader(b, "http_requests_over_rate_total", "counter", "Requests refused with 429 by the server-wide request rate.")
+		fmt.Fprintf(b, "http_requests_over_rate_total %d\n", s.overRate.Load())
+	}
+	if s.shedder != nil {
+		_, queued, shed := s.shedder.Stats()
+		writeMetricHeader(b, "http_requests_queued", "gauge", "Requests waiting for a handler slot.")
+		fmt.Fprintf(b, "http_requests_queued %d\n", queued)
+		writeMetricHeader(b, "http_requests_shed_total", "counter", "Requests refused with 503 because the server was saturated.")
+		fmt.Fprintf(b, "http_requests_shed_total %d\n", shed)
+	}
+	if upstreams := s.upstreamStatuses(); len(upstreams) > 0 {
+		writeMetricHeader(b, "http_proxy_upstream_healthy", "gauge", "1 while a proxy upstream is in rotation, 0 once health checks eject it.")
+		for _, u := range upstreams {
+			healthy := 0
+			if u.Healthy {
+				healthy = 1
+			}
+			fmt.Fprintf(b, "http_proxy_upstream_healthy{prefix=%q,upstream=%q} %d\n", u.Prefix, u.URL, healthy)
+		}
+		writeMetricHeader(b, "http_proxy_upstream_active_requests", "gauge", "Requests in flight to a proxy upstream.")
+		for _, u := range upstreams {
+			fmt.Fprintf(b, "http_proxy_upstream_active_requests{prefix=%q,upstream=%q} %d\n", u.Prefix, u.URL, u.Active)
+		}
+		writeMetricHeader(b, "http_proxy_upstream_requests_total", "counter", "Requests sent to a proxy upstream.")
+		for _, u := range upstreams {
+			fmt.Fprintf(b, "http_proxy_upstream_requests_total{prefix=%q,upstream=%q} %d\n", u.Prefix, u.URL, u.Requests)
+		}
+		writeMetricHeader(b, "http_proxy_upstream_errors_total", "counter", "Requests to a proxy upstream that got no response.")
+		for _, u := range upstreams {
+			fmt.Fprintf(b, "http_proxy_upstream_errors_total{prefix=%q,upstream=%q} %d\n", u.Prefix, u.URL, u.Errors)
+		}
+	}
+}
+
+func writeMetricHeader(b *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeRouteHistograms(b *bytes.Buffer, name string, m *sync.Map) {
+	var routes []string
+	m.Range(func(k, _ any) bool {
+		routes = append(routes, k.(string))
+		return true
+	})
+	sort.Strings(routes)
+	for _, route := range routes {
+		h, _ := m.Load(route)
+		writeHistogram(b, name, "route="+strconv.Quote(route), h.(*histogram))
+	}
+}
+
+// writeHistogram writes the _bucket, _sum, and _count series of h with the
+// given extra labels
+func writeHistogram(b *bytes.Buffer, name, labels string, h *histogram) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i].Load()
+		fmt.Fprintf(b, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	cumulative += h.counts[len(h.bounds)].Load()
+	fmt.Fprintf(b, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, cumulative)
+
+	suffix := ""
+	if labels != "" {
+		suffix = "{" + labels + "}"
+	}
+	fmt.Fprintf(b, "%s_sum%s %s\n", name, suffix, strconv.FormatFloat(math.Float64frombits(h.sum.Load()), 'g', -1, 64))
+	fmt.Fprintf(b, "%s_count%s %d\n", name, suffix, h.count.Load())
+}
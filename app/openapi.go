@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RouteDoc describes one method of a route for /openapi.json. Plugins
+// document their routes by also implementing RouteDocumenter.
+type RouteDoc struct {
+	Method       string
+	Summary      string
+	RequestType  string         // media type of the request body, if it has one
+	ResponseType string         // media type of successful responses
+	Responses    map[int]string // status to description, 200 when empty
+}
+
+// RouteDocumenter is implemented by RouteProvider plugins whose routes
+// should appear in /openapi.json, keyed by the same templates as Routes
+type RouteDocumenter interface {
+	RouteDocs() map[string][]RouteDoc
+}
+
+// The document is built from the route table, so its own routes are added
+// to the table here rather than in it
+func init() {
+	routes = append(routes, newRoutes([]route{
+		{pattern: "/openapi.json", handler: (*Server).handleOpenAPI},
+		{pattern: "/docs", handler: (*Server).handleSwaggerUI},
+	})...)
+}
+
+// swaggerUIPage loads Swagger UI from a CDN and points it at /openapi.json
+const swaggerUIPage = `<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>API docs</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: "/openapi.json", dom_id: "#ui"})</script>
+</body>
+</html>
+`
+
+// handleOpenAPI serves the OpenAPI document, when --openapi is set
+func (s *Server) handleOpenAPI(w ResponseWriter, req *Request) {
+	if !s.openAPI {
+		sendStatus(w, 404)
+		return
+	}
+	body, _ := json.MarshalIndent(s.openAPIDocument(), "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(append(body, '\n'))
+}
+
+// handleSwaggerUI serves a page browsing the OpenAPI document, when
+// --swagger-ui is set
+func (s *Server) handleSwaggerUI(w ResponseWriter, req *Request) {
+	if !s.openAPI || !s.swaggerUI {
+		sendStatus(w, 404)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(swaggerUIPage))
+}
+
+// openAPIDocument describes the documented routes this server answers:
+// plugin routes, then the built-in ones that are switched on
+func (s *Server) openAPIDocument() map[string]any {
+	paths := make(map[string]any)
+	add := func(r route) {
+		if len(r.docs) == 0 {
+			return
+		}
+		if _, ok := paths[r.pattern]; ok {
+			// Plugin routes shadow built-in ones
+			return
+		}
+		ops := make(map[string]any)
+		for _, d := range r.docs {
+			ops[strings.ToLower(d.Method)] = openAPIOperation(r, d)
+		}
+		paths[r.pattern] = ops
+	}
+	for _, r := range s.pluginRoutes {
+		add(r)
+	}
+	for _, r := range routes {
+		switch {
+		case r.pattern == "/version" && !s.versionEndpoint:
+		case r.pattern == "/metrics" && !s.metricsEndpoint:
+		case r.pattern == "/files/{filename}" && s.settings().directory == "":
+		default:
+			add(r)
+		}
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info":    map[string]string{"title": "http-server", "version": version},
+		"paths":   paths,
+	}
+}
+
+func openAPIOperation(r route, d RouteDoc) map[string]any {
+	op := map[string]any{}
+	if d.Summary != "" {
+		op["summary"] = d.Summary
+	}
+	if r.param != "" {
+		op["parameters"] = []map[string]any{{
+			"name": r.param, "in": "path", "required": true,
+			"schema": map[string]string{"type": "string"},
+		}}
+	}
+	if d.RequestType != "" {
+		op["requestBody"] = map[string]any{
+			"required": true,
+			"content":  map[string]any{d.RequestType: map[string]any{}},
+		}
+	}
+	statuses := d.Responses
+	if len(statuses) == 0 {
+		statuses = map[int]string{200: http.StatusText(200)}
+	}
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	responses := make(map[string]any, len(codes))
+	for _, code := range codes {
+		resp := map[string]any{"description": statuses[code]}
+		if code < 300 && d.ResponseType != "" {
+			resp["content"] = map[string]any{d.ResponseType: map[string]any{}}
+		}
+		responses[strconv.Itoa(code)] = resp
+	}
+	op["responses"] = responses
+	return op
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// readPidFile returns the process ID recorded in path
+func readPidFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// writePidFile records this process's ID in path. It refuses if the file
+// names another process that is still running, unless that is the process
+// that started this one in an upgrade.
+func writePidFile(path string) error {
+	if pid, err := readPidFile(path); err == nil && pid != os.Getpid() && pid != os.Getppid() && processRunning(pid) {
+		return fmt.Errorf("already running as pid %d", pid)
+	}
+	// Written in full before it appears, so a reader never sees it empty
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".pid-*")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(tmp, "%d\n", os.Getpid())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// removePidFile deletes the pid file on exit, unless a process that took
+// over in an upgrade has already replaced it
+func (s *Server) removePidFile() {
+	// The path means something else inside the chroot
+	if s.chroot {
+		return
+	}
+	if pid, err := readPidFile(s.pidFile); err != nil || pid != os.Getpid() {
+		return
+	}
+	if err := os.Remove(s.pidFile); err != nil {
+		s.log.Warn("failed to remove pid file", "path", s.pidFile, "err", err)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"plugin"
+	"strconv"
+	"strings"
+)
+
+// Plugin adds site-specific behaviour without patching the server. A
+// plugin implements any of PluginInit, RouteProvider, and Interceptor.
+//
+// Plugins built into the binary call RegisterPlugin from an init function
+// in a file of their own. Plugins loaded with --plugin are Go plugin .so
+// files; see httpPlugin.
+type Plugin interface {
+	Name() string
+}
+
+// PluginInit plugins are set up once the server is configured, before it
+// starts. An error stops the server from starting.
+type PluginInit interface {
+	Init(s *Server) error
+}
+
+// RouteProvider plugins add routes, keyed by path template as in the
+// built-in route table, e.g. "/hello/{name}". They are matched before the
+// built-in routes.
+type RouteProvider interface {
+	Routes() map[string]HandlerFunc
+}
+
+// Interceptor plugins wrap every route, seeing each request before its
+// handler and each response as it is written. They run inside the
+// configured middleware, in the order the plugins were loaded.
+type Interceptor interface {
+	Intercept(next HandlerFunc) HandlerFunc
+}
+
+var registeredPlugins []Plugin
+
+// RegisterPlugin builds p into the server. It must be called from an init
+// function.
+func RegisterPlugin(p Plugin) {
+	registeredPlugins = append(registeredPlugins, p)
+}
+
+// loadPlugins sets up the built-in plugins and then those in paths
+func (s *Server) loadPlugins(paths []string) error {
+	plugins := append([]Plugin(nil), registeredPlugins...)
+	for _, path := range paths {
+		p, err := openPlugin(path)
+		if err != nil {
+			return err
+		}
+		plugins = append(plugins, p)
+	}
+
+	var table []route
+	for _, p := range plugins {
+		if pi, ok := p.(PluginInit); ok {
+			if err := pi.Init(s); err != nil {
+				return fmt.Errorf("plugin %s: %w", p.Name(), err)
+			}
+		}
+		if rp, ok := p.(RouteProvider); ok {
+			var docs map[string][]RouteDoc
+			if rd, ok := p.(RouteDocumenter); ok {
+				docs = rd.RouteDocs()
+			}
+			for pattern, handler := range rp.Routes() {
+				if !strings.HasPrefix(pattern, "/") {
+					return fmt.Errorf("plugin %s: route %q must start with /", p.Name(), pattern)
+				}
+				table = append(table, route{pattern: pattern, handler: handler, docs: docs[pattern]})
+			}
+		}
+		if ic, ok := p.(Interceptor); ok {
+			s.Use(ic.Intercept)
+		}
+		s.log.Info("loaded plugin", "name", p.Name())
+	}
+	s.pluginRoutes = sortRoutes(append(s.pluginRoutes, newRoutes(table)...))
+	return nil
+}
+
+// httpPlugin is what a .so loaded with --plugin exports as its Plugin
+// symbol. A .so can't import package main, so it is written against
+// net/http instead:
+//
+//	type plugin struct{}
+//	func (plugin) Name() string { return "hello" }
+//	func (plugin) Routes() map[string]http.Handler { ... }
+//	func (plugin) Wrap(next http.Handler) http.Handler { return next }
+//	var Plugin plugin
+//
+// Built with go build -buildmode=plugin against the same Go version. Wrap
+// sees the request's headers but can't change what the server's own
+// handlers see; it can change the response by wrapping the writer.
+type httpPlugin interface {
+	Name() string
+	Routes() map[string]http.Handler
+	Wrap(next http.Handler) http.Handler
+}
+
+// soPlugin adapts an httpPlugin to the server's handler types
+type soPlugin struct {
+	httpPlugin
+}
+
+func openPlugin(path string) (Plugin, error) {
+	so, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := so.Lookup("Plugin")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	p, ok := sym.(httpPlugin)
+	if !ok {
+		return nil, errors.New(path + ": Plugin doesn't have the Name, Routes, and Wrap methods")
+	}
+	return soPlugin{p}, nil
+}
+
+func (p soPlugin) Routes() map[string]HandlerFunc {
+	routes := make(map[string]HandlerFunc)
+	for pattern, h := range p.httpPlugin.Routes() {
+		// As with http.ServeMux, a trailing slash matches the whole subtree
+		if strings.HasSuffix(pattern, "/") {
+			pattern += "{path}"
+		}
+		routes[pattern] = func(s *Server, w ResponseWriter, req *Request) {
+			h.ServeHTTP(&httpWriter{w: w, header: make(http.Header)}, toHTTPRequest(req))
+		}
+	}
+	return routes
+}
+
+func (p soPlugin) Intercept(next HandlerFunc) HandlerFunc {
+	return func(s *Server, w ResponseWriter, req *Request) {
+		inner := http.HandlerFunc(func(hw http.ResponseWriter, _ *http.Request) {
+			next(s, &nativeWriter{w: hw}, req)
+		})
+		p.Wrap(inner).ServeHTTP(&httpWriter{w: w, header: make(http.Header)}, toHTTPRequest(req))
+	}
+}
+
+// toHTTPRequest presents req as a net/http request, reading the body from
+// the connection
+func toHTTPRequest(req *Request) *http.Request {
+	var body io.Reader = http.NoBody
+	var length int64
+	if n, err := strconv.ParseInt(req.Header("Content-Length"), 10, 64); err == nil && n > 0 {
+		body, length = req.body, n
+	}
+	scheme := "http"
+	if req.tlsState != nil {
+		scheme = "https"
+	}
+	hr, err := http.NewRequest(req.Method, scheme+"://"+req.Header("Host")+req.Target, body)
+	if err != nil {
+		// The target already parsed once; fall back to the path alone
+		hr, _ = http.NewRequest(req.Method, req.Path, body)
+	}
+	hr.ContentLength = length
+	hr.RequestURI = req.Target
+	hr.Proto = req.Version
+	hr.ProtoMajor, hr.ProtoMinor, _ = http.ParseHTTPVersion(req.Version)
+	hr.Host = req.Header("Host")
+	hr.TLS = req.tlsState
+	if req.conn != nil {
+		hr.RemoteAddr = req.conn.RemoteAddr().String()
+	}
+	for _, h := range req.Headers() {
+		hr.Header.Add(h[0], h[1])
+	}
+	return hr
+}
+
+// httpWriter is a net/http ResponseWriter writing to one of ours
+type httpWriter struct {
+	w      ResponseWriter
+	header http.Header
+	wrote  bool
+}
+
+func (hw *httpWriter) Header() http.Header {
+	return hw.header
+}
+
+func (hw *httpWriter) WriteHeader(code int) {
+	if hw.wrote {
+		return
+	}
+	hw.wrote = true
+	for name, values := range hw.header {
+		for _, v := range values {
+			hw.w.Header().Add(name, v)
+		}
+	}
+	hw.w.WriteHeader(code)
+}
+
+func (hw *httpWriter) Write(p []byte) (int, error) {
+	hw.WriteHeader(200)
+	return hw.w.Write(p)
+}
+
+func (hw *httpWriter) Flush() {
+	if f, ok := hw.w.(flusher); ok {
+		_ = f.Flush()
+	}
+}
+
+// nativeWriter is one of our ResponseWriters writing to a net/http one
+type nativeWriter struct {
+	w      http.ResponseWriter
+	header Header
+	wrote  bool
+}
+
+func (nw *nativeWriter) Header() *Header {
+	return &nw.header
+}
+
+func (nw *nativeWriter) WriteHeader(code int) {
+	if nw.wrote {
+		return
+	}
+	nw.wrote = true
+	for _, f := range nw.header.fields {
+		nw.w.Header().Add(f[0], f[1])
+	}
+	nw.w.WriteHeader(code)
+}
+
+func (nw *nativeWriter) Write(p []byte) (int, error) {
+	nw.WriteHeader(200)
+	return nw.w.Write(p)
+}
+
+func (nw *nativeWriter) Flush() error {
+	if f, ok := nw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Buffer sizes for pooled connection readers and writers
+const (
+	readerBufferSize = 4096
+	writerBufferSize = 4096
+)
+
+// Pools shared by all connections so that steady-state request handling
+// doesn't allocate fresh readers, writers, or scratch buffers
+var (
+	readerPool = sync.Pool{
+		New: func() any { return bufio.NewReaderSize(nil, readerBufferSize) },
+	}
+	writerPool = sync.Pool{
+		New: func() any { return bufio.NewWriterSize(nil, writerBufferSize) },
+	}
+	bufferPool = sync.Pool{
+		New: func() any { return new(bytes.Buffer) },
+	}
+)
+
+func getReader(r io.Reader) *bufio.Reader {
+	br := readerPool.Get().(*bufio.Reader)
+	br.Reset(r)
+	return br
+}
+
+func putReader(br *bufio.Reader) {
+	// Drop the reference to the connection so it can be collected
+	br.Reset(nil)
+	readerPool.Put(br)
+}
+
+func getWriter(w io.Writer) *bufio.Writer {
+	bw := writerPool.Get().(*bufio.Writer)
+	bw.Reset(w)
+	return bw
+}
+
+func putWriter(bw *bufio.Writer) {
+	bw.Reset(nil)
+	writerPool.Put(bw)
+}
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	// Don't keep very large buffers alive in the pool
+	if buf.Cap() > 64*1024 {
+		return
+	}
+	bufferPool.Put(buf)
+}
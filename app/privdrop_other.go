@@ -0,0 +1,15 @@
+//go:build windows || plan9
+
+package main
+
+import "errors"
+
+// dropPrivileges isn't supported where there are no Unix user IDs
+func (s *Server) dropPrivileges() error {
+	return errors.New("--user, --group, and --chroot are not supported on this platform")
+}
+
+// chownSocket isn't supported where there are no Unix user IDs
+func chownSocket(path, owner string) error {
+	return errors.New("--socket-owner is not supported on this platform")
+}
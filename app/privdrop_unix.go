@@ -0,0 +1,115 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// dropPrivileges switches to runAsUser and runAsGroup once the listeners
+// are bound, chrooting into the serving directory first when asked. Files
+// outside the directory, like htpasswd or key files, are only readable
+// through descriptors opened before this point.
+func (s *Server) dropPrivileges() error {
+	uid, gid := -1, -1
+	if s.runAsUser != "" {
+		u, err := lookupUser(s.runAsUser)
+		if err != nil {
+			return err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if s.runAsGroup != "" {
+		g, err := lookupGroup(s.runAsGroup)
+		if err != nil {
+			return err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	// A process started by an upgrade inherits the switch already made
+	if uid > 0 && uid == os.Getuid() && !s.chroot {
+		return nil
+	}
+
+	if s.chroot {
+		live := *s.settings()
+		if live.directory == "" {
+			return errors.New("--chroot needs --directory")
+		}
+		if err := syscall.Chroot(live.directory); err != nil {
+			return fmt.Errorf("chroot %s: %w", live.directory, err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return err
+		}
+		s.log.Info("chrooted", "dir", live.directory)
+		live.directory = "/"
+		s.live.Store(&live)
+	}
+
+	// Group first, since changing it needs the privileges setuid gives up
+	if gid >= 0 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("setgroups: %w", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("setgid %d: %w", gid, err)
+		}
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setuid %d: %w", uid, err)
+		}
+		if uid != 0 && syscall.Setuid(0) == nil {
+			return errors.New("root privileges could be regained after setuid")
+		}
+	}
+	s.log.Info("dropped privileges", "uid", os.Getuid(), "gid", os.Getgid())
+	return nil
+}
+
+// lookupUser finds a user by name or numeric ID
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return user.LookupId(name)
+	}
+	return user.Lookup(name)
+}
+
+// lookupGroup finds a group by name or numeric ID
+func lookupGroup(name string) (*user.Group, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return user.LookupGroupId(name)
+	}
+	return user.LookupGroup(name)
+}
+
+// chownSocket gives a socket file to owner, "user", "user:group", or
+// ":group"
+func chownSocket(path, owner string) error {
+	uid, gid := -1, -1
+	name, group, _ := strings.Cut(owner, ":")
+	if name != "" {
+		u, err := lookupUser(name)
+		if err != nil {
+			return err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if group != "" {
+		g, err := lookupGroup(group)
+		if err != nil {
+			return err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return os.Chown(path, uid, gid)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for proxying to upstreams
+const (
+	defaultProxyMaxIdle        = 16
+	defaultProxyConnectTimeout = 5 * time.Second
+)
+
+// ringReplicas is how many points each upstream gets on the hash ring, so
+// paths spread evenly and only a share of them move when one drops out
+const ringReplicas = 100
+
+// proxyConfig is one --proxy setting
+type proxyConfig struct {
+	prefix    string
+	upstreams []*url.URL
+}
+
+// parseProxy reads PREFIX=URL[,URL...]
+func parseProxy(v string) (proxyConfig, error) {
+	prefix, targets, ok := strings.Cut(v, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") || targets == "" {
+		return proxyConfig{}, errors.New("must look like /api/=http://10.0.0.1:8080,http://10.0.0.2:8080")
+	}
+	pc := proxyConfig{prefix: prefix}
+	for _, target := range strings.Split(targets, ",") {
+		u, err := url.Parse(strings.TrimSpace(target))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return proxyConfig{}, fmt.Errorf("%q isn't an http:// or https:// URL", target)
+		}
+		pc.upstreams = append(pc.upstreams, u)
+	}
+	return pc, nil
+}
+
+// upstream is one backend of a proxied prefix
+type upstream struct {
+	url      *url.URL
+	active   atomic.Int64 // requests in flight
+	requests atomic.Uint64
+	errors   atomic.Uint64 // requests that got no response
+
+	// ejected is set while health checks find the upstream failing
+	ejected atomic.Bool
+}
+
+type ringPoint struct {
+	hash uint32
+	up   *upstream
+}
+
+// proxyRoute forwards requests under a prefix to its upstreams, picking one
+// per request by strategy: round-robin, least-conn, or hash, which keeps
+// each path on the same upstream. Idle connections are pooled per upstream.
+type proxyRoute struct {
+	prefix    string
+	route     string // template used as the route label
+	upstreams []*upstream
+	strategy  string
+	next      atomic.Uint64
+	ring      []ringPoint
+	transport *http.Transport
+	handler   HandlerFunc
+	health    healthCheck
+	// recorder saves or replays upstream responses, when set
+	recorder *recorder
+}
+
+func newProxyRoute(pc proxyConfig, strategy string, maxIdle int, connectTimeout time.Duration, health healthCheck) *proxyRoute {
+	p := &proxyRoute{
+		prefix:   pc.prefix,
+		route:    pc.prefix + "{path}",
+		strategy: strategy,
+		health:   health,
+		transport: &http.Transport{
+			DialContext:         (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}).DialContext,
+			MaxIdleConnsPerHost: maxIdle,
+			DisableKeepAlives:   maxIdle == 0,
+			IdleConnTimeout:     90 * time.Second,
+			// Bodies pass through as the upstream encoded them
+			DisableCompression: true,
+		},
+	}
+	for _, u := range pc.upstreams {
+		up := &upstream{url: u}
+		p.upstreams = append(p.upstreams, up)
+		for i := 0; i < ringReplicas; i++ {
+			p.ring = append(p.ring, ringPoint{hash: hashString(u.Host + "#" + strconv.Itoa(i)), up: up})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+	p.handler = func(s *Server, w ResponseWriter, req *Request) { p.serve(s, w, req) }
+	return p
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// matchProxy returns the proxy with the longest prefix of path, if any
+func (s *Server) matchProxy(path string) *proxyRoute {
+	for _, p := range s.proxies {
+		if strings.HasPrefix(path, p.prefix) {
+			return p
+		}
+	}
+	return nil
+}
+
+// pick chooses an upstream for path that hasn't been tried yet, leaving
+// out ejected ones when healthyOnly is set
+func (p *proxyRoute) pick(path string, tried []*upstream, healthyOnly bool) *upstream {
+	usable := func(up *upstream) bool {
+		if healthyOnly && up.ejected.Load() {
+			return false
+		}
+		for _, t := range tried {
+			if t == up {
+				return false
+			}
+		}
+		return true
+	}
+
+	switch p.strategy {
+	case "hash":
+		h := hashString(path)
+		start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+		for i := range p.ring {
+			if up := p.ring[(start+i)%len(p.ring)].up; usable(up) {
+				return up
+			}
+		}
+		return nil
+	case "least-conn":
+		// Ties go round-robin, so an idle pool doesn't all land on one
+		start := int(p.next.Add(1))
+		var best *upstream
+		for i := range p.upstreams {
+			up := p.upstreams[(start+i)%len(p.upstreams)]
+			if usable(up) && (best == nil || up.active.Load() < best.active.Load()) {
+				best = up
+			}
+		}
+		return best
+	default:
+		start := int(p.next.Add(1))
+		for i := range p.upstreams {
+			if up := p.upstreams[(start+i)%len(p.upstreams)]; usable(up) {
+				return up
+			}
+		}
+		return nil
+	}
+}
+
+// idempotentMethods may be sent again after a failed attempt
+var idempotentMethods = map[string]bool{
+	"GET": true, "HEAD": true, "OPTIONS": true, "TRACE": true, "PUT": true, "DELETE": true,
+}
+
+// hopHeaders apply to a single connection and aren't forwarded
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate", "Proxy-Authorization",
+	"TE", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+func isHopHeader(name, connection string) bool {
+	for _, h := range hopHeaders {
+		if strings.EqualFold(name, h) {
+			return true
+		}
+	}
+	// Headers the Connection header names are hop-by-hop too
+	for _, h := range strings.Split(connection, ",") {
+		if strings.EqualFold(name, strings.TrimSpace(h)) {
+			return true
+		}
+	}
+	return false
+}
+
+// serve forwards req to an upstream and relays the response. Idempotent
+// requests move on to the next upstream when one can't be connected to.
+func (p *proxyRoute) serve(s *Server, w ResponseWriter, req *Request) {
+	var body io.Reader
+	var length int64
+	if req.isChunked() {
+		// Streamed on as it is decoded, so the upstream gets it chunked too
+		body, length = req.body, -1
+	} else if cl := req.Header("Content-Length"); cl != "" {
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || n < 0 {
+			sendStatus(w, 400)
+			return
+		}
+		if n > 0 {
+			body, length = req.body, n
+		}
+	}
+
+	// Recording needs the whole body for the key
+	var recorded []byte
+	if p.recorder != nil {
+		var err error
+		if recorded, err = readBody(body); err != nil {
+			sendStatus(w, 400)
+			return
+		}
+		if body != nil {
+			body, length = bytes.NewReader(recorded), int64(len(recorded))
+		}
+		if p.recorder.replay {
+			resp, err := p.recorder.load(req, recorded)
+			if err != nil {
+				req.Logger().Error("failed to load recording", "err", err)
+				sendStatus(w, 500)
+			} else if resp == nil {
+				req.Logger().Warn("no recording for request", "method", req.Method, "target", req.Target)
+				sendStatus(w, 502)
+			} else {
+				p.relay(s, w, req, resp)
+			}
+			return
+		}
+	}
+
+	var tried []*upstream
+	for {
+		up := p.pick(req.Path, tried, true)
+		if up == nil && p.allEjected() {
+			// Better to try a failing upstream than to fail outright
+			up = p.pick(req.Path, tried, false)
+		}
+		if up == nil {
+			sendStatus(w, 502)
+			return
+		}
+		tried = append(tried, up)
+
+		up.active.Add(1)
+		up.requests.Add(1)
+		resp, err := p.roundTrip(up, req, body, length)
+		if err == nil {
+			if p.recorder != nil {
+				if err := p.recorder.save(req, recorded, resp); err != nil {
+					req.Logger().Error("failed to record response", "err", err)
+				}
+			}
+			p.relay(s, w, req, resp)
+			resp.Body.Close()
+			up.active.Add(-1)
+			return
+		}
+		up.active.Add(-1)
+		up.errors.Add(1)
+
+		req.Logger().Warn("upstream request failed", "upstream", up.url.Host, "err", err)
+		var opErr *net.OpError
+		if idempotentMethods[req.Method] && errors.As(err, &opErr) && opErr.Op == "dial" {
+			continue
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			sendStatus(w, 504)
+		} else {
+			sendStatus(w, 502)
+		}
+		return
+	}
+}
+
+// roundTrip sends req to up, with the forwarding headers added
+func (p *proxyRoute) roundTrip(up *upstream, req *Request, body io.Reader, length int64) (*http.Response, error) {
+	// As with nginx, an upstream URL with a path replaces the prefix. The
+	// path is passed on as the client encoded it.
+	path := req.Path
+	if base := up.url.EscapedPath(); base != "" && base != "/" {
+		path = strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(req.Path, p.prefix)
+	}
+	target := up.url.Scheme + "://" + up.url.Host + path
+	if req.RawQuery != "" {
+		target += "?" + req.RawQuery
+	}
+
+	out, err := http.NewRequestWithContext(context.Background(), req.Method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	out.ContentLength = length
+	connection := req.Header("Connection")
+	for _, h := range req.Headers() {
+		if !isHopHeader(h[0], connection) && !strings.EqualFold(h[0], "Host") && !strings.EqualFold(h[0], "Content-Length") {
+			out.Header.Add(h[0], h[1])
+		}
+	}
+	// The chain grows by the peer, whatever it claims to be forwarding for
+	if ip := peerIP(req); ip != "-" {
+		if prior := out.Header.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		out.Header.Set("X-Forwarded-For", ip)
+	}
+	proto := "http"
+	if req.tlsState != nil {
+		proto = "https"
+	}
+	out.Header.Set("X-Forwarded-Proto", proto)
+	if host := req.Header("Host"); host != "" {
+		out.Header.Set("X-Forwarded-Host", host)
+	}
+	return p.transport.RoundTrip(out)
+}
+
+// relay copies the upstream response to the client, streaming the body
+func (p *proxyRoute) relay(s *Server, w ResponseWriter, req *Request, resp *http.Response) {
+	connection := resp.Header.Get("Connection")
+	for name, values := range resp.Header {
+		// The response writer sets its own Date
+		if isHopHeader(name, connection) || name == "Content-Length" || name == "Date" {
+			continue
+		}
+		for _, v := range values {
+			w.Header().Add(name, v)
+		}
+	}
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.WriteHeader(resp.StatusCode)
+	if req.Method == "HEAD" {
+		return
+	}
+	if err := s.streamFile(w, req.conn, resp.Body); err != nil {
+		req.Logger().Warn("failed to relay upstream response", "upstream", resp.Request.URL.Host, "err", err)
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyForwardsBodies(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%d %q", r.ContentLength, body)
+	}))
+	defer upstream.Close()
+	ts := newTestServer(t, "--proxy", "/api/="+upstream.URL)
+
+	ts.Request("POST", "/api/x").Body("hello").Do().Status(200).BodyIs(`5 "hello"`)
+	ts.Raw("POST /api/x HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n" +
+		"3\r\nhel\r\n2\r\nlo\r\n0\r\n\r\n").Status(200).BodyIs(`-1 "hello"`)
+}
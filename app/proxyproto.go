@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLen is the longest a v1 header line may be, CRLF included
+const proxyV1MaxLen = 107
+
+// proxyProtoConn reads the PROXY protocol header a load balancer sends
+// ahead of the client's bytes, and reports the source address it carries
+// as the remote address. The header is read on the first Read or
+// RemoteAddr, so a slow sender holds up only its own connection.
+type proxyProtoConn struct {
+	net.Conn
+	timeout time.Duration
+
+	// deadline is the read deadline last set by the caller, put back once
+	// the header has been read under its own
+	deadline time.Time
+
+	once   sync.Once
+	reader *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+func newProxyProtoConn(conn net.Conn, timeout time.Duration) *proxyProtoConn {
+	return &proxyProtoConn{Conn: conn, timeout: timeout}
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxyProtoConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtoConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// RemoteAddr returns the client's address, or the balancer's when the
+// header says the connection is its own, such as a health check
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtoConn) readHeader() {
+	if c.timeout > 0 {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer func() { _ = c.Conn.SetReadDeadline(c.deadline) }()
+	}
+	c.reader = bufio.NewReaderSize(c.Conn, 512)
+	start, err := c.reader.Peek(len(proxyV2Signature))
+	switch {
+	case err == nil && bytes.Equal(start, proxyV2Signature):
+		c.remote, c.err = readProxyV2(c.reader)
+	case err == nil && bytes.HasPrefix(start, []byte("PROXY ")):
+		c.remote, c.err = readProxyV1(c.reader)
+	case err == nil:
+		c.err = errors.New("missing PROXY protocol header")
+	default:
+		c.err = err
+	}
+	if c.err != nil && c.err != io.EOF {
+		c.err = fmt.Errorf("proxy protocol: %w", c.err)
+	}
+}
+
+// readProxyV1 parses the text form, e.g. "PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, errors.New("v1 header too long")
+		}
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			// The connection closed partway through the header
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses the binary form. Addresses other than TCP over IPv4
+// or IPv6, and any TLVs, are skipped.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var head [16]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	if head[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", head[12]>>4)
+	}
+	// The only commands are LOCAL (0) and PROXY (1)
+	if cmd := head[12] & 0x0f; cmd > 1 {
+		return nil, fmt.Errorf("unsupported v2 command %d", cmd)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	// LOCAL connections come from the balancer itself
+	if head[12]&0x0f == 0 {
+		return nil, nil
+	}
+	switch head[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errors.New("short v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("short v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
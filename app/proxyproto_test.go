@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2Header builds a v2 header from its version and command byte,
+// address family byte, and address block
+func proxyV2Header(verCmd, family byte, block []byte) string {
+	head := append([]byte(nil), proxyV2Signature...)
+	head = append(head, verCmd, family)
+	head = binary.BigEndian.AppendUint16(head, uint16(len(block)))
+	return string(append(head, block...))
+}
+
+func TestProxyProtocol(t *testing.T) {
+	ipv4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0xc8, 0x02, 0x01, 0xbb}
+	ipv6 := append(append(net.ParseIP("2001:db8::7").To16(), net.ParseIP("2001:db8::1").To16()...), 0xc8, 0x02, 0x01, 0xbb)
+
+	tests := []struct {
+		name   string
+		header string
+		// remote is the address reported, "" when it's the balancer's own
+		remote string
+		err    string
+	}{
+		{"v1 ipv4", "PROXY TCP4 203.0.113.7 10.0.0.1 51202 443\r\n", "203.0.113.7:51202", ""},
+		{"v1 ipv6", "PROXY TCP6 2001:db8::7 2001:db8::1 51202 443\r\n", "[2001:db8::7]:51202", ""},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", ""},
+		{"v1 bad signature", "PROXX TCP4 203.0.113.7 10.0.0.1 51202 443\r\n", "", "missing PROXY protocol header"},
+		{"v1 ipv6 address on tcp4", "PROXY TCP4 2001:db8::7 2001:db8::1 51202 443\r\n", "", "malformed v1 header"},
+		{"v1 bad port", "PROXY TCP4 203.0.113.7 10.0.0.1 70000 443\r\n", "", "malformed v1 header"},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLen) + "\r\n", "", "v1 header too long"},
+		{"v1 truncated", "PROXY TCP4 203.0.113.7", "", "unexpected EOF"},
+
+		{"v2 ipv4", proxyV2Header(0x21, 0x11, ipv4), "203.0.113.7:51202", ""},
+		{"v2 ipv6", proxyV2Header(0x21, 0x21, ipv6), "[2001:db8::7]:51202", ""},
+		{"v2 ipv4 with tlvs", proxyV2Header(0x21, 0x11, append(ipv4, 0x04, 0x00, 0x01, 0xff)), "203.0.113.7:51202", ""},
+		{"v2 local", proxyV2Header(0x20, 0x00, nil), "", ""},
+		{"v2 bad signature", strings.Replace(proxyV2Header(0x21, 0x11, ipv4), "QUIT", "QUIZ", 1), "", "missing PROXY protocol header"},
+		{"v2 bad version", proxyV2Header(0x11, 0x11, ipv4), "", "unsupported v2 version 1"},
+		{"v2 bad command", proxyV2Header(0x22, 0x11, ipv4), "", "unsupported v2 command 2"},
+		{"v2 short address block", proxyV2Header(0x21, 0x11, ipv4[:8]), "", "short v2 IPv4 address block"},
+		{"v2 truncated header", proxyV2Header(0x21, 0x11, ipv4)[:14], "", "unexpected EOF"},
+		{"v2 truncated address block", proxyV2Header(0x21, 0x11, ipv4)[:20], "", "unexpected EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			go func() {
+				_, _ = io.WriteString(client, tt.header)
+				if tt.err == "" {
+					_, _ = io.WriteString(client, "GET")
+				}
+				client.Close()
+			}()
+			conn := newProxyProtoConn(server, time.Second)
+
+			remote := conn.RemoteAddr().String()
+			body, err := io.ReadAll(conn)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error %v", err)
+			}
+			if want := tt.remote; want == "" && remote != server.RemoteAddr().String() || want != "" && remote != want {
+				t.Errorf("remote address %s, want %q", remote, tt.remote)
+			}
+			if string(body) != "GET" {
+				t.Errorf("read %q after the header, want %q", body, "GET")
+			}
+		})
+	}
+}
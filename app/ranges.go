@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRanges is the most ranges a request may ask for before its Range
+// header is ignored, so overlapping ranges can't multiply a response
+const maxRanges = 16
+
+// byteRange is a span of a body
+type byteRange struct {
+	start, length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+var errUnsatisfiable = errors.New("no satisfiable range")
+
+// parseRange reads a Range header against a body of size bytes. Ranges
+// past the end are dropped, and errUnsatisfiable returned if that leaves
+// none. A missing or malformed header gives no ranges and no error, since
+// the whole body is the right answer then.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil, nil
+	}
+	parts := strings.Split(spec, ",")
+	if len(parts) > maxRanges {
+		return nil, nil
+	}
+	var ranges []byteRange
+	for _, part := range parts {
+		first, last, ok := strings.Cut(strings.TrimSpace(part), "-")
+		if !ok {
+			return nil, nil
+		}
+		var r byteRange
+		if first == "" {
+			// A suffix: the last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			n = min(n, size)
+			r = byteRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			end := size - 1
+			if last != "" {
+				if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+					return nil, nil
+				}
+				end = min(end, size-1)
+			}
+			if start >= size {
+				continue
+			}
+			r = byteRange{start: start, length: end - start + 1}
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiable
+	}
+	return ranges, nil
+}
+
+// ifRangeMatches reports whether a Range request's If-Range condition
+// holds, so the ranges can be served rather than the whole body. Only a
+// strong ETag or the exact Last-Modified date matches.
+func ifRangeMatches(req *Request, etag string, modTime time.Time) bool {
+	cond, ok := req.LookupHeader("If-Range")
+	if !ok {
+		return true
+	}
+	if strings.HasPrefix(cond, `"`) {
+		return etag != "" && !strings.HasPrefix(etag, "W/") && cond == etag
+	}
+	t, err := time.Parse(httpDateLayout, cond)
+	return err == nil && !modTime.IsZero() && t.Equal(modTime.UTC().Truncate(time.Second))
+}
+
+// notModified reports whether a GET or HEAD's If-None-Match or
+// If-Modified-Since says the client's copy is current. If-None-Match
+// compares ETags weakly and, when sent, decides alone.
+func notModified(req *Request, etag string, modTime time.Time) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	if inm, ok := req.LookupHeader("If-None-Match"); ok {
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := time.Parse(httpDateLayout, req.Header("If-Modified-Since"))
+	return err == nil && !modTime.IsZero() && !modTime.UTC().Truncate(time.Second).After(ims)
+}
+
+// serveRanges answers a GET or HEAD for a body of size bytes read from
+// content, honouring Range and If-Range: 206 with one range, a
+// multipart/byteranges 206 with several, 416 when none can be served, and
+// 200 with the whole body otherwise. etag and modTime, when set, are sent
+// as validators.
+func (s *Server) serveRanges(w ResponseWriter, req *Request, content io.ReaderAt, size int64, contentType, etag string, modTime time.Time) {
+	w.Header().Set("Accept-Ranges", "bytes")
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(httpDateLayout))
+	}
+
+	var ranges []byteRange
+	if header := req.Header("Range"); header != "" && req.Method == "GET" && ifRangeMatches(req, etag, modTime) {
+		var err error
+		if ranges, err = parseRange(header, size); err != nil {
+			w.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+			sendStatus(w, 416)
+			return
+		}
+	}
+
+	var body io.Reader
+	switch len(ranges) {
+	case 0:
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(200)
+		body = io.NewSectionReader(content, 0, size)
+	case 1:
+		r := ranges[0]
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Range", r.contentRange(size))
+		w.Header().Set("Content-Length", strconv.FormatInt(r.length, 10))
+		w.WriteHeader(206)
+		body = io.NewSectionReader(content, r.start, r.length)
+	default:
+		// The parts are written through a pipe so the length needn't be
+		// worked out first
+		pr, pw := io.Pipe()
+		mw := multipart.NewWriter(pw)
+		w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+		w.WriteHeader(206)
+		go func() {
+			for _, r := range ranges {
+				part, err := mw.CreatePart(textproto.MIMEHeader{
+					"Content-Type":  {contentType},
+					"Content-Range": {r.contentRange(size)},
+				})
+				if err == nil {
+					_, err = io.Copy(part, io.NewSectionReader(content, r.start, r.length))
+				}
+				if err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+			}
+			pw.CloseWithError(mw.Close())
+		}()
+		defer pr.Close()
+		body = pr
+	}
+	if req.Method == "HEAD" {
+		return
+	}
+	if err := s.streamFile(w, req.conn, body); err != nil {
+		req.Logger().Debug("range transfer aborted", "err", err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestRate is a request rate limit: perSecond on average, with bursts of
+// up to burst requests
+type requestRate struct {
+	perSecond float64
+	burst     int
+}
+
+var errBadRequestRate = errors.New("rate must look like 10/s, 600/m, or 5000/h")
+
+// parseRequestRate reads "N/s", "N/m", or "N/h", optionally followed by
+// ":BURST". The burst defaults to N, at least 1.
+func parseRequestRate(s string) (requestRate, error) {
+	s, burstStr, hasBurst := strings.Cut(s, ":")
+	countStr, unit, ok := strings.Cut(s, "/")
+	count, err := strconv.ParseFloat(countStr, 64)
+	if !ok || err != nil || count <= 0 {
+		return requestRate{}, errBadRequestRate
+	}
+	var per time.Duration
+	switch unit {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return requestRate{}, errBadRequestRate
+	}
+	rate := requestRate{perSecond: count / per.Seconds(), burst: max(int(count), 1)}
+	if hasBurst {
+		burst, err := strconv.Atoi(burstStr)
+		if err != nil || burst < 1 {
+			return requestRate{}, errBadRequestRate
+		}
+		rate.burst = burst
+	}
+	return rate, nil
+}
+
+// requestBucket is a token bucket counting requests. Unlike tokenBucket it
+// never blocks: callers are told how long to wait instead.
+type requestBucket struct {
+	mu     sync.Mutex
+	rate   requestRate
+	tokens float64
+	last   time.Time
+}
+
+func newRequestBucket(rate requestRate) *requestBucket {
+	return &requestBucket{rate: rate, tokens: float64(rate.burst), last: time.Now()}
+}
+
+// allow takes a token if one is available, otherwise reporting when the
+// next one will be
+func (b *requestBucket) allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate.perSecond
+	if b.tokens > float64(b.rate.burst) {
+		b.tokens = float64(b.rate.burst)
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / b.rate.perSecond * float64(time.Second))
+	return false, wait
+}
+
+// allowRequest checks the server-wide request rate, if one is set
+func (s *Server) allowRequest() (bool, time.Duration) {
+	limit := s.settings().requestLimit
+	if limit == nil {
+		return true, 0
+	}
+	ok, wait := limit.allow()
+	if !ok {
+		s.overRate.Add(1)
+	}
+	return ok, wait
+}
+
+// sendTooManyRequests answers with 429 and a Retry-After in whole seconds
+func sendTooManyRequests(w ResponseWriter, wait time.Duration) {
+	seconds := int64((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.FormatInt(max(seconds, 1), 10))
+	sendStatus(w, 429)
+}
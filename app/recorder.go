@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ResponseRecorder is a ResponseWriter that keeps what a handler writes,
+// so a handler can be tested without a connection:
+//
+//	s := New(WithLogOutput(io.Discard))
+//	req := NewRequest("GET", "/echo/abc", nil)
+//	req.SetPathValue("str", "abc")
+//	rec := NewRecorder()
+//	s.handleEcho(rec, req)
+//	// rec.Code == 200, rec.Body.String() == "abc"
+type ResponseRecorder struct {
+	// Code is the status written, 200 when the handler only wrote a body
+	Code int
+	// Body holds what the handler wrote, before any encoding the
+	// connection would apply
+	Body *bytes.Buffer
+	// Flushed is set once the handler flushes
+	Flushed bool
+
+	header      Header
+	wroteHeader bool
+}
+
+// NewRecorder returns a recorder that has seen nothing yet
+func NewRecorder() *ResponseRecorder {
+	return &ResponseRecorder{Code: 200, Body: new(bytes.Buffer)}
+}
+
+func (rec *ResponseRecorder) Header() *Header {
+	return &rec.header
+}
+
+func (rec *ResponseRecorder) WriteHeader(code int) {
+	if rec.wroteHeader {
+		return
+	}
+	rec.Code, rec.wroteHeader = code, true
+}
+
+func (rec *ResponseRecorder) Write(p []byte) (int, error) {
+	rec.WriteHeader(200)
+	return rec.Body.Write(p)
+}
+
+func (rec *ResponseRecorder) Flush() error {
+	rec.WriteHeader(200)
+	rec.Flushed = true
+	return nil
+}
+
+// NewRequest builds a request as the server would have parsed it from the
+// wire, for passing straight to a handler. headers are name, value pairs.
+// A non-nil body gets a Content-Length unless headers set one. The request
+// has no connection, so its client address is "-".
+func NewRequest(method, target string, body io.Reader, headers ...string) *Request {
+	if len(headers)%2 != 0 {
+		panic("NewRequest: headers must be name, value pairs")
+	}
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = io.ReadAll(body); err != nil {
+			panic(fmt.Sprintf("NewRequest: reading body: %v", err))
+		}
+	}
+	var head strings.Builder
+	head.WriteString(method + " " + target + " HTTP/1.1\r\nHost: example.com\r\n")
+	hasLength := false
+	for i := 0; i < len(headers); i += 2 {
+		head.WriteString(headers[i] + ": " + headers[i+1] + "\r\n")
+		hasLength = hasLength || strings.EqualFold(headers[i], "Content-Length")
+	}
+	if body != nil && !hasLength {
+		head.WriteString("Content-Length: " + strconv.Itoa(len(data)) + "\r\n")
+	}
+	head.WriteString("\r\n")
+
+	r := bufio.NewReader(io.MultiReader(strings.NewReader(head.String()), bytes.NewReader(data)))
+	req := &Request{}
+	if err := readRequest(r, req); err != nil {
+		panic(fmt.Sprintf("NewRequest: %v", err))
+	}
+	req.reader = r
+	return req
+}
+
+// SetPathValue sets what the route's {name} parameter matched, as routing
+// would have
+func (req *Request) SetPathValue(name, value string) {
+	req.pathParam, req.pathValue = name, value
+}
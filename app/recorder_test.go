@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newUnitServer builds a server that isn't listening, for calling handlers
+// directly
+func newUnitServer(t *testing.T, flags ...string) *Server {
+	t.Helper()
+	s := New(WithDirectory(t.TempDir()), WithLogOutput(io.Discard), WithFlags(flags...))
+	if s.initErr != nil {
+		t.Fatalf("New: %v", s.initErr)
+	}
+	return s
+}
+
+func TestRecorderEcho(t *testing.T) {
+	s := newUnitServer(t)
+	req := NewRequest("GET", "/echo/abc?upper=1", nil)
+	req.SetPathValue("str", "abc")
+	rec := NewRecorder()
+	s.handleEcho(rec, req)
+	if rec.Code != 200 || rec.Body.String() != "ABC" {
+		t.Errorf("got %d %q, want 200 %q", rec.Code, rec.Body, "ABC")
+	}
+	if got := rec.Header().Get("Content-Type"); got != "text/plain" {
+		t.Errorf("Content-Type = %q", got)
+	}
+}
+
+func TestRecorderUserAgent(t *testing.T) {
+	s := newUnitServer(t)
+	rec := NewRecorder()
+	s.handleUserAgent(rec, NewRequest("GET", "/user-agent", nil, "User-Agent", "unit/1.0"))
+	if rec.Body.String() != "unit/1.0" {
+		t.Errorf("body %q", rec.Body)
+	}
+}
+
+func TestRecorderFiles(t *testing.T) {
+	s := newUnitServer(t)
+	dir := s.settings().directory
+
+	req := NewRequest("POST", "/files/note.txt", strings.NewReader("remember"))
+	req.SetPathValue("filename", "note.txt")
+	rec := NewRecorder()
+	s.handleFiles(rec, req)
+	if rec.Code != 201 {
+		t.Fatalf("POST status %d", rec.Code)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "note.txt")); err != nil || string(data) != "remember" {
+		t.Fatalf("written file %q, %v", data, err)
+	}
+
+	req = NewRequest("GET", "/files/note.txt", nil)
+	req.SetPathValue("filename", "note.txt")
+	rec = NewRecorder()
+	s.handleFiles(rec, req)
+	if rec.Code != 200 || rec.Body.String() != "remember" {
+		t.Errorf("GET got %d %q", rec.Code, rec.Body)
+	}
+}
+
+// TestRecorderFilesTraversal calls the files handler with names that climb
+// out of the directory, as a route that doesn't clean its path could
+func TestRecorderFilesTraversal(t *testing.T) {
+	s := newUnitServer(t)
+	dir := s.settings().directory
+	outside := filepath.Join(dir, "..", "outside.txt")
+	if err := os.WriteFile(outside, []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"../outside.txt", "sub/../../outside.txt", "/etc/passwd", ""} {
+		req := NewRequest("GET", "/files/x", nil)
+		req.SetPathValue("filename", name)
+		rec := NewRecorder()
+		s.handleFiles(rec, req)
+		if rec.Code != 400 || rec.Body.Len() != 0 {
+			t.Errorf("GET %q got %d %q, want 400", name, rec.Code, rec.Body)
+		}
+	}
+
+	req := NewRequest("POST", "/files/x", strings.NewReader("pwned"))
+	req.SetPathValue("filename", "../outside.txt")
+	rec := NewRecorder()
+	s.handleFiles(rec, req)
+	if rec.Code != 400 {
+		t.Errorf("POST got %d, want 400", rec.Code)
+	}
+	if data, err := os.ReadFile(outside); err != nil || string(data) != "secret" {
+		t.Errorf("file outside the directory is now %q, %v", data, err)
+	}
+}
+
+func TestRecorderStatusAndFlush(t *testing.T) {
+	s := newUnitServer(t)
+	req := NewRequest("GET", "/status/404", nil)
+	req.SetPathValue("code", "404")
+	rec := NewRecorder()
+	s.handleStatus(rec, req)
+	if rec.Code != 404 {
+		t.Errorf("status %d, want 404", rec.Code)
+	}
+
+	req = NewRequest("GET", "/stream/2", nil)
+	req.SetPathValue("n", "2")
+	rec = NewRecorder()
+	s.handleStream(rec, req)
+	if !rec.Flushed || strings.Count(rec.Body.String(), "\n") != 2 {
+		t.Errorf("flushed %v, body %q", rec.Flushed, rec.Body)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+)
+
+// redactedValue replaces secrets wherever requests are logged
+const redactedValue = "[redacted]"
+
+// secretHeaders and secretParams name the headers and query parameters
+// whose values never appear in access logs, wire traces, or slow request
+// dumps. --redact-header and --redact-param add to them at startup.
+var (
+	secretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key", "X-CSRF-Token"}
+	secretParams  = []string{"api_key", "signature", "token", "access_token", "csrf_token"}
+)
+
+// addSecret appends name to list unless it's already there
+func addSecret(list []string, name string) []string {
+	for _, s := range list {
+		if strings.EqualFold(s, name) {
+			return list
+		}
+	}
+	return append(list, name)
+}
+
+func isSecretHeader(name []byte) bool {
+	for _, secret := range secretHeaders {
+		if equalFold(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactTarget masks the values of secret query parameters in a request
+// target. Targets without any are returned unchanged.
+func redactTarget(target string) string {
+	path, query, ok := strings.Cut(target, "?")
+	if !ok || query == "" {
+		return target
+	}
+	pairs := strings.Split(query, "&")
+	changed := false
+	for i, pair := range pairs {
+		name, _, _ := strings.Cut(pair, "=")
+		for _, secret := range secretParams {
+			if strings.EqualFold(name, secret) {
+				pairs[i] = name + "=" + redactedValue
+				changed = true
+				break
+			}
+		}
+	}
+	if !changed {
+		return target
+	}
+	return path + "?" + strings.Join(pairs, "&")
+}
+
+// redactHeaderLine hides the value of a secret header line, and secret
+// query parameters in a request line
+func redactHeaderLine(line []byte) []byte {
+	if method, rest, ok := bytes.Cut(line, []byte(" ")); ok && len(method) > 0 && bytes.Contains(rest, []byte(" HTTP/")) {
+		target, version, _ := bytes.Cut(rest, []byte(" "))
+		if redacted := redactTarget(string(target)); redacted != string(target) {
+			return []byte(string(method) + " " + redacted + " " + string(version))
+		}
+		return line
+	}
+	colon := bytes.IndexByte(line, ':')
+	if colon <= 0 {
+		return line
+	}
+	name := bytes.TrimSpace(line[:colon])
+	if isSecretHeader(name) {
+		return []byte(string(name) + ": " + redactedValue + "\r\n")
+	}
+	return line
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// defaultHSTSMaxAge is sent on TLS responses when HTTPS redirects are on
+const defaultHSTSMaxAge = 365 * 24 * time.Hour
+
+// hstsHeader formats a Strict-Transport-Security value
+func hstsHeader(maxAge time.Duration) string {
+	return "max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10)
+}
+
+// serveRedirects answers every request on l with a 301 to the same target
+// over HTTPS. Like the admin listener it handles one request per
+// connection.
+func (s *Server) serveRedirects(l net.Listener) {
+	for {
+		conn, err := s.Accept(l)
+		if err != nil {
+			// Listener closed
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			reader := getReader(conn)
+			defer putReader(reader)
+			w := getWriter(conn)
+			defer putWriter(w)
+			req := getRequest()
+			defer putRequest(req)
+
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if err := readRequest(reader, req); err != nil {
+				_ = writeStatus(w, 400, true)
+			} else {
+				_ = s.writeHTTPSRedirect(w, req)
+			}
+			_ = w.Flush()
+		}(conn)
+	}
+}
+
+// writeHTTPSRedirect sends a 301 pointing req's path and query at the TLS
+// listener
+func (s *Server) writeHTTPSRedirect(w io.Writer, req *Request) error {
+	host := req.Header("Host")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		return writeStatus(w, 400, true)
+	}
+	if port := s.httpsPort(); port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	_, err := fmt.Fprintf(w,
+		"HTTP/1.1 301 %s\r\nDate: %s\r\nLocation: https://%s%s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+		statusText(301), httpDate(), host, req.Target,
+	)
+	return err
+}
+
+// httpsPort is the port the TLS listeners are bound to
+func (s *Server) httpsPort() string {
+	if len(s.listeners) == 0 {
+		return "443"
+	}
+	_, port, _ := net.SplitHostPort(s.listeners[0].Addr().String())
+	return port
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// liveConfig is the part of the configuration that can change while the
+// server runs: the directory, timeouts, rate limits, and the middleware
+// built from the auth settings. A reload swaps in a whole new one, so
+// connections already open pick it up on their next request.
+type liveConfig struct {
+	directory    string
+	timeouts     phaseTimeouts
+	limiter      *clientLimiter
+	requestLimit *requestBucket
+	signer       *urlSigner
+	adminToken   string
+	given        map[string][]string
+	stubs        *stubStore
+	errorPages   *errorPages
+	headers      *headerPolicy
+
+	// middleware comes from the configuration and runs outside anything
+	// added with Use; chain wraps both around the route handler
+	middleware []Middleware
+	chain      HandlerFunc
+}
+
+// noSettings stands in before anything is configured
+var noSettings liveConfig
+
+// settings returns the configuration currently in force
+func (s *Server) settings() *liveConfig {
+	if live := s.live.Load(); live != nil {
+		return live
+	}
+	return &noSettings
+}
+
+// setSettings builds the handler chain for live and puts it in force
+func (s *Server) setSettings(live *liveConfig) {
+	var chain HandlerFunc = callRoute
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		chain = s.middleware[i](chain)
+	}
+	for i := len(live.middleware) - 1; i >= 0; i-- {
+		chain = live.middleware[i](chain)
+	}
+	live.chain = chain
+	s.live.Store(live)
+}
+
+// configure builds the reloadable settings from cfg. Rate limiter state
+// starts afresh each time.
+func (s *Server) configure(cfg *serverConfig) (*liveConfig, error) {
+	// Without a token the admin API is open to anyone who can reach it
+	if cfg.adminAddr != "" && cfg.adminToken == "" && !isLoopbackAddr(cfg.adminAddr) {
+		return nil, errors.New("--admin-addr off loopback needs --admin-token")
+	}
+	live := &liveConfig{
+		directory:  cfg.directory,
+		timeouts:   cfg.timeouts,
+		adminToken: cfg.adminToken,
+		given:      cfg.given,
+	}
+	if cfg.maxRequestRate != nil {
+		live.requestLimit = newRequestBucket(*cfg.maxRequestRate)
+	}
+	use := func(mw Middleware) { live.middleware = append(live.middleware, mw) }
+
+	if cfg.stubsPath != "" {
+		stubs, err := loadStubs(cfg.stubsPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load stubs: %w", err)
+		}
+		live.stubs = stubs
+	}
+
+	if cfg.errorPages != "" {
+		pages, err := loadErrorPages(cfg.errorPages, cfg.templateReload || cfg.dev)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load error pages: %w", err)
+		}
+		live.errorPages = pages
+	}
+
+	if len(cfg.headerRules) > 0 {
+		live.headers = &headerPolicy{rules: cfg.headerRules}
+	}
+	if len(cfg.clientRates) > 0 {
+		live.limiter = newClientLimiter(cfg.clientRates, cfg.rateLimitClients)
+		use(clientRateLimit(live.limiter))
+	}
+	if cfg.security != nil {
+		use(securityHeaders(cfg.security))
+	}
+	if cfg.corsConfig != nil {
+		if len(cfg.corsConfig.origins) == 0 {
+			return nil, errors.New("CORS options need at least one --cors-origin")
+		}
+		// Echoing any origin with credentials would let every site read
+		// responses as the user
+		if cfg.corsConfig.credentials && slices.Contains(cfg.corsConfig.origins, "*") {
+			return nil, errors.New("--cors-credentials can't be used with --cors-origin *")
+		}
+		use(cors(cfg.corsConfig))
+	}
+	if cfg.signingKey != "" {
+		live.signer = &urlSigner{key: []byte(cfg.signingKey), required: cfg.signedRequired}
+		use(signedURLs(live.signer))
+	} else if cfg.signedRequired {
+		return nil, errors.New("--signed-urls-required needs --url-signing-key")
+	}
+	if len(cfg.authRules) > 0 {
+		use(basicAuth(cfg.authRules, cfg.authRealm))
+	}
+	if len(cfg.jwtPrefixes) > 0 {
+		v := &jwtVerifier{issuer: cfg.jwtIssuer, audience: cfg.jwtAudience, scope: cfg.jwtScope}
+		if cfg.jwtSecret != "" {
+			v.secret = []byte(cfg.jwtSecret)
+		}
+		if cfg.jwtPublicKey != "" {
+			key, err := loadRSAPublicKey(cfg.jwtPublicKey)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load JWT public key: %w", err)
+			}
+			v.publicKey = key
+		}
+		if cfg.jwtJWKS != "" {
+			v.jwks = newJWKSCache(cfg.jwtJWKS, s.log)
+		}
+		if v.secret == nil && v.publicKey == nil && v.jwks == nil {
+			return nil, errors.New("--jwt-protect needs --jwt-secret, --jwt-public-key, or --jwt-jwks-url")
+		}
+		use(jwtAuth(v, cfg.jwtPrefixes))
+	}
+	if len(cfg.apiKeyPrefixes) > 0 {
+		if cfg.apiKeyFile == "" {
+			return nil, errors.New("--api-key-protect needs --api-keys")
+		}
+		// The store lives on the server so rate limits outlast reloads
+		keys := s.apiKeys
+		var err error
+		if keys != nil && keys.path == cfg.apiKeyFile {
+			err = keys.reload()
+		} else {
+			keys, err = loadAPIKeys(cfg.apiKeyFile)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load API keys: %w", err)
+		}
+		s.apiKeys = keys
+		use(apiKeyAuth(keys, cfg.apiKeyPrefixes, cfg.apiKeyHeader, cfg.apiKeyParam))
+	}
+	if len(cfg.csrfPrefixes) > 0 {
+		// Without a secret the server's own key is used, which outlasts
+		// reloads but not restarts
+		key := s.csrfKey
+		if cfg.csrfSecret != "" {
+			key = []byte(cfg.csrfSecret)
+		}
+		use(csrfProtect(newCSRFGuard(key, cfg.csrfPrefixes)))
+	}
+	// The manager lives on the server so sessions outlast reloads
+	if s.sessions != nil {
+		use(sessions(s.sessions))
+	}
+	return live, nil
+}
+
+// reload re-reads the command line and config file and applies what can
+// change without rebinding. Listeners, TLS, and logging destinations keep
+// their startup values. Nothing changes if the new configuration is
+// invalid.
+func (s *Server) reload() error {
+	cfg, err := parseFlags(s.args)
+	if err != nil {
+		return err
+	}
+	live, err := s.configure(cfg)
+	if err != nil {
+		return err
+	}
+	// Inside a chroot the directory can't move
+	if s.chroot {
+		live.directory = s.settings().directory
+	}
+	if cfg.addr() != s.addr {
+		s.log.Warn("listen address changes need a restart", "addr", s.addr, "configured", cfg.addr())
+	}
+	s.setSettings(live)
+	s.logLevel.Set(cfg.logLevel.Level())
+	s.log.Info("configuration reloaded")
+	return nil
+}
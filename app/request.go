@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+var (
+	errBadRequestLine     = errors.New("bad request line")
+	errNotHTTP            = errors.New("not http")
+	errLineTooLong        = errors.New("request line or header too long")
+	errHeadersTooLarge    = errors.New("too many header bytes or fields")
+	errBadHeader          = errors.New("malformed header")
+	errMissingHost        = errors.New("missing or repeated Host header")
+	errBadContentLength   = errors.New("invalid Content-Length")
+	errAmbiguousLength    = errors.New("both Content-Length and Transfer-Encoding")
+	errUnknownMethod      = errors.New("unknown method")
+	errUnsupportedCoding  = errors.New("unsupported transfer coding")
+	errUnsupportedVersion = errors.New("unsupported HTTP version")
+)
+
+// requestErrorStatus returns the status that answers a request readRequest
+// rejected
+func requestErrorStatus(err error) int {
+	switch err {
+	case errUnknownMethod, errUnsupportedCoding:
+		return 501
+	case errUnsupportedVersion:
+		return 505
+	case errHeadersTooLarge:
+		return 431
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return 408
+	}
+	return 400
+}
+
+// headerField holds the offsets of one header's name and value in Request.raw
+type headerField struct {
+	nameStart, nameEnd   int
+	valueStart, valueEnd int
+}
+
+// Request is a parsed request head. The method, path, and version are
+// materialized while parsing; header lines are copied into a buffer that is
+// reused across requests and only turned into strings when a handler asks
+// for them.
+type Request struct {
+	Method string
+	// Target is the request target as sent; Path and RawQuery are its two
+	// halves around the "?"
+	Target   string
+	Path     string
+	RawQuery string
+	Version  string
+
+	// Route is the template of the matched route, e.g. "/echo/{str}", and
+	// pathValue the text matched by its trailing parameter
+	Route     string
+	pathParam string
+	pathValue string
+	handler   HandlerFunc
+
+	// tlsState describes the connection's TLS session, nil for plain HTTP
+	tlsState *tls.ConnectionState
+
+	// user is the authenticated user name, if any, and claims the
+	// verified JWT claims
+	user   string
+	claims map[string]any
+
+	// csrfToken is the token the CSRF middleware expects back
+	csrfToken string
+
+	// signedURL is set when the request came through a valid signed link
+	signedURL bool
+
+	// trace is set when tracing is enabled
+	trace traceContext
+
+	// forwardedIP is the client address passed on by a trusted proxy
+	forwardedIP string
+
+	// session is set by the session middleware
+	session *Session
+
+	// conn is the connection the request arrived on, and reader the
+	// buffered reader holding any unread body
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// body reads the body off reader, decoding chunks or stopping at the
+	// Content-Length, so what's left unread can be drained afterwards.
+	// bodyLimit backs it for Content-Length bodies.
+	body      io.Reader
+	bodyLimit io.LimitedReader
+
+	// id numbers the request within the server for log correlation, and
+	// log carries the connection's fields
+	id  uint64
+	log *slog.Logger
+
+	raw    []byte
+	fields []headerField
+}
+
+var requestPool = sync.Pool{
+	New: func() any { return &Request{raw: make([]byte, 0, 1024), fields: make([]headerField, 0, 16)} },
+}
+
+func getRequest() *Request {
+	return requestPool.Get().(*Request)
+}
+
+func putRequest(req *Request) {
+	req.reset()
+	req.conn, req.reader = nil, nil
+	req.tlsState = nil
+	req.log = nil
+	requestPool.Put(req)
+}
+
+func (req *Request) reset() {
+	req.Method, req.Target, req.Path, req.RawQuery, req.Version = "", "", "", "", ""
+	req.Route, req.pathParam, req.pathValue = "", "", ""
+	req.handler = nil
+	req.user, req.claims = "", nil
+	req.csrfToken = ""
+	req.signedURL = false
+	req.trace = traceContext{}
+	req.forwardedIP = ""
+	req.session = nil
+	req.body, req.bodyLimit = nil, io.LimitedReader{}
+	req.raw = req.raw[:0]
+	req.fields = req.fields[:0]
+}
+
+// Logger returns a logger tagged with the request's correlation fields.
+// It is built on demand so requests that log nothing don't pay for it.
+func (req *Request) Logger() *slog.Logger {
+	log := req.log
+	if log == nil {
+		log = slog.Default()
+	}
+	if req.forwardedIP != "" {
+		log = log.With("client_ip", req.forwardedIP)
+	}
+	if req.trace.valid() {
+		return log.With("req_id", req.id, "method", req.Method, "path", req.Path,
+			"trace_id", hex.EncodeToString(req.trace.traceID[:]), "span_id", hex.EncodeToString(req.trace.spanID[:]))
+	}
+	return log.With("req_id", req.id, "method", req.Method, "path", req.Path)
+}
+
+// TLS returns the connection's TLS state, or nil for plain HTTP
+func (req *Request) TLS() *tls.ConnectionState {
+	return req.tlsState
+}
+
+// ClientSubject returns the subject of the client's verified certificate,
+// or "" when mutual TLS isn't in use
+func (req *Request) ClientSubject() string {
+	return clientSubject(req.tlsState)
+}
+
+// User returns the name the request authenticated as, or ""
+func (req *Request) User() string {
+	return req.user
+}
+
+// Claims returns the claims of the request's verified bearer token, or nil
+func (req *Request) Claims() map[string]any {
+	return req.claims
+}
+
+// clientIP returns the address of the client that sent req, without the
+// port, or "-" when it isn't known. Behind a trusted proxy that's the
+// address the proxy passed on.
+func clientIP(req *Request) string {
+	if req.forwardedIP != "" {
+		return req.forwardedIP
+	}
+	return peerIP(req)
+}
+
+// peerIP returns the address of the connection's other end, without the
+// port, or "-" when it isn't known
+func peerIP(req *Request) string {
+	if req.conn == nil {
+		return "-"
+	}
+	return remoteIP(req.conn.RemoteAddr())
+}
+
+// remoteIP returns the host part of a connection's remote address
+func remoteIP(addr net.Addr) string {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
+
+// CSRFToken returns the token forms on CSRF-protected paths must submit in
+// their csrf_token field, or "" elsewhere
+func (req *Request) CSRFToken() string {
+	return req.csrfToken
+}
+
+// hasCredentials reports whether the request carries an Authorization
+// header. Such requests bypass the shared response cache.
+func (req *Request) hasCredentials() bool {
+	_, ok := req.LookupHeader("Authorization")
+	return ok
+}
+
+// Query parses the query string
+func (req *Request) Query() url.Values {
+	query, _ := url.ParseQuery(req.RawQuery)
+	return query
+}
+
+// PathValue returns the text matched by the route's {name} parameter
+func (req *Request) PathValue(name string) string {
+	if name != req.pathParam {
+		return ""
+	}
+	return req.pathValue
+}
+
+// Header returns the value of the first header matching name
+// case-insensitively, or "" if there is none
+func (req *Request) Header(name string) string {
+	value, _ := req.LookupHeader(name)
+	return value
+}
+
+// LookupHeader is like Header but also reports whether the header was present
+func (req *Request) LookupHeader(name string) (string, bool) {
+	for _, f := range req.fields {
+		if equalFold(req.raw[f.nameStart:f.nameEnd], name) {
+			return string(req.raw[f.valueStart:f.valueEnd]), true
+		}
+	}
+	return "", false
+}
+
+// Cookie returns the value of the named cookie, or "" if it wasn't sent
+func (req *Request) Cookie(name string) string {
+	for _, f := range req.fields {
+		if !equalFold(req.raw[f.nameStart:f.nameEnd], "Cookie") {
+			continue
+		}
+		for _, pair := range strings.Split(string(req.raw[f.valueStart:f.valueEnd]), ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			if k == name {
+				return strings.Trim(v, "\"")
+			}
+		}
+	}
+	return ""
+}
+
+// Cookies returns every cookie sent, by name. A name sent more than once
+// keeps its first value, as Cookie does.
+func (req *Request) Cookies() map[string]string {
+	cookies := make(map[string]string)
+	for _, f := range req.fields {
+		if !equalFold(req.raw[f.nameStart:f.nameEnd], "Cookie") {
+			continue
+		}
+		for _, pair := range strings.Split(string(req.raw[f.valueStart:f.valueEnd]), ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			if _, seen := cookies[k]; k != "" && !seen {
+				cookies[k] = strings.Trim(v, "\"")
+			}
+		}
+	}
+	return cookies
+}
+
+// Headers returns a copy of all header fields in the order they were sent
+func (req *Request) Headers() [][2]string {
+	headers := make([][2]string, len(req.fields))
+	for i, f := range req.fields {
+		headers[i] = [2]string{
+			string(req.raw[f.nameStart:f.nameEnd]),
+			string(req.raw[f.valueStart:f.valueEnd]),
+		}
+	}
+	return headers
+}
+
+// Limits on a request's headers as a whole; each line is also bounded by
+// the connection's read buffer
+const (
+	maxHeaderBytes  = 32 << 10
+	maxHeaderFields = 100
+)
+
+// readRequest parses the next request head from r into req. The body, if
+// any, is left unread on r. Requests RFC 7230 says to reject are: folded or
+// malformed header lines, bare CRs, a missing or repeated Host on HTTP/1.1,
+// and bodies framed ambiguously.
+func readRequest(r *bufio.Reader, req *Request) error {
+	req.reset()
+
+	// Request line: METHOD SP PATH SP VERSION CRLF
+	line, err := readLine(r)
+	if err != nil {
+		return err
+	}
+	method, rest := nextField(line)
+	path, rest := nextField(rest)
+	version, rest := nextField(rest)
+	if len(version) == 0 || len(bytes.TrimSpace(rest)) != 0 {
+		return errBadRequestLine
+	}
+	if !bytes.HasPrefix(version, []byte("HTTP/")) {
+		return errNotHTTP
+	}
+	if !validToken(method) || hasCTL(path) {
+		return errBadRequestLine
+	}
+	// HTTP/d.d; other 1.x minors are answered as 1.1
+	if len(version) != 8 || !isDigit(version[5]) || version[6] != '.' || !isDigit(version[7]) {
+		return errBadRequestLine
+	}
+	if version[5] != '1' {
+		return errUnsupportedVersion
+	}
+	req.Method = internMethod(method)
+	req.Version = internVersion(version)
+	req.Target = string(path)
+	req.Path, req.RawQuery, _ = strings.Cut(req.Target, "?")
+
+	// Read headers until blank line
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return err
+		}
+		if len(line) == 0 { // end of headers
+			break
+		}
+		if len(req.fields) == maxHeaderFields || len(req.raw)+len(line) > maxHeaderBytes {
+			return errHeadersTooLarge
+		}
+		// Parse header: Name: Value. The name being a token rules out
+		// whitespace before the colon, and lines folded onto the previous
+		// one by leading whitespace.
+		colonIndex := bytes.IndexByte(line, ':')
+		if colonIndex <= 0 || !validToken(line[:colonIndex]) {
+			return errBadHeader
+		}
+		valueStart, valueEnd := trimOWS(line, colonIndex+1, len(line))
+		if bytes.IndexByte(line[valueStart:valueEnd], '\r') >= 0 || bytes.IndexByte(line[valueStart:valueEnd], 0) >= 0 {
+			return errBadHeader
+		}
+		base := len(req.raw)
+		req.raw = append(req.raw, line...)
+		req.fields = append(req.fields, headerField{
+			nameStart: base, nameEnd: base + colonIndex,
+			valueStart: base + valueStart, valueEnd: base + valueEnd,
+		})
+	}
+	if !knownMethod(req.Method) {
+		return errUnknownMethod
+	}
+	if err := req.checkFraming(); err != nil {
+		return err
+	}
+	req.setBody(r)
+	return nil
+}
+
+// checkFraming rejects requests whose Host or body length is ambiguous,
+// the headers request smuggling plays on
+func (req *Request) checkFraming() error {
+	hosts, lengths := 0, 0
+	var length, coding []byte
+	for _, f := range req.fields {
+		name, value := req.raw[f.nameStart:f.nameEnd], req.raw[f.valueStart:f.valueEnd]
+		switch {
+		case equalFold(name, "Host"):
+			hosts++
+		case equalFold(name, "Content-Length"):
+			if len(value) == 0 || len(value) > 18 || !allDigits(value) || (lengths > 0 && !bytes.Equal(value, length)) {
+				return errBadContentLength
+			}
+			lengths++
+			length = value
+		case equalFold(name, "Transfer-Encoding"):
+			if coding != nil {
+				return errUnsupportedCoding
+			}
+			coding = value
+		}
+	}
+	// Every version after 1.0 needs a Host, including minor versions this
+	// server answers as 1.1
+	if hosts > 1 || (hosts == 0 && req.Version != "HTTP/1.0") {
+		return errMissingHost
+	}
+	if coding != nil {
+		if !equalFold(coding, "chunked") {
+			return errUnsupportedCoding
+		}
+		if lengths > 0 {
+			return errAmbiguousLength
+		}
+	}
+	return nil
+}
+
+// knownMethod reports whether the server recognizes method. Methods are
+// case-sensitive, so "get" is not GET.
+func knownMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS", "PATCH", "TRACE", "CONNECT":
+		return true
+	}
+	return false
+}
+
+// validToken reports whether b is an RFC 9110 token, as methods and header
+// names must be
+func validToken(b []byte) bool {
+	for _, c := range b {
+		if !isTokenChar(c) {
+			return false
+		}
+	}
+	return len(b) > 0
+}
+
+// hasCTL reports whether b holds a control character
+func hasCTL(b []byte) bool {
+	for _, c := range b {
+		if c < ' ' || c == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func allDigits(b []byte) bool {
+	for _, c := range b {
+		if !isDigit(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// readLine returns the next line without its CRLF. The slice points into
+// r's buffer and is only valid until the next read.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errLineTooLong
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+// nextField splits off the next space-separated field of b
+func nextField(b []byte) (field, rest []byte) {
+	i := 0
+	for i < len(b) && (b[i] == ' ' || b[i] == '\t') {
+		i++
+	}
+	j := i
+	for j < len(b) && b[j] != ' ' && b[j] != '\t' {
+		j++
+	}
+	return b[i:j], b[j:]
+}
+
+// trimOWS narrows [start, end) of b to exclude surrounding spaces and tabs
+func trimOWS(b []byte, start, end int) (int, int) {
+	for start < end && (b[start] == ' ' || b[start] == '\t') {
+		start++
+	}
+	for end > start && (b[end-1] == ' ' || b[end-1] == '\t') {
+		end--
+	}
+	return start, end
+}
+
+// equalFold reports whether b and s are equal under ASCII case folding
+func equalFold(b []byte, s string) bool {
+	if len(b) != len(s) {
+		return false
+	}
+	for i := 0; i < len(b); i++ {
+		c1, c2 := b[i], s[i]
+		if c1 == c2 {
+			continue
+		}
+		if 'A' <= c1 && c1 <= 'Z' {
+			c1 += 'a' - 'A'
+		}
+		if 'A' <= c2 && c2 <= 'Z' {
+			c2 += 'a' - 'A'
+		}
+		if c1 != c2 {
+			return false
+		}
+	}
+	return true
+}
+
+// internMethod returns a shared string for common methods so parsing them
+// doesn't allocate
+func internMethod(b []byte) string {
+	switch string(b) {
+	case "GET":
+		return "GET"
+	case "POST":
+		return "POST"
+	case "PUT":
+		return "PUT"
+	case "DELETE":
+		return "DELETE"
+	case "HEAD":
+		return "HEAD"
+	case "OPTIONS":
+		return "OPTIONS"
+	case "PATCH":
+		return "PATCH"
+	}
+	return string(b)
+}
+
+func internVersion(b []byte) string {
+	switch string(b) {
+	case "HTTP/1.1":
+		return "HTTP/1.1"
+	case "HTTP/1.0":
+		return "HTTP/1.0"
+	}
+	return string(b)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const benchRequest = "GET /echo/abc HTTP/1.1\r\n" +
+	"Host: localhost:4221\r\n" +
+	"User-Agent: curl/8.4.0\r\n" +
+	"Accept: */*\r\n" +
+	"Accept-Encoding: gzip, deflate\r\n" +
+	"Connection: keep-alive\r\n" +
+	"\r\n"
+
+func TestReadRequest(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader(benchRequest))
+	req := getRequest()
+	defer putRequest(req)
+
+	if err := readRequest(r, req); err != nil {
+		t.Fatalf("readRequest: %v", err)
+	}
+	if req.Method != "GET" || req.Path != "/echo/abc" || req.Version != "HTTP/1.1" {
+		t.Fatalf("got request line %q %q %q", req.Method, req.Path, req.Version)
+	}
+	if got := req.Header("user-agent"); got != "curl/8.4.0" {
+		t.Errorf("User-Agent = %q", got)
+	}
+	if got := req.Header("Accept-Encoding"); got != "gzip, deflate" {
+		t.Errorf("Accept-Encoding = %q", got)
+	}
+	if _, ok := req.LookupHeader("Content-Length"); ok {
+		t.Errorf("Content-Length reported present")
+	}
+}
+
+func TestReadRequestAllocs(t *testing.T) {
+	data := []byte(benchRequest)
+	rd := bytes.NewReader(data)
+	r := bufio.NewReader(rd)
+	req := getRequest()
+	defer putRequest(req)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		rd.Reset(data)
+		r.Reset(rd)
+		if err := readRequest(r, req); err != nil {
+			t.Fatal(err)
+		}
+	})
+	// Only the path string should be allocated
+	if allocs > 1 {
+		t.Errorf("readRequest allocated %v times per request, want <= 1", allocs)
+	}
+}
+
+func BenchmarkReadRequest(b *testing.B) {
+	data := []byte(benchRequest)
+	rd := bytes.NewReader(data)
+	r := bufio.NewReader(rd)
+	req := getRequest()
+	defer putRequest(req)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		rd.Reset(data)
+		r.Reset(rd)
+		if err := readRequest(r, req); err != nil {
+			b.Fatal(err)
+		}
+		_ = req.Header("Connection")
+		_ = req.Header("Accept-Encoding")
+	}
+}
+
+// legacyReadRequest is the string-based parser readRequest replaced, kept
+// here so the benchmarks show the difference
+func legacyReadRequest(r *bufio.Reader) (string, string, map[string]string, error) {
+	reqLine, err := r.ReadString('\n')
+	if err != nil {
+		return "", "", nil, err
+	}
+	reqLine = strings.TrimRight(reqLine, "\r\n")
+	parts := strings.Fields(reqLine)
+	if len(parts) != 3 {
+		return "", "", nil, fmt.Errorf("bad request line")
+	}
+	headers := make(map[string]string)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", "", nil, err
+		}
+		if line == "\r\n" {
+			break
+		}
+		line = strings.TrimRight(line, "\r\n")
+		colonIndex := strings.Index(line, ":")
+		if colonIndex > 0 {
+			headers[strings.TrimSpace(line[:colonIndex])] = strings.TrimSpace(line[colonIndex+1:])
+		}
+	}
+	return parts[0], parts[1], headers, nil
+}
+
+func BenchmarkLegacyReadRequest(b *testing.B) {
+	data := []byte(benchRequest)
+	rd := bytes.NewReader(data)
+	r := bufio.NewReader(rd)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		rd.Reset(data)
+		r.Reset(rd)
+		_, _, headers, err := legacyReadRequest(r)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_ = headers["Connection"]
+		_ = headers["Accept-Encoding"]
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Header is an ordered list of response header fields. Names are matched
+// case-insensitively and written in the order they were first set.
+type Header struct {
+	fields [][2]string
+}
+
+// Get returns the first value for name, or "" if it isn't set
+func (h *Header) Get(name string) string {
+	for _, f := range h.fields {
+		if strings.EqualFold(f[0], name) {
+			return f[1]
+		}
+	}
+	return ""
+}
+
+// Set replaces any values for name with value
+func (h *Header) Set(name, value string) {
+	for i, f := range h.fields {
+		if strings.EqualFold(f[0], name) {
+			h.fields[i][1] = value
+			h.delFrom(name, i+1)
+			return
+		}
+	}
+	h.fields = append(h.fields, [2]string{name, value})
+}
+
+// Add appends a value for name, keeping existing ones
+func (h *Header) Add(name, value string) {
+	h.fields = append(h.fields, [2]string{name, value})
+}
+
+// Del removes all values for name
+func (h *Header) Del(name string) {
+	h.delFrom(name, 0)
+}
+
+func (h *Header) delFrom(name string, start int) {
+	kept := h.fields[:start]
+	for _, f := range h.fields[start:] {
+		if !strings.EqualFold(f[0], name) {
+			kept = append(kept, f)
+		}
+	}
+	h.fields = kept
+}
+
+// Len returns the number of header fields
+func (h *Header) Len() int {
+	return len(h.fields)
+}
+
+func (h *Header) reset() {
+	h.fields = h.fields[:0]
+}
+
+// errBodyTooLong is returned by Write for bytes past the Content-Length a
+// handler declared
+var errBodyTooLong = errors.New("response body longer than its Content-Length")
+
+// ResponseWriter is what handlers use to build a response. Headers must be
+// set before the first call to WriteHeader or Write.
+type ResponseWriter interface {
+	Header() *Header
+	WriteHeader(code int)
+	Write(p []byte) (int, error)
+}
+
+// flusher is implemented by ResponseWriters that can push buffered output
+// to the client mid-response
+type flusher interface {
+	Flush() error
+}
+
+// response is the ResponseWriter for a request on a live connection. When a
+// handler sets Content-Length the body is streamed straight out; otherwise
+// it is buffered so Content-Length can be filled in when the handler
+// returns, unless the handler flushes, which switches to chunked encoding.
+type response struct {
+	w   *bufio.Writer
+	req *Request
+
+	header        Header
+	status        int
+	wroteHeader   bool // status decided
+	headerSent    bool // status line and headers on the wire
+	contentLength int64
+	body          *bytes.Buffer
+	written       int64 // body bytes accepted from the handler
+	chunked       bool  // body sent with chunked transfer encoding
+
+	// closeConn is set when the connection ends after this response
+	closeConn bool
+	// err is the first error writing to the connection. The response is
+	// abandoned from then on, and every write fails with it.
+	err error
+	// errorPages, when set, gives bodyless error responses a page
+	errorPages *errorPages
+	// headers, when set, changes the header fields as they're sent
+	headers *headerPolicy
+}
+
+var responsePool = sync.Pool{
+	New: func() any { return &response{header: Header{fields: make([][2]string, 0, 8)}} },
+}
+
+func getResponse(w *bufio.Writer, req *Request) *response {
+	resp := responsePool.Get().(*response)
+	resp.reset(w, req)
+	return resp
+}
+
+func putResponse(resp *response) {
+	resp.reset(nil, nil)
+	responsePool.Put(resp)
+}
+
+func (r *response) reset(w *bufio.Writer, req *Request) {
+	if r.body != nil {
+		putBuffer(r.body)
+	}
+	*r = response{w: w, req: req, header: r.header, contentLength: -1}
+	r.header.reset()
+}
+
+func (r *response) Header() *Header {
+	return &r.header
+}
+
+func (r *response) WriteHeader(code int) {
+	if r.wroteHeader {
+		return
+	}
+	r.wroteHeader = true
+	r.status = code
+
+	if cl := r.header.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil && n >= 0 {
+			r.contentLength = n
+		}
+	}
+	if strings.EqualFold(r.header.Get("Connection"), "close") {
+		r.closeConn = true
+	}
+}
+
+func (r *response) Write(p []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(200)
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	if !bodyAllowed(r.status) {
+		return 0, nil
+	}
+	// A HEAD response's body is only measured, for its Content-Length
+	if r.req.Method == "HEAD" {
+		r.written += int64(len(p))
+		return len(p), nil
+	}
+	// Bytes past a declared Content-Length would be read as the start of
+	// the next response
+	if r.contentLength >= 0 && r.written+int64(len(p)) > r.contentLength {
+		n, err := r.Write(p[:r.contentLength-r.written])
+		r.closeConn = true
+		if err == nil {
+			err = errBodyTooLong
+		}
+		return n, err
+	}
+	r.written += int64(len(p))
+
+	if r.chunked {
+		n, err := r.writeChunk(p)
+		return n, r.failed(err)
+	}
+	// Unknown length: hold the body until finish or a flush
+	if r.contentLength < 0 {
+		if r.body == nil {
+			r.body = getBuffer()
+		}
+		return r.body.Write(p)
+	}
+
+	if !r.headerSent {
+		if err := r.sendHeader(); err != nil {
+			return 0, r.failed(err)
+		}
+	}
+	n, err := r.w.Write(p)
+	return n, r.failed(err)
+}
+
+// failed records err if it's the first failure writing to the connection,
+// and returns the first failure
+func (r *response) failed(err error) error {
+	if r.err == nil {
+		r.err = err
+	}
+	return r.err
+}
+
+// Flush pushes everything written so far onto the connection. A body of
+// unknown length switches to chunked encoding here, except for HEAD
+// requests and HTTP/1.0 clients, whose responses stay buffered until the
+// handler returns.
+func (r *response) Flush() error {
+	if !r.wroteHeader {
+		r.WriteHeader(200)
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if !r.headerSent {
+		if r.contentLength < 0 && bodyAllowed(r.status) {
+			if r.req.Version != "HTTP/1.1" || r.req.Method == "HEAD" {
+				return nil
+			}
+			r.chunked = true
+			r.header.Set("Transfer-Encoding", "chunked")
+		}
+		if r.contentLength >= 0 || r.chunked {
+			if err := r.sendHeader(); err != nil {
+				return r.failed(err)
+			}
+		}
+		if r.chunked && r.body != nil {
+			if _, err := r.writeChunk(r.body.Bytes()); err != nil {
+				return r.failed(err)
+			}
+			r.body.Reset()
+		}
+	}
+	return r.failed(r.w.Flush())
+}
+
+// writeChunk writes p as one chunk of a chunked body
+func (r *response) writeChunk(p []byte) (int, error) {
+	if len(p) == 0 {
+		// An empty chunk would end the body
+		return 0, nil
+	}
+	r.w.WriteString(strconv.FormatInt(int64(len(p)), 16))
+	r.w.WriteString("\r\n")
+	r.w.Write(p)
+	if _, err := r.w.WriteString("\r\n"); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// finish completes the response once the handler has returned, or
+// returns the error that abandoned it
+func (r *response) finish() error {
+	if !r.wroteHeader {
+		r.WriteHeader(200)
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if r.chunked {
+		_, err := r.w.WriteString("0\r\n\r\n")
+		return r.failed(err)
+	}
+	if r.headerSent {
+		// The client is still waiting for the rest of a declared body, so
+		// only closing the connection ends the response
+		if r.written < r.contentLength && r.req.Method != "HEAD" {
+			r.closeConn = true
+		}
+		return nil
+	}
+	if !bodyAllowed(r.status) {
+		return r.failed(r.sendHeader())
+	}
+	if r.errorPages != nil && r.status >= 400 && r.written == 0 {
+		r.errorPages.render(r)
+	}
+	// Every response carries its length, so the connection can be reused:
+	// the body buffered, the bytes a HEAD request would have had, or none
+	// when a handler declared a length it never wrote
+	if r.contentLength < 0 || (r.written == 0 && r.req.Method != "HEAD") {
+		r.contentLength = r.written
+		r.header.Set("Content-Length", strconv.FormatInt(r.contentLength, 10))
+	}
+	if err := r.sendHeader(); err != nil {
+		return r.failed(err)
+	}
+	if r.body != nil {
+		_, err := r.w.Write(r.body.Bytes())
+		return r.failed(err)
+	}
+	return nil
+}
+
+func (r *response) sendHeader() error {
+	r.headerSent = true
+	if r.headers != nil {
+		r.headers.apply(&r.header, r.req.Path)
+	}
+	w := r.w
+	w.WriteString("HTTP/1.1 ")
+	w.WriteString(strconv.Itoa(r.status))
+	w.WriteByte(' ')
+	w.WriteString(statusText(r.status))
+	w.WriteString("\r\nDate: ")
+	w.Write(httpDate())
+	w.WriteString("\r\n")
+	for _, f := range r.header.fields {
+		w.WriteString(f[0])
+		w.WriteString(": ")
+		w.WriteString(f[1])
+		w.WriteString("\r\n")
+	}
+	if r.closeConn && r.header.Get("Connection") == "" {
+		w.WriteString("Connection: close\r\n")
+	}
+	_, err := w.WriteString("\r\n")
+	return err
+}
+
+// writeCanned sends a pre-rendered bodyless response
+func (r *response) writeCanned(code int, c cannedResponse) error {
+	r.wroteHeader, r.headerSent = true, true
+	r.status = code
+	r.contentLength = 0
+	return r.failed(c.writeTo(r.w))
+}
+
+// canned reports whether the response can still be sent as pre-rendered
+// bytes
+func (r *response) canned() bool {
+	return !r.wroteHeader && r.header.Len() == 0 && r.errorPages == nil && r.headers == nil && r.req.bodyDone()
+}
+
+// bodyAllowed reports whether a response with the given status may carry a body
+func bodyAllowed(code int) bool {
+	return code >= 200 && code != 204 && code != 304
+}
+
+// sendStatus answers with a bodyless response for code. When the handler
+// hasn't set any headers the pre-rendered canned bytes are used, unless
+// there are error pages or header rules to change them, or an unread body
+// may yet decide whether the connection closes.
+func sendStatus(w ResponseWriter, code int) {
+	if r, ok := w.(*response); ok && r.canned() {
+		if pair, ok := cannedResponses[code]; ok {
+			c := pair[0]
+			if r.closeConn {
+				c = pair[1]
+			}
+			_ = r.writeCanned(code, c)
+			return
+		}
+	}
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(code)
+}
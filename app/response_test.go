@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestKeepAliveFraming sends responses of every kind down one connection,
+// each followed by a request whose response has to be found intact after it
+func TestKeepAliveFraming(t *testing.T) {
+	ts := newTestServer(t)
+	ts.writeFile("a.txt", "hello")
+	// A file beside the served directory, which must stay out of reach
+	if err := os.WriteFile(filepath.Join(ts.dir, "..", "outside.txt"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		req    *testRequest
+		status int
+	}{
+		{ts.Get("/files/missing"), 404},
+		{ts.Get("/files/../outside.txt"), 404},
+		{ts.Get("/no-such-route"), 404},
+		{ts.Request("PUT", "/files/a.txt").Body("x"), 405},
+		{ts.Request("POST", "/files/b.txt").Body("abc"), 201},
+		{ts.Get("/status/400"), 400},
+		{ts.Get("/status/500"), 500},
+		{ts.Get("/status/204"), 204},
+		{ts.Get("/basic-auth/ann/secret"), 401},
+		{ts.Get("/redirect/1"), 302},
+		{ts.Get("/files/a.txt").Header("If-None-Match", `"nope"`), 200},
+		{ts.Get("/stream/2"), 200},
+		{ts.Request("HEAD", "/echo/abc"), 200},
+		{ts.Request("HEAD", "/files/missing"), 405},
+		{ts.Request("HEAD", "/cache"), 200},
+	}
+	c := ts.Conn()
+	for _, tt := range tests {
+		c.Do(tt.req).Status(tt.status)
+		c.Do(ts.Get("/echo/next")).Status(200).BodyIs("next")
+	}
+	c.Raw("GET / HTTP/1.1\r\n\r\n").Status(400)
+}
+
+// TestKeepAliveFramingPipe repeats a few of the above over a pipe, whose
+// writes don't buffer
+func TestKeepAliveFramingPipe(t *testing.T) {
+	ts := newPipeServer(t)
+	c := ts.Conn()
+	c.Do(ts.Get("/files/missing")).Status(404)
+	c.Do(ts.Request("HEAD", "/echo/abc")).Status(200).HeaderIs("Content-Length", "3").BodyIs("")
+	c.Do(ts.Get("/echo/abc")).Status(200).BodyIs("abc")
+}
+
+// writeResponse runs handler against a response for method and returns
+// what went onto the wire, whether the connection would close, and the
+// handler's error
+func writeResponse(t *testing.T, method string, handler func(w ResponseWriter) error) (string, bool, error) {
+	t.Helper()
+	var out bytes.Buffer
+	w := bufio.NewWriter(&out)
+	resp := getResponse(w, NewRequest(method, "/", nil))
+	defer putResponse(resp)
+	err := handler(resp)
+	if ferr := resp.finish(); ferr != nil {
+		t.Fatalf("finish: %v", ferr)
+	}
+	_ = w.Flush()
+	return out.String(), resp.closeConn, err
+}
+
+func TestResponseDeclaredLength(t *testing.T) {
+	t.Run("never written", func(t *testing.T) {
+		wire, closeConn, _ := writeResponse(t, "GET", func(w ResponseWriter) error {
+			w.Header().Set("Content-Length", "10")
+			w.WriteHeader(500)
+			return nil
+		})
+		if !strings.Contains(wire, "Content-Length: 0\r\n") || closeConn {
+			t.Errorf("got %q, close %v; want Content-Length: 0 and keep-alive", wire, closeConn)
+		}
+	})
+	t.Run("too long", func(t *testing.T) {
+		wire, closeConn, err := writeResponse(t, "GET", func(w ResponseWriter) error {
+			w.Header().Set("Content-Length", "3")
+			_, err := w.Write([]byte("abcdef"))
+			return err
+		})
+		if !errors.Is(err, errBodyTooLong) || !strings.HasSuffix(wire, "\r\n\r\nabc") || !closeConn {
+			t.Errorf("got %q, %v, close %v; want the body cut at 3 bytes and the connection closed", wire, err, closeConn)
+		}
+	})
+	t.Run("too short", func(t *testing.T) {
+		_, closeConn, _ := writeResponse(t, "GET", func(w ResponseWriter) error {
+			w.Header().Set("Content-Length", "10")
+			_, err := w.Write([]byte("abc"))
+			return err
+		})
+		if !closeConn {
+			t.Error("connection kept alive after a short body")
+		}
+	})
+	t.Run("head", func(t *testing.T) {
+		wire, closeConn, _ := writeResponse(t, "HEAD", func(w ResponseWriter) error {
+			_, err := w.Write([]byte("abc"))
+			return err
+		})
+		if !strings.Contains(wire, "Content-Length: 3\r\n") || !strings.HasSuffix(wire, "\r\n\r\n") || closeConn {
+			t.Errorf("got %q, close %v; want Content-Length: 3 with no body", wire, closeConn)
+		}
+	})
+	t.Run("head with declared length", func(t *testing.T) {
+		wire, closeConn, _ := writeResponse(t, "HEAD", func(w ResponseWriter) error {
+			w.Header().Set("Content-Length", "42")
+			return nil
+		})
+		if !strings.Contains(wire, "Content-Length: 42\r\n") || closeConn {
+			t.Errorf("got %q, close %v; want the declared length kept", wire, closeConn)
+		}
+	})
+}
+
+// failingWriter accepts limit bytes and then fails every write
+type failingWriter struct {
+	limit int
+}
+
+var errBrokenPipe = errors.New("broken pipe")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n := w.limit
+		w.limit = 0
+		return n, errBrokenPipe
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+func TestResponseWriteError(t *testing.T) {
+	w := bufio.NewWriterSize(&failingWriter{limit: 100}, 16)
+	resp := getResponse(w, NewRequest("GET", "/", nil))
+	defer putResponse(resp)
+	resp.Header().Set("Content-Length", "1000")
+	chunk := bytes.Repeat([]byte{'a'}, 50)
+	var err error
+	for i := 0; i < 20 && err == nil; i++ {
+		_, err = resp.Write(chunk)
+	}
+	if !errors.Is(err, errBrokenPipe) {
+		t.Fatalf("Write = %v, want %v", err, errBrokenPipe)
+	}
+	// Once the connection has failed nothing more is attempted
+	if n, err := resp.Write(chunk); n != 0 || !errors.Is(err, errBrokenPipe) {
+		t.Errorf("Write after failure = %d, %v", n, err)
+	}
+	if err := resp.Flush(); !errors.Is(err, errBrokenPipe) {
+		t.Errorf("Flush after failure = %v", err)
+	}
+	if err := resp.finish(); !errors.Is(err, errBrokenPipe) {
+		t.Errorf("finish after failure = %v", err)
+	}
+}
+
+// TestAbortedResponseCounted hangs up partway through a streamed response
+// and checks the server stops and counts it
+func TestAbortedResponseCounted(t *testing.T) {
+	ts := newPipeServer(t, "--metrics-endpoint")
+	conn, err := ts.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _, _ = io.WriteString(conn, "GET /stream/100 HTTP/1.1\r\nHost: x\r\n\r\n") }()
+	if _, err := io.ReadFull(conn, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ts.s.metrics.aborted.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("aborted response not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ts.Get("/metrics").Do().Status(200).BodyContains("http_responses_aborted_total 1\n")
+}
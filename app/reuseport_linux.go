@@ -0,0 +1,5 @@
+package main
+
+// SO_REUSEPORT from <asm-generic/socket.h>; the frozen syscall package
+// doesn't define it for Linux
+const soReusePort = 0xf
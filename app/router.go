@@ -0,0 +1,225 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// HandlerFunc handles one request. Handlers are Server methods so they can
+// reach the server's configuration.
+type HandlerFunc func(s *Server, w ResponseWriter, req *Request)
+
+// Middleware wraps a handler to run code before or after it. The request's
+// route is already matched when a middleware runs.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Use adds middleware around every route, inside the middleware the
+// configuration sets up. The first one added runs outermost. It must be
+// called before Start.
+func (s *Server) Use(mw ...Middleware) {
+	s.middleware = append(s.middleware, mw...)
+	live := *s.settings()
+	s.setSettings(&live)
+}
+
+// callRoute runs the handler of the route the request matched, going
+// through the response cache when the request is cacheable. Requests with
+// credentials or an Origin, or whose response already sets a cookie, skip
+// the cache, since the stored bytes would replay headers written for
+// another client. So do requests with a query, which the cache is keyed
+// without.
+func callRoute(s *Server, w ResponseWriter, req *Request) {
+	if resp, ok := w.(*response); ok && s.cache != nil && s.cache.cacheable(req.Method, req.Path) &&
+		req.RawQuery == "" && !req.hasCredentials() && req.Header("Origin") == "" && w.Header().Get("Set-Cookie") == "" {
+		s.handleCachedRequest(resp, req)
+		return
+	}
+	req.handler(s, w, req)
+}
+
+// route maps a path template to its handler. A template ending in {name}
+// matches any path with the text before it as a prefix, and the rest of the
+// path is available as req.PathValue(name).
+type route struct {
+	pattern string
+	handler HandlerFunc
+	docs    []RouteDoc // for /openapi.json
+
+	prefix string // pattern up to the parameter
+	param  string // parameter name, "" for exact matches
+}
+
+// unmatchedRoute labels requests that didn't match any route
+const unmatchedRoute = "unmatched"
+
+var routes = newRoutes([]route{
+	{pattern: "/", handler: (*Server).handleRoot, docs: []RouteDoc{
+		{Method: "GET", Summary: "Check the server is up", ResponseType: "text/plain"},
+	}},
+	{pattern: "/echo/{str}", handler: (*Server).handleEcho, docs: []RouteDoc{
+		{Method: "GET", Summary: "Echo the rest of the path, gzipped if accepted, with ?upper=1, ?repeat=n, ?status=code, and ?header=Name:Value", ResponseType: "text/plain",
+			Responses: map[int]string{200: "The text, or the chosen status", 400: "An invalid option"}},
+	}},
+	{pattern: "/user-agent", handler: (*Server).handleUserAgent, docs: []RouteDoc{
+		{Method: "GET", Summary: "Echo the User-Agent header", ResponseType: "text/plain"},
+	}},
+	{pattern: "/headers", handler: (*Server).handleHeaders, docs: []RouteDoc{
+		{Method: "GET", Summary: "Report the request headers", ResponseType: "application/json"},
+	}},
+	{pattern: "/ip", handler: (*Server).handleIP, docs: []RouteDoc{
+		{Method: "GET", Summary: "Report the client address, as forwarded by trusted proxies", ResponseType: "application/json"},
+	}},
+	{pattern: "/anything", handler: (*Server).handleAnything, docs: anythingDocs},
+	{pattern: "/anything/{path}", handler: (*Server).handleAnything, docs: anythingDocs},
+	{pattern: "/redirect/{n}", handler: (*Server).handleRedirect, docs: []RouteDoc{
+		{Method: "GET", Summary: "Redirect n times, with ?code= 301, 302, 303, 307, or 308, then answer 200", ResponseType: "text/plain",
+			Responses: map[int]string{200: "The end of the chain", 302: "The next redirect", 400: "Bad n or code"}},
+	}},
+	{pattern: "/stream/{n}", handler: (*Server).handleStream, docs: []RouteDoc{
+		{Method: "GET", Summary: "Send n JSON lines, up to 100, each in its own chunk", ResponseType: "application/x-ndjson"},
+	}},
+	{pattern: "/drip", handler: (*Server).handleDrip, docs: []RouteDoc{
+		{Method: "GET", Summary: "Trickle ?numbytes= bytes over ?duration=, after ?delay=, with status ?code=", ResponseType: "application/octet-stream"},
+	}},
+	{pattern: "/events", handler: (*Server).handleEvents, docs: []RouteDoc{
+		{Method: "GET", Summary: "Server-sent tick events, ?count= of them ?interval= apart, resuming after Last-Event-ID", ResponseType: "text/event-stream"},
+	}},
+	{pattern: "/cookies", handler: (*Server).handleCookies, docs: []RouteDoc{
+		{Method: "GET", Summary: "Report the cookies sent", ResponseType: "application/json"},
+	}},
+	{pattern: "/cookies/set", handler: (*Server).handleSetCookies, docs: []RouteDoc{
+		{Method: "GET", Summary: "Set a cookie per query parameter, then redirect to /cookies",
+			Responses: map[int]string{302: "Redirect to /cookies", 400: "A name or value that can't be a cookie"}},
+	}},
+	{pattern: "/cookies/delete", handler: (*Server).handleDeleteCookies, docs: []RouteDoc{
+		{Method: "GET", Summary: "Delete the cookies named in the query, then redirect to /cookies",
+			Responses: map[int]string{302: "Redirect to /cookies"}},
+	}},
+	{pattern: "/basic-auth/{credentials}", handler: (*Server).handleBasicAuthTest, docs: []RouteDoc{
+		{Method: "GET", Summary: "Challenge for Basic auth, accepting the credentials given as user/pass in the path", ResponseType: "application/json",
+			Responses: map[int]string{200: "Authenticated", 401: "Missing or wrong credentials"}},
+	}},
+	{pattern: "/range/{n}", handler: (*Server).handleRange, docs: []RouteDoc{
+		{Method: "GET", Summary: "Serve n bytes of a-z repeated, honouring Range and If-Range", ResponseType: "application/octet-stream",
+			Responses: map[int]string{200: "The whole body", 206: "The requested ranges", 416: "No satisfiable range"}},
+	}},
+	{pattern: "/uuid", handler: (*Server).handleUUID, docs: []RouteDoc{
+		{Method: "GET", Summary: "A random version 4 UUID", ResponseType: "application/json"},
+	}},
+	{pattern: "/base64/{value}", handler: (*Server).handleBase64, docs: []RouteDoc{
+		{Method: "GET", Summary: "Decode URL-safe base64", ResponseType: "text/plain",
+			Responses: map[int]string{200: "The decoded value", 400: "Not base64"}},
+	}},
+	{pattern: "/cache", handler: (*Server).handleCache, docs: cacheDocs},
+	{pattern: "/cache/{seconds}", handler: (*Server).handleCache, docs: cacheDocs},
+	{pattern: "/files/{filename}", handler: (*Server).handleFiles, docs: []RouteDoc{
+		{Method: "GET", Summary: "Download a file", ResponseType: "application/octet-stream",
+			Responses: map[int]string{200: "The file", 404: "No such file"}},
+		{Method: "POST", Summary: "Upload a file, replacing any of the same name", RequestType: "application/octet-stream",
+			Responses: map[int]string{201: "Stored", 400: "Missing or short body", 422: "Refused by an upload scanner"}},
+		{Method: "DELETE", Summary: "Delete a file",
+			Responses: map[int]string{204: "Deleted", 404: "No such file"}},
+	}},
+	{pattern: "/status/{code}", handler: (*Server).handleStatus, docs: []RouteDoc{
+		{Method: "GET", Summary: "Answer with the status in the path, after ?delay= and with ?body= if given", ResponseType: "text/plain",
+			Responses: map[int]string{200: "The requested status, whichever it is", 400: "Not a status from 200 to 599, or a bad delay"}},
+	}},
+	{pattern: "/metrics", handler: (*Server).handleMetrics, docs: []RouteDoc{
+		{Method: "GET", Summary: "Prometheus metrics", ResponseType: "text/plain"},
+	}},
+	{pattern: "/healthz", handler: (*Server).handleHealthz, docs: []RouteDoc{
+		{Method: "GET", Summary: "Liveness probe", ResponseType: "text/plain"},
+	}},
+	{pattern: "/readyz", handler: (*Server).handleReadyz, docs: []RouteDoc{
+		{Method: "GET", Summary: "Readiness probe", ResponseType: "text/plain",
+			Responses: map[int]string{200: "Ready", 503: "Not ready, with the failed checks"}},
+	}},
+	{pattern: "/version", handler: (*Server).handleVersion, docs: []RouteDoc{
+		{Method: "GET", Summary: "Build details", ResponseType: "application/json"},
+	}},
+})
+
+// anythingDocs documents /anything, which takes any method
+var anythingDocs = func() []RouteDoc {
+	var docs []RouteDoc
+	for _, method := range []string{"GET", "POST", "PUT", "PATCH", "DELETE"} {
+		docs = append(docs, RouteDoc{Method: method, Summary: "Reflect the request as JSON", RequestType: "*/*", ResponseType: "application/json",
+			Responses: map[int]string{200: "The request", 413: "Body over 1 MiB"}})
+	}
+	return docs
+}()
+
+// cacheDocs documents /cache and /cache/{seconds}
+var cacheDocs = []RouteDoc{
+	{Method: "GET", Summary: "Send ETag and Last-Modified, answering 304 when the request's validators match; with seconds, allow caching that long",
+		ResponseType: "application/json", Responses: map[int]string{200: "Fresh validators", 304: "Not modified"}},
+}
+
+func newRoutes(table []route) []route {
+	for i := range table {
+		r := &table[i]
+		r.prefix = r.pattern
+		if strings.HasSuffix(r.pattern, "}") {
+			if open := strings.LastIndexByte(r.pattern, '{'); open >= 0 {
+				r.prefix = r.pattern[:open]
+				r.param = r.pattern[open+1 : len(r.pattern)-1]
+			}
+		}
+	}
+	return table
+}
+
+// sortRoutes orders a table built from a map, whose order is random, so
+// exact templates go first, then the longest prefix
+func sortRoutes(table []route) []route {
+	sort.SliceStable(table, func(i, j int) bool {
+		a, b := table[i], table[j]
+		if (a.param == "") != (b.param == "") {
+			return a.param == ""
+		}
+		return len(a.prefix) > len(b.prefix)
+	})
+	return table
+}
+
+// matchRoute finds the route for path and the text matched by its parameter
+func matchRoute(path string) (*route, string) {
+	return matchRouteIn(routes, path)
+}
+
+// matchRouteIn is matchRoute over another route table
+func matchRouteIn(table []route, path string) (*route, string) {
+	for i := range table {
+		r := &table[i]
+		if r.param == "" {
+			if path == r.pattern {
+				return r, ""
+			}
+		} else if strings.HasPrefix(path, r.prefix) {
+			return r, path[len(r.prefix):]
+		}
+	}
+	return nil, ""
+}
+
+// routeLabel returns the template of the route a request matched, for use
+// as a low-cardinality metric label
+func routeLabel(req *Request) string {
+	if req.Route != "" {
+		return req.Route
+	}
+	if r, _ := matchRoute(req.Path); r != nil {
+		return r.pattern
+	}
+	return unmatchedRoute
+}
+
+// hasAnyPrefix reports whether path starts with one of prefixes
+func hasAnyPrefix(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
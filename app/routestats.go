@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// routeWindowSize is how many recent requests each route's rolling
+// statistics are computed over
+const routeWindowSize = 1024
+
+// routeStats keeps a rolling window of recent requests per route template
+type routeStats struct {
+	mu     sync.Mutex
+	routes map[string]*routeWindow
+}
+
+// routeWindow is a ring buffer of a route's most recent requests
+type routeWindow struct {
+	mu        sync.Mutex
+	latencies [routeWindowSize]time.Duration
+	errors    [routeWindowSize]bool
+	next      int
+	filled    bool
+	total     uint64
+}
+
+// routeSummary is the rolling view of one route
+type routeSummary struct {
+	Requests   uint64  `json:"requests"`
+	Window     int     `json:"window"`
+	P50        string  `json:"p50"`
+	P95        string  `json:"p95"`
+	P99        string  `json:"p99"`
+	ErrorRatio float64 `json:"error_ratio"`
+}
+
+func newRouteStats() *routeStats {
+	return &routeStats{routes: make(map[string]*routeWindow)}
+}
+
+// observe records one request. Server errors count against the error ratio.
+func (rs *routeStats) observe(route string, status int, duration time.Duration) {
+	rs.mu.Lock()
+	w, ok := rs.routes[route]
+	if !ok {
+		w = new(routeWindow)
+		rs.routes[route] = w
+	}
+	rs.mu.Unlock()
+
+	w.mu.Lock()
+	w.latencies[w.next] = duration
+	w.errors[w.next] = status >= 500
+	w.next++
+	if w.next == routeWindowSize {
+		w.next, w.filled = 0, true
+	}
+	w.total++
+	w.mu.Unlock()
+}
+
+// summary computes percentiles and the error ratio for every route
+func (rs *routeStats) summary() map[string]routeSummary {
+	rs.mu.Lock()
+	windows := make(map[string]*routeWindow, len(rs.routes))
+	for route, w := range rs.routes {
+		windows[route] = w
+	}
+	rs.mu.Unlock()
+
+	out := make(map[string]routeSummary, len(windows))
+	for route, w := range windows {
+		w.mu.Lock()
+		n := w.next
+		if w.filled {
+			n = routeWindowSize
+		}
+		latencies := make([]time.Duration, n)
+		copy(latencies, w.latencies[:n])
+		errors := 0
+		for _, failed := range w.errors[:n] {
+			if failed {
+				errors++
+			}
+		}
+		total := w.total
+		w.mu.Unlock()
+
+		if n == 0 {
+			continue
+		}
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		out[route] = routeSummary{
+			Requests:   total,
+			Window:     n,
+			P50:        percentile(latencies, 50).String(),
+			P95:        percentile(latencies, 95).String(),
+			P99:        percentile(latencies, 99).String(),
+			ErrorRatio: float64(errors) / float64(n),
+		}
+	}
+	return out
+}
+
+// logRouteStats writes a summary line per route every interval
+func (s *Server) logRouteStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		summary := s.routeStats.summary()
+		routes := make([]string, 0, len(summary))
+		for route := range summary {
+			routes = append(routes, route)
+		}
+		sort.Strings(routes)
+		for _, route := range routes {
+			sum := summary[route]
+			s.log.Info("route stats", "route", route, "requests", sum.Requests, "window", sum.Window,
+				"p50", sum.P50, "p95", sum.P95, "p99", sum.P99, "error_ratio", sum.ErrorRatio)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// defaultSecurityHeaders are sent by the security headers middleware unless
+// overridden. Strict-Transport-Security is configured separately and only
+// sent over TLS.
+var defaultSecurityHeaders = [][2]string{
+	{"X-Content-Type-Options", "nosniff"},
+	{"X-Frame-Options", "DENY"},
+	{"Referrer-Policy", "strict-origin-when-cross-origin"},
+	{"Content-Security-Policy", "default-src 'self'"},
+}
+
+// securityPolicy is the set of headers to add, with overrides for path
+// prefixes. An empty value removes a header.
+type securityPolicy struct {
+	headers [][2]string
+	routes  []routeHeaders
+}
+
+type routeHeaders struct {
+	prefix  string
+	headers [][2]string
+}
+
+func newSecurityPolicy() *securityPolicy {
+	return &securityPolicy{headers: append([][2]string(nil), defaultSecurityHeaders...)}
+}
+
+// parseHeaderSetting reads "Name: value"
+func parseHeaderSetting(v string) ([2]string, error) {
+	name, value, ok := strings.Cut(v, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.ContainsAny(name, " \t") {
+		return [2]string{}, errors.New("header must look like \"Name: value\"")
+	}
+	return [2]string{name, strings.TrimSpace(value)}, nil
+}
+
+// set overrides a header everywhere
+func (p *securityPolicy) set(h [2]string) {
+	p.headers = setHeaderValue(p.headers, h)
+}
+
+// setRoute overrides a header for paths starting with prefix
+func (p *securityPolicy) setRoute(prefix string, h [2]string) {
+	for i := range p.routes {
+		if p.routes[i].prefix == prefix {
+			p.routes[i].headers = setHeaderValue(p.routes[i].headers, h)
+			return
+		}
+	}
+	p.routes = append(p.routes, routeHeaders{prefix: prefix, headers: [][2]string{h}})
+}
+
+func setHeaderValue(headers [][2]string, h [2]string) [][2]string {
+	for i := range headers {
+		if strings.EqualFold(headers[i][0], h[0]) {
+			headers[i][1] = h[1]
+			return headers
+		}
+	}
+	return append(headers, h)
+}
+
+// securityHeaders returns a middleware adding the policy's headers to every
+// response. Handlers may still override them.
+func securityHeaders(p *securityPolicy) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(s *Server, w ResponseWriter, req *Request) {
+			h := w.Header()
+			p.apply(h, p.headers, req)
+			// Longest matching prefix wins over shorter ones
+			var best *routeHeaders
+			for i := range p.routes {
+				r := &p.routes[i]
+				if strings.HasPrefix(req.Path, r.prefix) && (best == nil || len(r.prefix) > len(best.prefix)) {
+					best = r
+				}
+			}
+			if best != nil {
+				p.apply(h, best.headers, req)
+			}
+			next(s, w, req)
+		}
+	}
+}
+
+func (p *securityPolicy) apply(h *Header, headers [][2]string, req *Request) {
+	for _, f := range headers {
+		if strings.EqualFold(f[0], "Strict-Transport-Security") && req.TLS() == nil {
+			continue
+		}
+		if f[1] == "" {
+			h.Del(f[0])
+		} else {
+			h.Set(f[0], f[1])
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package main
+
+import "fmt"
+
+// runService implements the service subcommand, which only Windows has;
+// elsewhere use the init system, with --daemon and --pid-file if need be
+func runService(args []string) int {
+	fmt.Println("service is only supported on Windows; see --daemon and --pid-file")
+	return 1
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// The service control manager and event log APIs, which the frozen syscall
+// package doesn't wrap
+var (
+	advapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procOpenSCManagerW                = advapi32.NewProc("OpenSCManagerW")
+	procCreateServiceW                = advapi32.NewProc("CreateServiceW")
+	procOpenServiceW                  = advapi32.NewProc("OpenServiceW")
+	procDeleteService                 = advapi32.NewProc("DeleteService")
+	procCloseServiceHandle            = advapi32.NewProc("CloseServiceHandle")
+	procStartServiceCtrlDispatcherW   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerExW = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus              = advapi32.NewProc("SetServiceStatus")
+	procRegisterEventSourceW          = advapi32.NewProc("RegisterEventSourceW")
+	procReportEventW                  = advapi32.NewProc("ReportEventW")
+	procRegCreateKeyExW               = advapi32.NewProc("RegCreateKeyExW")
+	procRegSetValueExW                = advapi32.NewProc("RegSetValueExW")
+	procRegDeleteKeyW                 = advapi32.NewProc("RegDeleteKeyW")
+)
+
+// From winsvc.h, winnt.h, and winreg.h
+const (
+	scManagerAllAccess     = 0xf003f
+	serviceAllAccess       = 0xf01ff
+	serviceWin32OwnProcess = 0x10
+	serviceAutoStart       = 2
+	serviceErrorNormal     = 1
+	accessDelete           = 0x10000
+
+	serviceStopped      = 1
+	serviceStartPending = 2
+	serviceStopPending  = 3
+	serviceRunning      = 4
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+	serviceAcceptStop         = 1
+	serviceAcceptShutdown     = 4
+
+	errorCallNotImplemented = 120
+
+	eventlogErrorType       = 1
+	eventlogWarningType     = 2
+	eventlogInformationType = 4
+
+	hkeyLocalMachine = 0x80000002
+	keyAllAccess     = 0xf003f
+	regExpandSZ      = 2
+	regDWORD         = 4
+)
+
+// eventLogKey is where event sources are registered
+const eventLogKey = `SYSTEM\CurrentControlSet\Services\EventLog\Application\`
+
+type serviceStatus struct {
+	serviceType             uint32
+	currentState            uint32
+	controlsAccepted        uint32
+	win32ExitCode           uint32
+	serviceSpecificExitCode uint32
+	checkPoint              uint32
+	waitHint                uint32
+}
+
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// runService implements the service subcommand
+func runService(args []string) int {
+	if len(args) < 2 {
+		fmt.Println(commandUsage("service"))
+		return 2
+	}
+	var err error
+	switch name := args[1]; args[0] {
+	case "install":
+		err = installService(name, args[2:])
+	case "uninstall":
+		err = uninstallService(name)
+	case "run":
+		// How the service manager starts an installed service
+		err = runAsService(name, args[2:])
+	default:
+		fmt.Printf("unknown service command %q\n", args[0])
+		return 2
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	return 0
+}
+
+// installService registers a service that runs this binary with flags,
+// started automatically at boot, and an event log source of the same name
+func installService(name string, flags []string) error {
+	cfg, err := parseFlags(flags)
+	if err != nil {
+		return err
+	}
+	// Services start in the system directory
+	if cfg.directory != "" && !filepath.IsAbs(cfg.directory) {
+		return errors.New("--directory must be an absolute path for a service")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmdline := []string{syscall.EscapeArg(exe), "service", "run", syscall.EscapeArg(name)}
+	for _, flag := range flags {
+		cmdline = append(cmdline, syscall.EscapeArg(flag))
+	}
+
+	m, err := openSCManager()
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(m)
+	h, _, err := procCreateServiceW.Call(m,
+		uintptr(unsafe.Pointer(utf16Ptr(name))), uintptr(unsafe.Pointer(utf16Ptr(name))),
+		serviceAllAccess, serviceWin32OwnProcess, serviceAutoStart, serviceErrorNormal,
+		uintptr(unsafe.Pointer(utf16Ptr(strings.Join(cmdline, " ")))),
+		0, 0, 0, 0, 0)
+	if h == 0 {
+		return fmt.Errorf("failed to create service: %v", err)
+	}
+	procCloseServiceHandle.Call(h)
+
+	if err := installEventSource(name); err != nil {
+		return fmt.Errorf("service installed, but failed to register event log source: %v", err)
+	}
+	fmt.Printf("installed service %s; start it with: sc start %s\n", name, name)
+	return nil
+}
+
+func uninstallService(name string) error {
+	m, err := openSCManager()
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(m)
+	h, _, err := procOpenServiceW.Call(m, uintptr(unsafe.Pointer(utf16Ptr(name))), accessDelete)
+	if h == 0 {
+		return fmt.Errorf("failed to open service: %v", err)
+	}
+	defer procCloseServiceHandle.Call(h)
+	if ok, _, err := procDeleteService.Call(h); ok == 0 {
+		return fmt.Errorf("failed to delete service: %v", err)
+	}
+	procRegDeleteKeyW.Call(hkeyLocalMachine, uintptr(unsafe.Pointer(utf16Ptr(eventLogKey+name))))
+	fmt.Printf("removed service %s\n", name)
+	return nil
+}
+
+func openSCManager() (uintptr, error) {
+	m, _, err := procOpenSCManagerW.Call(0, 0, scManagerAllAccess)
+	if m == 0 {
+		return 0, fmt.Errorf("failed to connect to the service manager: %v", err)
+	}
+	return m, nil
+}
+
+// installEventSource registers name as an event source whose messages are
+// shown as given, using EventCreate.exe's "%1" message table
+func installEventSource(name string) error {
+	var key syscall.Handle
+	if r, _, _ := procRegCreateKeyExW.Call(hkeyLocalMachine, uintptr(unsafe.Pointer(utf16Ptr(eventLogKey+name))),
+		0, 0, 0, keyAllAccess, 0, uintptr(unsafe.Pointer(&key)), 0); r != 0 {
+		return syscall.Errno(r)
+	}
+	defer syscall.RegCloseKey(key)
+
+	msgFile := syscall.StringToUTF16(`%SystemRoot%\System32\EventCreate.exe`)
+	if r, _, _ := procRegSetValueExW.Call(uintptr(key), uintptr(unsafe.Pointer(utf16Ptr("EventMessageFile"))), 0,
+		regExpandSZ, uintptr(unsafe.Pointer(&msgFile[0])), uintptr(len(msgFile)*2)); r != 0 {
+		return syscall.Errno(r)
+	}
+	types := uint32(eventlogErrorType | eventlogWarningType | eventlogInformationType)
+	if r, _, _ := procRegSetValueExW.Call(uintptr(key), uintptr(unsafe.Pointer(utf16Ptr("TypesSupported"))), 0,
+		regDWORD, uintptr(unsafe.Pointer(&types)), 4); r != 0 {
+		return syscall.Errno(r)
+	}
+	return nil
+}
+
+// windowsService runs the server under the service control manager
+type windowsService struct {
+	name  string
+	args  []string
+	event uintptr
+
+	mu     sync.Mutex
+	handle uintptr
+	status serviceStatus
+	server *Server
+}
+
+// runAsService hands the process to the service control manager, which
+// calls back into main on another thread. It returns once the server has
+// stopped.
+func runAsService(name string, args []string) error {
+	ws := &windowsService{name: name, args: args}
+	ws.event, _, _ = procRegisterEventSourceW.Call(0, uintptr(unsafe.Pointer(utf16Ptr(name))))
+	table := []serviceTableEntry{
+		{name: utf16Ptr(name), proc: syscall.NewCallback(ws.main)},
+		{},
+	}
+	if ok, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0]))); ok == 0 {
+		return fmt.Errorf("failed to start as a service (service run is for the service manager): %v", err)
+	}
+	return nil
+}
+
+// main is the service's ServiceMain
+func (ws *windowsService) main(argc uint32, argv **uint16) uintptr {
+	ws.handle, _, _ = procRegisterServiceCtrlHandlerExW.Call(
+		uintptr(unsafe.Pointer(utf16Ptr(ws.name))), syscall.NewCallback(ws.control), 0)
+	ws.setState(serviceStartPending, 0)
+	runServer(ws.args, &serviceRun{
+		log: eventLogWriter{ws.event},
+		started: func(s *Server) {
+			ws.mu.Lock()
+			ws.server = s
+			ws.mu.Unlock()
+			ws.setState(serviceRunning, serviceAcceptStop|serviceAcceptShutdown)
+		},
+	})
+	ws.setState(serviceStopped, 0)
+	return 0
+}
+
+// control is the service's HandlerEx, called for stop and shutdown requests
+func (ws *windowsService) control(control, eventType uint32, eventData, context uintptr) uintptr {
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		ws.mu.Lock()
+		s := ws.server
+		ws.mu.Unlock()
+		if s == nil {
+			return 0
+		}
+		ws.setState(serviceStopPending, 0)
+		go s.Shutdown()
+		return 0
+	case serviceControlInterrogate:
+		ws.mu.Lock()
+		procSetServiceStatus.Call(ws.handle, uintptr(unsafe.Pointer(&ws.status)))
+		ws.mu.Unlock()
+		return 0
+	}
+	return errorCallNotImplemented
+}
+
+func (ws *windowsService) setState(state, accepts uint32) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.status = serviceStatus{serviceType: serviceWin32OwnProcess, currentState: state, controlsAccepted: accepts}
+	// Pending states promise progress within the wait hint
+	if state == serviceStartPending || state == serviceStopPending {
+		ws.status.waitHint = 60000
+	}
+	procSetServiceStatus.Call(ws.handle, uintptr(unsafe.Pointer(&ws.status)))
+}
+
+// eventLogWriter reports each server log line as an event, typed by the
+// line's level
+type eventLogWriter struct {
+	source uintptr
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	if w.source == 0 {
+		return len(p), nil
+	}
+	kind := eventlogInformationType
+	if bytes.Contains(p, []byte(`"level":"ERROR"`)) || bytes.Contains(p, []byte("level=ERROR")) {
+		kind = eventlogErrorType
+	} else if bytes.Contains(p, []byte(`"level":"WARN"`)) || bytes.Contains(p, []byte("level=WARN")) {
+		kind = eventlogWarningType
+	}
+	msg, err := syscall.UTF16PtrFromString(strings.TrimRight(string(bytes.ReplaceAll(p, []byte{0}, nil)), "\n"))
+	if err != nil {
+		return 0, err
+	}
+	// Event ID 1 is EventCreate.exe's "%1"
+	if ok, _, err := procReportEventW.Call(w.source, uintptr(kind), 0, 1, 0, 1, 0,
+		uintptr(unsafe.Pointer(&msg)), 0); ok == 0 {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// utf16Ptr converts s for a Windows API call; s never holds a NUL here
+func utf16Ptr(s string) *uint16 {
+	p, _ := syscall.UTF16PtrFromString(s)
+	return p
+}
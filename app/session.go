@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session defaults
+const (
+	defaultSessionCookie = "session"
+	defaultSessionTTL    = 24 * time.Hour
+)
+
+// SessionStore keeps session values by ID. The in-memory store is built
+// in; a Redis or file store implements the same three methods and is set
+// with Server.SetSessionStore before Start.
+type SessionStore interface {
+	// Load returns the values of a live session, or ok false when there
+	// is none or it has expired
+	Load(id string) (values map[string]string, ok bool, err error)
+	// Save stores values, replacing what was there, to expire after ttl
+	Save(id string, values map[string]string, ttl time.Duration) error
+	Delete(id string) error
+}
+
+// memorySessionStore is a SessionStore in the server's memory. Sessions
+// are lost on restart.
+type memorySessionStore struct {
+	mu        sync.Mutex
+	sessions  map[string]memorySession
+	lastSweep time.Time
+}
+
+type memorySession struct {
+	values  map[string]string
+	expires time.Time
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: make(map[string]memorySession)}
+}
+
+func (m *memorySessionStore) Load(id string) (map[string]string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sess, ok := m.sessions[id]
+	if !ok || time.Now().After(sess.expires) {
+		return nil, false, nil
+	}
+	values := make(map[string]string, len(sess.values))
+	for k, v := range sess.values {
+		values[k] = v
+	}
+	return values, true, nil
+}
+
+func (m *memorySessionStore) Save(id string, values map[string]string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.sessions[id] = memorySession{values: values, expires: now.Add(ttl)}
+	// Expired sessions are dropped at most once a TTL
+	if now.Sub(m.lastSweep) > ttl {
+		for id, sess := range m.sessions {
+			if now.After(sess.expires) {
+				delete(m.sessions, id)
+			}
+		}
+		m.lastSweep = now
+	}
+	return nil
+}
+
+func (m *memorySessionStore) Delete(id string) error {
+	m.mu.Lock()
+	delete(m.sessions, id)
+	m.mu.Unlock()
+	return nil
+}
+
+// sessionManager issues session cookies holding a random ID and its
+// HMAC, so IDs can't be guessed or forged into the store's keyspace.
+// Sessions expire after ttl without a request.
+type sessionManager struct {
+	secret []byte
+	cookie string
+	ttl    time.Duration
+	store  SessionStore
+}
+
+// newSessionManager signs IDs with secret, or with a random key when it
+// is empty, in which case sessions don't survive a restart
+func newSessionManager(secret, cookie string, ttl time.Duration, store SessionStore) (*sessionManager, error) {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &sessionManager{secret: key, cookie: cookie, ttl: ttl, store: store}, nil
+}
+
+func (m *sessionManager) sign(id string) string {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the ID in a cookie value, or "" if it wasn't issued here
+func (m *sessionManager) verify(value string) string {
+	id, sig, ok := strings.Cut(value, ".")
+	if !ok || id == "" || !hmac.Equal([]byte(sig), []byte(m.sign(id))) {
+		return ""
+	}
+	return id
+}
+
+// Session is the state kept for one client across requests. It is loaded
+// on first use, so requests that never touch it cost nothing, and saved
+// when the handler returns.
+type Session struct {
+	m   *sessionManager
+	w   ResponseWriter
+	req *Request
+
+	loaded    bool
+	id        string
+	values    map[string]string
+	destroyed bool
+}
+
+// Session returns the request's session, or nil without --sessions
+func (req *Request) Session() *Session {
+	return req.session
+}
+
+// SetSessionStore replaces the in-memory session store, e.g. with one
+// backed by Redis or files. It must be called before Start.
+func (s *Server) SetSessionStore(store SessionStore) {
+	if s.sessions != nil {
+		s.sessions.store = store
+	}
+}
+
+func (sess *Session) load() {
+	if sess.loaded {
+		return
+	}
+	sess.loaded = true
+	if id := sess.m.verify(sess.req.Cookie(sess.m.cookie)); id != "" {
+		values, ok, err := sess.m.store.Load(id)
+		if err != nil {
+			sess.req.Logger().Error("failed to load session", "err", err)
+		}
+		if ok {
+			sess.id, sess.values = id, values
+			return
+		}
+	}
+	sess.values = make(map[string]string)
+}
+
+// Get returns the value stored under key, or ""
+func (sess *Session) Get(key string) string {
+	sess.load()
+	return sess.values[key]
+}
+
+// Set stores value under key, starting a session if there isn't one. It
+// must be called before the response header is written.
+func (sess *Session) Set(key, value string) {
+	sess.load()
+	if sess.id == "" {
+		sess.start()
+	}
+	sess.values[key] = value
+}
+
+// Delete removes key from the session
+func (sess *Session) Delete(key string) {
+	sess.load()
+	delete(sess.values, key)
+}
+
+// Destroy ends the session and clears its cookie. It must be called
+// before the response header is written.
+func (sess *Session) Destroy() {
+	sess.load()
+	if sess.id != "" {
+		if err := sess.m.store.Delete(sess.id); err != nil {
+			sess.req.Logger().Error("failed to delete session", "err", err)
+		}
+	}
+	sess.setCookie("", true)
+	sess.id, sess.values, sess.destroyed = "", make(map[string]string), true
+}
+
+// Renew moves the session's values to a new ID, so an ID planted before
+// a login is never trusted with the logged-in session. It must be called
+// before the response header is written.
+func (sess *Session) Renew() {
+	sess.load()
+	if sess.id != "" {
+		if err := sess.m.store.Delete(sess.id); err != nil {
+			sess.req.Logger().Error("failed to delete session", "err", err)
+		}
+	}
+	sess.start()
+}
+
+// start issues a new ID and its cookie
+func (sess *Session) start() {
+	b := make([]byte, 24)
+	_, _ = rand.Read(b)
+	sess.id = base64.RawURLEncoding.EncodeToString(b)
+	sess.setCookie(sess.id+"."+sess.m.sign(sess.id), false)
+	sess.destroyed = false
+}
+
+// setCookie sets the session cookie, or deletes it with expire. It has no
+// expiry of its own; the store's TTL decides how long a session lives.
+func (sess *Session) setCookie(value string, expire bool) {
+	c := Cookie{Name: sess.m.cookie, Value: value, HttpOnly: true, SameSite: "Lax", Secure: sess.req.TLS() != nil}
+	if expire {
+		c.MaxAge = -1
+	}
+	if err := SetCookie(sess.w, c); err != nil {
+		sess.req.Logger().Error("failed to set session cookie", "err", err)
+	}
+}
+
+// save writes a used session back, which also restarts its TTL
+func (sess *Session) save() {
+	if !sess.loaded || sess.id == "" || sess.destroyed {
+		return
+	}
+	if err := sess.m.store.Save(sess.id, sess.values, sess.m.ttl); err != nil {
+		sess.req.Logger().Error("failed to save session", "err", err)
+	}
+}
+
+// sessions returns a middleware giving each request a Session
+func sessions(m *sessionManager) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(s *Server, w ResponseWriter, req *Request) {
+			sess := &Session{m: m, w: w, req: req}
+			req.session = sess
+			next(s, w, req)
+			sess.save()
+		}
+	}
+}
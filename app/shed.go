@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for load shedding, which is off unless --max-in-flight is set
+const (
+	defaultQueueTimeout = time.Second
+	defaultRetryAfter   = 1
+)
+
+// loadShedder caps the number of requests handled at once. Requests beyond
+// the cap wait in a bounded queue for up to queueTimeout; once the queue is
+// full or the wait times out they are refused with 503 so latency stays
+// predictable for the requests that are admitted.
+type loadShedder struct {
+	slots        chan struct{}
+	maxQueue     int64
+	queueTimeout time.Duration
+	unavailable  cannedResponse
+
+	inFlight atomic.Int64
+	queued   atomic.Int64
+	shed     atomic.Uint64
+}
+
+func newLoadShedder(maxInFlight, maxQueue int, queueTimeout time.Duration, retryAfter int) *loadShedder {
+	return &loadShedder{
+		slots:        make(chan struct{}, maxInFlight),
+		maxQueue:     int64(maxQueue),
+		queueTimeout: queueTimeout,
+		unavailable:  newCannedResponse(503, true, fmt.Sprintf("Retry-After: %d", retryAfter)),
+	}
+}
+
+// acquire reserves a slot for a request, reporting false if the request
+// should be shed instead
+func (l *loadShedder) acquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		l.inFlight.Add(1)
+		return true
+	default:
+	}
+
+	if l.queued.Add(1) > l.maxQueue {
+		l.queued.Add(-1)
+		l.shed.Add(1)
+		return false
+	}
+	defer l.queued.Add(-1)
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		l.inFlight.Add(1)
+		return true
+	case <-timer.C:
+		l.shed.Add(1)
+		return false
+	}
+}
+
+func (l *loadShedder) release() {
+	l.inFlight.Add(-1)
+	<-l.slots
+}
+
+// Stats returns the current in-flight and queued request counts and the
+// total number of shed requests
+func (l *loadShedder) Stats() (inFlight, queued int64, shed uint64) {
+	return l.inFlight.Load(), l.queued.Load(), l.shed.Load()
+}
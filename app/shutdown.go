@@ -0,0 +1,55 @@
+package main
+
+import "time"
+
+// defaultDrainTimeout bounds how long shutdown waits for requests in flight
+const defaultDrainTimeout = 30 * time.Second
+
+// Shutdown stops accepting connections and closes the idle ones. Requests
+// in flight finish and are answered with Connection: close, and Start
+// returns once every connection is gone or the drain timeout runs out.
+func (s *Server) Shutdown() {
+	if s.draining.Swap(true) {
+		return
+	}
+	s.log.Info("shutting down", "drain_timeout", s.drainTimeout)
+	s.Close()
+
+	// A connection marks itself idle before checking draining, so each one
+	// either sees draining or is woken here
+	s.connsMu.Lock()
+	for tc := range s.conns {
+		if tc.idle.Load() {
+			_ = tc.Conn.SetReadDeadline(time.Now())
+		}
+	}
+	s.connsMu.Unlock()
+}
+
+// drain waits for the connections left after Shutdown, closing any still
+// open when the drain timeout runs out
+func (s *Server) drain() {
+	done := make(chan struct{})
+	go func() {
+		s.connWG.Wait()
+		close(done)
+	}()
+	var expired <-chan time.Time
+	if s.drainTimeout > 0 {
+		timer := time.NewTimer(s.drainTimeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-done:
+		s.log.Info("all connections drained")
+	case <-expired:
+		s.connsMu.Lock()
+		s.log.Warn("drain timeout expired, closing connections", "open", len(s.conns))
+		for tc := range s.conns {
+			_ = tc.Conn.Close()
+		}
+		s.connsMu.Unlock()
+	}
+}
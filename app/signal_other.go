@@ -0,0 +1,29 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"os"
+	"os/signal"
+)
+
+// watchReopenSignal is a no-op where SIGUSR1 doesn't exist
+func (s *Server) watchReopenSignal() {}
+
+// watchReloadSignal is a no-op where SIGHUP doesn't exist; the admin
+// endpoint still reloads
+func (s *Server) watchReloadSignal() {}
+
+// watchShutdownSignals shuts down gracefully on an interrupt. A second one
+// exits at once.
+func (s *Server) watchShutdownSignals() {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, os.Interrupt)
+	go func() {
+		<-ch
+		s.Shutdown()
+		<-ch
+		s.log.Warn("second signal, exiting without draining")
+		os.Exit(1)
+	}()
+}
@@ -0,0 +1,48 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchReopenSignal reopens the server's log files whenever SIGUSR1 arrives,
+// which is what logrotate's postrotate scripts conventionally send
+func (s *Server) watchReopenSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	go func() {
+		for range ch {
+			s.reopenLogs()
+		}
+	}()
+}
+
+// watchReloadSignal reloads the configuration whenever SIGHUP arrives
+func (s *Server) watchReloadSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if err := s.reload(); err != nil {
+				s.log.Error("failed to reload configuration", "err", err)
+			}
+		}
+	}()
+}
+
+// watchShutdownSignals shuts down gracefully on SIGINT or SIGTERM. A second
+// signal exits at once.
+func (s *Server) watchShutdownSignals() {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-ch
+		s.Shutdown()
+		<-ch
+		s.log.Warn("second signal, exiting without draining")
+		os.Exit(1)
+	}()
+}
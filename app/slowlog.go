@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// requestPhases splits a request's handling time into reading the head,
+// running the handler (including any body it streamed), and flushing the
+// rest of the response
+type requestPhases struct {
+	read, handler, write time.Duration
+}
+
+func (p requestPhases) total() time.Duration {
+	return p.read + p.handler + p.write
+}
+
+// slowest names the phase that took longest
+func (p requestPhases) slowest() string {
+	switch {
+	case p.read >= p.handler && p.read >= p.write:
+		return "read"
+	case p.handler >= p.write:
+		return "handler"
+	default:
+		return "write"
+	}
+}
+
+// logSlowRequest warns about a request that took longer than the
+// configured threshold, with enough detail to reproduce it
+func (s *Server) logSlowRequest(req *Request, resp *response, phases requestPhases) {
+	headers := req.Headers()
+	attrs := make([]any, 0, len(headers))
+	for _, h := range headers {
+		value := h[1]
+		if isSecretHeader([]byte(h[0])) {
+			value = redactedValue
+		}
+		attrs = append(attrs, slog.String(h[0], value))
+	}
+
+	req.Logger().Warn("slow request",
+		"target", redactTarget(req.Target),
+		"version", req.Version,
+		"route", routeLabel(req),
+		"status", resp.status,
+		"bytes", resp.written,
+		"duration", phases.total(),
+		"slow_phase", phases.slowest(),
+		slog.Group("phases",
+			"read", phases.read,
+			"handler", phases.handler,
+			"write", phases.write,
+		),
+		slog.Group("headers", attrs...),
+	)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// socketOptions holds the TCP tuning applied to listeners and to every
+// accepted connection. Zero sizes leave the OS defaults in place.
+type socketOptions struct {
+	noDelay     bool
+	keepAlive   time.Duration // 0 disables SO_KEEPALIVE
+	readBuffer  int
+	writeBuffer int
+	backlog     int // accept queue length hint, 0 uses the OS default
+}
+
+func defaultSocketOptions() socketOptions {
+	return socketOptions{
+		noDelay:   true,
+		keepAlive: 15 * time.Second,
+	}
+}
+
+// applyConn sets the per-connection options on an accepted connection
+func (o socketOptions) applyConn(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tcpConn.SetNoDelay(o.noDelay); err != nil {
+		return err
+	}
+	if o.keepAlive > 0 {
+		if err := tcpConn.SetKeepAlive(true); err != nil {
+			return err
+		}
+		if err := tcpConn.SetKeepAlivePeriod(o.keepAlive); err != nil {
+			return err
+		}
+	} else if err := tcpConn.SetKeepAlive(false); err != nil {
+		return err
+	}
+	if o.readBuffer > 0 {
+		if err := tcpConn.SetReadBuffer(o.readBuffer); err != nil {
+			return err
+		}
+	}
+	if o.writeBuffer > 0 {
+		if err := tcpConn.SetWriteBuffer(o.writeBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyListener sets the listener-level options
+func (o socketOptions) applyListener(l net.Listener) error {
+	if o.backlog <= 0 {
+		return nil
+	}
+	tcpListener, ok := l.(*net.TCPListener)
+	if !ok {
+		return nil
+	}
+	rc, err := tcpListener.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return setBacklog(rc, o.backlog)
+}
@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setBacklog(c syscall.RawConn, backlog int) error {
+	return errors.New("setting the accept backlog is not supported on this platform")
+}
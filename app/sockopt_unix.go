@@ -0,0 +1,18 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import "syscall"
+
+// setBacklog calls listen(2) again on an already listening socket, which
+// updates the accept queue length (still capped by the kernel's somaxconn)
+func setBacklog(c syscall.RawConn, backlog int) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
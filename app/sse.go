@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /events sends 10 events a second apart unless asked otherwise
+const (
+	defaultEventCount    = 10
+	defaultEventInterval = time.Second
+	maxEventCount        = 1000
+	minEventInterval     = 100 * time.Millisecond
+	maxEventInterval     = time.Minute
+	eventRetry           = 3 * time.Second
+)
+
+// EventStream writes server-sent events. Each event is flushed as it is
+// sent, under the per-chunk write deadline.
+type EventStream struct {
+	s   *Server
+	w   ResponseWriter
+	req *Request
+}
+
+// StartEventStream answers req with a text/event-stream, ready for Send
+func (s *Server) StartEventStream(w ResponseWriter, req *Request) (*EventStream, error) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	es := &EventStream{s: s, w: w, req: req}
+	return es, es.flush()
+}
+
+// LastEventID returns the ID of the last event a reconnecting client saw
+func (req *Request) LastEventID() string {
+	return req.Header("Last-Event-ID")
+}
+
+// Send writes one event. id and event may be empty; data may span lines.
+func (es *EventStream) Send(id, event, data string) error {
+	var b strings.Builder
+	if id != "" {
+		b.WriteString("id: " + id + "\n")
+	}
+	if event != "" {
+		b.WriteString("event: " + event + "\n")
+	}
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	return es.write(b.String())
+}
+
+// Retry tells the client how long to wait before reconnecting
+func (es *EventStream) Retry(d time.Duration) error {
+	return es.write("retry: " + strconv.FormatInt(d.Milliseconds(), 10) + "\n\n")
+}
+
+// Comment writes a line clients ignore, to keep idle connections open
+func (es *EventStream) Comment(text string) error {
+	return es.write(": " + text + "\n\n")
+}
+
+func (es *EventStream) write(text string) error {
+	if es.req.conn != nil {
+		_ = es.req.conn.SetWriteDeadline(time.Now().Add(es.s.chunkWriteTimeout))
+	}
+	if _, err := es.w.Write([]byte(text)); err != nil {
+		return err
+	}
+	return es.flush()
+}
+
+func (es *EventStream) flush() error {
+	if f, ok := es.w.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// handleEvents sends ?count= timestamped tick events ?interval= apart.
+// Event IDs count up, and a client reconnecting with Last-Event-ID picks
+// up after the last one it saw.
+func (s *Server) handleEvents(w ResponseWriter, req *Request) {
+	query := req.Query()
+	count := defaultEventCount
+	if v := query.Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			sendStatus(w, 400)
+			return
+		}
+		count = min(n, maxEventCount)
+	}
+	interval, ok := parseTestDuration(query.Get("interval"), defaultEventInterval, maxEventInterval)
+	if !ok {
+		sendStatus(w, 400)
+		return
+	}
+	interval = max(interval, minEventInterval)
+	next := 1
+	if last, err := strconv.Atoi(req.LastEventID()); err == nil && last >= 0 {
+		next = last + 1
+	}
+
+	if req.Method == "HEAD" {
+		w.Header().Set("Content-Type", "text/event-stream")
+		return
+	}
+	es, err := s.StartEventStream(w, req)
+	if err == nil {
+		err = es.Retry(eventRetry)
+	}
+	for i := 0; i < count && err == nil; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		// Shutdown ends the stream; the client reconnects elsewhere
+		if s.draining.Load() {
+			return
+		}
+		data, _ := json.Marshal(map[string]any{"time": time.Now().UTC().Format(time.RFC3339Nano)})
+		err = es.Send(strconv.Itoa(next+i), "tick", string(data))
+	}
+	if err != nil {
+		req.Logger().Debug("event stream aborted", "err", err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// runtimeStats is the snapshot served on the admin listener's /stats
+type runtimeStats struct {
+	Uptime         string  `json:"uptime"`
+	UptimeSeconds  float64 `json:"uptime_seconds"`
+	Goroutines     int     `json:"goroutines"`
+	OpenConns      int64   `json:"open_connections"`
+	InFlight       int64   `json:"in_flight_requests"`
+	RequestsServed uint64  `json:"requests_served"`
+
+	Routes    map[string]routeSummary `json:"routes,omitempty"`
+	Upstreams []upstreamStatus        `json:"upstreams,omitempty"`
+
+	Memory struct {
+		HeapAlloc    uint64 `json:"heap_alloc_bytes"`
+		HeapInuse    uint64 `json:"heap_inuse_bytes"`
+		HeapObjects  uint64 `json:"heap_objects"`
+		Sys          uint64 `json:"sys_bytes"`
+		TotalAlloc   uint64 `json:"total_alloc_bytes"`
+		Mallocs      uint64 `json:"mallocs"`
+		Frees        uint64 `json:"frees"`
+		NumGC        uint32 `json:"num_gc"`
+		PauseTotalNs uint64 `json:"gc_pause_total_ns"`
+		LastGC       string `json:"last_gc,omitempty"`
+	} `json:"memory"`
+
+	Build struct {
+		GoVersion string            `json:"go_version"`
+		Path      string            `json:"path,omitempty"`
+		Version   string            `json:"version,omitempty"`
+		Settings  map[string]string `json:"settings,omitempty"`
+	} `json:"build"`
+}
+
+// runtimeStats takes an operational snapshot of the process
+func (s *Server) runtimeStats() runtimeStats {
+	var st runtimeStats
+	uptime := time.Since(s.started)
+	st.Uptime = uptime.Round(time.Second).String()
+	st.UptimeSeconds = uptime.Seconds()
+	st.Goroutines = runtime.NumGoroutine()
+	st.RequestsServed = s.reqIDs.Load()
+	st.OpenConns = int64(s.connCount())
+	if s.metrics != nil {
+		st.InFlight = s.metrics.inFlight.Load()
+	}
+	if s.routeStats != nil {
+		st.Routes = s.routeStats.summary()
+	}
+	st.Upstreams = s.upstreamStatuses()
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	st.Memory.HeapAlloc = ms.HeapAlloc
+	st.Memory.HeapInuse = ms.HeapInuse
+	st.Memory.HeapObjects = ms.HeapObjects
+	st.Memory.Sys = ms.Sys
+	st.Memory.TotalAlloc = ms.TotalAlloc
+	st.Memory.Mallocs = ms.Mallocs
+	st.Memory.Frees = ms.Frees
+	st.Memory.NumGC = ms.NumGC
+	st.Memory.PauseTotalNs = ms.PauseTotalNs
+	if ms.LastGC > 0 {
+		st.Memory.LastGC = time.Unix(0, int64(ms.LastGC)).UTC().Format(time.RFC3339Nano)
+	}
+
+	st.Build.GoVersion = runtime.Version()
+	if info, ok := debug.ReadBuildInfo(); ok {
+		st.Build.Path = info.Main.Path
+		st.Build.Version = info.Main.Version
+		for _, setting := range info.Settings {
+			// Only the VCS details are interesting, the rest is build flags
+			if strings.HasPrefix(setting.Key, "vcs.") {
+				if st.Build.Settings == nil {
+					st.Build.Settings = make(map[string]string)
+				}
+				st.Build.Settings[setting.Key] = setting.Value
+			}
+		}
+	}
+	return st
+}
+
+// statsJSON renders the runtime snapshot as indented JSON
+func (s *Server) statsJSON() []byte {
+	body, _ := json.MarshalIndent(s.runtimeStats(), "", "  ")
+	return append(body, '\n')
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Defaults for streaming file bodies
+const (
+	defaultFileChunkSize     = 64 * 1024
+	defaultChunkWriteTimeout = 5 * time.Second
+)
+
+// chunkPool hands out fixed-size buffers for streaming file bodies
+type chunkPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newChunkPool(size int) *chunkPool {
+	p := &chunkPool{size: size}
+	p.pool.New = func() any {
+		b := make([]byte, size)
+		return &b
+	}
+	return p
+}
+
+func (p *chunkPool) Get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+func (p *chunkPool) Put(b *[]byte) {
+	p.pool.Put(b)
+}
+
+// streamFile copies r to w one chunk at a time, pushing each chunk onto the
+// connection under its own write deadline. A slow client keeps the transfer
+// alive as long as every chunk makes it out in time; a stalled one is cut
+// off after a single chunk timeout.
+func (s *Server) streamFile(w ResponseWriter, conn net.Conn, r io.Reader) error {
+	chunk := s.chunks.Get()
+	defer s.chunks.Put(chunk)
+	buf := *chunk
+
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			if conn != nil {
+				_ = conn.SetWriteDeadline(time.Now().Add(s.chunkWriteTimeout))
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			if f, ok := w.(flusher); ok {
+				if err := f.Flush(); err != nil {
+					return err
+				}
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stubCheckInterval is how often the stubs file is checked for changes
+const stubCheckInterval = 2 * time.Second
+
+// stub is one canned response from the --stubs file
+type stub struct {
+	Method   string            `json:"method"` // any method when empty
+	Path     string            `json:"path"`   // a route template, e.g. /api/users/{id}
+	Status   int               `json:"status"` // 200 when unset
+	Headers  map[string]string `json:"headers"`
+	Body     string            `json:"body"`
+	BodyFile string            `json:"body_file"` // relative to the stubs file
+	Latency  string            `json:"latency"`   // a duration to wait first, e.g. 300ms
+
+	route   route
+	latency time.Duration
+}
+
+// stubStore holds the stubs from a JSON file, a list of objects like
+//
+//	[{"method": "GET", "path": "/api/users/{id}", "status": 200,
+//	  "headers": {"Content-Type": "application/json"},
+//	  "body_file": "user.json", "latency": "200ms"}]
+//
+// reloading it when it changes. The first stub matching the method and
+// path answers; body files are read on every request, so they can be
+// edited in place.
+type stubStore struct {
+	path string
+
+	mu      sync.RWMutex
+	stubs   []*stub
+	modTime time.Time
+	checked time.Time
+}
+
+func loadStubs(path string) (*stubStore, error) {
+	st := &stubStore{path: path}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := st.load(info.ModTime()); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (st *stubStore) load(modTime time.Time) error {
+	f, err := os.Open(st.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var stubs []*stub
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&stubs); err != nil {
+		return fmt.Errorf("%s: %w", st.path, err)
+	}
+	for i, sb := range stubs {
+		if !strings.HasPrefix(sb.Path, "/") {
+			return fmt.Errorf("%s: stub %d: path must start with /", st.path, i+1)
+		}
+		if sb.Status == 0 {
+			sb.Status = 200
+		} else if sb.Status < 100 || sb.Status > 599 {
+			return fmt.Errorf("%s: stub %d: invalid status %d", st.path, i+1, sb.Status)
+		}
+		if sb.Latency != "" {
+			if sb.latency, err = time.ParseDuration(sb.Latency); err != nil || sb.latency < 0 {
+				return fmt.Errorf("%s: stub %d: invalid latency %q", st.path, i+1, sb.Latency)
+			}
+		}
+		if sb.BodyFile != "" && !filepath.IsAbs(sb.BodyFile) {
+			sb.BodyFile = filepath.Join(filepath.Dir(st.path), sb.BodyFile)
+		}
+		sb.Method = strings.ToUpper(sb.Method)
+		sb.route = newRoutes([]route{{pattern: sb.Path}})[0]
+	}
+
+	st.mu.Lock()
+	st.stubs, st.modTime = stubs, modTime
+	st.mu.Unlock()
+	return nil
+}
+
+// match finds the stub for a request and the text matched by its path
+// parameter, first reloading the file if it has changed
+func (st *stubStore) match(method, path string) (*stub, string) {
+	st.mu.RLock()
+	stale := time.Since(st.checked) > stubCheckInterval
+	st.mu.RUnlock()
+	if stale {
+		st.refresh()
+	}
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	for _, sb := range st.stubs {
+		if sb.Method != "" && sb.Method != method {
+			continue
+		}
+		if r, value := matchRouteIn([]route{sb.route}, path); r != nil {
+			return sb, value
+		}
+	}
+	return nil, ""
+}
+
+// refresh reloads the stubs file when its modification time moved. A file
+// that fails to parse leaves the previous stubs in place.
+func (st *stubStore) refresh() {
+	st.mu.Lock()
+	if time.Since(st.checked) <= stubCheckInterval {
+		st.mu.Unlock()
+		return
+	}
+	st.checked = time.Now()
+	modTime := st.modTime
+	st.mu.Unlock()
+
+	info, err := os.Stat(st.path)
+	if err != nil || info.ModTime().Equal(modTime) {
+		return
+	}
+	if err := st.load(info.ModTime()); err != nil {
+		// Checked again once the file changes
+		st.mu.Lock()
+		st.modTime = info.ModTime()
+		st.mu.Unlock()
+	}
+}
+
+// matchStub finds the stub for req, when --stubs is set
+func (s *Server) matchStub(req *Request) (*stub, string) {
+	if st := s.settings().stubs; st != nil {
+		return st.match(req.Method, req.Path)
+	}
+	return nil, ""
+}
+
+// serve answers with the stub's canned response
+func (sb *stub) serve(s *Server, w ResponseWriter, req *Request) {
+	if sb.latency > 0 {
+		time.Sleep(sb.latency)
+	}
+	body := []byte(sb.Body)
+	if sb.BodyFile != "" {
+		var err error
+		if body, err = os.ReadFile(sb.BodyFile); err != nil {
+			req.Logger().Error("failed to read stub body", "file", sb.BodyFile, "err", err)
+			sendStatus(w, 500)
+			return
+		}
+	}
+	for name, value := range sb.Headers {
+		w.Header().Set(name, value)
+	}
+	w.WriteHeader(sb.Status)
+	if req.Method != "HEAD" {
+		_, _ = w.Write(body)
+	}
+}
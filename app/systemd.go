@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// systemdListeners returns the sockets systemd passed with the LISTEN_FDS
+// protocol, keyed by the kind their FileDescriptorName= gives: main, plain,
+// redirect, admin, or acme. Unnamed sockets are main listeners.
+func (s *Server) systemdListeners() map[string][]net.Listener {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	// The variables may have been meant for a parent process
+	if pid != os.Getpid() || n <= 0 {
+		return nil
+	}
+
+	listeners := make(map[string][]net.Listener)
+	for i := 0; i < n; i++ {
+		kind := "main"
+		if i < len(names) {
+			switch names[i] {
+			case "plain", "redirect", "admin", "acme":
+				kind = names[i]
+			}
+		}
+		f := os.NewFile(uintptr(3+i), kind)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			s.log.Warn("failed to use socket from systemd", "fd", 3+i, "err", err)
+			continue
+		}
+		listeners[kind] = append(listeners[kind], l)
+	}
+	s.log.Info("using sockets from systemd", "count", n)
+	return listeners
+}
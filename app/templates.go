@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// templateSet holds the pages of a template directory. Every *.html file
+// is a page, named by its path relative to the directory, except those
+// under layouts/ and partials/, which are parsed into every page so pages
+// can call and override them:
+//
+//	layouts/base.html   {{define "base"}}<html>...{{block "content" .}}{{end}}...{{end}}
+//	partials/nav.html   {{define "nav"}}...{{end}}
+//	index.html          {{template "base" .}}{{define "content"}}...{{template "nav"}}...{{end}}
+type templateSet struct {
+	dir string
+	// reload reparses the directory when a file in it changes
+	reload bool
+
+	mu     sync.RWMutex
+	pages  map[string]*template.Template
+	newest time.Time // latest modification time seen when parsed
+	files  int
+}
+
+func loadTemplates(dir string, reload bool) (*templateSet, error) {
+	ts := &templateSet{dir: dir, reload: reload}
+	if err := ts.parse(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// isLayoutOrPartial reports whether a template file is a layout or partial
+func isLayoutOrPartial(rel string) bool {
+	return strings.HasPrefix(rel, "layouts/") || strings.HasPrefix(rel, "partials/")
+}
+
+func (ts *templateSet) parse() error {
+	var shared, pages []string
+	newest, files, err := ts.scan(func(rel string) {
+		if isLayoutOrPartial(rel) {
+			shared = append(shared, rel)
+		} else {
+			pages = append(pages, rel)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	base := template.New("")
+	for _, rel := range shared {
+		if err := parseTemplateFile(base, ts.dir, rel); err != nil {
+			return err
+		}
+	}
+	parsed := make(map[string]*template.Template, len(pages))
+	for _, rel := range pages {
+		t, err := base.Clone()
+		if err != nil {
+			return err
+		}
+		if err := parseTemplateFile(t, ts.dir, rel); err != nil {
+			return err
+		}
+		parsed[rel] = t
+	}
+
+	ts.mu.Lock()
+	ts.pages, ts.newest, ts.files = parsed, newest, files
+	ts.mu.Unlock()
+	return nil
+}
+
+func parseTemplateFile(t *template.Template, dir, rel string) error {
+	text, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(rel)))
+	if err != nil {
+		return err
+	}
+	_, err = t.New(rel).Parse(string(text))
+	return err
+}
+
+// scan calls found with the slash-separated relative path of every
+// template file, and returns the newest modification time and the count
+func (ts *templateSet) scan(found func(rel string)) (time.Time, int, error) {
+	var newest time.Time
+	var files int
+	err := filepath.WalkDir(ts.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".html" {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		files++
+		if found != nil {
+			rel, _ := filepath.Rel(ts.dir, path)
+			found(filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return newest, files, err
+}
+
+// lookup returns the page called name, reparsing first in reload mode if
+// anything changed. A failed reparse is reported and the old pages kept.
+func (ts *templateSet) lookup(name string) (*template.Template, error) {
+	if ts.reload {
+		newest, files, err := ts.scan(nil)
+		ts.mu.RLock()
+		changed := err == nil && (newest.After(ts.newest) || files != ts.files)
+		ts.mu.RUnlock()
+		if changed {
+			if err := ts.parse(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	ts.mu.RLock()
+	t := ts.pages[name]
+	ts.mu.RUnlock()
+	if t == nil || isLayoutOrPartial(name) {
+		return nil, fmt.Errorf("no template %q", name)
+	}
+	return t, nil
+}
+
+// Render answers with the page called name, such as "index.html" or
+// "errors/404.html", executed with data. The page is rendered in full
+// before anything is sent, so a template error becomes a 500 rather than
+// half a page.
+func (s *Server) Render(w ResponseWriter, code int, name string, data any) error {
+	if s.templates == nil {
+		sendStatus(w, 500)
+		return fmt.Errorf("no --templates directory for %q", name)
+	}
+	t, err := s.templates.lookup(name)
+	if err != nil {
+		sendStatus(w, 500)
+		return err
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := t.ExecuteTemplate(buf, name, data); err != nil {
+		sendStatus(w, 500)
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(code)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseRate parses a byte rate such as "10MB/s", "512KB", or "65536". Units
+// are powers of 1024; a rate of 0 means unlimited.
+func parseRate(s string) (int64, error) {
+	n, err := parseSize(strings.TrimSuffix(strings.TrimSpace(s), "/s"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return n, nil
+}
+
+// parseSize parses a byte count such as "100MB", "64K", or "4096", with
+// units in powers of 1024
+func parseSize(s string) (int64, error) {
+	v := strings.TrimSpace(s)
+	multiplier := int64(1)
+	upper := strings.ToUpper(v)
+	for _, unit := range []struct {
+		suffix string
+		factor int64
+	}{
+		{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+	} {
+		if strings.HasSuffix(upper, unit.suffix) {
+			multiplier = unit.factor
+			v = v[:len(v)-len(unit.suffix)]
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// routeRate overrides the connection rate for paths under a prefix
+type routeRate struct {
+	prefix string
+	rate   int64
+}
+
+// rateFor returns the response byte rate for a path: the longest matching
+// route override, or the server-wide default
+func (s *Server) rateFor(path string) int64 {
+	rate, matched := s.maxRate, -1
+	for _, rr := range s.routeRates {
+		if len(rr.prefix) > matched && strings.HasPrefix(path, rr.prefix) {
+			rate, matched = rr.rate, len(rr.prefix)
+		}
+	}
+	return rate
+}
+
+// tokenBucket paces byte output to rate bytes per second, allowing bursts
+// of up to burst bytes
+type tokenBucket struct {
+	rate   int64
+	burst  int64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	burst := rate / 4
+	if burst < 4096 {
+		burst = 4096
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: float64(burst), last: time.Now()}
+}
+
+// take blocks until n bytes (at most burst) may be sent
+func (b *tokenBucket) take(n int64) {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens < 0 {
+		wait := time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+		time.Sleep(wait)
+	}
+}
+
+// throttledWriter sits between a connection's buffered writer and the
+// socket. When a rate is set, writes are cut into burst-sized pieces paced
+// by a token bucket, and each piece gets a fresh write deadline so pacing
+// doesn't eat into the time allowed for the client to accept it.
+type throttledWriter struct {
+	conn         net.Conn
+	writeTimeout time.Duration
+	bucket       *tokenBucket
+}
+
+var _ io.Writer = (*throttledWriter)(nil)
+
+// setRate switches pacing for the next response; 0 disables it
+func (tw *throttledWriter) setRate(rate int64) {
+	if rate <= 0 {
+		tw.bucket = nil
+		return
+	}
+	if tw.bucket == nil || tw.bucket.rate != rate {
+		tw.bucket = newTokenBucket(rate)
+	}
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	if tw.bucket == nil {
+		return tw.conn.Write(p)
+	}
+	written := 0
+	for len(p) > 0 {
+		piece := p
+		if int64(len(piece)) > tw.bucket.burst {
+			piece = piece[:tw.bucket.burst]
+		}
+		tw.bucket.take(int64(len(piece)))
+		_ = tw.conn.SetWriteDeadline(time.Now().Add(tw.writeTimeout))
+		n, err := tw.conn.Write(piece)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default phase timeouts. Header reads are bounded in total so a client
+// trickling bytes can't hold a connection; body reads and writes are bounded
+// per operation so large transfers complete as long as they keep moving.
+const (
+	defaultIdleTimeout    = 5 * time.Second
+	defaultHeaderTimeout  = 5 * time.Second
+	defaultBodyTimeout    = 10 * time.Second
+	defaultHandlerTimeout = 30 * time.Second
+)
+
+// phaseTimeouts are the deadlines for each phase of a request, 0 meaning
+// no limit
+type phaseTimeouts struct {
+	idle    time.Duration // waiting for the first byte of a request
+	header  time.Duration // from the first byte to the end of the headers
+	body    time.Duration // each read of the body, while the handler runs
+	handler time.Duration // from the last request byte to the first response byte
+	write   time.Duration // each write of the response
+}
+
+// timeoutConn applies the deadlines of the request phase it is in. Reads
+// and writes extend their own deadline when a per-operation timeout is set,
+// and once the handler timeout fires every operation fails until cleared.
+type timeoutConn struct {
+	net.Conn
+	read, write time.Duration
+
+	// handlerTimer is guarded by handlerMu, since the body may be read on
+	// another goroutine than the one writing the response
+	handlerMu      sync.Mutex
+	handlerTimer   *time.Timer
+	handlerTimeout time.Duration
+	expired        atomic.Bool
+
+	// idle is set while waiting for the next request, when shutdown may
+	// close the connection
+	idle atomic.Bool
+
+	// opened and requests are reported by the admin connection list
+	opened   time.Time
+	requests atomic.Uint64
+	// lastActive is when bytes last moved either way, in Unix nanoseconds
+	lastActive atomic.Int64
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+	if c.expired.Load() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if c.read > 0 {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.read))
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.touch()
+		// A body still arriving isn't the handler stalling, so its time
+		// starts over
+		c.handlerMu.Lock()
+		if c.handlerTimer != nil {
+			c.handlerTimer.Reset(c.handlerTimeout)
+		}
+		c.handlerMu.Unlock()
+	}
+	return n, err
+}
+
+func (c *timeoutConn) Write(p []byte) (int, error) {
+	if c.expired.Load() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	// The response has started, so the handler is no longer stalled
+	c.stopHandlerTimer()
+	if c.write > 0 {
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(c.write))
+	}
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+// touch records activity on the connection
+func (c *timeoutConn) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// idleFor returns how long the connection has gone without activity
+func (c *timeoutConn) idleFor(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, c.lastActive.Load()))
+}
+
+// waitIdle starts the wait for the next request
+func (c *timeoutConn) waitIdle(t *phaseTimeouts) {
+	c.read = 0
+	_ = c.Conn.SetReadDeadline(deadline(time.Now(), t.idle))
+	c.idle.Store(true)
+}
+
+// readHeaders bounds the whole header read from start
+func (c *timeoutConn) readHeaders(t *phaseTimeouts, start time.Time) {
+	c.idle.Store(false)
+	_ = c.Conn.SetReadDeadline(deadline(start, t.header))
+}
+
+// deadline returns from+d, or no deadline when d is 0
+func deadline(from time.Time, d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return from.Add(d)
+}
+
+// startHandler switches body reads to per-read deadlines and starts the
+// handler timer, which aborts the connection's I/O if nothing has been
+// written by the time it fires. Reading more of the body restarts it, so
+// slow uploads aren't cut off.
+func (c *timeoutConn) startHandler(t *phaseTimeouts) {
+	c.read = t.body
+	if t.handler > 0 {
+		c.handlerMu.Lock()
+		c.handlerTimeout = t.handler
+		c.handlerTimer = time.AfterFunc(t.handler, func() {
+			c.expired.Store(true)
+			_ = c.Conn.SetDeadline(time.Now())
+		})
+		c.handlerMu.Unlock()
+	}
+}
+
+// finishHandler stops the handler timer, reporting whether it had fired.
+// The connection is usable again afterwards.
+func (c *timeoutConn) finishHandler() bool {
+	c.stopHandlerTimer()
+	c.read = 0
+	return c.expired.Swap(false)
+}
+
+func (c *timeoutConn) stopHandlerTimer() {
+	c.handlerMu.Lock()
+	if c.handlerTimer != nil {
+		c.handlerTimer.Stop()
+		c.handlerTimer = nil
+	}
+	c.handlerMu.Unlock()
+}
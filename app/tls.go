@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// selfSignedValidity is how long generated development certificates last
+const selfSignedValidity = 90 * 24 * time.Hour
+
+// loadTLSConfig builds the server's TLS configuration from a PEM
+// certificate chain and private key
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return newTLSConfig(cert), nil
+}
+
+// selfSignedTLSConfig builds a TLS configuration around a self-signed
+// certificate for localhost. With cacheDir set the certificate is kept
+// there and reused while it is still valid, so it only has to be trusted
+// once.
+func selfSignedTLSConfig(cacheDir string) (*tls.Config, error) {
+	if cacheDir == "" {
+		certPEM, keyPEM, err := generateSelfSigned()
+		if err != nil {
+			return nil, err
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		return newTLSConfig(cert), nil
+	}
+
+	certFile := filepath.Join(cacheDir, "localhost.crt")
+	keyFile := filepath.Join(cacheDir, "localhost.key")
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil && time.Now().Before(leaf.NotAfter) {
+			return newTLSConfig(cert), nil
+		}
+	}
+	certPEM, keyPEM, err := generateSelfSigned()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cacheDir, 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(certFile, certPEM, 0o644); err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return newTLSConfig(cert), nil
+}
+
+// staticTLSConfig builds the TLS configuration from --tls-cert or
+// --tls-self-signed, or returns nil when TLS is off or comes from ACME
+func staticTLSConfig(cfg *serverConfig) (*tls.Config, error) {
+	if (cfg.tlsCert == "") != (cfg.tlsKey == "") {
+		return nil, errors.New("--tls-cert and --tls-key must be given together")
+	}
+	if cfg.tlsSelfSigned && (cfg.tlsCert != "" || len(cfg.acmeDomains) > 0) {
+		return nil, errors.New("--tls-self-signed can't be combined with --tls-cert or --acme-domain")
+	}
+	if cfg.tlsCert != "" && len(cfg.acmeDomains) > 0 {
+		return nil, errors.New("--acme-domain can't be combined with --tls-cert")
+	}
+	if cfg.tlsCert == "" && !cfg.tlsSelfSigned {
+		if cfg.tlsClientCA != "" && len(cfg.acmeDomains) == 0 {
+			return nil, errors.New("--tls-client-ca requires TLS to be enabled")
+		}
+		return nil, nil
+	}
+
+	var config *tls.Config
+	var err error
+	if cfg.tlsSelfSigned {
+		config, err = selfSignedTLSConfig(cfg.tlsSelfSignedCache)
+	} else {
+		config, err = loadTLSConfig(cfg.tlsCert, cfg.tlsKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	if cfg.tlsClientCA != "" {
+		mode, _ := parseClientAuth(cfg.tlsClientAuth)
+		if err := enableClientAuth(config, cfg.tlsClientCA, mode); err != nil {
+			return nil, fmt.Errorf("failed to load client CA bundle: %w", err)
+		}
+	}
+	return config, nil
+}
+
+// generateSelfSigned creates a PEM certificate and key valid for
+// localhost and the loopback addresses
+func generateSelfSigned() (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "localhost", Organization: []string{"Development"}},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// newTLSConfig returns the server's TLS settings around cert
+func newTLSConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		// Only HTTP/1.1 is spoken here
+		NextProtos: []string{"http/1.1"},
+	}
+}
+
+// parseClientAuth maps --tls-client-auth values onto crypto/tls policies
+func parseClientAuth(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	case "verify-if-given":
+		return tls.VerifyClientCertIfGiven, nil
+	case "none":
+		return tls.NoClientCert, nil
+	}
+	return 0, fmt.Errorf("unknown client auth mode %q", mode)
+}
+
+// enableClientAuth makes config verify client certificates against the
+// PEM CA bundle in caFile
+func enableClientAuth(config *tls.Config, caFile string, mode tls.ClientAuthType) error {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return errors.New("no certificates found in " + caFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = mode
+	return nil
+}
+
+// clientSubject returns the subject of the verified client certificate,
+// or "" when the client didn't present one
+func clientSubject(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.String()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// tlsPolicy restricts the protocol versions, cipher suites, and key
+// exchange curves the server negotiates. Zero fields keep crypto/tls
+// defaults. Cipher suites only apply up to TLS 1.2; TLS 1.3 suites aren't
+// configurable.
+type tlsPolicy struct {
+	minVersion   uint16
+	maxVersion   uint16
+	cipherSuites []uint16
+	curves       []tls.CurveID
+}
+
+// tlsPresets follow Mozilla's server side TLS recommendations. "modern" is
+// TLS 1.3 only; "intermediate" also allows TLS 1.2 with forward-secret AEAD
+// suites.
+var tlsPresets = map[string]tlsPolicy{
+	"modern": {
+		minVersion: tls.VersionTLS13,
+		curves:     []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+	},
+	"intermediate": {
+		minVersion: tls.VersionTLS12,
+		cipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+		curves: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+	},
+}
+
+// parseTLSVersion reads "1.2" or "1.3"; older versions aren't offered
+func parseTLSVersion(v string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(v), "tls") {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version %q, use 1.2 or 1.3", v)
+}
+
+// parseCipherSuites reads a comma-separated list of IANA suite names such
+// as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Suites crypto/tls considers
+// insecure are refused.
+func parseCipherSuites(v string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no cipher suites given")
+	}
+	return ids, nil
+}
+
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if strings.EqualFold(suite.Name, name) {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// parseCurves reads a comma-separated list of X25519, P-256, P-384, and
+// P-521
+func parseCurves(v string) ([]tls.CurveID, error) {
+	var curves []tls.CurveID
+	for _, name := range strings.Split(v, ",") {
+		switch strings.ToUpper(strings.TrimSpace(name)) {
+		case "X25519":
+			curves = append(curves, tls.X25519)
+		case "P-256", "P256":
+			curves = append(curves, tls.CurveP256)
+		case "P-384", "P384":
+			curves = append(curves, tls.CurveP384)
+		case "P-521", "P521":
+			curves = append(curves, tls.CurveP521)
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown curve %q", name)
+		}
+	}
+	if len(curves) == 0 {
+		return nil, fmt.Errorf("no curves given")
+	}
+	return curves, nil
+}
+
+func (p *tlsPolicy) isZero() bool {
+	return p.minVersion == 0 && p.maxVersion == 0 && p.cipherSuites == nil && p.curves == nil
+}
+
+// with returns p overridden by the non-zero fields of o
+func (p tlsPolicy) with(o tlsPolicy) tlsPolicy {
+	if o.minVersion != 0 {
+		p.minVersion = o.minVersion
+	}
+	if o.maxVersion != 0 {
+		p.maxVersion = o.maxVersion
+	}
+	if o.cipherSuites != nil {
+		p.cipherSuites = o.cipherSuites
+	}
+	if o.curves != nil {
+		p.curves = o.curves
+	}
+	return p
+}
+
+// apply sets the policy's non-zero fields on config
+func (p *tlsPolicy) apply(config *tls.Config) error {
+	if p.minVersion != 0 && p.maxVersion != 0 && p.minVersion > p.maxVersion {
+		return fmt.Errorf("minimum TLS version is above the maximum")
+	}
+	if p.minVersion != 0 {
+		config.MinVersion = p.minVersion
+	}
+	if p.maxVersion != 0 {
+		config.MaxVersion = p.maxVersion
+	}
+	if p.cipherSuites != nil {
+		config.CipherSuites = p.cipherSuites
+	}
+	if p.curves != nil {
+		config.CurvePreferences = p.curves
+	}
+	return nil
+}
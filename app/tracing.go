@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Span export tuning
+const (
+	spanQueueSize     = 4096
+	spanBatchSize     = 512
+	spanFlushInterval = 5 * time.Second
+	spanExportTimeout = 10 * time.Second
+)
+
+// traceContext identifies a request's span and the trace it belongs to
+type traceContext struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // zero for root spans
+	sampled  bool
+}
+
+func (tc *traceContext) valid() bool {
+	return tc.traceID != [16]byte{}
+}
+
+// parseTraceparent reads a W3C traceparent header,
+// "00-<trace-id>-<parent-id>-<flags>"
+func parseTraceparent(v string) (traceContext, bool) {
+	var tc traceContext
+	if len(v) < 55 || v[2] != '-' || v[35] != '-' || v[52] != '-' {
+		return tc, false
+	}
+	// Future versions may append fields, version 00 may not
+	if v[:2] == "ff" || (v[:2] == "00" && len(v) != 55) || (len(v) > 55 && v[55] != '-') {
+		return tc, false
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(tc.traceID[:], []byte(v[3:35])); err != nil {
+		return tc, false
+	}
+	if _, err := hex.Decode(tc.parentID[:], []byte(v[36:52])); err != nil {
+		return tc, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(v[53:55])); err != nil {
+		return tc, false
+	}
+	if tc.traceID == [16]byte{} || tc.parentID == [8]byte{} {
+		return tc, false
+	}
+	tc.sampled = flags[0]&1 == 1
+	return tc, true
+}
+
+// startTrace continues the trace from the request's traceparent header, or
+// starts a new sampled one, and gives the request a fresh span ID
+func startTrace(req *Request) {
+	tc, ok := parseTraceparent(req.Header("Traceparent"))
+	if !ok {
+		tc = traceContext{sampled: true}
+		putUint64(tc.traceID[:8], rand.Uint64())
+		putUint64(tc.traceID[8:], rand.Uint64())
+	}
+	putUint64(tc.spanID[:], rand.Uint64()|1)
+	req.trace = tc
+}
+
+func putUint64(b []byte, v uint64) {
+	for i := range b {
+		b[i] = byte(v >> (8 * (len(b) - 1 - i)))
+	}
+}
+
+// tracer batches finished request spans and exports them to an OTLP/HTTP
+// collector as JSON
+type tracer struct {
+	endpoint string
+	service  string
+	client   *http.Client
+	log      *slog.Logger
+
+	spans   chan otlpSpan
+	dropped atomic.Uint64
+}
+
+// newTracer exports to endpoint, a collector base URL such as
+// http://localhost:4318 or a full URL ending in /v1/traces
+func newTracer(endpoint, service string, log *slog.Logger) *tracer {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint += "/v1/traces"
+	}
+	t := &tracer{
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: spanExportTimeout},
+		log:      log,
+		spans:    make(chan otlpSpan, spanQueueSize),
+	}
+	go t.run()
+	return t
+}
+
+// finish records the request's span. Spans are dropped rather than
+// blocking the request when the export queue is full.
+func (t *tracer) finish(req *Request, resp *response, start, end time.Time) {
+	tc := &req.trace
+	if !tc.sampled {
+		return
+	}
+	route := routeLabel(req)
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(tc.traceID[:]),
+		SpanID:            hex.EncodeToString(tc.spanID[:]),
+		Name:              req.Method,
+		Kind:              2, // SPAN_KIND_SERVER
+		StartTimeUnixNano: strconv.FormatInt(start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes: []otlpAttribute{
+			stringAttribute("http.request.method", req.Method),
+			stringAttribute("url.path", req.Path),
+			intAttribute("http.response.status_code", int64(resp.status)),
+			intAttribute("http.response.body.size", resp.written),
+		},
+	}
+	// Requests that matched no route are named by method alone
+	if route != unmatchedRoute {
+		span.Name += " " + route
+		span.Attributes = append(span.Attributes, stringAttribute("http.route", route))
+	}
+	if tc.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(tc.parentID[:])
+	}
+	if n, err := strconv.ParseInt(req.Header("Content-Length"), 10, 64); err == nil {
+		span.Attributes = append(span.Attributes, intAttribute("http.request.body.size", n))
+	}
+	if ua := req.Header("User-Agent"); ua != "" {
+		span.Attributes = append(span.Attributes, stringAttribute("user_agent.original", ua))
+	}
+	if resp.status >= 500 {
+		span.Status.Code = 2 // STATUS_CODE_ERROR
+	}
+
+	select {
+	case t.spans <- span:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+func (t *tracer) run() {
+	ticker := time.NewTicker(spanFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]otlpSpan, 0, spanBatchSize)
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) < spanBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		t.export(batch)
+		batch = batch[:0]
+	}
+}
+
+func (t *tracer) export(spans []otlpSpan) {
+	payload := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{stringAttribute("service.name", t.service)}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "codecrafters-http-server"},
+			Spans: spans,
+		}},
+	}}}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.log.Error("failed to encode spans", "err", err)
+		return
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.log.Warn("failed to export spans", "endpoint", t.endpoint, "spans", len(spans), "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		t.log.Warn("collector rejected spans", "endpoint", t.endpoint, "spans", len(spans), "status", resp.StatusCode)
+	}
+	if dropped := t.dropped.Swap(0); dropped > 0 {
+		t.log.Warn("dropped spans, export queue full", "spans", dropped)
+	}
+}
+
+// The OTLP/HTTP JSON encoding of an ExportTraceServiceRequest. IDs are hex
+// and 64-bit integers are strings, as the protocol's JSON mapping requires.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            struct {
+		Code int `json:"code,omitempty"`
+	} `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func intAttribute(key string, value int64) otlpAttribute {
+	v := strconv.FormatInt(value, 10)
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: &v}}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// splitListenAddr reads a listen address, either host:port or
+// unix:/path/to.sock
+func splitListenAddr(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// listenerAddr describes the address l is actually bound to, with the
+// port the kernel picked or the unix: prefix
+func listenerAddr(l net.Listener) string {
+	if l.Addr().Network() == "unix" {
+		return "unix:" + l.Addr().String()
+	}
+	return l.Addr().String()
+}
+
+// removeStaleSocket deletes a socket file left by a server that didn't
+// shut down cleanly. A socket something still listens on is left alone, and
+// so is anything that isn't a socket.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and isn't a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	return os.Remove(path)
+}
+
+// setSocketAccess applies --socket-mode and --socket-owner to a newly bound
+// socket file
+func (s *Server) setSocketAccess(path string) error {
+	if s.socketMode != 0 {
+		if err := os.Chmod(path, s.socketMode); err != nil {
+			return err
+		}
+	}
+	if s.socketOwner != "" {
+		return chownSocket(path, s.socketOwner)
+	}
+	return nil
+}
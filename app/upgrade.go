@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Environment handshake between a server and the new process it starts to
+// upgrade itself: the kinds of the listeners passed as descriptors 3 and
+// up, and the descriptor to report readiness on
+const (
+	upgradeListenersEnv = "HTTP_SERVER_LISTENERS"
+	upgradeReadyEnv     = "HTTP_SERVER_READY_FD"
+)
+
+// boundListener is a listener the server holds, with the kind it was bound
+// as so a new process can take it over
+type boundListener struct {
+	kind string
+	l    net.Listener
+}
+
+// bind returns the listener a previous process handed over for kind, or
+// binds a new one on addr with lc. addr may be a unix: socket path.
+func (s *Server) bind(kind, addr string, lc *net.ListenConfig) (net.Listener, error) {
+	s.inheritOnce.Do(s.loadInherited)
+	var l net.Listener
+	if ls := s.inherited[kind]; len(ls) > 0 {
+		l, s.inherited[kind] = ls[0], ls[1:]
+	} else {
+		if lc == nil {
+			lc = &net.ListenConfig{}
+		}
+		network, address := splitListenAddr(addr)
+		if network == "unix" {
+			if err := removeStaleSocket(address); err != nil {
+				return nil, err
+			}
+		} else if s.ipv6Only {
+			// tcp6 sets IPV6_V6ONLY, where plain tcp binds :: dual-stack
+			network = "tcp6"
+		}
+		var err error
+		if l, err = lc.Listen(context.Background(), network, address); err != nil {
+			return nil, err
+		}
+		if network == "unix" {
+			if err := s.setSocketAccess(address); err != nil {
+				l.Close()
+				return nil, err
+			}
+		}
+	}
+	s.bound = append(s.bound, boundListener{kind: kind, l: l})
+	return l, nil
+}
+
+// loadInherited picks up the listeners and ready pipe left by the process
+// that started this one, or the sockets systemd activated it with
+func (s *Server) loadInherited() {
+	if s.inherited = s.systemdListeners(); s.inherited != nil {
+		return
+	}
+	kinds := os.Getenv(upgradeListenersEnv)
+	readyFD, _ := strconv.Atoi(os.Getenv(upgradeReadyEnv))
+	// Anything this process starts must not see them
+	os.Unsetenv(upgradeListenersEnv)
+	os.Unsetenv(upgradeReadyEnv)
+	// A daemonizing parent waits on the ready pipe without handing over
+	// any listeners
+	if readyFD > 0 {
+		s.readyPipe = os.NewFile(uintptr(readyFD), "ready")
+	}
+	if kinds == "" {
+		return
+	}
+
+	s.inherited = make(map[string][]net.Listener)
+	for i, kind := range strings.Split(kinds, ",") {
+		f := os.NewFile(uintptr(3+i), kind)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			s.log.Warn("failed to inherit listener", "kind", kind, "err", err)
+			continue
+		}
+		// Socket files are this process's to remove now
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(true)
+		}
+		s.inherited[kind] = append(s.inherited[kind], l)
+	}
+	s.log.Info("inherited listeners", "kinds", kinds)
+}
+
+// notifyReady tells the process that started this one that it is serving,
+// so the old one can drain and exit
+func (s *Server) notifyReady() {
+	s.inheritOnce.Do(s.loadInherited)
+	// Listeners the old process had that this one wasn't configured for
+	for kind, ls := range s.inherited {
+		for _, l := range ls {
+			s.log.Warn("closing unused inherited listener", "kind", kind, "addr", l.Addr().String())
+			l.Close()
+		}
+	}
+	s.inherited = nil
+	if s.readyPipe == nil {
+		return
+	}
+	_, _ = s.readyPipe.Write([]byte{1})
+	s.readyPipe.Close()
+	s.readyPipe = nil
+}
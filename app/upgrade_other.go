@@ -0,0 +1,7 @@
+//go:build windows || plan9
+
+package main
+
+// watchUpgradeSignal is a no-op where listeners can't be handed to a new
+// process
+func (s *Server) watchUpgradeSignal() {}
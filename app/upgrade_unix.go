@@ -0,0 +1,117 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// upgradeTimeout bounds how long a new process gets to start serving
+const upgradeTimeout = 30 * time.Second
+
+// watchUpgradeSignal upgrades the server in place whenever SIGUSR2 arrives
+func (s *Server) watchUpgradeSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+	go func() {
+		for range ch {
+			if err := s.upgrade(); err != nil {
+				s.log.Error("upgrade failed, still serving", "err", err)
+			}
+		}
+	}()
+}
+
+// upgrade starts the binary at the path this process was started from,
+// with the same arguments, handing it every listening socket. Once the new
+// process reports it is serving, this one drains and exits; connections
+// queued meanwhile are accepted by whichever process gets to them first, so
+// none are refused. If the new process fails to start this one carries on.
+func (s *Server) upgrade() error {
+	if s.chroot {
+		return errors.New("can't start a new binary from inside a chroot")
+	}
+	if s.draining.Load() || !s.upgrading.CompareAndSwap(false, true) {
+		return errors.New("already upgrading or shutting down")
+	}
+	defer s.upgrading.Store(false)
+
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return err
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var kinds []string
+	for _, b := range s.bound {
+		fl, ok := b.l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("%s listener can't be handed over", b.kind)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		kinds = append(kinds, b.kind)
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		upgradeListenersEnv+"="+strings.Join(kinds, ","),
+		upgradeReadyEnv+"="+strconv.Itoa(3+len(files)),
+	)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+	s.log.Info("started new process", "pid", cmd.Process.Pid, "path", path)
+
+	// The pipe reads EOF instead if the new process exits first
+	result := make(chan error, 1)
+	go func() {
+		_, err := ready.Read(make([]byte, 1))
+		result <- err
+	}()
+	select {
+	case err = <-result:
+	case <-time.After(upgradeTimeout):
+		err = errors.New("timed out")
+	}
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("new process didn't start serving: %v", err)
+	}
+	s.log.Info("new process is serving, draining", "pid", cmd.Process.Pid)
+	// The new process outlives this one, and keeps using the socket files
+	_ = cmd.Process.Release()
+	for _, b := range s.bound {
+		if ul, ok := b.l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	s.Shutdown()
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// scanCommandTimeout bounds how long an external scanner may take
+const scanCommandTimeout = time.Minute
+
+// UploadScanner inspects an uploaded file before it replaces anything under
+// the directory. body streams the upload from a temporary file. Returning
+// an error vetoes the write, which is answered with 422.
+type UploadScanner func(req *Request, filename string, body io.Reader) error
+
+// errUploadRejected wraps the reasons scanners give for vetoing a write
+var errUploadRejected = errors.New("upload rejected")
+
+// scanUpload runs every scanner in turn, reopening the body for each
+func (s *Server) scanUpload(req *Request, filename string, open func() (io.ReadCloser, error)) error {
+	for _, scan := range s.UploadScanners {
+		body, err := open()
+		if err != nil {
+			return err
+		}
+		err = scan(req, filename, body)
+		body.Close()
+		if err != nil {
+			return fmt.Errorf("%w: %v", errUploadRejected, err)
+		}
+	}
+	return nil
+}
+
+// denyContentTypes returns a scanner refusing uploads whose sniffed
+// content type starts with one of types, such as "text/html"
+func denyContentTypes(types []string) UploadScanner {
+	return func(req *Request, filename string, body io.Reader) error {
+		head := make([]byte, 512)
+		n, err := io.ReadFull(body, head)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		sniffed := http.DetectContentType(head[:n])
+		for _, t := range types {
+			if strings.HasPrefix(sniffed, t) {
+				return fmt.Errorf("content type %s is not allowed", sniffed)
+			}
+		}
+		return nil
+	}
+}
+
+// denyPattern returns a scanner refusing uploads that match re anywhere
+func denyPattern(re *regexp.Regexp) UploadScanner {
+	return func(req *Request, filename string, body io.Reader) error {
+		if re.MatchReader(bufio.NewReader(body)) {
+			return fmt.Errorf("content matches %q", re.String())
+		}
+		return nil
+	}
+}
+
+// scanCommand returns a scanner piping each upload into an external
+// command, e.g. "clamdscan --no-summary -". A non-zero exit vetoes the
+// write, with the command's output as the reason.
+func scanCommand(command string) UploadScanner {
+	args := strings.Fields(command)
+	return func(req *Request, filename string, body io.Reader) error {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdin = body
+		cmd.Env = append(cmd.Environ(), "UPLOAD_FILENAME="+filename)
+		var out bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &out, &out
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		timer := time.AfterFunc(scanCommandTimeout, func() { _ = cmd.Process.Kill() })
+		defer timer.Stop()
+		if err := cmd.Wait(); err != nil {
+			if reason := strings.TrimSpace(out.String()); reason != "" {
+				return fmt.Errorf("%s: %s", args[0], reason)
+			}
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		return nil
+	}
+}
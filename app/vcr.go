@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// recorder saves upstream responses to dir, one JSON file per request, or
+// with replay set answers from those files without contacting upstreams.
+// Requests are keyed by method, target, and body; headers are left out so
+// recordings survive changing cookies and trace IDs.
+type recorder struct {
+	dir    string
+	replay bool
+}
+
+// recording is one saved exchange. Body is base64 in the file.
+type recording struct {
+	Method string      `json:"method"`
+	Target string      `json:"target"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// path returns the file a request is recorded in
+func (rec *recorder) path(req *Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, req.Method+" "+req.Target+"\n")
+	h.Write(body)
+	return filepath.Join(rec.dir, hex.EncodeToString(h.Sum(nil))+".json")
+}
+
+// load returns the response recorded for a request, or nil when there is
+// none
+func (rec *recorder) load(req *Request, body []byte) (*http.Response, error) {
+	data, err := os.ReadFile(rec.path(req, body))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var r recording
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode:    r.Status,
+		Header:        r.Header,
+		Body:          io.NopCloser(bytes.NewReader(r.Body)),
+		ContentLength: int64(len(r.Body)),
+		Request:       &http.Request{URL: &url.URL{Host: "recording"}},
+	}, nil
+}
+
+// save records resp for a request. resp's body is read in full and
+// replaced, so it can still be relayed.
+func (rec *recorder) save(req *Request, body []byte, resp *http.Response) error {
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+	if err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(recording{
+		Method: req.Method,
+		Target: req.Target,
+		Status: resp.StatusCode,
+		Header: resp.Header,
+		Body:   data,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Written whole and renamed, so a replay never reads half a file
+	tmp, err := os.CreateTemp(rec.dir, ".recording-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(out)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), rec.path(req, body))
+}
+
+// readBody buffers a proxied request body so it can be part of the key
+func readBody(body io.Reader) ([]byte, error) {
+	if body == nil {
+		return nil, nil
+	}
+	return io.ReadAll(body)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information, set at build time with
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// Otherwise commit and buildDate fall back to the revision and commit time
+// the go command embeds when building from a checkout
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// buildInfo is what --version and /version report
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+func currentBuild() buildInfo {
+	b := buildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return b
+	}
+	vcs := make(map[string]string)
+	for _, setting := range info.Settings {
+		vcs[setting.Key] = setting.Value
+	}
+	if b.Commit == "" && vcs["vcs.revision"] != "" {
+		b.Commit = vcs["vcs.revision"]
+		if vcs["vcs.modified"] == "true" {
+			b.Commit += "-dirty"
+		}
+	}
+	if b.BuildDate == "" {
+		b.BuildDate = vcs["vcs.time"]
+	}
+	return b
+}
+
+// String is the one-line --version output
+func (b buildInfo) String() string {
+	s := "http-server " + b.Version
+	if b.Commit != "" {
+		s += " (" + b.Commit
+		if b.BuildDate != "" {
+			s += ", " + b.BuildDate
+		}
+		s += ")"
+	}
+	return fmt.Sprintf("%s %s %s", s, b.GoVersion, b.Platform)
+}
+
+func (b buildInfo) json() []byte {
+	body, _ := json.MarshalIndent(b, "", "  ")
+	return append(body, '\n')
+}
+
+// handleVersion reports the build, when --version-endpoint is set
+func (s *Server) handleVersion(w ResponseWriter, req *Request) {
+	if !s.versionEndpoint {
+		sendStatus(w, 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(currentBuild().json())
+}
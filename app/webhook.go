@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Webhook delivery tuning
+const (
+	webhookQueueSize      = 1024
+	webhookTimeout        = 10 * time.Second
+	webhookFirstRetry     = time.Second
+	webhookMaxRetryDelay  = time.Minute
+	defaultWebhookRetries = 5
+)
+
+// fileEvent is the JSON body POSTed to webhooks
+type fileEvent struct {
+	Event    string `json:"event"`
+	Time     string `json:"time"`
+	File     string `json:"file"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256,omitempty"`
+	ClientIP string `json:"client_ip"`
+	User     string `json:"user,omitempty"`
+}
+
+// webhooks delivers file events to each URL in the background, in order,
+// retrying with exponential backoff. Events are dropped rather than
+// blocking the request when a URL's queue is full.
+type webhooks struct {
+	targets []*webhookTarget
+}
+
+type webhookTarget struct {
+	url     string
+	secret  []byte
+	retries int
+	client  *http.Client
+	log     *slog.Logger
+	events  chan []byte
+}
+
+func newWebhooks(urls []string, secret string, retries int, log *slog.Logger) *webhooks {
+	h := &webhooks{}
+	for _, u := range urls {
+		t := &webhookTarget{
+			url:     u,
+			secret:  []byte(secret),
+			retries: retries,
+			client:  &http.Client{Timeout: webhookTimeout},
+			log:     log.With("webhook", u),
+			events:  make(chan []byte, webhookQueueSize),
+		}
+		h.targets = append(h.targets, t)
+		go t.run()
+	}
+	return h
+}
+
+// fire queues ev for every webhook
+func (h *webhooks) fire(ev fileEvent) {
+	ev.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	body, _ := json.Marshal(ev)
+	for _, t := range h.targets {
+		select {
+		case t.events <- body:
+		default:
+			t.log.Warn("webhook queue full, dropping event", "event", ev.Event, "file", ev.File)
+		}
+	}
+}
+
+func (t *webhookTarget) run() {
+	for body := range t.events {
+		delay := webhookFirstRetry
+		for attempt := 0; ; attempt++ {
+			err := t.deliver(body)
+			if err == nil {
+				break
+			}
+			if attempt == t.retries {
+				t.log.Error("webhook delivery failed, giving up", "attempts", attempt+1, "err", err)
+				break
+			}
+			t.log.Warn("webhook delivery failed", "attempt", attempt+1, "retry_in", delay, "err", err)
+			time.Sleep(delay)
+			delay = min(2*delay, webhookMaxRetryDelay)
+		}
+	}
+}
+
+// deliver POSTs body once. With a secret set, X-Webhook-Signature carries
+// its HMAC-SHA256 so receivers can check where it came from.
+func (t *webhookTarget) deliver(body []byte) error {
+	req, err := http.NewRequest("POST", t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "http-server/"+version)
+	if len(t.secret) > 0 {
+		mac := hmac.New(sha256.New, t.secret)
+		mac.Write(body)
+		req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"strconv"
+	"unicode/utf8"
+)
+
+// maxWireText caps how much of each read or write is logged verbatim
+const maxWireText = 2048
+
+// wireConn logs every read and write on a connection for --trace-wire
+type wireConn struct {
+	net.Conn
+	log *slog.Logger
+}
+
+func (c *wireConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.log.Info("wire", "dir", "recv", "bytes", n, "data", wireSummary(p[:n]))
+	}
+	return n, err
+}
+
+func (c *wireConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.log.Info("wire", "dir", "send", "bytes", n, "data", wireSummary(p[:n]))
+	}
+	return n, err
+}
+
+// wireSummary renders raw bytes for the trace log. Header lines carrying
+// credentials are redacted, and anything after a blank line that isn't
+// text is reduced to its size.
+func wireSummary(p []byte) string {
+	var b bytes.Buffer
+	rest := p
+	for len(rest) > 0 {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		if !isText(line) {
+			b.WriteString("[" + strconv.Itoa(len(rest)) + " bytes binary]")
+			break
+		}
+		if b.Len()+len(line) > maxWireText {
+			b.WriteString("[" + strconv.Itoa(len(rest)) + " more bytes]")
+			break
+		}
+		b.Write(redactHeaderLine(line))
+		rest = rest[len(line):]
+	}
+	return b.String()
+}
+
+// isText reports whether p is printable UTF-8, allowing tabs and line ends
+func isText(p []byte) bool {
+	if !utf8.Valid(p) {
+		return false
+	}
+	for _, c := range p {
+		if c < 0x20 && c != '\t' && c != '\r' && c != '\n' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,21 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// dirWritable goes by dir's permission bits, which is all these systems
+// report without creating a file
+func dirWritable(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0o200 == 0 {
+		return errors.New("read-only")
+	}
+	return nil
+}
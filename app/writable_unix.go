@@ -0,0 +1,14 @@
+//go:build !windows && !plan9
+
+package main
+
+import "syscall"
+
+// W_OK|X_OK from access(2): files can be created in the directory
+const accessCreate = 0x2 | 0x1
+
+// dirWritable asks the kernel whether files can be created in dir,
+// without creating one
+func dirWritable(dir string) error {
+	return syscall.Access(dir, accessCreate)
+}